@@ -9,6 +9,7 @@ package bmp // import "golang.org/x/image/bmp"
 
 import (
 	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"io"
@@ -117,13 +118,81 @@ func decodeNRGBA(r io.Reader, c image.Config, topDown, allowAlpha bool) (image.I
 	return rgba, nil
 }
 
+// DecodeOptions bound the image dimensions that DecodeWithOptions accepts from
+// a BMP header. A zero limit means no limit.
+type DecodeOptions struct {
+	// MaxWidth and MaxHeight limit the width and height in the info header.
+	MaxWidth  int
+	MaxHeight int
+	// MaxPixels limits the width times the height.
+	MaxPixels int64
+	// MaxBytes is the maximum number of bytes allocated for the decoded image
+	// and the decoder's row buffer.
+	MaxBytes int64
+}
+
+// A LimitError is returned by DecodeWithOptions when a BMP header describes an
+// image that is larger than its DecodeOptions allow. No pixel data has been
+// read at that point.
+type LimitError struct {
+	// Limit is "MaxWidth", "MaxHeight", "MaxPixels" or "MaxBytes".
+	Limit string
+	// Value is what the header asks for, and Max is the limit.
+	Value int64
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("bmp: image exceeds %s: %d > %d", e.Limit, e.Value, e.Max)
+}
+
+// check returns a *LimitError if decoding an image with the configuration c
+// and bpp bits per pixel would exceed o's limits. o may be nil.
+func (o *DecodeOptions) check(c image.Config, bpp int) error {
+	if o == nil {
+		return nil
+	}
+	w, h := int64(c.Width), int64(c.Height)
+	// Paletted images have one byte per pixel and the others have four. The
+	// row buffer holds a row of the encoded pixels, which are decoded in place
+	// for 32 bits per pixel.
+	n, row := w*h, (w*int64(bpp)+31)/32*4
+	if bpp > 8 {
+		n *= 4
+	}
+	if bpp == 32 {
+		row = 0
+	}
+	switch {
+	case o.MaxWidth > 0 && w > int64(o.MaxWidth):
+		return &LimitError{"MaxWidth", w, int64(o.MaxWidth)}
+	case o.MaxHeight > 0 && h > int64(o.MaxHeight):
+		return &LimitError{"MaxHeight", h, int64(o.MaxHeight)}
+	case o.MaxPixels > 0 && w*h > o.MaxPixels:
+		return &LimitError{"MaxPixels", w * h, o.MaxPixels}
+	case o.MaxBytes > 0 && n+row > o.MaxBytes:
+		return &LimitError{"MaxBytes", n + row, o.MaxBytes}
+	}
+	return nil
+}
+
 // Decode reads a BMP image from r and returns it as an image.Image.
 // Limitation: The file must be 8, 24 or 32 bits per pixel.
 func Decode(r io.Reader) (image.Image, error) {
+	return DecodeWithOptions(r, nil)
+}
+
+// DecodeWithOptions is like Decode, but returns a *LimitError for images that
+// exceed the limits given by o. o may be nil, in which case there are no
+// limits.
+func DecodeWithOptions(r io.Reader, o *DecodeOptions) (image.Image, error) {
 	c, bpp, topDown, allowAlpha, err := decodeConfig(r)
 	if err != nil {
 		return nil, err
 	}
+	if err := o.check(c, bpp); err != nil {
+		return nil, err
+	}
 	switch bpp {
 	case 1, 2, 4, 8:
 		return decodePaletted(r, c, topDown, bpp)
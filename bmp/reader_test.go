@@ -91,3 +91,37 @@ func TestEOF(t *testing.T) {
 		t.Errorf("Error should be io.ErrUnexpectedEOF on nil but got %v", err)
 	}
 }
+
+func TestDecodeLimits(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, image.NewGray(image.Rect(0, 0, 3, 2))); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	// Declare a 1<<20 by 1<<16 image, which needs 64 GiB.
+	huge := append([]byte(nil), buf.Bytes()...)
+	copy(huge[18:26], []byte{0, 0, 0x10, 0, 0, 0, 1, 0})
+
+	for _, tc := range []struct {
+		data  []byte
+		o     DecodeOptions
+		limit string
+	}{
+		{huge, DecodeOptions{MaxWidth: 1 << 16}, "MaxWidth"},
+		{huge, DecodeOptions{MaxHeight: 1 << 10}, "MaxHeight"},
+		{huge, DecodeOptions{MaxPixels: 1 << 30}, "MaxPixels"},
+		{huge, DecodeOptions{MaxBytes: 1 << 30}, "MaxBytes"},
+		{buf.Bytes(), DecodeOptions{MaxBytes: 3*2 + 4 - 1}, "MaxBytes"},
+		{buf.Bytes(), DecodeOptions{MaxWidth: 3, MaxHeight: 2, MaxPixels: 6, MaxBytes: 3*2 + 4}, ""},
+	} {
+		_, err := DecodeWithOptions(bytes.NewReader(tc.data), &tc.o)
+		if tc.limit == "" {
+			if err != nil {
+				t.Errorf("%+v: %v", tc.o, err)
+			}
+			continue
+		}
+		if e, ok := err.(*LimitError); !ok || e.Limit != tc.limit {
+			t.Errorf("%+v: got %v, want a %s LimitError", tc.o, err, tc.limit)
+		}
+	}
+}
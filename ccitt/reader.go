@@ -10,6 +10,7 @@ package ccitt
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"image"
 	"io"
 	"math/bits"
@@ -59,6 +60,48 @@ type Options struct {
 	Align bool
 	// Invert means that black is the 1 bit or 0xFF byte, and white is 0.
 	Invert bool
+
+	// MaxWidth, MaxHeight and MaxPixels, if positive, limit the width, height
+	// and number of pixels of the images that are decoded. Exceeding a limit
+	// is a *LimitError. For an image whose height is not known in advance,
+	// the rows are counted as they are decoded.
+	MaxWidth  int
+	MaxHeight int
+	MaxPixels int64
+}
+
+// A LimitError is returned by DecodeIntoGray, or by a Reader's Read method,
+// when the image is wider, taller or larger than its Options allow.
+type LimitError struct {
+	// Limit is "MaxWidth", "MaxHeight" or "MaxPixels".
+	Limit string
+	// Value is the width, the height or their product, and Max is the limit.
+	// For a height that is not known in advance, the height is the number of
+	// rows decoded so far.
+	Value int64
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("ccitt: image exceeds %s: %d > %d", e.Limit, e.Value, e.Max)
+}
+
+// check returns a *LimitError if an image with the given width and height
+// exceeds o's limits. o may be nil.
+func (o *Options) check(width, height int) error {
+	if o == nil {
+		return nil
+	}
+	w, h := int64(width), int64(height)
+	switch {
+	case o.MaxWidth > 0 && w > int64(o.MaxWidth):
+		return &LimitError{"MaxWidth", w, int64(o.MaxWidth)}
+	case o.MaxHeight > 0 && h > int64(o.MaxHeight):
+		return &LimitError{"MaxHeight", h, int64(o.MaxHeight)}
+	case o.MaxPixels > 0 && w*h > o.MaxPixels:
+		return &LimitError{"MaxPixels", w * h, o.MaxPixels}
+	}
+	return nil
 }
 
 // maxWidth is the maximum (inclusive) supported width. This is a limitation of
@@ -300,6 +343,12 @@ type reader struct {
 	align  bool
 	invert bool
 
+	// opts holds the limits, if any, that are checked as rows are decoded
+	// when the image height is not known in advance. rowsDecoded counts those
+	// rows.
+	opts        *Options
+	rowsDecoded int
+
 	// atStartOfRow is whether we have just started the row. Some parts of the
 	// spec say to treat this situation as if "wi = -1".
 	atStartOfRow bool
@@ -364,7 +413,11 @@ func (z *reader) Read(p []byte) (int, error) {
 				}
 
 				if err := z.decodeEOL(); err == errMissingEOL {
-					// No-op. It's another row of pixel data.
+					// It's another row of pixel data.
+					z.rowsDecoded++
+					if z.readErr = z.opts.check(z.width, z.rowsDecoded); z.readErr != nil {
+						break
+					}
 				} else if err != nil {
 					z.readErr = err
 					break
@@ -733,6 +786,9 @@ func DecodeIntoGray(dst *image.Gray, r io.Reader, order Order, sf SubFormat, opt
 	if bounds.Dx() > maxWidth {
 		return errUnsupportedWidth
 	}
+	if err := opts.check(bounds.Dx(), bounds.Dy()); err != nil {
+		return err
+	}
 
 	z := reader{
 		br:        bitReader{r: r, order: order},
@@ -781,6 +837,10 @@ func NewReader(r io.Reader, order Order, sf SubFormat, width int, height int, op
 		readErr = errInvalidBounds
 	} else if width > maxWidth {
 		readErr = errUnsupportedWidth
+	} else if height >= 0 {
+		readErr = opts.check(width, height)
+	} else {
+		readErr = opts.check(width, 0)
 	}
 
 	return &reader{
@@ -791,5 +851,6 @@ func NewReader(r io.Reader, order Order, sf SubFormat, width int, height int, op
 		width:         width,
 		rowsRemaining: height,
 		readErr:       readErr,
+		opts:          opts,
 	}
 }
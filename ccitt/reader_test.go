@@ -460,3 +460,44 @@ func testDecodeIntoGray(t *testing.T, fileName string, order Order, sf SubFormat
 
 	compareImages(t, got, want)
 }
+
+func TestDecodeLimits(t *testing.T) {
+	const fileName, width, height = "testdata/bw-gopher.ccitt_group4", 153, 55
+	src, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	for _, tc := range []struct {
+		opts  Options
+		limit string
+	}{
+		{Options{MaxWidth: width}, ""},
+		{Options{MaxWidth: width - 1}, "MaxWidth"},
+		{Options{MaxHeight: height}, ""},
+		{Options{MaxHeight: height - 1}, "MaxHeight"},
+		{Options{MaxPixels: width * height}, ""},
+		{Options{MaxPixels: width*height - 1}, "MaxPixels"},
+	} {
+		for _, h := range []int{height, AutoDetectHeight} {
+			_, err := ioutil.ReadAll(NewReader(bytes.NewReader(src), MSB, Group4, width, h, &tc.opts))
+			if !isLimitError(err, tc.limit) {
+				t.Errorf("NewReader(height=%d, %+v): got %v, want limit %q", h, tc.opts, err, tc.limit)
+			}
+		}
+		dst := image.NewGray(image.Rect(0, 0, width, height))
+		err := DecodeIntoGray(dst, bytes.NewReader(src), MSB, Group4, &tc.opts)
+		if !isLimitError(err, tc.limit) {
+			t.Errorf("DecodeIntoGray(%+v): got %v, want limit %q", tc.opts, err, tc.limit)
+		}
+	}
+}
+
+// isLimitError returns whether err is a *LimitError for the given limit, or
+// nil if limit is empty.
+func isLimitError(err error, limit string) bool {
+	if limit == "" {
+		return err == nil
+	}
+	e, ok := err.(*LimitError)
+	return ok && e.Limit == limit
+}
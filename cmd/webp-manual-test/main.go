@@ -110,9 +110,35 @@ func test(name string) error {
 		return fmt.Errorf("Decode: %v", err)
 	}
 	format, encode := "-pgm", encodePGM
-	if _, lossless := gotImage.(*image.NRGBA); lossless {
+	_, lossless := gotImage.(*image.NRGBA)
+	if lossless {
 		format, encode = "-pam", encodePAM
 	}
+	if err := compare(filename, format, gotImage, encode); err != nil {
+		return err
+	}
+	if lossless {
+		return nil
+	}
+
+	// Check the conversion of lossy images to RGB, which dwebp does with
+	// fancy upsampling by default.
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("Seek: %v", err)
+	}
+	gotImage, err = webp.DecodeWithOptions(f, &webp.DecodeOptions{RGB: true})
+	if err != nil {
+		return fmt.Errorf("DecodeWithOptions: %v", err)
+	}
+	if err := compare(filename, "-pam", gotImage, encodePAM); err != nil {
+		return fmt.Errorf("RGB: %v", err)
+	}
+	return nil
+}
+
+// compare checks that gotImage, encoded by encode, matches dwebp's decoding
+// of filename in the given output format.
+func compare(filename, format string, gotImage image.Image, encode func(image.Image) ([]byte, error)) error {
 	got, err := encode(gotImage)
 	if err != nil {
 		return fmt.Errorf("encode: %v", err)
@@ -140,19 +166,27 @@ func test(name string) error {
 	return nil
 }
 
-// encodePAM encodes gotImage in the PAM format.
+// encodePAM encodes gotImage in the PAM format. An *image.RGBA is opaque, so
+// that its pixels are the same as non-premultiplied ones.
 func encodePAM(gotImage image.Image) ([]byte, error) {
-	m, ok := gotImage.(*image.NRGBA)
-	if !ok {
-		return nil, fmt.Errorf("lossless image did not decode to an *image.NRGBA")
+	var (
+		pix    []byte
+		stride int
+	)
+	switch g := gotImage.(type) {
+	case *image.NRGBA:
+		pix, stride = g.Pix[g.PixOffset(g.Rect.Min.X, g.Rect.Min.Y):], g.Stride
+	case *image.RGBA:
+		pix, stride = g.Pix[g.PixOffset(g.Rect.Min.X, g.Rect.Min.Y):], g.Stride
+	default:
+		return nil, fmt.Errorf("image did not decode to an *image.NRGBA or *image.RGBA")
 	}
-	b := m.Bounds()
+	b := gotImage.Bounds()
 	w, h := b.Dx(), b.Dy()
 	buf := new(bytes.Buffer)
 	fmt.Fprintf(buf, "P7\nWIDTH %d\nHEIGHT %d\nDEPTH 4\nMAXVAL 255\nTUPLTYPE RGB_ALPHA\nENDHDR\n", w, h)
-	for y := b.Min.Y; y < b.Max.Y; y++ {
-		o := m.PixOffset(b.Min.X, y)
-		buf.Write(m.Pix[o : o+4*w])
+	for y := 0; y < h; y++ {
+		buf.Write(pix[y*stride : y*stride+4*w])
 	}
 	return buf.Bytes(), nil
 }
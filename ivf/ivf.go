@@ -0,0 +1,206 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ivf implements a reader for the IVF video container format, as
+// written by libvpx for VP8 and VP9 streams.
+//
+// An IVF stream starts with a 32-byte file header, followed by a sequence of
+// frames. Each frame consists of a 12-byte frame header (containing a 4-byte
+// frame size and an 8-byte timestamp) and the frame data.
+package ivf // import "golang.org/x/image/ivf"
+
+import (
+	"errors"
+	"io"
+	"math"
+	"math/bits"
+	"time"
+)
+
+var (
+	errInvalidFileHeader = errors.New("ivf: invalid file header")
+	errShortFrameData    = errors.New("ivf: short frame data")
+	errShortFrameHeader  = errors.New("ivf: short frame header")
+	errStaleReader       = errors.New("ivf: stale reader")
+)
+
+const (
+	fileHeaderSize  = 32
+	frameHeaderSize = 12
+)
+
+// FileHeader is an IVF file header.
+type FileHeader struct {
+	// FourCC is the codec, such as "VP80" for VP8.
+	FourCC [4]byte
+	// Width and Height are the frame dimensions, in pixels.
+	Width, Height int
+	// TimebaseNum and TimebaseDen give the unit of the frame timestamps:
+	// TimebaseNum/TimebaseDen seconds.
+	TimebaseNum, TimebaseDen uint32
+	// NumFrames is the number of frames, as recorded by the writer. It may be
+	// inaccurate for streams that were not written to completion.
+	NumFrames uint32
+}
+
+// Duration returns a timestamp, in units of the time base, as a
+// time.Duration. It saturates if the duration is too large. A zero time base
+// denominator gives zero.
+func (h FileHeader) Duration(timestamp uint64) time.Duration {
+	if h.TimebaseDen == 0 {
+		return 0
+	}
+	hi, lo := bits.Mul64(timestamp, uint64(h.TimebaseNum)*uint64(time.Second))
+	if hi >= uint64(h.TimebaseDen) {
+		return math.MaxInt64
+	}
+	q, _ := bits.Div64(hi, lo, uint64(h.TimebaseDen))
+	if q > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(q)
+}
+
+// FrameHeader is an IVF frame header.
+type FrameHeader struct {
+	// Size is the length of the frame data, in bytes.
+	Size uint32
+	// Timestamp is the frame's presentation time, in units of the time base.
+	Timestamp uint64
+}
+
+// u16 decodes the first two bytes of b as a little-endian integer.
+func u16(b []byte) uint16 {
+	return uint16(b[0]) | uint16(b[1])<<8
+}
+
+// u32 decodes the first four bytes of b as a little-endian integer.
+func u32(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
+
+// u64 decodes the first eight bytes of b as a little-endian integer.
+func u64(b []byte) uint64 {
+	return uint64(u32(b)) | uint64(u32(b[4:]))<<32
+}
+
+// Reader reads frames from an underlying io.Reader.
+type Reader struct {
+	r   io.Reader
+	err error
+
+	header      FileHeader
+	frameReader *frameReader
+	buf         [fileHeaderSize]byte
+}
+
+// NewReader reads the IVF stream's file header from r, and returns a Reader
+// for its frames.
+func NewReader(r io.Reader) (*Reader, error) {
+	z := &Reader{r: r}
+	if _, err := io.ReadFull(r, z.buf[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errInvalidFileHeader
+		}
+		return nil, err
+	}
+	b := z.buf[:]
+	if b[0] != 'D' || b[1] != 'K' || b[2] != 'I' || b[3] != 'F' || u16(b[4:]) != 0 {
+		return nil, errInvalidFileHeader
+	}
+	headerLen := int64(u16(b[6:]))
+	if headerLen < fileHeaderSize {
+		return nil, errInvalidFileHeader
+	}
+	z.header = FileHeader{
+		FourCC:      [4]byte{b[8], b[9], b[10], b[11]},
+		Width:       int(u16(b[12:])),
+		Height:      int(u16(b[14:])),
+		TimebaseNum: u32(b[16:]),
+		TimebaseDen: u32(b[20:]),
+		NumFrames:   u32(b[24:]),
+	}
+	// Skip any extension of the file header.
+	if n, err := io.CopyN(io.Discard, r, headerLen-fileHeaderSize); err != nil {
+		if err == io.EOF && n < headerLen-fileHeaderSize {
+			err = errInvalidFileHeader
+		}
+		return nil, err
+	}
+	return z, nil
+}
+
+// Header returns the IVF stream's file header.
+func (z *Reader) Header() FileHeader {
+	return z.header
+}
+
+// Next returns the next frame's header and data. It returns io.EOF if there
+// are no more frames. The io.Reader returned becomes stale after the next
+// Next call, and should no longer be used.
+//
+// It is valid to call Next even if all of the previous frame's data has not
+// been read.
+func (z *Reader) Next() (fh FrameHeader, frameData io.Reader, err error) {
+	if z.err != nil {
+		return FrameHeader{}, nil, z.err
+	}
+
+	// Drain the rest of the previous frame.
+	if z.frameReader != nil && z.frameReader.n != 0 {
+		if _, z.err = io.Copy(io.Discard, z.frameReader); z.err != nil {
+			return FrameHeader{}, nil, z.err
+		}
+	}
+	z.frameReader = nil
+
+	// Read the next frame header. A clean io.EOF means there are no more
+	// frames.
+	b := z.buf[:frameHeaderSize]
+	if _, z.err = io.ReadFull(z.r, b); z.err != nil {
+		if z.err == io.ErrUnexpectedEOF {
+			z.err = errShortFrameHeader
+		}
+		return FrameHeader{}, nil, z.err
+	}
+	fh = FrameHeader{
+		Size:      u32(b[0:]),
+		Timestamp: u64(b[4:]),
+	}
+	z.frameReader = &frameReader{z: z, n: int64(fh.Size)}
+	return fh, z.frameReader, nil
+}
+
+type frameReader struct {
+	z *Reader
+	n int64
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	z := f.z
+	if f != z.frameReader {
+		return 0, errStaleReader
+	}
+	if z.err != nil {
+		return 0, z.err
+	}
+	if f.n == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > f.n {
+		p = p[:f.n]
+	}
+	n, err := z.r.Read(p)
+	f.n -= int64(n)
+	if err == io.EOF {
+		err = nil
+		if n == 0 {
+			err = errShortFrameData
+		}
+	}
+	if err != nil {
+		z.err = err
+	}
+	return n, err
+}
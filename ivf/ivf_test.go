@@ -0,0 +1,119 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ivf
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"testing"
+	"time"
+)
+
+// encodeIVF returns an IVF stream with the given header length, and frames
+// whose timestamps are their indexes times 10.
+func encodeIVF(headerLen int, frames ...string) []byte {
+	b := []byte("DKIF\x00\x00")
+	b = append(b, uint8(headerLen), uint8(headerLen>>8))
+	b = append(b, "VP80\x40\x01\xf0\x00\x01\x00\x00\x00\x1e\x00\x00\x00"...)
+	b = append(b, uint8(len(frames)), 0, 0, 0, 0, 0, 0, 0)
+	b = append(b, make([]byte, headerLen-fileHeaderSize)...)
+	for i, f := range frames {
+		n, ts := len(f), 10*i
+		b = append(b, uint8(n), uint8(n>>8), uint8(n>>16), uint8(n>>24))
+		b = append(b, uint8(ts), 0, 0, 0, 0, 0, 0, 0)
+		b = append(b, f...)
+	}
+	return b
+}
+
+func TestReader(t *testing.T) {
+	frames := []string{"abc", "", "defgh", "ij"}
+	for _, headerLen := range []int{32, 40} {
+		z, err := NewReader(bytes.NewReader(encodeIVF(headerLen, frames...)))
+		if err != nil {
+			t.Fatalf("headerLen=%d: NewReader: %v", headerLen, err)
+		}
+		want := FileHeader{
+			FourCC:      [4]byte{'V', 'P', '8', '0'},
+			Width:       320,
+			Height:      240,
+			TimebaseNum: 1,
+			TimebaseDen: 30,
+			NumFrames:   4,
+		}
+		if got := z.Header(); got != want {
+			t.Errorf("headerLen=%d: Header: got %+v, want %+v", headerLen, got, want)
+		}
+		for i, f := range frames {
+			fh, data, err := z.Next()
+			if err != nil {
+				t.Fatalf("headerLen=%d: frame %d: Next: %v", headerLen, i, err)
+			}
+			if fh.Size != uint32(len(f)) || fh.Timestamp != uint64(10*i) {
+				t.Errorf("headerLen=%d: frame %d: got %+v", headerLen, i, fh)
+			}
+			// Leave the third frame partially read.
+			if i == 2 {
+				b := make([]byte, 2)
+				if _, err := io.ReadFull(data, b); err != nil || string(b) != "de" {
+					t.Errorf("headerLen=%d: frame %d: got %q, %v", headerLen, i, b, err)
+				}
+				continue
+			}
+			if b, err := io.ReadAll(data); err != nil || string(b) != f {
+				t.Errorf("headerLen=%d: frame %d: got %q, %v, want %q", headerLen, i, b, err, f)
+			}
+		}
+		if _, _, err := z.Next(); err != io.EOF {
+			t.Errorf("headerLen=%d: Next: got %v, want io.EOF", headerLen, err)
+		}
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	valid := encodeIVF(32, "abc")
+	testCases := []struct {
+		name string
+		b    []byte
+		want error
+	}{
+		{"short file header", valid[:31], errInvalidFileHeader},
+		{"bad signature", append([]byte("DKIG"), valid[4:]...), errInvalidFileHeader},
+		{"short frame header", valid[:40], errShortFrameHeader},
+		{"short frame data", valid[:45], errShortFrameData},
+	}
+	for _, tc := range testCases {
+		z, err := NewReader(bytes.NewReader(tc.b))
+		if err == nil {
+			_, data, err1 := z.Next()
+			err = err1
+			if err == nil {
+				_, err = io.ReadAll(data)
+			}
+		}
+		if err != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestDuration(t *testing.T) {
+	testCases := []struct {
+		h    FileHeader
+		ts   uint64
+		want time.Duration
+	}{
+		{FileHeader{TimebaseNum: 1, TimebaseDen: 30}, 45, 1500 * time.Millisecond},
+		{FileHeader{TimebaseNum: 1001, TimebaseDen: 30000}, 30, 1001 * time.Millisecond},
+		{FileHeader{TimebaseNum: 1, TimebaseDen: 0}, 30, 0},
+		{FileHeader{TimebaseNum: 1, TimebaseDen: 1}, math.MaxUint64, math.MaxInt64},
+	}
+	for _, tc := range testCases {
+		if got := tc.h.Duration(tc.ts); got != tc.want {
+			t.Errorf("%+v, %d: got %v, want %v", tc.h, tc.ts, got, tc.want)
+		}
+	}
+}
@@ -5,6 +5,7 @@
 package riff_test
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -40,6 +41,81 @@ func ExampleReader() {
 	// .	.	SIX  "pqrstu"
 }
 
+func ExampleWriter() {
+	var (
+		one = []byte("a")
+		two = []byte("bc")
+	)
+	// The RIFF and LIST chunk lengths are precomputed, so that the output
+	// need not be seekable.
+	listLen := 4 + riff.ChunkSize(uint32(len(two)))
+	riffLen := 4 + riff.ChunkSize(uint32(len(one))) + riff.ChunkSize(uint32(listLen))
+
+	buf := &bytes.Buffer{}
+	w, err := riff.NewWriter(buf, riff.FourCC{'R', 'O', 'O', 'T'}, riffLen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w.WriteChunk(riff.FourCC{'O', 'N', 'E', ' '}, one)
+	w.BeginList(riff.FourCC{'M', 'E', 'T', 'A'}, listLen)
+	w.WriteChunk(riff.FourCC{'T', 'W', 'O', ' '}, two)
+	w.End()
+	if err := w.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	formType, r, err := riff.NewReader(buf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("RIFF(%s)\n", formType)
+	if err := dump(r, ".\t"); err != nil {
+		log.Fatal(err)
+	}
+	// Output:
+	// RIFF(ROOT)
+	// .	ONE  "a"
+	// .	LIST(META)
+	// .	.	TWO  "bc"
+}
+
+func ExampleIndex() {
+	x, err := riff.NewIndex(strings.NewReader(data), int64(len(data)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("RIFF(%s)\n", x.FormType)
+	depth := map[int]int{-1: 0}
+	for i, c := range x.Chunks {
+		depth[i] = depth[c.Parent] + 1
+		indent := strings.Repeat(".\t", depth[i])
+		if c.ID == riff.LIST {
+			fmt.Printf("%sLIST(%s) at %d\n", indent, c.ListType, c.Offset)
+			continue
+		}
+		b, err := ioutil.ReadAll(x.Data(i))
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s%s %q at %d\n", indent, c.ID, b, c.Offset)
+	}
+	// Output:
+	// RIFF(ROOT)
+	// .	ZERO "" at 20
+	// .	ONE  "a" at 28
+	// .	LIST(META) at 38
+	// .	.	LIST(GOOD) at 50
+	// .	.	.	ONE  "a" at 62
+	// .	.	.	FIVE "klmno" at 72
+	// .	.	ZERO "" at 86
+	// .	.	LIST(BAD ) at 94
+	// .	.	.	THRE "def" at 106
+	// .	TWO  "bc" at 118
+	// .	LIST(UGLY) at 128
+	// .	.	FOUR "ghij" at 140
+	// .	.	SIX  "pqrstu" at 152
+}
+
 func dump(r *riff.Reader, indent string) error {
 	for {
 		chunkID, chunkLen, chunkData, err := r.Next()
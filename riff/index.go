@@ -0,0 +1,132 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package riff
+
+import (
+	"io"
+)
+
+// Chunk is an entry of an Index.
+type Chunk struct {
+	// ID is the chunk's ID.
+	ID FourCC
+	// ListType is the list type of a LIST chunk, such as "movi" or "wavl".
+	ListType FourCC
+	// Offset is the offset of the chunk data, after its 8-byte header, in the
+	// underlying io.ReaderAt.
+	Offset int64
+	// Len is the chunk's length. As for a Reader, the data of a LIST chunk
+	// starts with its list type.
+	Len uint32
+	// Parent is the Index.Chunks index of the enclosing LIST chunk, or -1 if
+	// the chunk is not in a LIST chunk.
+	Parent int
+}
+
+// Index lists the chunks of a RIFF stream, for random access to their data.
+type Index struct {
+	// FormType is the RIFF stream's form type, such as "AVI " or "WAVE".
+	FormType FourCC
+	// Chunks are the chunks, including LIST chunks and their subchunks, in
+	// the order that they occur in the stream. Each LIST chunk precedes its
+	// subchunks.
+	Chunks []Chunk
+
+	r io.ReaderAt
+}
+
+// NewIndex returns the Index of the RIFF stream held by the first size bytes
+// of r. Only the chunk headers are read.
+func NewIndex(r io.ReaderAt, size int64) (*Index, error) {
+	var buf [chunkHeaderSize + 4]byte
+	if err := readAt(r, buf[:12], 0, size, errMissingRIFFChunkHeader); err != nil {
+		return nil, err
+	}
+	if buf[0] != 'R' || buf[1] != 'I' || buf[2] != 'F' || buf[3] != 'F' {
+		return nil, errMissingRIFFChunkHeader
+	}
+	riffLen := int64(u32(buf[4:]))
+	if riffLen < 4 || chunkHeaderSize+riffLen > size {
+		return nil, errShortChunkData
+	}
+	x := &Index{
+		FormType: FourCC{buf[8], buf[9], buf[10], buf[11]},
+		r:        r,
+	}
+
+	// list is a LIST chunk, or the RIFF chunk, whose subchunks are being
+	// indexed.
+	type list struct {
+		// parent is the LIST chunk's index in x.Chunks.
+		parent int
+		// end is the offset of the end of its data, and next is the offset of
+		// the chunk that follows it, after any padding byte.
+		end, next int64
+	}
+	stack := []list{{parent: -1, end: chunkHeaderSize + riffLen}}
+	for off := int64(12); len(stack) > 0; {
+		l := stack[len(stack)-1]
+		if off == l.end {
+			stack = stack[:len(stack)-1]
+			off = l.next
+			continue
+		}
+		if l.end-off < chunkHeaderSize {
+			return nil, errShortChunkHeader
+		}
+		if err := readAt(r, buf[:chunkHeaderSize], off, l.end, errShortChunkHeader); err != nil {
+			return nil, err
+		}
+		c := Chunk{
+			ID:     FourCC{buf[0], buf[1], buf[2], buf[3]},
+			Offset: off + chunkHeaderSize,
+			Len:    u32(buf[4:]),
+			Parent: l.parent,
+		}
+		end := c.Offset + int64(c.Len)
+		next := end + int64(c.Len&1)
+		if next > l.end {
+			return nil, errListSubchunkTooLong
+		}
+		x.Chunks = append(x.Chunks, c)
+		if c.ID != LIST {
+			off = next
+			continue
+		}
+		if c.Len < 4 {
+			return nil, errShortChunkData
+		}
+		if err := readAt(r, buf[:4], c.Offset, end, errShortChunkData); err != nil {
+			return nil, err
+		}
+		x.Chunks[len(x.Chunks)-1].ListType = FourCC{buf[0], buf[1], buf[2], buf[3]}
+		stack = append(stack, list{parent: len(x.Chunks) - 1, end: end, next: next})
+		off = c.Offset + 4
+	}
+	return x, nil
+}
+
+// readAt reads len(p) bytes from r at offset off, which must not exceed
+// limit. It returns errShort if r holds too few bytes.
+func readAt(r io.ReaderAt, p []byte, off, limit int64, errShort error) error {
+	if off+int64(len(p)) > limit {
+		return errShort
+	}
+	n, err := r.ReadAt(p, off)
+	if n == len(p) {
+		return nil
+	}
+	if err == io.EOF {
+		err = errShort
+	}
+	return err
+}
+
+// Data returns the data of the i'th chunk of x.Chunks. For a LIST chunk, it
+// can be passed to NewListReader.
+func (x *Index) Data(i int) *io.SectionReader {
+	c := x.Chunks[i]
+	return io.NewSectionReader(x.r, c.Offset, int64(c.Len))
+}
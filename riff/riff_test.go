@@ -6,6 +6,10 @@ package riff
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
 	"testing"
 )
 
@@ -67,3 +71,218 @@ func TestShortChunks(t *testing.T) {
 		}
 	}
 }
+
+// seekBuffer is an in-memory io.WriteSeeker.
+type seekBuffer struct {
+	b   []byte
+	off int
+}
+
+func (s *seekBuffer) Write(p []byte) (int, error) {
+	if n := s.off + len(p); n > len(s.b) {
+		s.b = append(s.b, make([]byte, n-len(s.b))...)
+	}
+	copy(s.b[s.off:], p)
+	s.off += len(p)
+	return len(p), nil
+}
+
+func (s *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += int64(s.off)
+	case io.SeekEnd:
+		offset += int64(len(s.b))
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	s.off = int(offset)
+	return offset, nil
+}
+
+// writeTree writes a RIFF(ROOT) stream holding a data chunk, a LIST(LIST)
+// holding two data chunks, one with other chunks nested in it, and another
+// data chunk. If known is false, every length is back-patched.
+func writeTree(w io.Writer, known bool) error {
+	n := func(n int64) int64 {
+		if known {
+			return n
+		}
+		return -1
+	}
+	const nested = 12 + 8 + 8 + 4
+	z, err := NewWriter(w, FourCC{'R', 'O', 'O', 'T'}, n(4+ChunkSize(1)+8+4+ChunkSize(3)+ChunkSize(nested)+ChunkSize(0)))
+	if err != nil {
+		return err
+	}
+	z.WriteChunk(FourCC{'O', 'N', 'E', ' '}, []byte("a"))
+	z.BeginList(FourCC{'L', 'I', 'S', 'T'}, n(4+ChunkSize(3)+ChunkSize(nested)))
+	z.WriteChunk(FourCC{'T', 'H', 'R', 'E'}, []byte("def"))
+	z.BeginChunk(FourCC{'N', 'E', 'S', 'T'}, n(nested))
+	z.Write([]byte("header"))
+	z.BeginChunk(FourCC{'F', 'I', 'V', 'E'}, n(5))
+	z.Write([]byte("kl"))
+	z.Write([]byte("mno"))
+	z.End()
+	z.WriteChunk(FourCC{'Z', 'E', 'R', 'O'}, nil)
+	z.Write([]byte("tail"))
+	z.End()
+	z.End()
+	z.WriteChunk(FourCC{'Z', 'E', 'R', 'O'}, []byte{})
+	return z.Close()
+}
+
+func TestWriter(t *testing.T) {
+	want := "RIFF\x56\x00\x00\x00ROOT" +
+		"ONE \x01\x00\x00\x00a\x00" +
+		"LIST\x38\x00\x00\x00LIST" +
+		"THRE\x03\x00\x00\x00def\x00" +
+		"NEST\x20\x00\x00\x00header" +
+		"FIVE\x05\x00\x00\x00klmno\x00" +
+		"ZERO\x00\x00\x00\x00" +
+		"tail" +
+		"ZERO\x00\x00\x00\x00"
+
+	streamed := &bytes.Buffer{}
+	if err := writeTree(streamed, true); err != nil {
+		t.Fatalf("known lengths: %v", err)
+	}
+	if got := streamed.String(); got != want {
+		t.Errorf("known lengths:\ngot  %q\nwant %q", got, want)
+	}
+
+	// The back-patched RIFF stream does not start at offset zero.
+	seeker := &seekBuffer{b: []byte("xyz"), off: 3}
+	if err := writeTree(seeker, false); err != nil {
+		t.Fatalf("back-patched lengths: %v", err)
+	}
+	if got := string(seeker.b[3:]); got != want {
+		t.Errorf("back-patched lengths:\ngot  %q\nwant %q", got, want)
+	}
+}
+
+func TestWriterErrors(t *testing.T) {
+	abcd := FourCC{'a', 'b', 'c', 'd'}
+	testCases := []struct {
+		name string
+		f    func(z *Writer) error
+		want error
+	}{
+		{"too long", func(z *Writer) error {
+			z.BeginChunk(abcd, 2)
+			_, err := z.Write([]byte("abc"))
+			return err
+		}, errChunkTooLong},
+		{"too short", func(z *Writer) error {
+			z.BeginChunk(abcd, 2)
+			z.Write([]byte("a"))
+			return z.End()
+		}, errChunkLenMismatch},
+		{"wrong RIFF length", func(z *Writer) error {
+			return z.Close()
+		}, errChunkLenMismatch},
+		{"not seekable", func(z *Writer) error {
+			return z.BeginChunk(abcd, -1)
+		}, errNotSeekable},
+		{"write to list", func(z *Writer) error {
+			z.BeginList(abcd, 4)
+			_, err := z.Write([]byte("a"))
+			return err
+		}, errNoDataChunk},
+		{"write to RIFF", func(z *Writer) error {
+			_, err := z.Write([]byte("a"))
+			return err
+		}, errNoDataChunk},
+		{"unmatched end", func(z *Writer) error {
+			return z.End()
+		}, errNoOpenChunk},
+	}
+	for _, tc := range testCases {
+		z, err := NewWriter(&bytes.Buffer{}, abcd, 100)
+		if err != nil {
+			t.Fatalf("%s: NewWriter: %v", tc.name, err)
+		}
+		if got := tc.f(z); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	if _, err := NewWriter(&bytes.Buffer{}, abcd, -1); err != errNotSeekable {
+		t.Errorf("NewWriter: got %v, want %v", err, errNotSeekable)
+	}
+	z, err := NewWriter(&seekBuffer{}, abcd, -1)
+	if err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := z.WriteChunk(abcd, nil); err != errClosedWriter {
+		t.Errorf("WriteChunk after Close: got %v, want %v", err, errClosedWriter)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if err := writeTree(buf, true); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	x, err := NewIndex(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("NewIndex: %v", err)
+	}
+	if x.FormType != (FourCC{'R', 'O', 'O', 'T'}) {
+		t.Errorf("FormType: got %q, want %q", x.FormType, "ROOT")
+	}
+	want := []Chunk{
+		{ID: FourCC{'O', 'N', 'E', ' '}, Offset: 20, Len: 1, Parent: -1},
+		{ID: LIST, ListType: FourCC{'L', 'I', 'S', 'T'}, Offset: 30, Len: 56, Parent: -1},
+		{ID: FourCC{'T', 'H', 'R', 'E'}, Offset: 42, Len: 3, Parent: 1},
+		{ID: FourCC{'N', 'E', 'S', 'T'}, Offset: 54, Len: 32, Parent: 1},
+		{ID: FourCC{'Z', 'E', 'R', 'O'}, Offset: 94, Len: 0, Parent: -1},
+	}
+	if !reflect.DeepEqual(x.Chunks, want) {
+		t.Fatalf("Chunks:\ngot  %+v\nwant %+v", x.Chunks, want)
+	}
+	for i, c := range x.Chunks {
+		b, err := ioutil.ReadAll(x.Data(i))
+		if err != nil {
+			t.Fatalf("chunk %d: ReadAll: %v", i, err)
+		}
+		if got, want := b, data[c.Offset:c.Offset+int64(c.Len)]; !bytes.Equal(got, want) {
+			t.Errorf("chunk %d: got %q, want %q", i, got, want)
+		}
+	}
+	listType, r, err := NewListReader(x.Chunks[1].Len, x.Data(1))
+	if err != nil {
+		t.Fatalf("NewListReader: %v", err)
+	}
+	if id, _, _, err := r.Next(); listType != x.Chunks[1].ListType || id != x.Chunks[2].ID || err != nil {
+		t.Errorf("NewListReader: got %q, %q, %v", listType, id, err)
+	}
+}
+
+func TestIndexErrors(t *testing.T) {
+	valid := "RIFF\x1a\x00\x00\x00ROOTabcd\x01\x00\x00\x00a\x00" + "LIST\x04\x00\x00\x00list"
+	testCases := []struct {
+		name string
+		s    string
+		want error
+	}{
+		{"valid", valid, nil},
+		{"truncated", valid[:len(valid)-1], errShortChunkData},
+		{"no RIFF", "RIFX" + valid[4:], errMissingRIFFChunkHeader},
+		{"short header", "RIFF\x08\x00\x00\x00ROOTabcd", errShortChunkHeader},
+		{"subchunk too long", "RIFF\x0c\x00\x00\x00ROOTabcd\x01\x00\x00\x00", errListSubchunkTooLong},
+		{"missing padding", "RIFF\x0d\x00\x00\x00ROOTabcd\x01\x00\x00\x00a", errListSubchunkTooLong},
+		{"short LIST", "RIFF\x0e\x00\x00\x00ROOTLIST\x02\x00\x00\x00ab", errShortChunkData},
+	}
+	for _, tc := range testCases {
+		_, err := NewIndex(bytes.NewReader([]byte(tc.s)), int64(len(tc.s)))
+		if err != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
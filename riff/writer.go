@@ -0,0 +1,233 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package riff
+
+import (
+	"errors"
+	"io"
+	"math"
+)
+
+var (
+	errChunkLenMismatch = errors.New("riff: chunk length mismatch")
+	errChunkTooLong     = errors.New("riff: chunk too long")
+	errClosedWriter     = errors.New("riff: write to closed writer")
+	errNotSeekable      = errors.New("riff: unknown chunk length requires a seekable writer")
+	errNoDataChunk      = errors.New("riff: write outside of a data chunk")
+	errNoOpenChunk      = errors.New("riff: end without an open chunk")
+)
+
+// ChunkSize returns the number of bytes taken by a chunk with the given chunk
+// length, including its header and padding. It helps to precompute the
+// length of a LIST or RIFF chunk, which is 4 plus the sum of its subchunks'
+// sizes.
+func ChunkSize(chunkLen uint32) int64 {
+	return chunkHeaderSize + int64(chunkLen) + int64(chunkLen&1)
+}
+
+// openChunk is a chunk whose header is written but that is not yet ended.
+type openChunk struct {
+	// start is the offset of the chunk data, relative to the start of the
+	// RIFF stream.
+	start int64
+	// chunkLen is the chunk's length, or negative if it is back-patched.
+	chunkLen int64
+	list     bool
+}
+
+// Writer writes chunks to an underlying io.Writer.
+//
+// The length of each chunk is either given when it is begun, or back-patched
+// when it is ended, which requires the underlying io.Writer to also be an
+// io.WriteSeeker. Padding bytes are written as needed.
+type Writer struct {
+	w   io.Writer
+	err error
+
+	// seekable is whether back-patching is possible, and base is the
+	// underlying io.WriteSeeker's offset of the RIFF stream.
+	seekable bool
+	base     int64
+	// off is the number of bytes written.
+	off int64
+	// open holds the chunks being written, outermost first. The first is the
+	// RIFF chunk.
+	open []openChunk
+	buf  [chunkHeaderSize]byte
+}
+
+// NewWriter returns a *Writer that writes a RIFF stream with the given form
+// type, such as "AVI " or "WAVE", to w.
+//
+// riffLen is the RIFF chunk's length: 4 plus the sum of the sizes of the
+// chunks to be written. If it is negative, it is back-patched by Close.
+func NewWriter(w io.Writer, formType FourCC, riffLen int64) (*Writer, error) {
+	z := &Writer{w: w}
+	if ws, ok := w.(io.WriteSeeker); ok {
+		// Some io.WriteSeekers, such as an *os.File for a pipe, cannot seek.
+		base, err := ws.Seek(0, io.SeekCurrent)
+		z.base, z.seekable = base, err == nil
+	}
+	if err := z.begin(FourCC{'R', 'I', 'F', 'F'}, riffLen, true); err != nil {
+		return nil, err
+	}
+	if _, err := z.write(formType[:]); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// BeginList begins a LIST chunk with the given list type, such as "movi" or
+// "wavl". The chunks that follow, until the matching call to End, are its
+// subchunks.
+//
+// listLen is the LIST chunk's length: 4 plus the sum of the sizes of its
+// subchunks. If it is negative, it is back-patched by End.
+func (z *Writer) BeginList(listType FourCC, listLen int64) error {
+	if err := z.begin(LIST, listLen, true); err != nil {
+		return err
+	}
+	_, err := z.write(listType[:])
+	return err
+}
+
+// BeginChunk begins a data chunk. Its data is written by calls to Write,
+// until the matching call to End. For formats such as WEBP, whose chunks may
+// hold other chunks, chunks may also be begun within a data chunk.
+//
+// If chunkLen is negative, it is back-patched by End.
+func (z *Writer) BeginChunk(chunkID FourCC, chunkLen int64) error {
+	return z.begin(chunkID, chunkLen, false)
+}
+
+func (z *Writer) begin(chunkID FourCC, chunkLen int64, list bool) error {
+	if z.err != nil {
+		return z.err
+	}
+	if chunkLen > math.MaxUint32 {
+		z.err = errChunkTooLong
+		return z.err
+	}
+	if chunkLen < 0 && !z.seekable {
+		z.err = errNotSeekable
+		return z.err
+	}
+	copy(z.buf[:4], chunkID[:])
+	putU32(z.buf[4:], uint32(chunkLen))
+	if _, err := z.write(z.buf[:]); err != nil {
+		return err
+	}
+	z.open = append(z.open, openChunk{
+		start:    z.off,
+		chunkLen: chunkLen,
+		list:     list,
+	})
+	return nil
+}
+
+// WriteChunk writes a whole data chunk.
+func (z *Writer) WriteChunk(chunkID FourCC, data []byte) error {
+	if err := z.BeginChunk(chunkID, int64(len(data))); err != nil {
+		return err
+	}
+	if _, err := z.Write(data); err != nil {
+		return err
+	}
+	return z.End()
+}
+
+// Write writes data to the current data chunk.
+func (z *Writer) Write(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	if len(z.open) == 0 || z.open[len(z.open)-1].list {
+		z.err = errNoDataChunk
+		return 0, z.err
+	}
+	c := z.open[len(z.open)-1]
+	if c.chunkLen >= 0 && z.off-c.start+int64(len(p)) > c.chunkLen {
+		z.err = errChunkTooLong
+		return 0, z.err
+	}
+	return z.write(p)
+}
+
+func (z *Writer) write(p []byte) (int, error) {
+	n, err := z.w.Write(p)
+	z.off += int64(n)
+	if err != nil {
+		z.err = err
+	}
+	return n, err
+}
+
+// End ends the current LIST or data chunk. It checks that the chunk's length
+// is as given, or otherwise back-patches it, and writes any padding byte.
+func (z *Writer) End() error {
+	if z.err != nil {
+		return z.err
+	}
+	if len(z.open) <= 1 {
+		z.err = errNoOpenChunk
+		return z.err
+	}
+	return z.end()
+}
+
+func (z *Writer) end() error {
+	c := z.open[len(z.open)-1]
+	z.open = z.open[:len(z.open)-1]
+	n := z.off - c.start
+	if c.chunkLen >= 0 && n != c.chunkLen {
+		z.err = errChunkLenMismatch
+		return z.err
+	}
+	if c.chunkLen < 0 {
+		if n > math.MaxUint32 {
+			z.err = errChunkTooLong
+			return z.err
+		}
+		ws := z.w.(io.WriteSeeker)
+		if _, z.err = ws.Seek(z.base+c.start-4, io.SeekStart); z.err != nil {
+			return z.err
+		}
+		putU32(z.buf[:4], uint32(n))
+		if _, z.err = ws.Write(z.buf[:4]); z.err != nil {
+			return z.err
+		}
+		if _, z.err = ws.Seek(z.base+z.off, io.SeekStart); z.err != nil {
+			return z.err
+		}
+	}
+	if n&1 != 0 {
+		z.buf[0] = 0
+		if _, err := z.write(z.buf[:1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close ends any open chunks, and then the RIFF chunk. It does not close the
+// underlying io.Writer.
+func (z *Writer) Close() error {
+	for z.err == nil && len(z.open) > 0 {
+		z.end()
+	}
+	if z.err != nil {
+		return z.err
+	}
+	z.err = errClosedWriter
+	return nil
+}
+
+// putU32 encodes v as a little-endian integer in the first four bytes of b.
+func putU32(b []byte, v uint32) {
+	b[0] = uint8(v)
+	b[1] = uint8(v >> 8)
+	b[2] = uint8(v >> 16)
+	b[3] = uint8(v >> 24)
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"image"
+	"math"
+)
+
+// ycbcrRatio returns the image.YCbCrSubsampleRatio of a YCbCr image with the
+// given horizontal and vertical chroma subsampling, if there is one.
+func ycbcrRatio(sub [2]int) (image.YCbCrSubsampleRatio, bool) {
+	switch sub {
+	case [2]int{1, 1}:
+		return image.YCbCrSubsampleRatio444, true
+	case [2]int{2, 1}:
+		return image.YCbCrSubsampleRatio422, true
+	case [2]int{2, 2}:
+		return image.YCbCrSubsampleRatio420, true
+	case [2]int{1, 2}:
+		return image.YCbCrSubsampleRatio440, true
+	case [2]int{4, 1}:
+		return image.YCbCrSubsampleRatio411, true
+	case [2]int{4, 2}:
+		return image.YCbCrSubsampleRatio410, true
+	}
+	return 0, false
+}
+
+// A whitePoint is the reference white of CIE L*a*b* colors, with the matrix
+// that converts CIE XYZ colors relative to it to linear sRGB.
+type whitePoint struct {
+	x, y, z float64
+	toRGB   [3][3]float64
+}
+
+var (
+	// d65 is the white point of CIELab images, unless their WhitePoint tag
+	// says otherwise, and of sRGB (IEC 61966-2-1).
+	d65 = &whitePoint{
+		0.95047, 1, 1.08883,
+		[3][3]float64{
+			{3.2406, -1.5372, -0.4986},
+			{-0.9689, 1.8758, 0.0415},
+			{0.0557, -0.2040, 1.0570},
+		},
+	}
+	// d50 is the white point of ICCLab images, which is the ICC profile
+	// connection space's. Its matrix adapts colors to D65 with the Bradford
+	// transform before converting them to sRGB.
+	d50 = &whitePoint{
+		0.96422, 1, 0.82521,
+		[3][3]float64{
+			{3.1338561, -1.6168667, -0.4906146},
+			{-0.9787684, 1.9161415, 0.0334540},
+			{0.0719453, -0.2289914, 1.4052427},
+		},
+	}
+)
+
+// labToRGB converts a CIE L*a*b* color, relative to the white point w, to
+// sRGB, with each component in [0, 1]. Colors outside of the sRGB gamut are
+// clamped.
+func labToRGB(l, a, b float64, w *whitePoint) (r, g, bl float64) {
+	// Convert to CIE XYZ (CIE 15:2004, section 8.2.1).
+	finv := func(t float64) float64 {
+		if t > 6.0/29 {
+			return t * t * t
+		}
+		return 3 * (6.0 / 29) * (6.0 / 29) * (t - 4.0/29)
+	}
+	fy := (l + 16) / 116
+	x := w.x * finv(fy+a/500)
+	y := w.y * finv(fy)
+	z := w.z * finv(fy-b/200)
+
+	// Convert to sRGB (IEC 61966-2-1).
+	gamma := func(v float64) float64 {
+		if v <= 0.0031308 {
+			v *= 12.92
+		} else {
+			v = 1.055*math.Pow(v, 1/2.4) - 0.055
+		}
+		return math.Max(0, math.Min(1, v))
+	}
+	m := &w.toRGB
+	return gamma(m[0][0]*x + m[0][1]*y + m[0][2]*z),
+		gamma(m[1][0]*x + m[1][1]*y + m[1][2]*z),
+		gamma(m[2][0]*x + m[2][1]*y + m[2][2]*z)
+}
@@ -16,43 +16,149 @@ type byteReader interface {
 
 // unpackBits decodes the PackBits-compressed data in src and returns the
 // uncompressed data.
+func unpackBits(r io.Reader) ([]byte, error) {
+	return io.ReadAll(newUnpackBitsReader(r))
+}
+
+// unpackBitsReader decodes the PackBits-compressed data read from r.
 //
 // The PackBits compression format is described in section 9 (p. 42)
 // of the TIFF spec.
-func unpackBits(r io.Reader) ([]byte, error) {
-	buf := make([]byte, 128)
-	dst := make([]byte, 0, 1024)
+type unpackBitsReader struct {
+	r byteReader
+	// n is the number of bytes left in the current run, which is a run of
+	// literal bytes if literal is true, or else of the byte b.
+	n       int
+	literal bool
+	b       byte
+}
+
+func newUnpackBitsReader(r io.Reader) *unpackBitsReader {
 	br, ok := r.(byteReader)
 	if !ok {
 		br = bufio.NewReader(r)
 	}
+	return &unpackBitsReader{r: br}
+}
 
-	for {
-		b, err := br.ReadByte()
-		if err != nil {
-			if err == io.EOF {
-				return dst, nil
+func (u *unpackBitsReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if u.n == 0 {
+			b, err := u.r.ReadByte()
+			if err != nil {
+				return n, err
+			}
+			code := int(int8(b))
+			switch {
+			case code >= 0:
+				u.n, u.literal = code+1, true
+			case code == -128:
+				// No-op.
+			default:
+				if u.b, err = u.r.ReadByte(); err != nil {
+					return n, noEOF(err)
+				}
+				u.n, u.literal = 1-code, false
 			}
-			return nil, err
+			continue
 		}
-		code := int(int8(b))
-		switch {
-		case code >= 0:
-			n, err := io.ReadFull(br, buf[:code+1])
-			if err != nil {
-				return nil, err
+		k := minInt(u.n, len(p)-n)
+		if u.literal {
+			if _, err := io.ReadFull(u.r, p[n:n+k]); err != nil {
+				return n, noEOF(err)
 			}
-			dst = append(dst, buf[:n]...)
-		case code == -128:
-			// No-op.
-		default:
-			if b, err = br.ReadByte(); err != nil {
-				return nil, err
+		} else {
+			for i := n; i < n+k; i++ {
+				p[i] = u.b
 			}
-			for j := 0; j < 1-code; j++ {
-				buf[j] = b
+		}
+		n += k
+		u.n -= k
+	}
+	return n, nil
+}
+
+// noEOF returns err, unless it is io.EOF, in which case it returns
+// io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// packBits appends the PackBits-compressed form of src to dst and returns the
+// result. Runs of two or more equal bytes are replicated, unless they are two
+// bytes within a literal run.
+func packBits(dst, src []byte) []byte {
+	for len(src) > 0 {
+		n := 1
+		for n < len(src) && n < 128 && src[n] == src[0] {
+			n++
+		}
+		if n >= 2 {
+			dst = append(dst, byte(1-n), src[0])
+			src = src[n:]
+			continue
+		}
+		// The literal run ends where a run of three equal bytes starts.
+		n = 1
+		for n < len(src) && n < 128 && !(n+2 < len(src) && src[n] == src[n+1] && src[n] == src[n+2]) {
+			n++
+		}
+		dst = append(dst, byte(n-1))
+		dst = append(dst, src[:n]...)
+		src = src[n:]
+	}
+	return dst
+}
+
+// packBitsWriter compresses the data written to it with PackBits, one row of
+// rowLen bytes at a time, as the spec requires that rows are compressed on
+// their own.
+type packBitsWriter struct {
+	w      io.Writer
+	rowLen int
+	row    []byte
+	buf    []byte
+}
+
+func newPackBitsWriter(w io.Writer, rowLen int) *packBitsWriter {
+	return &packBitsWriter{w: w, rowLen: rowLen, row: make([]byte, 0, rowLen)}
+}
+
+func (p *packBitsWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		k := p.rowLen - len(p.row)
+		if k > len(b) {
+			k = len(b)
+		}
+		p.row = append(p.row, b[:k]...)
+		b = b[k:]
+		if len(p.row) == p.rowLen {
+			if err := p.flush(); err != nil {
+				return n - len(b), err
 			}
-			dst = append(dst, buf[:1-code]...)
 		}
 	}
+	return n, nil
+}
+
+// flush writes the compressed form of the row read so far.
+func (p *packBitsWriter) flush() error {
+	p.buf = packBits(p.buf[:0], p.row)
+	p.row = p.row[:0]
+	_, err := p.w.Write(p.buf)
+	return err
+}
+
+// Close writes any incomplete last row. It does not close the underlying
+// writer.
+func (p *packBitsWriter) Close() error {
+	if len(p.row) == 0 {
+		return nil
+	}
+	return p.flush()
 }
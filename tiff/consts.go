@@ -22,17 +22,32 @@ const (
 	ifdLen = 12 // Length of an IFD entry in bytes.
 )
 
+// A BigTIFF file has 64-bit offsets and counts, so that it can be larger than
+// 4 GiB. Its header is followed by the size of an offset (8) and by 2 zero
+// bytes, and its IFD entries are 20 bytes each. It is described at
+// https://www.awaresystems.be/imaging/tiff/bigtiff.html
+const (
+	leBigHeader = "II\x2B\x00" // Header for little-endian BigTIFF files.
+	beBigHeader = "MM\x00\x2B" // Header for big-endian BigTIFF files.
+
+	bigIFDLen = 20 // Length of a BigTIFF IFD entry in bytes.
+)
+
 // Data types (p. 14-16 of the spec).
 const (
-	dtByte     = 1
-	dtASCII    = 2
-	dtShort    = 3
-	dtLong     = 4
-	dtRational = 5
+	dtByte      = 1
+	dtASCII     = 2
+	dtShort     = 3
+	dtLong      = 4
+	dtRational  = 5
+	dtSRational = 10
+	dtLong8     = 16 // BigTIFF only.
 )
 
-// The length of one instance of each data type in bytes.
-var lengths = [...]uint32{0, 1, 1, 2, 4, 8}
+// The length of one instance of each data type in bytes. Types 6 to 13 are
+// the signed, undefined and floating-point types of the TIFF 6.0 spec, and
+// types 16 to 18 are the 64-bit types of BigTIFF.
+var lengths = [...]uint32{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8, 4, 0, 0, 8, 8, 8}
 
 // Tags (see p. 28-41 of the spec).
 const (
@@ -65,6 +80,10 @@ const (
 	tColorMap     = 320
 	tExtraSamples = 338
 	tSampleFormat = 339
+
+	tJPEGTables = 347 // JPEG quantization and Huffman tables (TIFF Technical Note 2).
+
+	tYCbCrSubSampling = 530
 )
 
 // Compression types (defined in various places in the spec and supplements).
@@ -91,12 +110,21 @@ const (
 	pCMYK        = 5
 	pYCbCr       = 6
 	pCIELab      = 8
+	pICCLab      = 9 // CIELab with unsigned a* and b* (TIFF Technical Note 3).
 )
 
 // Values for the tPredictor tag (page 64-65 of the spec).
 const (
-	prNone       = 1
-	prHorizontal = 2
+	prNone          = 1
+	prHorizontal    = 2
+	prFloatingPoint = 3 // Adobe Photoshop TIFF Technical Note 3.
+)
+
+// Values for the tSampleFormat tag (page 80 of the TIFF 6.0 supplement).
+const (
+	sfUint  = 1
+	sfInt   = 2
+	sfFloat = 3
 )
 
 // Values for the tResolutionUnit tag (page 18).
@@ -118,6 +146,11 @@ const (
 	mRGBA
 	mNRGBA
 	mCMYK
+	mYCbCr
+	mLab
+	mICCLab
+	mInt   // Signed integer samples.
+	mFloat // Floating-point samples.
 )
 
 // CompressionType describes the type of compression used in Options.
@@ -130,6 +163,7 @@ const (
 	LZW
 	CCITTGroup3
 	CCITTGroup4
+	PackBits
 )
 
 // specValue returns the compression type constant from the TIFF spec that
@@ -144,6 +178,8 @@ func (c CompressionType) specValue() uint32 {
 		return cG3
 	case CCITTGroup4:
 		return cG4
+	case PackBits:
+		return cPackBits
 	}
 	return cNone
 }
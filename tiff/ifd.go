@@ -0,0 +1,283 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// A DataType is the type of the values of an IFD entry (p. 15-16 of the
+// spec, and the BigTIFF extension for the 64-bit types).
+type DataType uint16
+
+const (
+	TypeByte      DataType = 1
+	TypeASCII     DataType = 2
+	TypeShort     DataType = 3
+	TypeLong      DataType = 4
+	TypeRational  DataType = 5
+	TypeSByte     DataType = 6
+	TypeUndefined DataType = 7
+	TypeSShort    DataType = 8
+	TypeSLong     DataType = 9
+	TypeSRational DataType = 10
+	TypeFloat     DataType = 11
+	TypeDouble    DataType = 12
+	TypeIFD       DataType = 13
+	TypeLong8     DataType = 16
+	TypeSLong8    DataType = 17
+	TypeIFD8      DataType = 18
+)
+
+// Tag numbers of some of the metadata that can be passed to Encode in
+// Options.Tags. Any other tag number can be used, such as that of a private
+// tag (32768 or greater).
+const (
+	TagImageDescription = 270
+	TagMake             = 271
+	TagModel            = 272
+	TagXResolution      = 282
+	TagYResolution      = 283
+	TagResolutionUnit   = 296
+	TagSoftware         = 305
+	TagDateTime         = 306
+	TagArtist           = 315
+	TagHostComputer     = 316
+	TagCopyright        = 33432
+)
+
+// A Rational is an unsigned fraction, with a Rational data type.
+type Rational struct {
+	Num, Den uint32
+}
+
+// An SRational is a signed fraction, with an SRational data type.
+type SRational struct {
+	Num, Den int32
+}
+
+// A Tag is an entry of an IFD.
+type Tag struct {
+	ID   uint16
+	Type DataType
+	// Count is the number of values. For the ASCII type, it is the number of
+	// bytes, including the terminating NUL.
+	Count uint64
+	// Value holds the values, with a Go type that depends on Type:
+	//
+	//	- Byte, Undefined: []byte
+	//	- ASCII: string, without the terminating NUL
+	//	- Short: []uint16
+	//	- Long, IFD: []uint32
+	//	- Long8, IFD8: []uint64
+	//	- SByte: []int8
+	//	- SShort: []int16
+	//	- SLong: []int32
+	//	- SLong8: []int64
+	//	- Rational: []Rational
+	//	- SRational: []SRational
+	//	- Float: []float32
+	//	- Double: []float64
+	//
+	// When decoding, Value is nil if the data type is unknown or the values
+	// could not be read.
+	Value interface{}
+}
+
+// An IFD is an Image File Directory, which holds the tags of one of the
+// pages of a TIFF file.
+type IFD struct {
+	// Tags holds every entry of the IFD, sorted by ID.
+	Tags []Tag
+}
+
+// Tag returns the tag with the given ID, or nil if there is none.
+func (ifd *IFD) Tag(id uint16) *Tag {
+	i := sort.Search(len(ifd.Tags), func(i int) bool { return ifd.Tags[i].ID >= id })
+	if i < len(ifd.Tags) && ifd.Tags[i].ID == id {
+		return &ifd.Tags[i]
+	}
+	return nil
+}
+
+// ifdTag decodes the IFD entry in p, which must be at least d.ifdLen() bytes
+// long, into a Tag.
+func (d *decoder) ifdTag(p []byte) Tag {
+	t := Tag{
+		ID:   d.byteOrder.Uint16(p[0:2]),
+		Type: DataType(d.byteOrder.Uint16(p[2:4])),
+	}
+	if d.bigTIFF {
+		t.Count = d.byteOrder.Uint64(p[4:12])
+	} else {
+		t.Count = uint64(d.byteOrder.Uint32(p[4:8]))
+	}
+	if _, raw, err := d.ifdData(p); err == nil {
+		t.Value = tagValue(d.byteOrder, t.Type, raw)
+	}
+	return t
+}
+
+// tagValue decodes raw, the data of an entry with the data type dt, into a
+// Tag's Value.
+func tagValue(order binary.ByteOrder, dt DataType, raw []byte) interface{} {
+	switch dt {
+	case TypeByte, TypeUndefined:
+		return append([]byte(nil), raw...)
+	case TypeASCII:
+		if n := len(raw); n > 0 && raw[n-1] == 0 {
+			raw = raw[:n-1]
+		}
+		return string(raw)
+	case TypeShort:
+		v := make([]uint16, len(raw)/2)
+		for i := range v {
+			v[i] = order.Uint16(raw[2*i:])
+		}
+		return v
+	case TypeLong, TypeIFD:
+		v := make([]uint32, len(raw)/4)
+		for i := range v {
+			v[i] = order.Uint32(raw[4*i:])
+		}
+		return v
+	case TypeLong8, TypeIFD8:
+		v := make([]uint64, len(raw)/8)
+		for i := range v {
+			v[i] = order.Uint64(raw[8*i:])
+		}
+		return v
+	case TypeSByte:
+		v := make([]int8, len(raw))
+		for i := range v {
+			v[i] = int8(raw[i])
+		}
+		return v
+	case TypeSShort:
+		v := make([]int16, len(raw)/2)
+		for i := range v {
+			v[i] = int16(order.Uint16(raw[2*i:]))
+		}
+		return v
+	case TypeSLong:
+		v := make([]int32, len(raw)/4)
+		for i := range v {
+			v[i] = int32(order.Uint32(raw[4*i:]))
+		}
+		return v
+	case TypeSLong8:
+		v := make([]int64, len(raw)/8)
+		for i := range v {
+			v[i] = int64(order.Uint64(raw[8*i:]))
+		}
+		return v
+	case TypeRational:
+		v := make([]Rational, len(raw)/8)
+		for i := range v {
+			v[i] = Rational{order.Uint32(raw[8*i:]), order.Uint32(raw[8*i+4:])}
+		}
+		return v
+	case TypeSRational:
+		v := make([]SRational, len(raw)/8)
+		for i := range v {
+			v[i] = SRational{int32(order.Uint32(raw[8*i:])), int32(order.Uint32(raw[8*i+4:]))}
+		}
+		return v
+	case TypeFloat:
+		v := make([]float32, len(raw)/4)
+		for i := range v {
+			v[i] = math.Float32frombits(order.Uint32(raw[4*i:]))
+		}
+		return v
+	case TypeDouble:
+		v := make([]float64, len(raw)/8)
+		for i := range v {
+			v[i] = math.Float64frombits(order.Uint64(raw[8*i:]))
+		}
+		return v
+	}
+	return nil
+}
+
+// tagData returns t's values as the data of an ifdEntry, checking that
+// their Go type matches t's data type. Signed and floating-point values are
+// stored as their bit patterns.
+func tagData(t Tag) ([]uint64, error) {
+	var data []uint64
+	ok := false
+	switch v := t.Value.(type) {
+	case []byte:
+		ok = t.Type == TypeByte || t.Type == TypeUndefined
+		for _, x := range v {
+			data = append(data, uint64(x))
+		}
+	case string:
+		ok = t.Type == TypeASCII
+		for i := 0; i < len(v); i++ {
+			data = append(data, uint64(v[i]))
+		}
+		data = append(data, 0)
+	case []uint16:
+		ok = t.Type == TypeShort
+		for _, x := range v {
+			data = append(data, uint64(x))
+		}
+	case []uint32:
+		ok = t.Type == TypeLong || t.Type == TypeIFD
+		for _, x := range v {
+			data = append(data, uint64(x))
+		}
+	case []uint64:
+		ok = t.Type == TypeLong8 || t.Type == TypeIFD8
+		data = append(data, v...)
+	case []int8:
+		ok = t.Type == TypeSByte
+		for _, x := range v {
+			data = append(data, uint64(uint8(x)))
+		}
+	case []int16:
+		ok = t.Type == TypeSShort
+		for _, x := range v {
+			data = append(data, uint64(uint16(x)))
+		}
+	case []int32:
+		ok = t.Type == TypeSLong
+		for _, x := range v {
+			data = append(data, uint64(uint32(x)))
+		}
+	case []int64:
+		ok = t.Type == TypeSLong8
+		for _, x := range v {
+			data = append(data, uint64(x))
+		}
+	case []Rational:
+		ok = t.Type == TypeRational
+		for _, x := range v {
+			data = append(data, uint64(x.Num), uint64(x.Den))
+		}
+	case []SRational:
+		ok = t.Type == TypeSRational
+		for _, x := range v {
+			data = append(data, uint64(uint32(x.Num)), uint64(uint32(x.Den)))
+		}
+	case []float32:
+		ok = t.Type == TypeFloat
+		for _, x := range v {
+			data = append(data, uint64(math.Float32bits(x)))
+		}
+	case []float64:
+		ok = t.Type == TypeDouble
+		for _, x := range v {
+			data = append(data, math.Float64bits(x))
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("tiff: tag %d: value of type %T does not match data type %d", t.ID, t.Value, t.Type)
+	}
+	return data, nil
+}
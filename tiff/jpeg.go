@@ -0,0 +1,102 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+// This file implements decoding the JPEG compression of TIFF Technical Note
+// 2, in which each strip or tile is a JPEG stream. The streams may share
+// their quantization and Huffman tables, which are then given by the
+// JPEGTables entry, as an abbreviated stream that has no image.
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+)
+
+const (
+	jpegSOI = "\xff\xd8" // Start Of Image marker.
+	jpegEOI = "\xff\xd9" // End Of Image marker.
+
+	// jpegAdobeRGB is an Adobe APP14 marker segment with a transform flag of
+	// zero, which tells image/jpeg that a 3-component image is RGB.
+	jpegAdobeRGB = "\xff\xee\x00\x0eAdobe\x00\x64\x00\x00\x00\x00\x00"
+)
+
+// readJPEG decodes the JPEG stream of a strip or tile from r, and returns
+// its samples, interleaved like those of an uncompressed strip or tile of
+// width by height pixels. The stream's image must be no larger than maxWidth
+// by maxHeight pixels.
+func (d *decoder) readJPEG(r io.Reader, width, height, maxWidth, maxHeight int) ([]byte, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// The stream starts with the strip's or tile's SOI marker, followed by
+	// the tables, without their SOI and EOI markers. An RGB image, which
+	// has not been converted to YCbCr, needs an Adobe marker.
+	tables := bytes.TrimPrefix(d.jpegTables, []byte(jpegSOI))
+	tables = bytes.TrimSuffix(tables, []byte(jpegEOI))
+	stream := []byte(jpegSOI)
+	if d.firstVal(tPhotometricInterpretation) == pRGB {
+		stream = append(stream, jpegAdobeRGB...)
+	}
+	stream = append(stream, tables...)
+	stream = append(stream, bytes.TrimPrefix(data, []byte(jpegSOI))...)
+
+	c, err := jpeg.DecodeConfig(bytes.NewReader(stream))
+	if err != nil {
+		return nil, err
+	}
+	if c.Width > maxWidth || c.Height > maxHeight {
+		return nil, FormatError("JPEG image larger than its strip or tile")
+	}
+	m, err := jpeg.Decode(bytes.NewReader(stream))
+	if err != nil {
+		return nil, err
+	}
+
+	spp := len(d.features[tBitsPerSample])
+	buf := make([]byte, spp*width*height)
+	b := m.Bounds()
+	w, h := minInt(width, b.Dx()), minInt(height, b.Dy())
+	switch m := m.(type) {
+	case *image.Gray:
+		if spp != 1 {
+			return nil, FormatError("JPEG image has wrong number of samples")
+		}
+		for y := 0; y < h; y++ {
+			i := m.PixOffset(b.Min.X, b.Min.Y+y)
+			copy(buf[y*width:y*width+w], m.Pix[i:i+w])
+		}
+	case *image.YCbCr:
+		if spp != 3 {
+			return nil, FormatError("JPEG image has wrong number of samples")
+		}
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				yi := m.YOffset(b.Min.X+x, b.Min.Y+y)
+				ci := m.COffset(b.Min.X+x, b.Min.Y+y)
+				i := 3 * (y*width + x)
+				buf[i+0], buf[i+1], buf[i+2] = color.YCbCrToRGB(m.Y[yi], m.Cb[ci], m.Cr[ci])
+			}
+		}
+	case *image.RGBA:
+		if spp != 3 {
+			return nil, FormatError("JPEG image has wrong number of samples")
+		}
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				j := m.PixOffset(b.Min.X+x, b.Min.Y+y)
+				i := 3 * (y*width + x)
+				copy(buf[i:i+3], m.Pix[j:j+3])
+			}
+		}
+	default:
+		return nil, UnsupportedError("JPEG color model")
+	}
+	return buf, nil
+}
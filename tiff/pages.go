@@ -0,0 +1,178 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"encoding/binary"
+	"image"
+	"io"
+)
+
+// A Page is one of the images, or pages, of a TIFF file.
+type Page struct {
+	Image image.Image
+	// IFD holds all of the page's IFD entries, including those that the
+	// decoder does not use.
+	IFD *IFD
+}
+
+// A Decoder reads the pages of a multi-page TIFF file, such as a fax or a
+// scanned document, one at a time. Each page has its own Image File Directory
+// (IFD), and each IFD gives the offset of the next one.
+type Decoder struct {
+	r         io.ReaderAt
+	byteOrder binary.ByteOrder
+	bigTIFF   bool
+	o         *DecodeOptions
+	// next is the offset of the next IFD, or zero if there are no more.
+	next int64
+	// n is the number of IFDs read so far, and seen holds their offsets.
+	n    int
+	seen map[int64]bool
+	err  error
+}
+
+// NewDecoder returns a Decoder that reads the pages of the TIFF file in r.
+// Any *LimitError for a page's image is returned by Next, and o.MaxIFDs
+// limits the number of pages. o may be nil, in which case there are no
+// limits.
+func NewDecoder(r io.Reader, o *DecodeOptions) (*Decoder, error) {
+	ra := newReaderAt(r)
+	byteOrder, bigTIFF, next, err := readHeader(ra)
+	if err != nil {
+		return nil, err
+	}
+	if next == 0 {
+		return nil, FormatError("no IFD")
+	}
+	return &Decoder{
+		r:         ra,
+		byteOrder: byteOrder,
+		bigTIFF:   bigTIFF,
+		o:         o,
+		next:      next,
+		seen:      make(map[int64]bool),
+	}, nil
+}
+
+// nextIFD returns a decoder for the next page's IFD, or io.EOF if there are
+// no more pages.
+func (d *Decoder) nextIFD() (*decoder, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	if d.next == 0 {
+		return nil, io.EOF
+	}
+	if d.o != nil && d.o.MaxIFDs > 0 && d.n >= d.o.MaxIFDs {
+		d.err = &LimitError{"MaxIFDs", int64(d.n + 1), int64(d.o.MaxIFDs)}
+		return nil, d.err
+	}
+	if d.seen[d.next] {
+		d.err = FormatError("IFD loop")
+		return nil, d.err
+	}
+	d.seen[d.next] = true
+	d.n++
+
+	ifd, err := newIFDDecoder(d.r, d.byteOrder, d.bigTIFF, d.next, true)
+	if err != nil {
+		d.err = err
+		return nil, err
+	}
+	b := make([]byte, 4)
+	if d.bigTIFF {
+		b = make([]byte, 8)
+	}
+	if _, err := d.r.ReadAt(b, ifd.nextIFDOffset); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		d.err = err
+		return nil, err
+	}
+	d.next = ifd.offset(b)
+	return ifd, nil
+}
+
+// Next decodes and returns the next page. It returns io.EOF if there are no
+// more pages.
+func (d *Decoder) Next() (*Page, error) {
+	ifd, err := d.nextIFD()
+	if err != nil {
+		return nil, err
+	}
+	m, err := ifd.decodeImage(d.o)
+	if err != nil {
+		d.err = err
+		return nil, err
+	}
+	return &Page{Image: m, IFD: ifd.ifd}, nil
+}
+
+// DecodeAll reads all of the pages of a TIFF file from r.
+func DecodeAll(r io.Reader) ([]*Page, error) {
+	d, err := NewDecoder(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	var pages []*Page
+	for {
+		page, err := d.Next()
+		if err == io.EOF {
+			return pages, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, page)
+	}
+}
+
+// DecodeConfigAll returns the color model and dimensions of each of the pages
+// of a TIFF file, without decoding their images. The number of pages is the
+// length of the returned slice.
+func DecodeConfigAll(r io.Reader) ([]image.Config, error) {
+	var configs []image.Config
+	err := eachIFD(r, func(d *decoder) {
+		configs = append(configs, d.config)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+// DecodeIFDs returns the IFD of each of the pages of a TIFF file, without
+// decoding their images.
+func DecodeIFDs(r io.Reader) ([]*IFD, error) {
+	var ifds []*IFD
+	err := eachIFD(r, func(d *decoder) {
+		ifds = append(ifds, d.ifd)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ifds, nil
+}
+
+// eachIFD calls f with the decoder of each of the IFDs of the TIFF file in r,
+// in order, without decoding their images.
+func eachIFD(r io.Reader, f func(d *decoder)) error {
+	d, err := NewDecoder(r, nil)
+	if err != nil {
+		return err
+	}
+	for {
+		ifd, err := d.nextIFD()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		f(ifd)
+	}
+}
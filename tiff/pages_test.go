@@ -0,0 +1,174 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// tPageIndex is a private tag that multiPage gives each page.
+const tPageIndex = 65000
+
+// multiPage returns an uncompressed, little-endian TIFF file whose pages are
+// the given images, and the offset of the last IFD's next IFD offset.
+func multiPage(pages []*image.Gray) (data []byte, lastNext int) {
+	le := binary.LittleEndian
+	buf := []byte(leHeader + "\x00\x00\x00\x00")
+	next := 4
+	for i, m := range pages {
+		w, h := m.Bounds().Dx(), m.Bounds().Dy()
+		pixOffset := len(buf)
+		for y := 0; y < h; y++ {
+			buf = append(buf, m.Pix[y*m.Stride:y*m.Stride+w]...)
+		}
+		le.PutUint32(buf[next:], uint32(len(buf)))
+		entries := []ifdEntry{
+			{tImageWidth, dtShort, []uint64{uint64(w)}},
+			{tImageLength, dtShort, []uint64{uint64(h)}},
+			{tBitsPerSample, dtShort, []uint64{8}},
+			{tCompression, dtShort, []uint64{cNone}},
+			{tPhotometricInterpretation, dtShort, []uint64{pBlackIsZero}},
+			{tStripOffsets, dtLong, []uint64{uint64(pixOffset)}},
+			{tSamplesPerPixel, dtShort, []uint64{1}},
+			{tRowsPerStrip, dtShort, []uint64{uint64(h)}},
+			{tStripByteCounts, dtLong, []uint64{uint64(w * h)}},
+			{tPageIndex, dtShort, []uint64{uint64(i)}},
+		}
+		buf = append(buf, byte(len(entries)), 0)
+		for _, e := range entries {
+			var b [ifdLen]byte
+			le.PutUint16(b[0:], uint16(e.tag))
+			le.PutUint16(b[2:], uint16(e.datatype))
+			le.PutUint32(b[4:], 1)
+			e.putData(b[8:])
+			buf = append(buf, b[:]...)
+		}
+		next = len(buf)
+		buf = append(buf, 0, 0, 0, 0)
+	}
+	return buf, next
+}
+
+// tagUints returns the integer values of the tag of ifd with the given ID, or
+// nil if there is no such tag.
+func tagUints(ifd *IFD, id uint16) []uint {
+	t := ifd.Tag(id)
+	if t == nil {
+		return nil
+	}
+	data, err := tagData(*t)
+	if err != nil {
+		return nil
+	}
+	v := make([]uint, len(data))
+	for i, x := range data {
+		v[i] = uint(x)
+	}
+	return v
+}
+
+func testPages() []*image.Gray {
+	var pages []*image.Gray
+	for i, r := range []image.Rectangle{
+		image.Rect(0, 0, 3, 2),
+		image.Rect(0, 0, 5, 4),
+		image.Rect(0, 0, 1, 7),
+	} {
+		m := image.NewGray(r)
+		for j := range m.Pix {
+			m.Pix[j] = uint8(40*i + j)
+		}
+		pages = append(pages, m)
+	}
+	return pages
+}
+
+func TestDecodeAll(t *testing.T) {
+	want := testPages()
+	data, _ := multiPage(want)
+
+	pages, err := DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("DecodeAll: %v", err)
+	}
+	if len(pages) != len(want) {
+		t.Fatalf("got %d pages, want %d", len(pages), len(want))
+	}
+	for i, p := range pages {
+		if !reflect.DeepEqual(p.Image, want[i]) {
+			t.Errorf("page %d: images differ", i)
+		}
+		if got := tagUints(p.IFD, tPageIndex); !reflect.DeepEqual(got, []uint{uint(i)}) {
+			t.Errorf("page %d: private tag: got %v, want [%d]", i, got, i)
+		}
+		if got, want := tagUints(p.IFD, tImageWidth), []uint{uint(want[i].Bounds().Dx())}; !reflect.DeepEqual(got, want) {
+			t.Errorf("page %d: ImageWidth: got %v, want %v", i, got, want)
+		}
+	}
+
+	configs, err := DecodeConfigAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("DecodeConfigAll: %v", err)
+	}
+	if len(configs) != len(want) {
+		t.Fatalf("DecodeConfigAll: got %d pages, want %d", len(configs), len(want))
+	}
+	for i, c := range configs {
+		if c.Width != want[i].Bounds().Dx() || c.Height != want[i].Bounds().Dy() {
+			t.Errorf("DecodeConfigAll: page %d: got %dx%d, want %v", i, c.Width, c.Height, want[i].Bounds().Size())
+		}
+	}
+
+	// Decode reads the first page.
+	m, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if !reflect.DeepEqual(m, want[0]) {
+		t.Errorf("Decode: got a different image than the first page")
+	}
+}
+
+func TestDecoderLimits(t *testing.T) {
+	data, lastNext := multiPage(testPages())
+
+	d, err := NewDecoder(bytes.NewReader(data), &DecodeOptions{MaxIFDs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := d.Next(); err != nil {
+			t.Fatalf("page %d: %v", i, err)
+		}
+	}
+	if _, err := d.Next(); err == nil {
+		t.Errorf("page 2: got nil error, want a MaxIFDs LimitError")
+	} else if e, ok := err.(*LimitError); !ok || e.Limit != "MaxIFDs" {
+		t.Errorf("page 2: got %v, want a MaxIFDs LimitError", err)
+	}
+
+	// Make the last page's IFD link back to the first.
+	loop := append([]byte(nil), data...)
+	copy(loop[lastNext:], loop[4:8])
+	d, err = NewDecoder(bytes.NewReader(loop), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		_, err := d.Next()
+		if err == nil {
+			continue
+		}
+		if err == io.EOF || i != 3 {
+			t.Errorf("page %d: got %v, want an error for the IFD loop", i, err)
+		}
+		break
+	}
+}
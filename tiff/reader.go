@@ -16,6 +16,7 @@ import (
 	"image/color"
 	"io"
 	"math"
+	"math/bits"
 
 	"golang.org/x/image/ccitt"
 	"golang.org/x/image/tiff/lzw"
@@ -90,15 +91,29 @@ func safeReadAt(r io.ReaderAt, n uint64, off int64) ([]byte, error) {
 type decoder struct {
 	r         io.ReaderAt
 	byteOrder binary.ByteOrder
+	bigTIFF   bool
 	config    image.Config
 	mode      imageMode
 	bpp       uint
 	features  map[int][]uint
 	palette   []color.Color
 
+	// ifd, if non-nil, holds every IFD entry, including those that the
+	// decoder does not use.
+	ifd *IFD
+	// ycbcrSub is the horizontal and vertical chroma subsampling of a
+	// YCbCr image.
+	ycbcrSub [2]int
+	// jpegTables holds the JPEGTables entry, an abbreviated JPEG stream
+	// with the tables shared by the strips or tiles, if any.
+	jpegTables []byte
+	// nextIFDOffset is the offset of the 4 bytes that hold the offset of the
+	// next IFD, if any.
+	nextIFDOffset int64
+
 	buf   []byte
 	off   int    // Current offset in buf.
-	v     uint32 // Buffer value for reading with arbitrary bit depths.
+	v     uint64 // Buffer value for reading with arbitrary bit depths.
 	nbits uint   // Remaining number of bits in v.
 }
 
@@ -112,58 +127,100 @@ func (d *decoder) firstVal(tag int) uint {
 	return f[0]
 }
 
-// ifdUint decodes the IFD entry in p, which must be of the Byte, Short
-// or Long type, and returns the decoded uint values.
+// ifdUint decodes the IFD entry in p, which must be of the Byte, Short,
+// Long or (for BigTIFF) Long8 type, and returns the decoded uint values.
 func (d *decoder) ifdUint(p []byte) (u []uint, err error) {
-	var raw []byte
-	if len(p) < ifdLen {
-		return nil, FormatError("bad IFD entry")
-	}
-
-	datatype := d.byteOrder.Uint16(p[2:4])
-	if dt := int(datatype); dt <= 0 || dt >= len(lengths) {
-		return nil, UnsupportedError("IFD entry datatype")
-	}
-
-	count := d.byteOrder.Uint32(p[4:8])
-	if count > math.MaxInt32/lengths[datatype] {
-		return nil, FormatError("IFD data too large")
-	}
-	if datalen := lengths[datatype] * count; datalen > 4 {
-		// The IFD contains a pointer to the real value.
-		raw, err = safeReadAt(d.r, uint64(datalen), int64(d.byteOrder.Uint32(p[8:12])))
-	} else {
-		raw = p[8 : 8+datalen]
-	}
+	datatype, raw, err := d.ifdData(p)
 	if err != nil {
 		return nil, err
 	}
 
-	u = make([]uint, count)
+	u = make([]uint, len(raw)/int(lengths[datatype]))
 	switch datatype {
 	case dtByte:
-		for i := uint32(0); i < count; i++ {
+		for i := range u {
 			u[i] = uint(raw[i])
 		}
 	case dtShort:
-		for i := uint32(0); i < count; i++ {
+		for i := range u {
 			u[i] = uint(d.byteOrder.Uint16(raw[2*i : 2*(i+1)]))
 		}
 	case dtLong:
-		for i := uint32(0); i < count; i++ {
+		for i := range u {
 			u[i] = uint(d.byteOrder.Uint32(raw[4*i : 4*(i+1)]))
 		}
+	case dtLong8:
+		for i := range u {
+			u[i] = uint(d.byteOrder.Uint64(raw[8*i : 8*(i+1)]))
+		}
 	default:
 		return nil, UnsupportedError("data type")
 	}
 	return u, nil
 }
 
+// ifdData returns the data type and the raw data of the IFD entry in p.
+func (d *decoder) ifdData(p []byte) (datatype uint16, raw []byte, err error) {
+	if len(p) < d.ifdLen() {
+		return 0, nil, FormatError("bad IFD entry")
+	}
+
+	datatype = d.byteOrder.Uint16(p[2:4])
+	if dt := int(datatype); dt <= 0 || dt >= len(lengths) || lengths[dt] == 0 {
+		return 0, nil, UnsupportedError("IFD entry datatype")
+	}
+
+	// The count is followed by the value, if it fits, or else by the
+	// offset of the value.
+	var count uint64
+	var field []byte
+	if d.bigTIFF {
+		count, field = d.byteOrder.Uint64(p[4:12]), p[12:20]
+	} else {
+		count, field = uint64(d.byteOrder.Uint32(p[4:8])), p[8:12]
+	}
+	if count > math.MaxInt32/uint64(lengths[datatype]) {
+		return 0, nil, FormatError("IFD data too large")
+	}
+	if datalen := uint64(lengths[datatype]) * count; datalen > uint64(len(field)) {
+		// The IFD contains a pointer to the real value.
+		raw, err = safeReadAt(d.r, datalen, d.offset(field))
+	} else {
+		raw = field[:datalen]
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	return datatype, raw, nil
+}
+
+// ifdLen returns the length of an IFD entry in bytes.
+func (d *decoder) ifdLen() int {
+	if d.bigTIFF {
+		return bigIFDLen
+	}
+	return ifdLen
+}
+
+// offset decodes the offset in p, which is 8 bytes long for BigTIFF and 4
+// bytes long otherwise.
+func (d *decoder) offset(p []byte) int64 {
+	if d.bigTIFF {
+		return int64(d.byteOrder.Uint64(p))
+	}
+	return int64(d.byteOrder.Uint32(p))
+}
+
 // parseIFD decides whether the IFD entry in p is "interesting" and
 // stows away the data in the decoder. It returns the tag number of the
 // entry and an error, if any.
 func (d *decoder) parseIFD(p []byte) (int, error) {
 	tag := d.byteOrder.Uint16(p[0:2])
+	if d.ifd != nil {
+		// Entries that are invalid are kept with a nil Value. They are only
+		// an error if the decoder uses them.
+		d.ifd.Tags = append(d.ifd.Tags, d.ifdTag(p))
+	}
 	switch tag {
 	case tBitsPerSample,
 		tExtraSamples,
@@ -181,7 +238,9 @@ func (d *decoder) parseIFD(p []byte) (int, error) {
 		tImageWidth,
 		tFillOrder,
 		tT4Options,
-		tT6Options:
+		tT6Options,
+		tYCbCrSubSampling,
+		tSampleFormat:
 		val, err := d.ifdUint(p)
 		if err != nil {
 			return 0, err
@@ -205,20 +264,12 @@ func (d *decoder) parseIFD(p []byte) (int, error) {
 				0xffff,
 			}
 		}
-	case tSampleFormat:
-		// Page 27 of the spec: If the SampleFormat is present and
-		// the value is not 1 [= unsigned integer data], a Baseline
-		// TIFF reader that cannot handle the SampleFormat value
-		// must terminate the import process gracefully.
-		val, err := d.ifdUint(p)
+	case tJPEGTables:
+		_, raw, err := d.ifdData(p)
 		if err != nil {
 			return 0, err
 		}
-		for _, v := range val {
-			if v != 1 {
-				return 0, UnsupportedError("sample format")
-			}
-		}
+		d.jpegTables = append([]byte(nil), raw...)
 	}
 	return int(tag), nil
 }
@@ -230,23 +281,58 @@ func (d *decoder) readBits(n uint) (v uint32, ok bool) {
 		if d.off >= len(d.buf) {
 			return 0, false
 		}
-		d.v |= uint32(d.buf[d.off])
+		d.v |= uint64(d.buf[d.off])
 		d.off++
 		d.nbits += 8
 	}
 	d.nbits -= n
 	rv := d.v >> d.nbits
 	d.v &^= rv << d.nbits
-	return rv, true
+	return uint32(rv), true
+}
+
+// readSample reads a sample of d.bpp bits with readBits. Samples of 16, 24
+// or 32 bits are in the byte order of the file, and the others are packed
+// with the most significant bit first.
+func (d *decoder) readSample() (v uint32, ok bool) {
+	v, ok = d.readBits(d.bpp)
+	if ok && d.byteOrder == binary.LittleEndian {
+		switch d.bpp {
+		case 16:
+			v = uint32(bits.ReverseBytes16(uint16(v)))
+		case 24:
+			v = bits.ReverseBytes32(v) >> 8
+		case 32:
+			v = bits.ReverseBytes32(v)
+		}
+	}
+	return v, ok
+}
+
+// scaleSample scales v, a sample of n bits, to the range from 0 to max.
+func scaleSample(v uint32, n uint, max uint32) uint32 {
+	return uint32(uint64(v) * uint64(max) / (1<<n - 1))
 }
 
 // flushBits discards the unread bits in the buffer used by readBits.
-// It is used at the end of a line.
+// It is used at the start of a line, by startRow.
 func (d *decoder) flushBits() {
 	d.v = 0
 	d.nbits = 0
 }
 
+// startRow moves to the pixel at column x of row y of a strip or tile of
+// the given width, counted from its top-left corner, so that pixels outside
+// of the image being decoded are skipped. It is used at the start of a line.
+func (d *decoder) startRow(x, y, width int) {
+	bits := int(d.bpp) * len(d.features[tBitsPerSample])
+	d.off = y*((width*bits+7)/8) + x*bits/8
+	d.flushBits()
+	if n := x * bits % 8; n != 0 {
+		d.readBits(uint(n))
+	}
+}
+
 // minInt returns the smaller of x or y.
 func minInt(a, b int) int {
 	if a <= b {
@@ -255,6 +341,50 @@ func minInt(a, b int) int {
 	return b
 }
 
+// maxInt returns the larger of x or y.
+func maxInt(a, b int) int {
+	if a >= b {
+		return a
+	}
+	return b
+}
+
+// decodeRGBBits decodes the raw data of an RGB image whose samples are
+// neither 8 nor 16 bits, scaling them to 8 bits if they have fewer and to 16
+// bits otherwise. Its arguments are those of decode, with rMinX, rMinY, rMaxX
+// and rMaxY giving the part of the strip or tile within the bounds of dst.
+func (d *decoder) decodeRGBBits(dst image.Image, xmin, ymin, xmax, rMinX, rMinY, rMaxX, rMaxY int) error {
+	max := uint32(0xff)
+	if d.bpp > 8 {
+		max = 0xffff
+	}
+	samples := len(d.features[tBitsPerSample])
+	s := [4]uint32{3: max}
+	for y := rMinY; y < rMaxY; y++ {
+		d.startRow(rMinX-xmin, y-ymin, xmax-xmin)
+		for x := rMinX; x < rMaxX; x++ {
+			for i := 0; i < samples; i++ {
+				v, ok := d.readSample()
+				if !ok {
+					return errNoPixels
+				}
+				s[i] = scaleSample(v, d.bpp, max)
+			}
+			switch img := dst.(type) {
+			case *image.RGBA:
+				img.SetRGBA(x, y, color.RGBA{uint8(s[0]), uint8(s[1]), uint8(s[2]), uint8(s[3])})
+			case *image.NRGBA:
+				img.SetNRGBA(x, y, color.NRGBA{uint8(s[0]), uint8(s[1]), uint8(s[2]), uint8(s[3])})
+			case *image.RGBA64:
+				img.SetRGBA64(x, y, color.RGBA64{uint16(s[0]), uint16(s[1]), uint16(s[2]), uint16(s[3])})
+			case *image.NRGBA64:
+				img.SetNRGBA64(x, y, color.NRGBA64{uint16(s[0]), uint16(s[1]), uint16(s[2]), uint16(s[3])})
+			}
+		}
+	}
+	return nil
+}
+
 // decode decodes the raw data of an image.
 // It reads from d.buf and writes the strip or tile into dst.
 func (d *decoder) decode(dst image.Image, xmin, ymin, xmax, ymax int) error {
@@ -264,6 +394,9 @@ func (d *decoder) decode(dst image.Image, xmin, ymin, xmax, ymax int) error {
 	// In this case, p contains the color difference to the preceding pixel.
 	// See page 64-65 of the spec.
 	if d.firstVal(tPredictor) == prHorizontal {
+		if d.mode == mYCbCr || d.mode == mFloat {
+			return UnsupportedError("horizontal predictor with YCbCr or floating-point samples")
+		}
 		switch d.bpp {
 		case 16:
 			var off int
@@ -293,19 +426,29 @@ func (d *decoder) decode(dst image.Image, xmin, ymin, xmax, ymax int) error {
 					off++
 				}
 			}
-		case 1:
-			return UnsupportedError("horizontal predictor with 1 BitsPerSample")
+		default:
+			return UnsupportedError(fmt.Sprintf("horizontal predictor with %d BitsPerSample", d.bpp))
 		}
 	}
+	if d.firstVal(tPredictor) == prFloatingPoint {
+		return UnsupportedError("floating-point predictor")
+	}
 
+	// Only the pixels within the bounds of dst are decoded.
+	rMinX := maxInt(xmin, dst.Bounds().Min.X)
+	rMinY := maxInt(ymin, dst.Bounds().Min.Y)
 	rMaxX := minInt(xmax, dst.Bounds().Max.X)
 	rMaxY := minInt(ymax, dst.Bounds().Max.Y)
+	if (d.mode == mRGB || d.mode == mRGBA || d.mode == mNRGBA) && d.bpp != 8 && d.bpp != 16 {
+		return d.decodeRGBBits(dst, xmin, ymin, xmax, rMinX, rMinY, rMaxX, rMaxY)
+	}
 	switch d.mode {
 	case mGray, mGrayInvert:
 		if d.bpp == 16 {
 			img := dst.(*image.Gray16)
-			for y := ymin; y < rMaxY; y++ {
-				for x := xmin; x < rMaxX; x++ {
+			for y := rMinY; y < rMaxY; y++ {
+				d.startRow(rMinX-xmin, y-ymin, xmax-xmin)
+				for x := rMinX; x < rMaxX; x++ {
 					if d.off+2 > len(d.buf) {
 						return errNoPixels
 					}
@@ -316,15 +459,29 @@ func (d *decoder) decode(dst image.Image, xmin, ymin, xmax, ymax int) error {
 					}
 					img.SetGray16(x, y, color.Gray16{v})
 				}
-				if rMaxX == img.Bounds().Max.X {
-					d.off += 2 * (xmax - img.Bounds().Max.X)
+			}
+		} else if d.bpp > 8 {
+			img := dst.(*image.Gray16)
+			for y := rMinY; y < rMaxY; y++ {
+				d.startRow(rMinX-xmin, y-ymin, xmax-xmin)
+				for x := rMinX; x < rMaxX; x++ {
+					v, ok := d.readSample()
+					if !ok {
+						return errNoPixels
+					}
+					v = scaleSample(v, d.bpp, 0xffff)
+					if d.mode == mGrayInvert {
+						v = 0xffff - v
+					}
+					img.SetGray16(x, y, color.Gray16{uint16(v)})
 				}
 			}
 		} else {
 			img := dst.(*image.Gray)
 			max := uint32((1 << d.bpp) - 1)
-			for y := ymin; y < rMaxY; y++ {
-				for x := xmin; x < rMaxX; x++ {
+			for y := rMinY; y < rMaxY; y++ {
+				d.startRow(rMinX-xmin, y-ymin, xmax-xmin)
+				for x := rMinX; x < rMaxX; x++ {
 					v, ok := d.readBits(d.bpp)
 					if !ok {
 						return errNoPixels
@@ -335,31 +492,30 @@ func (d *decoder) decode(dst image.Image, xmin, ymin, xmax, ymax int) error {
 					}
 					img.SetGray(x, y, color.Gray{uint8(v)})
 				}
-				d.flushBits()
 			}
 		}
 	case mPaletted:
 		img := dst.(*image.Paletted)
 		pLen := len(d.palette)
-		for y := ymin; y < rMaxY; y++ {
-			for x := xmin; x < rMaxX; x++ {
-				v, ok := d.readBits(d.bpp)
+		for y := rMinY; y < rMaxY; y++ {
+			d.startRow(rMinX-xmin, y-ymin, xmax-xmin)
+			for x := rMinX; x < rMaxX; x++ {
+				v, ok := d.readSample()
 				if !ok {
 					return errNoPixels
 				}
-				idx := uint8(v)
-				if int(idx) >= pLen {
+				if v >= uint32(pLen) {
 					return errInvalidColorIndex
 				}
-				img.SetColorIndex(x, y, idx)
+				img.SetColorIndex(x, y, uint8(v))
 			}
-			d.flushBits()
 		}
 	case mRGB:
 		if d.bpp == 16 {
 			img := dst.(*image.RGBA64)
-			for y := ymin; y < rMaxY; y++ {
-				for x := xmin; x < rMaxX; x++ {
+			for y := rMinY; y < rMaxY; y++ {
+				d.startRow(rMinX-xmin, y-ymin, xmax-xmin)
+				for x := rMinX; x < rMaxX; x++ {
 					if d.off+6 > len(d.buf) {
 						return errNoPixels
 					}
@@ -372,10 +528,10 @@ func (d *decoder) decode(dst image.Image, xmin, ymin, xmax, ymax int) error {
 			}
 		} else {
 			img := dst.(*image.RGBA)
-			for y := ymin; y < rMaxY; y++ {
-				min := img.PixOffset(xmin, y)
+			for y := rMinY; y < rMaxY; y++ {
+				min := img.PixOffset(rMinX, y)
 				max := img.PixOffset(rMaxX, y)
-				off := (y - ymin) * (xmax - xmin) * 3
+				off := ((y-ymin)*(xmax-xmin) + rMinX - xmin) * 3
 				for i := min; i < max; i += 4 {
 					if off+3 > len(d.buf) {
 						return errNoPixels
@@ -391,8 +547,9 @@ func (d *decoder) decode(dst image.Image, xmin, ymin, xmax, ymax int) error {
 	case mNRGBA:
 		if d.bpp == 16 {
 			img := dst.(*image.NRGBA64)
-			for y := ymin; y < rMaxY; y++ {
-				for x := xmin; x < rMaxX; x++ {
+			for y := rMinY; y < rMaxY; y++ {
+				d.startRow(rMinX-xmin, y-ymin, xmax-xmin)
+				for x := rMinX; x < rMaxX; x++ {
 					if d.off+8 > len(d.buf) {
 						return errNoPixels
 					}
@@ -406,21 +563,148 @@ func (d *decoder) decode(dst image.Image, xmin, ymin, xmax, ymax int) error {
 			}
 		} else {
 			img := dst.(*image.NRGBA)
-			for y := ymin; y < rMaxY; y++ {
-				min := img.PixOffset(xmin, y)
+			for y := rMinY; y < rMaxY; y++ {
+				min := img.PixOffset(rMinX, y)
 				max := img.PixOffset(rMaxX, y)
-				i0, i1 := (y-ymin)*(xmax-xmin)*4, (y-ymin+1)*(xmax-xmin)*4
+				i0, i1 := ((y-ymin)*(xmax-xmin)+rMinX-xmin)*4, ((y-ymin)*(xmax-xmin)+rMaxX-xmin)*4
 				if i1 > len(d.buf) {
 					return errNoPixels
 				}
 				copy(img.Pix[min:max], d.buf[i0:i1])
 			}
 		}
+	case mCMYK:
+		img := dst.(*image.CMYK)
+		for y := rMinY; y < rMaxY; y++ {
+			min := img.PixOffset(rMinX, y)
+			max := img.PixOffset(rMaxX, y)
+			i0, i1 := ((y-ymin)*(xmax-xmin)+rMinX-xmin)*4, ((y-ymin)*(xmax-xmin)+rMaxX-xmin)*4
+			if i1 > len(d.buf) {
+				return errNoPixels
+			}
+			copy(img.Pix[min:max], d.buf[i0:i1])
+		}
+	case mYCbCr:
+		// The samples are in data units of hs by vs luma samples, in
+		// row-major order, followed by one Cb and one Cr sample (p. 93 of
+		// the spec). The rows of units are padded to the width of the strip
+		// or tile.
+		hs, vs := d.ycbcrSub[0], d.ycbcrSub[1]
+		n := hs*vs + 2
+		// The rows of units above dst are skipped.
+		y0 := ymin + (rMinY-ymin)/vs*vs
+		d.off = (y0 - ymin) / vs * ((xmax - xmin + hs - 1) / hs) * n
+		for y := y0; y < rMaxY; y += vs {
+			for x := xmin; x < xmax; x += hs {
+				if d.off+n > len(d.buf) {
+					return errNoPixels
+				}
+				u := d.buf[d.off : d.off+n]
+				d.off += n
+				if x+hs <= rMinX || x >= rMaxX {
+					continue
+				}
+				cb, cr := u[n-2], u[n-1]
+				i0, j0 := maxInt(rMinX-x, 0), maxInt(rMinY-y, 0)
+				switch img := dst.(type) {
+				case *image.YCbCr:
+					for j := j0; j < vs && y+j < rMaxY; j++ {
+						for i := i0; i < hs && x+i < rMaxX; i++ {
+							img.Y[img.YOffset(x+i, y+j)] = u[j*hs+i]
+						}
+					}
+					c := img.COffset(x+i0, y+j0)
+					img.Cb[c], img.Cr[c] = cb, cr
+				case *image.RGBA:
+					for j := j0; j < vs && y+j < rMaxY; j++ {
+						for i := i0; i < hs && x+i < rMaxX; i++ {
+							r, g, b := color.YCbCrToRGB(u[j*hs+i], cb, cr)
+							img.SetRGBA(x+i, y+j, color.RGBA{r, g, b, 0xff})
+						}
+					}
+				}
+			}
+		}
+	case mInt:
+		img := dst.(*GrayInt16)
+		for y := rMinY; y < rMaxY; y++ {
+			d.startRow(rMinX-xmin, y-ymin, xmax-xmin)
+			for x := rMinX; x < rMaxX; x++ {
+				if d.off+2 > len(d.buf) {
+					return errNoPixels
+				}
+				img.Pix[img.PixOffset(x, y)] = int16(d.byteOrder.Uint16(d.buf[d.off : d.off+2]))
+				d.off += 2
+			}
+		}
+	case mFloat:
+		n := int(d.bpp / 8)
+		for y := rMinY; y < rMaxY; y++ {
+			off := ((y-ymin)*(xmax-xmin) + rMinX - xmin) * n
+			if off+(rMaxX-rMinX)*n > len(d.buf) {
+				return errNoPixels
+			}
+			switch img := dst.(type) {
+			case *GrayFloat32:
+				for x := rMinX; x < rMaxX; x++ {
+					img.Pix[img.PixOffset(x, y)] = math.Float32frombits(d.byteOrder.Uint32(d.buf[off:]))
+					off += 4
+				}
+			case *GrayFloat64:
+				for x := rMinX; x < rMaxX; x++ {
+					img.Pix[img.PixOffset(x, y)] = math.Float64frombits(d.byteOrder.Uint64(d.buf[off:]))
+					off += 8
+				}
+			}
+		}
+	case mLab, mICCLab:
+		white := d65
+		if d.mode == mICCLab {
+			white = d50
+		}
+		if d.bpp == 16 {
+			img := dst.(*image.RGBA64)
+			for y := rMinY; y < rMaxY; y++ {
+				d.startRow(rMinX-xmin, y-ymin, xmax-xmin)
+				for x := rMinX; x < rMaxX; x++ {
+					if d.off+6 > len(d.buf) {
+						return errNoPixels
+					}
+					l := d.byteOrder.Uint16(d.buf[d.off+0 : d.off+2])
+					a := d.byteOrder.Uint16(d.buf[d.off+2 : d.off+4])
+					b := d.byteOrder.Uint16(d.buf[d.off+4 : d.off+6])
+					d.off += 6
+					if d.mode == mICCLab {
+						a, b = a-0x8000, b-0x8000
+					}
+					r, g, bl := labToRGB(float64(l)*100/0xffff, float64(int16(a))/0x100, float64(int16(b))/0x100, white)
+					img.SetRGBA64(x, y, color.RGBA64{uint16(r*0xffff + 0.5), uint16(g*0xffff + 0.5), uint16(bl*0xffff + 0.5), 0xffff})
+				}
+			}
+		} else {
+			img := dst.(*image.RGBA)
+			for y := rMinY; y < rMaxY; y++ {
+				off := ((y-ymin)*(xmax-xmin) + rMinX - xmin) * 3
+				for x := rMinX; x < rMaxX; x++ {
+					if off+3 > len(d.buf) {
+						return errNoPixels
+					}
+					l, a, b := d.buf[off+0], d.buf[off+1], d.buf[off+2]
+					off += 3
+					if d.mode == mICCLab {
+						a, b = a-0x80, b-0x80
+					}
+					r, g, bl := labToRGB(float64(l)*100/0xff, float64(int8(a)), float64(int8(b)), white)
+					img.SetRGBA(x, y, color.RGBA{uint8(r*0xff + 0.5), uint8(g*0xff + 0.5), uint8(bl*0xff + 0.5), 0xff})
+				}
+			}
+		}
 	case mRGBA:
 		if d.bpp == 16 {
 			img := dst.(*image.RGBA64)
-			for y := ymin; y < rMaxY; y++ {
-				for x := xmin; x < rMaxX; x++ {
+			for y := rMinY; y < rMaxY; y++ {
+				d.startRow(rMinX-xmin, y-ymin, xmax-xmin)
+				for x := rMinX; x < rMaxX; x++ {
 					if d.off+8 > len(d.buf) {
 						return errNoPixels
 					}
@@ -434,10 +718,10 @@ func (d *decoder) decode(dst image.Image, xmin, ymin, xmax, ymax int) error {
 			}
 		} else {
 			img := dst.(*image.RGBA)
-			for y := ymin; y < rMaxY; y++ {
-				min := img.PixOffset(xmin, y)
+			for y := rMinY; y < rMaxY; y++ {
+				min := img.PixOffset(rMinX, y)
 				max := img.PixOffset(rMaxX, y)
-				i0, i1 := (y-ymin)*(xmax-xmin)*4, (y-ymin+1)*(xmax-xmin)*4
+				i0, i1 := ((y-ymin)*(xmax-xmin)+rMinX-xmin)*4, ((y-ymin)*(xmax-xmin)+rMaxX-xmin)*4
 				if i1 > len(d.buf) {
 					return errNoPixels
 				}
@@ -449,46 +733,98 @@ func (d *decoder) decode(dst image.Image, xmin, ymin, xmax, ymax int) error {
 	return nil
 }
 
-func newDecoder(r io.Reader) (*decoder, error) {
-	d := &decoder{
-		r:        newReaderAt(r),
-		features: make(map[int][]uint),
-	}
-
-	p := make([]byte, 8)
-	if _, err := d.r.ReadAt(p, 0); err != nil {
+// readHeader reads the header of the TIFF file in r and returns its byte
+// order, whether it is a BigTIFF file, and the offset of its first IFD.
+func readHeader(r io.ReaderAt) (byteOrder binary.ByteOrder, bigTIFF bool, ifdOffset int64, err error) {
+	var p [16]byte
+	if _, err := r.ReadAt(p[:8], 0); err != nil {
 		if err == io.EOF {
 			err = io.ErrUnexpectedEOF
 		}
-		return nil, err
+		return nil, false, 0, err
 	}
 	switch string(p[0:4]) {
 	case leHeader:
-		d.byteOrder = binary.LittleEndian
+		byteOrder = binary.LittleEndian
 	case beHeader:
-		d.byteOrder = binary.BigEndian
+		byteOrder = binary.BigEndian
+	case leBigHeader:
+		byteOrder, bigTIFF = binary.LittleEndian, true
+	case beBigHeader:
+		byteOrder, bigTIFF = binary.BigEndian, true
 	default:
-		return nil, FormatError("malformed header")
+		return nil, false, 0, FormatError("malformed header")
+	}
+	if !bigTIFF {
+		return byteOrder, false, int64(byteOrder.Uint32(p[4:8])), nil
+	}
+	if byteOrder.Uint16(p[4:6]) != 8 || byteOrder.Uint16(p[6:8]) != 0 {
+		return nil, false, 0, FormatError("malformed BigTIFF header")
+	}
+	if _, err := r.ReadAt(p[8:16], 8); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, false, 0, err
+	}
+	return byteOrder, true, int64(byteOrder.Uint64(p[8:16])), nil
+}
+
+// newDecoder returns a decoder for the first image in r.
+func newDecoder(r io.Reader) (*decoder, error) {
+	ra := newReaderAt(r)
+	byteOrder, bigTIFF, ifdOffset, err := readHeader(ra)
+	if err != nil {
+		return nil, err
 	}
+	return newIFDDecoder(ra, byteOrder, bigTIFF, ifdOffset, false)
+}
 
-	ifdOffset := int64(d.byteOrder.Uint32(p[4:8]))
+// newIFDDecoder returns a decoder for the image whose IFD is at ifdOffset in
+// r. If allTags is true, the decoder's tags field holds all of the IFD's
+// entries with integer values, and its ifd field holds all of them.
+func newIFDDecoder(r io.ReaderAt, byteOrder binary.ByteOrder, bigTIFF bool, ifdOffset int64, allTags bool) (*decoder, error) {
+	d := &decoder{
+		r:         r,
+		byteOrder: byteOrder,
+		bigTIFF:   bigTIFF,
+		features:  make(map[int][]uint),
+	}
+	if allTags {
+		d.ifd = &IFD{}
+	}
 
-	// The first two bytes contain the number of entries (12 bytes each).
-	if _, err := d.r.ReadAt(p[0:2], ifdOffset); err != nil {
+	// The IFD starts with the number of entries, in 2 bytes, or in 8 bytes
+	// for BigTIFF.
+	p := make([]byte, 8)
+	countLen := 2
+	if bigTIFF {
+		countLen = 8
+	}
+	if _, err := d.r.ReadAt(p[:countLen], ifdOffset); err != nil {
 		return nil, err
 	}
-	numItems := int(d.byteOrder.Uint16(p[0:2]))
+	var numItems uint64
+	if bigTIFF {
+		numItems = d.byteOrder.Uint64(p)
+	} else {
+		numItems = uint64(d.byteOrder.Uint16(p))
+	}
+	if numItems > math.MaxUint16 {
+		return nil, FormatError("too many IFD entries")
+	}
+	entriesLen := d.ifdLen() * int(numItems)
+	d.nextIFDOffset = ifdOffset + int64(countLen+entriesLen)
 
 	// All IFD entries are read in one chunk.
-	var err error
-	p, err = safeReadAt(d.r, uint64(ifdLen*numItems), ifdOffset+2)
+	p, err := safeReadAt(d.r, uint64(entriesLen), ifdOffset+int64(countLen))
 	if err != nil {
 		return nil, err
 	}
 
 	prevTag := -1
-	for i := 0; i < len(p); i += ifdLen {
-		tag, err := d.parseIFD(p[i : i+ifdLen])
+	for i := 0; i < len(p); i += d.ifdLen() {
+		tag, err := d.parseIFD(p[i : i+d.ifdLen()])
 		if err != nil {
 			return nil, err
 		}
@@ -506,29 +842,49 @@ func newDecoder(r io.Reader) (*decoder, error) {
 		d.features[tBitsPerSample] = []uint{1}
 	}
 	d.bpp = d.firstVal(tBitsPerSample)
-	switch d.bpp {
-	case 0:
-		return nil, FormatError("BitsPerSample must not be 0")
-	case 1, 8, 16:
-		// Nothing to do, these are accepted by this implementation.
+
+	// Page 27 of the spec: If the SampleFormat is present and
+	// the value is not 1 [= unsigned integer data], a Baseline
+	// TIFF reader that cannot handle the SampleFormat value
+	// must terminate the import process gracefully. Signed 16-bit
+	// and 32- or 64-bit floating-point samples are supported, for
+	// gray images.
+	sampleFormat := d.firstVal(tSampleFormat)
+	for _, v := range d.features[tSampleFormat] {
+		if v != sampleFormat {
+			return nil, UnsupportedError("sample format")
+		}
+	}
+	switch sampleFormat {
+	case 0, sfUint:
+		sampleFormat = sfUint
+	case sfInt:
+		if d.bpp != 16 {
+			return nil, UnsupportedError(fmt.Sprintf("signed samples with BitsPerSample of %v", d.bpp))
+		}
+	case sfFloat:
+		if d.bpp != 32 && d.bpp != 64 {
+			return nil, UnsupportedError(fmt.Sprintf("floating-point samples with BitsPerSample of %v", d.bpp))
+		}
 	default:
+		return nil, UnsupportedError("sample format")
+	}
+
+	// Unsigned samples of up to 32 bits are accepted by this
+	// implementation, and decoded to 8 or 16 bits.
+	switch {
+	case d.bpp == 0:
+		return nil, FormatError("BitsPerSample must not be 0")
+	case d.bpp > 32 && sampleFormat != sfFloat:
 		return nil, UnsupportedError(fmt.Sprintf("BitsPerSample of %v", d.bpp))
 	}
 
 	// Determine the image mode.
 	switch d.firstVal(tPhotometricInterpretation) {
 	case pRGB:
-		if d.bpp == 16 {
-			for _, b := range d.features[tBitsPerSample] {
-				if b != 16 {
-					return nil, FormatError("wrong number of samples for 16bit RGB")
-				}
-			}
-		} else {
-			for _, b := range d.features[tBitsPerSample] {
-				if b != 8 {
-					return nil, FormatError("wrong number of samples for 8bit RGB")
-				}
+		for _, b := range d.features[tBitsPerSample] {
+			if b != d.bpp {
+				return nil, FormatError(fmt.Sprintf("wrong number of samples for %dbit RGB", d.bpp))
 			}
 		}
 		// RGB images normally have 3 samples per pixel.
@@ -540,7 +896,7 @@ func newDecoder(r io.Reader) (*decoder, error) {
 		switch len(d.features[tBitsPerSample]) {
 		case 3:
 			d.mode = mRGB
-			if d.bpp == 16 {
+			if d.bpp > 8 {
 				d.config.ColorModel = color.RGBA64Model
 			} else {
 				d.config.ColorModel = color.RGBAModel
@@ -549,14 +905,14 @@ func newDecoder(r io.Reader) (*decoder, error) {
 			switch d.firstVal(tExtraSamples) {
 			case 1:
 				d.mode = mRGBA
-				if d.bpp == 16 {
+				if d.bpp > 8 {
 					d.config.ColorModel = color.RGBA64Model
 				} else {
 					d.config.ColorModel = color.RGBAModel
 				}
 			case 2:
 				d.mode = mNRGBA
-				if d.bpp == 16 {
+				if d.bpp > 8 {
 					d.config.ColorModel = color.NRGBA64Model
 				} else {
 					d.config.ColorModel = color.NRGBAModel
@@ -572,22 +928,102 @@ func newDecoder(r io.Reader) (*decoder, error) {
 		d.config.ColorModel = color.Palette(d.palette)
 	case pWhiteIsZero:
 		d.mode = mGrayInvert
-		if d.bpp == 16 {
+		if d.bpp > 8 {
 			d.config.ColorModel = color.Gray16Model
 		} else {
 			d.config.ColorModel = color.GrayModel
 		}
 	case pBlackIsZero:
 		d.mode = mGray
-		if d.bpp == 16 {
+		if d.bpp > 8 {
 			d.config.ColorModel = color.Gray16Model
 		} else {
 			d.config.ColorModel = color.GrayModel
 		}
+	case pCMYK:
+		if len(d.features[tBitsPerSample]) != 4 {
+			return nil, UnsupportedError("CMYK with other than 4 samples")
+		}
+		for _, b := range d.features[tBitsPerSample] {
+			if b != 8 {
+				return nil, UnsupportedError("CMYK with other than 8 BitsPerSample")
+			}
+		}
+		d.mode = mCMYK
+		d.config.ColorModel = color.CMYKModel
+	case pYCbCr:
+		if len(d.features[tBitsPerSample]) != 3 {
+			return nil, FormatError("wrong number of samples for YCbCr")
+		}
+		// The JPEG decoder converts YCbCr to RGB.
+		if d.firstVal(tCompression) == cJPEG {
+			d.mode = mRGB
+			d.config.ColorModel = color.RGBAModel
+			break
+		}
+		for _, b := range d.features[tBitsPerSample] {
+			if b != 8 {
+				return nil, UnsupportedError("YCbCr with other than 8 BitsPerSample")
+			}
+		}
+		// The default subsampling is 2x2 (p. 92 of the spec).
+		d.ycbcrSub = [2]int{2, 2}
+		if sub := d.features[tYCbCrSubSampling]; len(sub) == 2 {
+			d.ycbcrSub = [2]int{int(sub[0]), int(sub[1])}
+		}
+		for _, v := range d.ycbcrSub {
+			if v != 1 && v != 2 && v != 4 {
+				return nil, FormatError("bad YCbCrSubSampling")
+			}
+		}
+		d.mode = mYCbCr
+		d.config.ColorModel = color.YCbCrModel
+		if _, ok := ycbcrRatio(d.ycbcrSub); !ok {
+			d.config.ColorModel = color.RGBAModel
+		}
+	case pCIELab, pICCLab:
+		if len(d.features[tBitsPerSample]) != 3 {
+			return nil, UnsupportedError("CIELab with other than 3 samples")
+		}
+		if d.bpp != 8 && d.bpp != 16 {
+			return nil, UnsupportedError(fmt.Sprintf("CIELab with %d BitsPerSample", d.bpp))
+		}
+		for _, b := range d.features[tBitsPerSample] {
+			if b != d.bpp {
+				return nil, FormatError("wrong number of samples for CIELab")
+			}
+		}
+		d.mode = mLab
+		if d.firstVal(tPhotometricInterpretation) == pICCLab {
+			d.mode = mICCLab
+		}
+		d.config.ColorModel = color.RGBAModel
+		if d.bpp == 16 {
+			d.config.ColorModel = color.RGBA64Model
+		}
 	default:
 		return nil, UnsupportedError("color model")
 	}
-	if d.firstVal(tPhotometricInterpretation) != pRGB {
+	if d.firstVal(tCompression) == cJPEG {
+		for _, b := range d.features[tBitsPerSample] {
+			if b != 8 {
+				return nil, UnsupportedError(fmt.Sprintf("JPEG with BitsPerSample of %v", b))
+			}
+		}
+	}
+	if sampleFormat != sfUint {
+		if d.mode != mGray && d.mode != mGrayInvert {
+			return nil, UnsupportedError("sample format for color model")
+		}
+		d.mode = mInt
+		if sampleFormat == sfFloat {
+			d.mode = mFloat
+		}
+		d.config.ColorModel = color.Gray16Model
+	}
+	switch d.firstVal(tPhotometricInterpretation) {
+	case pRGB, pCMYK, pYCbCr, pCIELab, pICCLab:
+	default:
 		if len(d.features[tBitsPerSample]) != 1 {
 			return nil, UnsupportedError("extra samples")
 		}
@@ -613,14 +1049,127 @@ func ccittFillOrder(tiffFillOrder uint) ccitt.Order {
 	return ccitt.MSB
 }
 
+// DecodeOptions limit the resources used to decode a TIFF file: the pages
+// that DecodeWithOptions and a Decoder decode, and the regions that
+// DecodeRegionWithOptions decodes. A zero limit means no limit.
+type DecodeOptions struct {
+	// MaxWidth and MaxHeight limit the ImageWidth and ImageLength of a page,
+	// or the size of a region.
+	MaxWidth  int
+	MaxHeight int
+	// MaxPixels limits the width times the height.
+	MaxPixels int64
+	// MaxBytes is the maximum number of bytes allocated for the decoded image
+	// and for the decompressed data of one strip or tile.
+	MaxBytes int64
+	// MaxIFDs is the maximum number of IFDs, or pages, that a Decoder reads.
+	// The other limits apply to each page.
+	MaxIFDs int
+}
+
+// A LimitError means that a page's IFD, or the number of IFDs, exceeds the
+// DecodeOptions. It is found from the IFD alone, before any strip or tile is
+// read.
+type LimitError struct {
+	// Limit is "MaxWidth", "MaxHeight", "MaxPixels", "MaxBytes" or
+	// "MaxIFDs".
+	Limit string
+	// Value is the amount that the page, or the file, needs, and Max is the
+	// limit.
+	Value int64
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("tiff: image exceeds %s: %d > %d", e.Limit, e.Value, e.Max)
+}
+
+// check returns a *LimitError if decoding an image of the given size, which
+// is d's image or a region of it, in blocks of the given size, would exceed
+// o's limits. o may be nil.
+func (o *DecodeOptions) check(d *decoder, size image.Point, blockWidth, blockHeight int) error {
+	if o == nil {
+		return nil
+	}
+	w, h := int64(size.X), int64(size.Y)
+	// Each decoded pixel takes one or two bytes per sample, with gray and
+	// paletted images having one sample and the others having four.
+	bytesPerPixel := int64(1)
+	if d.mode != mGray && d.mode != mGrayInvert && d.mode != mPaletted {
+		bytesPerPixel = 4
+	}
+	if d.bpp > 8 {
+		bytesPerPixel *= 2
+	}
+	if d.mode == mInt || d.mode == mFloat {
+		// Images of samples have one sample per pixel.
+		bytesPerPixel = int64(d.bpp / 8)
+	}
+	samples := int64(len(d.features[tBitsPerSample]))
+	blockBytes := (int64(blockWidth)*int64(d.bpp)*samples + 7) / 8 * int64(blockHeight)
+	n := w*h*bytesPerPixel + blockBytes
+	switch {
+	case o.MaxWidth > 0 && w > int64(o.MaxWidth):
+		return &LimitError{"MaxWidth", w, int64(o.MaxWidth)}
+	case o.MaxHeight > 0 && h > int64(o.MaxHeight):
+		return &LimitError{"MaxHeight", h, int64(o.MaxHeight)}
+	case o.MaxPixels > 0 && w*h > o.MaxPixels:
+		return &LimitError{"MaxPixels", w * h, o.MaxPixels}
+	case o.MaxBytes > 0 && n > o.MaxBytes:
+		return &LimitError{"MaxBytes", n, o.MaxBytes}
+	}
+	return nil
+}
+
 // Decode reads a TIFF image from r and returns it as an image.Image.
 // The type of Image returned depends on the contents of the TIFF.
 func Decode(r io.Reader) (img image.Image, err error) {
+	return DecodeWithOptions(r, nil)
+}
+
+// DecodeWithOptions is like Decode, but returns a *LimitError for images that
+// exceed the limits given by o. o may be nil, in which case there are no
+// limits.
+func DecodeWithOptions(r io.Reader, o *DecodeOptions) (image.Image, error) {
 	d, err := newDecoder(r)
 	if err != nil {
-		return
+		return nil, err
 	}
+	return d.decodeImage(o)
+}
+
+// DecodeRegion reads the part of the first image of the TIFF file in r that
+// lies within rect, and returns it as an image.Image whose bounds are rect's
+// intersection with the image's bounds. Only the strips or tiles that
+// intersect rect are read and decompressed, and only the rows of a strip
+// that are needed are kept.
+func DecodeRegion(r io.ReaderAt, rect image.Rectangle) (image.Image, error) {
+	return DecodeRegionWithOptions(r, rect, nil)
+}
+
+// DecodeRegionWithOptions is like DecodeRegion, but returns a *LimitError if
+// the region exceeds the limits given by o. o may be nil, in which case there
+// are no limits.
+func DecodeRegionWithOptions(r io.ReaderAt, rect image.Rectangle, o *DecodeOptions) (image.Image, error) {
+	byteOrder, bigTIFF, ifdOffset, err := readHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	d, err := newIFDDecoder(r, byteOrder, bigTIFF, ifdOffset, false)
+	if err != nil {
+		return nil, err
+	}
+	return d.decodeRegion(o, rect)
+}
+
+// decodeImage decodes d's image, returning a *LimitError if it exceeds o's
+// limits. o may be nil.
+func (d *decoder) decodeImage(o *DecodeOptions) (image.Image, error) {
+	return d.decodeRegion(o, image.Rect(0, 0, d.config.Width, d.config.Height))
+}
 
+// decodeRegion decodes the part of d's image within rect, like decodeImage.
+func (d *decoder) decodeRegion(o *DecodeOptions, rect image.Rectangle) (img image.Image, err error) {
 	blockPadding := false
 	blockWidth := d.config.Width
 	blockHeight := d.config.Height
@@ -676,11 +1225,28 @@ func Decode(r io.Reader) (img image.Image, err error) {
 	if n := blocksAcross * blocksDown; len(blockOffsets) < n || len(blockCounts) < n {
 		return nil, FormatError("inconsistent header")
 	}
+	// Only the strips or tiles from i0 to i1 across and j0 to j1 down
+	// intersect rect, and each is clipped to the image, which is the part
+	// of d's image within rect.
+	rect = rect.Intersect(image.Rect(0, 0, d.config.Width, d.config.Height))
+	if err := o.check(d, rect.Size(), blockWidth, blockHeight); err != nil {
+		return nil, err
+	}
+	i0, i1, j0, j1 := 0, 0, 0, 0
+	if !rect.Empty() {
+		i0, i1 = rect.Min.X/blockWidth, minInt((rect.Max.X+blockWidth-1)/blockWidth, blocksAcross)
+		j0, j1 = rect.Min.Y/blockHeight, minInt((rect.Max.Y+blockHeight-1)/blockHeight, blocksDown)
+	}
+	imgRect := rect
+	defer func() {
+		if img != nil {
+			setSampleRange(img, d.firstVal(tPhotometricInterpretation) == pWhiteIsZero)
+		}
+	}()
 
-	imgRect := image.Rect(0, 0, d.config.Width, d.config.Height)
 	switch d.mode {
 	case mGray, mGrayInvert:
-		if d.bpp == 16 {
+		if d.bpp > 8 {
 			img = image.NewGray16(imgRect)
 		} else {
 			img = image.NewGray(imgRect)
@@ -688,42 +1254,88 @@ func Decode(r io.Reader) (img image.Image, err error) {
 	case mPaletted:
 		img = image.NewPaletted(imgRect, d.palette)
 	case mNRGBA:
-		if d.bpp == 16 {
+		if d.bpp > 8 {
 			img = image.NewNRGBA64(imgRect)
 		} else {
 			img = image.NewNRGBA(imgRect)
 		}
-	case mRGB, mRGBA:
-		if d.bpp == 16 {
+	case mRGB, mRGBA, mLab, mICCLab:
+		if d.bpp > 8 {
 			img = image.NewRGBA64(imgRect)
 		} else {
 			img = image.NewRGBA(imgRect)
 		}
+	case mCMYK:
+		img = image.NewCMYK(imgRect)
+	case mInt:
+		img = NewGrayInt16(imgRect)
+	case mFloat:
+		if d.bpp == 32 {
+			img = NewGrayFloat32(imgRect)
+		} else {
+			img = NewGrayFloat64(imgRect)
+		}
+	case mYCbCr:
+		if ratio, ok := ycbcrRatio(d.ycbcrSub); ok {
+			img = image.NewYCbCr(imgRect, ratio)
+		} else {
+			img = image.NewRGBA(imgRect)
+		}
 	}
 
 	if blocksAcross == 0 || blocksDown == 0 {
 		return
 	}
-	// Maximum data per pixel is 8 bytes (RGBA64).
-	blockMaxDataSize := int64(blockWidth) * int64(blockHeight) * 8
-	for i := 0; i < blocksAcross; i++ {
+	// Maximum data per pixel is 8 bytes (RGBA64), or 16 with 32-bit samples.
+	maxPixelSize := int64(8)
+	if d.bpp > 16 {
+		maxPixelSize = 16
+	}
+	blockMaxDataSize := int64(blockWidth) * int64(blockHeight) * maxPixelSize
+	for i := i0; i < i1; i++ {
 		blkW := blockWidth
 		if !blockPadding && i == blocksAcross-1 && d.config.Width%blockWidth != 0 {
 			blkW = d.config.Width % blockWidth
 		}
-		for j := 0; j < blocksDown; j++ {
+		for j := j0; j < j1; j++ {
 			blkH := blockHeight
 			if !blockPadding && j == blocksDown-1 && d.config.Height%blockHeight != 0 {
 				blkH = d.config.Height % blockHeight
 			}
 			offset := int64(blockOffsets[j*blocksAcross+i])
 			n := int64(blockCounts[j*blocksAcross+i])
+			xmin := i * blockWidth
+			ymin := j * blockHeight
+			xmax := xmin + blkW
+			ymax := ymin + blkH
+
+			// The rows of the block above and below rect are not kept,
+			// except with JPEG compression, which decodes whole blocks.
+			// skip is the length of the data of the rows above, and lim
+			// that of the rows that are kept.
+			var skip int64
+			lim := blockMaxDataSize
+			if d.firstVal(tCompression) != cJPEG {
+				rowBytes, rows := d.rowGroup(blkW)
+				skipRows := maxInt(rect.Min.Y-ymin, 0) / rows * rows
+				ymin += skipRows
+				ymax = minInt(ymax, rect.Max.Y)
+				skip = int64(skipRows/rows) * int64(rowBytes)
+				lim = int64((ymax-ymin+rows-1)/rows) * int64(rowBytes)
+			}
 			switch d.firstVal(tCompression) {
 
 			// According to the spec, Compression does not have a default value,
 			// but some tools interpret a missing Compression value as none, so we do
 			// the same.
 			case cNone, 0:
+				offset, n = offset+skip, n-skip
+				if n > lim {
+					n = lim
+				}
+				if n < 0 {
+					n = 0
+				}
 				if b, ok := d.r.(*buffer); ok {
 					d.buf, err = b.Slice(int(offset), int(n))
 				} else {
@@ -733,15 +1345,15 @@ func Decode(r io.Reader) (img image.Image, err error) {
 				inv := d.firstVal(tPhotometricInterpretation) == pWhiteIsZero
 				order := ccittFillOrder(d.firstVal(tFillOrder))
 				r := ccitt.NewReader(io.NewSectionReader(d.r, offset, n), order, ccitt.Group3, blkW, blkH, &ccitt.Options{Invert: inv, Align: false})
-				d.buf, err = readBuf(r, d.buf, blockMaxDataSize)
+				d.buf, err = readBuf(r, d.buf, skip, lim)
 			case cG4:
 				inv := d.firstVal(tPhotometricInterpretation) == pWhiteIsZero
 				order := ccittFillOrder(d.firstVal(tFillOrder))
 				r := ccitt.NewReader(io.NewSectionReader(d.r, offset, n), order, ccitt.Group4, blkW, blkH, &ccitt.Options{Invert: inv, Align: false})
-				d.buf, err = readBuf(r, d.buf, blockMaxDataSize)
+				d.buf, err = readBuf(r, d.buf, skip, lim)
 			case cLZW:
 				r := lzw.NewReader(io.NewSectionReader(d.r, offset, n), lzw.MSB, 8)
-				d.buf, err = readBuf(r, d.buf, blockMaxDataSize)
+				d.buf, err = readBuf(r, d.buf, skip, lim)
 				r.Close()
 			case cDeflate, cDeflateOld:
 				var r io.ReadCloser
@@ -749,10 +1361,12 @@ func Decode(r io.Reader) (img image.Image, err error) {
 				if err != nil {
 					return nil, err
 				}
-				d.buf, err = readBuf(r, d.buf, blockMaxDataSize)
+				d.buf, err = readBuf(r, d.buf, skip, lim)
 				r.Close()
 			case cPackBits:
-				d.buf, err = unpackBits(io.NewSectionReader(d.r, offset, n))
+				d.buf, err = readBuf(newUnpackBitsReader(io.NewSectionReader(d.r, offset, n)), d.buf, skip, lim)
+			case cJPEG:
+				d.buf, err = d.readJPEG(io.NewSectionReader(d.r, offset, n), blkW, blkH, blockWidth, blockHeight)
 			default:
 				err = UnsupportedError(fmt.Sprintf("compression value %d", d.firstVal(tCompression)))
 			}
@@ -760,10 +1374,6 @@ func Decode(r io.Reader) (img image.Image, err error) {
 				return nil, err
 			}
 
-			xmin := i * blockWidth
-			ymin := j * blockHeight
-			xmax := xmin + blkW
-			ymax := ymin + blkH
 			err = d.decode(img, xmin, ymin, xmax, ymax)
 			if err != nil {
 				return nil, err
@@ -773,13 +1383,31 @@ func Decode(r io.Reader) (img image.Image, err error) {
 	return
 }
 
-func readBuf(r io.Reader, buf []byte, lim int64) ([]byte, error) {
+// readBuf discards the first skip bytes of r and reads at most lim of the
+// following bytes into buf.
+func readBuf(r io.Reader, buf []byte, skip, lim int64) ([]byte, error) {
+	if _, err := io.CopyN(io.Discard, r, skip); err != nil && err != io.EOF {
+		return nil, err
+	}
 	b := bytes.NewBuffer(buf[:0])
 	_, err := b.ReadFrom(io.LimitReader(r, lim))
 	return b.Bytes(), err
 }
 
+// rowGroup returns the length of the decompressed data of a group of rows of
+// a strip or tile of the given width, and the number of rows in a group,
+// which is more than one for subsampled YCbCr data.
+func (d *decoder) rowGroup(width int) (n, rows int) {
+	if d.mode == mYCbCr {
+		hs, vs := d.ycbcrSub[0], d.ycbcrSub[1]
+		return (width + hs - 1) / hs * (hs*vs + 2), vs
+	}
+	return (width*int(d.bpp)*len(d.features[tBitsPerSample]) + 7) / 8, 1
+}
+
 func init() {
 	image.RegisterFormat("tiff", leHeader, Decode, DecodeConfig)
 	image.RegisterFormat("tiff", beHeader, Decode, DecodeConfig)
+	image.RegisterFormat("tiff", leBigHeader, Decode, DecodeConfig)
+	image.RegisterFormat("tiff", beBigHeader, Decode, DecodeConfig)
 }
@@ -12,6 +12,9 @@ import (
 	"errors"
 	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
 	"io"
 	"io/ioutil"
 	"os"
@@ -83,6 +86,37 @@ func TestUnpackBits(t *testing.T) {
 	}
 }
 
+// TestPackBits tests that PackBits-encoded data decodes to the original data.
+func TestPackBits(t *testing.T) {
+	long := make([]byte, 300)
+	for i := range long {
+		long[i] = byte(i * i / 50)
+	}
+	for _, src := range []string{
+		"",
+		"\x01",
+		"\xaa\xaa",
+		"\x01\x02\x02\x03\x03\x03\x04",
+		"\xaa\xaa\xaa\x80\x00\x2a\xaa\xaa\xaa\xaa\x80\x00\x2a\x22\xaa\xaa\xaa\xaa\xaa\xaa\xaa\xaa\xaa\xaa",
+		strings.Repeat("\x00", 300),
+		strings.Repeat("\x01\x02", 200),
+		string(long),
+	} {
+		packed := packBits(nil, []byte(src))
+		buf, err := unpackBits(bytes.NewReader(packed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != src {
+			t.Errorf("packBits(%x): unpacks to %x", src, buf)
+		}
+	}
+	// The example data from Wikipedia packs to 15 bytes.
+	if got := packBits(nil, []byte("\xaa\xaa\xaa\x80\x00\x2a\xaa\xaa\xaa\xaa\x80\x00\x2a\x22\xaa\xaa\xaa\xaa\xaa\xaa\xaa\xaa\xaa\xaa")); len(got) != 15 {
+		t.Errorf("packBits: got %d bytes (%x), want 15", len(got), got)
+	}
+}
+
 func TestShortBlockData(t *testing.T) {
 	b, err := ioutil.ReadFile("../testdata/bw-uncompressed.tiff")
 	if err != nil {
@@ -560,6 +594,9 @@ func appendIFD(b []byte, enc byteOrder, entries map[uint16]interface{}) []byte {
 			case 0:
 				ifd = enc.AppendUint32(ifd, 0)
 			case 1:
+				ifd = enc.AppendUint16(ifd, v[0])
+				ifd = enc.AppendUint16(ifd, 0)
+			case 2:
 				ifd = enc.AppendUint16(ifd, v[0])
 				ifd = enc.AppendUint16(ifd, v[1])
 			default:
@@ -582,6 +619,16 @@ func appendIFD(b []byte, enc byteOrder, entries map[uint16]interface{}) []byte {
 					b = enc.AppendUint32(b, e)
 				}
 			}
+		case []byte:
+			ifd = enc.AppendUint16(ifd, uint16(TypeUndefined))
+			ifd = enc.AppendUint32(ifd, uint32(len(v)))
+			if len(v) <= 4 {
+				ifd = append(ifd, make([]byte, 4)...)
+				copy(ifd[len(ifd)-4:], v)
+			} else {
+				ifd = enc.AppendUint32(ifd, uint32(len(b)))
+				b = append(b, v...)
+			}
 		default:
 			panic(fmt.Errorf("unhandled type %T", v))
 		}
@@ -593,3 +640,499 @@ func appendIFD(b []byte, enc byteOrder, entries map[uint16]interface{}) []byte {
 	b = enc.AppendUint32(b, 0)
 	return b
 }
+
+func TestDecodeLimits(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, image.NewGray(image.Rect(0, 0, 3, 2)), nil); err != nil {
+		t.Fatal(err)
+	}
+	// Declare a 65535x65535 image, in one strip, which must be rejected
+	// without allocating it. The tags are ImageWidth, ImageLength and
+	// RowsPerStrip.
+	huge := buf.Bytes()
+	for _, r := range [][2]string{
+		{"00 01 03 00 01 00 00 00 03 00 00 00", "00 01 03 00 01 00 00 00 ff ff 00 00"},
+		{"01 01 03 00 01 00 00 00 02 00 00 00", "01 01 03 00 01 00 00 00 ff ff 00 00"},
+		{"16 01 03 00 01 00 00 00 02 00 00 00", "16 01 03 00 01 00 00 00 ff ff 00 00"},
+	} {
+		var err error
+		if huge, err = replace(huge, r[0], r[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		src   []byte
+		opts  DecodeOptions
+		limit string
+	}{
+		{huge, DecodeOptions{MaxWidth: 65534}, "MaxWidth"},
+		{huge, DecodeOptions{MaxHeight: 65534}, "MaxHeight"},
+		{huge, DecodeOptions{MaxPixels: 1 << 20}, "MaxPixels"},
+		{huge, DecodeOptions{MaxBytes: 1 << 20}, "MaxBytes"},
+		// The 3x2 image takes 6 bytes, and so does its one strip.
+		{buf.Bytes(), DecodeOptions{MaxBytes: 12}, ""},
+		{buf.Bytes(), DecodeOptions{MaxBytes: 11}, "MaxBytes"},
+	} {
+		_, err := DecodeWithOptions(bytes.NewReader(tc.src), &tc.opts)
+		if tc.limit == "" {
+			if err != nil {
+				t.Errorf("%+v: got %v, want nil", tc.opts, err)
+			}
+			continue
+		}
+		if e, ok := err.(*LimitError); !ok || e.Limit != tc.limit {
+			t.Errorf("%+v: got %v, want a %s LimitError", tc.opts, err, tc.limit)
+		}
+	}
+}
+
+// countingReaderAt is an io.ReaderAt that counts the bytes read from it.
+type countingReaderAt struct {
+	r io.ReaderAt
+	n int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.n += n
+	return n, err
+}
+
+func TestDecodeRegion(t *testing.T) {
+	for _, name := range []string{
+		"video-001.tiff",
+		"video-001-strip-64.tiff",
+		"video-001-tile-64x64.tiff",
+		"video-001-paletted.tiff",
+		"video-001-gray-16bit.tiff",
+		"bw-deflate.tiff",
+		"bw-packbits.tiff",
+		"bw-gopher_ccittGroup4.tiff",
+		"blue-purple-pink.lzwcompressed.tiff",
+	} {
+		data, err := ioutil.ReadFile(testdataDir + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		full, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, rect := range []image.Rectangle{
+			image.Rect(10, 20, 70, 90),
+			image.Rect(64, 64, 128, 103),
+			image.Rect(100, 0, 150, 10),
+			image.Rect(-5, -5, 1000, 1000),
+			image.Rect(200, 200, 210, 210),
+		} {
+			m, err := DecodeRegion(bytes.NewReader(data), rect)
+			if err != nil {
+				t.Errorf("%s %v: %v", name, rect, err)
+				continue
+			}
+			want := rect.Intersect(full.Bounds())
+			if got := m.Bounds(); got != want {
+				t.Errorf("%s %v: bounds: got %v, want %v", name, rect, got, want)
+				continue
+			}
+			compare(t, full.(interface {
+				SubImage(image.Rectangle) image.Image
+			}).SubImage(want), m)
+		}
+	}
+
+	// Only one of the tiles, and the header and IFD, should be read.
+	data, err := ioutil.ReadFile(testdataDir + "video-001-tile-64x64.tiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &countingReaderAt{r: bytes.NewReader(data)}
+	if _, err := DecodeRegion(r, image.Rect(70, 70, 80, 80)); err != nil {
+		t.Fatal(err)
+	}
+	if r.n > len(data)/4 {
+		t.Errorf("read %d of %d bytes", r.n, len(data))
+	}
+
+	// Only the rows of the strip within rect should be read.
+	data, err = ioutil.ReadFile(testdataDir + "video-001-uncompressed.tiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r = &countingReaderAt{r: bytes.NewReader(data)}
+	if _, err := DecodeRegion(r, image.Rect(10, 70, 20, 80)); err != nil {
+		t.Fatal(err)
+	}
+	if r.n > len(data)/4 {
+		t.Errorf("read %d of %d bytes", r.n, len(data))
+	}
+
+	// The limits apply to the region, rather than to the whole image.
+	o := &DecodeOptions{MaxPixels: 100}
+	if _, err := DecodeRegionWithOptions(bytes.NewReader(data), image.Rect(10, 70, 20, 80), o); err != nil {
+		t.Errorf("10x10 region: %v", err)
+	}
+	if _, err := DecodeRegionWithOptions(bytes.NewReader(data), image.Rect(10, 70, 20, 81), o); err == nil {
+		t.Error("10x11 region: got nil error, want non-nil")
+	}
+}
+
+// splitJPEG splits the JPEG stream in data into an abbreviated stream with
+// its quantization and Huffman tables, like a JPEGTables entry, and the
+// rest of the stream.
+func splitJPEG(data []byte) (tables, rest []byte) {
+	tables, rest = []byte(jpegSOI), []byte(jpegSOI)
+	p := data[2:]
+	for p[1] != 0xda { // Start Of Scan.
+		n := 2 + int(p[2])<<8 + int(p[3])
+		if p[1] == 0xdb || p[1] == 0xc4 { // DQT or DHT.
+			tables = append(tables, p[:n]...)
+		} else {
+			rest = append(rest, p[:n]...)
+		}
+		p = p[n:]
+	}
+	return append(tables, jpegEOI...), append(rest, p...)
+}
+
+func TestDecodeJPEG(t *testing.T) {
+	const w, h = 80, 50
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			src.SetRGBA(x, y, color.RGBA{uint8(3 * x), uint8(4 * y), 0x80, 0xff})
+		}
+	}
+	for _, tc := range []struct {
+		desc         string
+		gray, tiled  bool
+		sharedTables bool
+	}{
+		{"YCbCr strips", false, false, false},
+		{"YCbCr tiles with JPEGTables", false, true, true},
+		{"gray strips with JPEGTables", true, false, true},
+		{"gray tiles", true, true, false},
+	} {
+		var m image.Image = src
+		entries := map[uint16]interface{}{
+			tImageWidth:                uint16(w),
+			tImageLength:               uint16(h),
+			tCompression:               uint16(cJPEG),
+			tPhotometricInterpretation: uint16(pYCbCr),
+			tBitsPerSample:             []uint16{8, 8, 8},
+		}
+		if tc.gray {
+			g := image.NewGray(src.Bounds())
+			draw.Draw(g, g.Bounds(), src, image.Point{}, draw.Src)
+			m = g
+			entries[tPhotometricInterpretation] = uint16(pBlackIsZero)
+			entries[tBitsPerSample] = uint16(8)
+		}
+
+		// The blocks are 32x32 tiles or 16-row strips.
+		bw, bh := 32, 32
+		if !tc.tiled {
+			bw, bh = w, 16
+		}
+		data := newTIFF(binary.BigEndian)
+		var offsets, counts []uint32
+		var tables []byte
+		for y := 0; y < h; y += bh {
+			for x := 0; x < w; x += bw {
+				block := image.NewRGBA(image.Rect(0, 0, bw, bh))
+				if !tc.tiled {
+					block.Rect.Max.Y = minInt(bh, h-y)
+				}
+				draw.Draw(block, block.Bounds(), m, image.Pt(x, y), draw.Src)
+				var b image.Image = block
+				if tc.gray {
+					g := image.NewGray(block.Bounds())
+					draw.Draw(g, g.Bounds(), block, image.Point{}, draw.Src)
+					b = g
+				}
+				var buf bytes.Buffer
+				if err := jpeg.Encode(&buf, b, &jpeg.Options{Quality: 100}); err != nil {
+					t.Fatal(err)
+				}
+				stream := buf.Bytes()
+				if tc.sharedTables {
+					tables, stream = splitJPEG(stream)
+				}
+				offsets = append(offsets, uint32(len(data)))
+				counts = append(counts, uint32(len(stream)))
+				data = append(data, stream...)
+			}
+		}
+		if tc.tiled {
+			entries[tTileWidth] = uint16(bw)
+			entries[tTileLength] = uint16(bh)
+			entries[tTileOffsets] = offsets
+			entries[tTileByteCounts] = counts
+		} else {
+			entries[tRowsPerStrip] = uint16(bh)
+			entries[tStripOffsets] = offsets
+			entries[tStripByteCounts] = counts
+		}
+		if tables != nil {
+			entries[tJPEGTables] = tables
+		}
+		data = appendIFD(data, binary.BigEndian, entries)
+
+		got, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		if got.Bounds() != m.Bounds() {
+			t.Errorf("%s: bounds: got %v, want %v", tc.desc, got.Bounds(), m.Bounds())
+			continue
+		}
+	loop:
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				r0, g0, b0, _ := m.At(x, y).RGBA()
+				r1, g1, b1, _ := got.At(x, y).RGBA()
+				if absDiff(r0, r1) > 0x600 || absDiff(g0, g1) > 0x600 || absDiff(b0, b1) > 0x600 {
+					t.Errorf("%s: pixel at (%d, %d): got %v, want %v", tc.desc, x, y, got.At(x, y), m.At(x, y))
+					break loop
+				}
+			}
+		}
+	}
+}
+
+func absDiff(a, b uint32) uint32 {
+	if a < b {
+		return b - a
+	}
+	return a - b
+}
+
+// photometricTIFF returns a big-endian TIFF image with one strip of the
+// given samples.
+func photometricTIFF(w, h int, photometric uint16, bitsPerSample []uint16, samples []byte, entries map[uint16]interface{}) []byte {
+	data := newTIFF(binary.BigEndian)
+	data = append(data, samples...)
+	if entries == nil {
+		entries = map[uint16]interface{}{}
+	}
+	entries[tImageWidth] = uint16(w)
+	entries[tImageLength] = uint16(h)
+	entries[tPhotometricInterpretation] = photometric
+	entries[tBitsPerSample] = bitsPerSample
+	entries[tStripOffsets] = uint32(8)
+	entries[tStripByteCounts] = uint32(len(samples))
+	return appendIFD(data, binary.BigEndian, entries)
+}
+
+func TestDecodeCMYK(t *testing.T) {
+	samples := []byte{
+		0x00, 0x40, 0x80, 0xff, 0x01, 0x02, 0x03, 0x04,
+		0x10, 0x20, 0x30, 0x40, 0xfe, 0xfd, 0xfc, 0xfb,
+	}
+	m, err := Decode(bytes.NewReader(photometricTIFF(2, 2, pCMYK, []uint16{8, 8, 8, 8}, samples, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := m.(*image.CMYK)
+	if !ok {
+		t.Fatalf("got %T, want *image.CMYK", m)
+	}
+	if !bytes.Equal(got.Pix, samples) {
+		t.Errorf("got %v, want %v", got.Pix, samples)
+	}
+}
+
+func TestDecodeYCbCr(t *testing.T) {
+	// The 5x3 image has 3x2 data units of 2x2 pixels, or 2x1 of 4x4, or
+	// 5x3 of 1x1, with the edges padded. The samples of each unit differ.
+	for _, sub := range [][2]int{{2, 2}, {1, 1}, {2, 1}, {4, 4}} {
+		const w, h = 5, 3
+		hs, vs := sub[0], sub[1]
+		var samples []byte
+		var units int
+		for y := 0; y < h; y += vs {
+			for x := 0; x < w; x += hs {
+				for i := 0; i < hs*vs; i++ {
+					samples = append(samples, byte(16*units+i))
+				}
+				samples = append(samples, byte(100+units), byte(200+units))
+				units++
+			}
+		}
+		// ycbcrAt returns the color of the pixel at (x, y).
+		ycbcrAt := func(x, y int) color.YCbCr {
+			ux, uy := x/hs, y/vs
+			u := uy*((w+hs-1)/hs) + ux
+			i := (y%vs)*hs + x%hs
+			return color.YCbCr{byte(16*u + i), byte(100 + u), byte(200 + u)}
+		}
+
+		entries := map[uint16]interface{}{
+			tYCbCrSubSampling: []uint16{uint16(hs), uint16(vs)},
+		}
+		data := photometricTIFF(w, h, pYCbCr, []uint16{8, 8, 8}, samples, entries)
+		m, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%v: %v", sub, err)
+			continue
+		}
+		region, err := DecodeRegion(bytes.NewReader(data), image.Rect(1, 1, 4, 3))
+		if err != nil {
+			t.Errorf("%v: %v", sub, err)
+			continue
+		}
+		compare(t, m.(interface {
+			SubImage(image.Rectangle) image.Image
+		}).SubImage(region.Bounds()), region)
+		if _, ok := ycbcrRatio(sub); ok != (m.ColorModel() == color.YCbCrModel) {
+			t.Errorf("%v: got %T", sub, m)
+			continue
+		}
+	loop:
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				want := ycbcrAt(x, y)
+				var got color.Color
+				if ycbcr, ok := m.(*image.YCbCr); ok {
+					got = ycbcr.YCbCrAt(x, y)
+				} else {
+					r, g, b := color.YCbCrToRGB(want.Y, want.Cb, want.Cr)
+					want := color.RGBA{r, g, b, 0xff}
+					if got := m.At(x, y); got != want {
+						t.Errorf("%v: pixel at (%d, %d): got %v, want %v", sub, x, y, got, want)
+						break loop
+					}
+					continue
+				}
+				if got != want {
+					t.Errorf("%v: pixel at (%d, %d): got %v, want %v", sub, x, y, got, want)
+					break loop
+				}
+			}
+		}
+	}
+}
+
+func TestDecodeCIELab(t *testing.T) {
+	for _, tc := range []struct {
+		desc        string
+		photometric uint16
+		bits        uint16
+		samples     []byte
+		want        []color.Color
+	}{
+		{
+			"CIELab", pCIELab, 8,
+			// White, black, red and blue.
+			[]byte{0xff, 0, 0, 0, 0, 0, 136, 80, 67, 82, 79, 0x94},
+			[]color.Color{
+				color.RGBA{0xff, 0xff, 0xff, 0xff}, color.RGBA{0, 0, 0, 0xff},
+				color.RGBA{0xff, 0, 0, 0xff}, color.RGBA{0, 0, 0xff, 0xff},
+			},
+		},
+		{
+			"ICCLab", pICCLab, 8,
+			// The same colors, relative to D50 rather than D65.
+			[]byte{0xff, 0x80, 0x80, 0, 0x80, 0x80, 138, 209, 198, 75, 196, 16},
+			[]color.Color{
+				color.RGBA{0xff, 0xff, 0xff, 0xff}, color.RGBA{0, 0, 0, 0xff},
+				color.RGBA{0xff, 0, 0, 0xff}, color.RGBA{0, 0, 0xff, 0xff},
+			},
+		},
+		{
+			"16-bit CIELab", pCIELab, 16,
+			[]byte{0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			[]color.Color{color.RGBA64{0xffff, 0xffff, 0xffff, 0xffff}, color.RGBA64{0, 0, 0, 0xffff}},
+		},
+		{
+			"16-bit ICCLab", pICCLab, 16,
+			[]byte{0xff, 0xff, 0x80, 0, 0x80, 0, 0, 0, 0x80, 0, 0x80, 0},
+			[]color.Color{color.RGBA64{0xffff, 0xffff, 0xffff, 0xffff}, color.RGBA64{0, 0, 0, 0xffff}},
+		},
+	} {
+		w := len(tc.want)
+		m, err := Decode(bytes.NewReader(photometricTIFF(w, 1, tc.photometric, []uint16{tc.bits, tc.bits, tc.bits}, tc.samples, nil)))
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		for x, want := range tc.want {
+			r0, g0, b0, _ := want.RGBA()
+			r1, g1, b1, _ := m.At(x, 0).RGBA()
+			// The samples only approximate red and blue.
+			if absDiff(r0, r1) > 0x300 || absDiff(g0, g1) > 0x300 || absDiff(b0, b1) > 0x300 {
+				t.Errorf("%s: pixel %d: got %v, want %v", tc.desc, x, m.At(x, 0), want)
+			}
+		}
+	}
+}
+
+func TestDecodeBitDepths(t *testing.T) {
+	var colorMap []uint16
+	for _, c := range []uint16{0, 0x1111, 0x2222} {
+		for i := 0; i < 16; i++ {
+			colorMap = append(colorMap, c*uint16(i))
+		}
+	}
+	for _, tc := range []struct {
+		desc        string
+		photometric uint16
+		bits        []uint16
+		samples     []byte
+		entries     map[uint16]interface{}
+		want        []color.Color
+	}{
+		{
+			"2-bit gray", pBlackIsZero, []uint16{2}, []byte{0x1b}, nil,
+			[]color.Color{color.Gray{0}, color.Gray{0x55}, color.Gray{0xaa}, color.Gray{0xff}},
+		},
+		{
+			"4-bit WhiteIsZero", pWhiteIsZero, []uint16{4}, []byte{0x0f}, nil,
+			[]color.Color{color.Gray{0xff}, color.Gray{0}},
+		},
+		{
+			"12-bit gray", pBlackIsZero, []uint16{12}, []byte{0x55, 0x5f, 0xff}, nil,
+			[]color.Color{color.Gray16{0x5555}, color.Gray16{0xffff}},
+		},
+		{
+			"24-bit gray", pBlackIsZero, []uint16{24}, []byte{0x12, 0x34, 0x56, 0xff, 0xff, 0xff}, nil,
+			[]color.Color{color.Gray16{0x1234}, color.Gray16{0xffff}},
+		},
+		{
+			"32-bit gray", pBlackIsZero, []uint16{32}, []byte{0x80, 0, 0, 0, 0, 0, 0, 0}, nil,
+			[]color.Color{color.Gray16{0x7fff}, color.Gray16{0}},
+		},
+		{
+			"4-bit paletted", pPaletted, []uint16{4}, []byte{0x1f},
+			map[uint16]interface{}{tColorMap: colorMap},
+			[]color.Color{color.RGBA64{0, 0x1111, 0x2222, 0xffff}, color.RGBA64{0, 0xffff, 0xfffe, 0xffff}},
+		},
+		{
+			"2-bit RGB", pRGB, []uint16{2, 2, 2}, []byte{0xc6, 0x70}, nil,
+			[]color.Color{color.RGBA{0xff, 0, 0x55, 0xff}, color.RGBA{0xaa, 0x55, 0xff, 0xff}},
+		},
+		{
+			"12-bit RGB", pRGB, []uint16{12, 12, 12}, []byte{0xff, 0xf0, 0x00, 0x55, 0x50}, nil,
+			[]color.Color{color.RGBA64{0xffff, 0, 0x5555, 0xffff}},
+		},
+		{
+			"4-bit NRGBA", pRGB, []uint16{4, 4, 4, 4}, []byte{0xf0, 0x5a},
+			map[uint16]interface{}{tExtraSamples: uint16(2)},
+			[]color.Color{color.NRGBA{0xff, 0, 0x55, 0xaa}},
+		},
+	} {
+		data := photometricTIFF(len(tc.want), 1, tc.photometric, tc.bits, tc.samples, tc.entries)
+		m, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %v", tc.desc, err)
+			continue
+		}
+		for x, want := range tc.want {
+			if got := m.At(x, 0); got != want {
+				t.Errorf("%s: pixel %d: got %v, want %v", tc.desc, x, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,314 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// The images in this file hold one sample per pixel of a type that has no
+// color of its own, such as the elevations or measurements of scientific
+// data, which TIFF stores with a SampleFormat of signed integer or IEEE
+// floating point. Their At method maps the samples to shades of gray, for
+// display, with those from Min to Max spread from black to white. Decode
+// sets Min and Max to the smallest and largest of the decoded samples, or
+// the other way around for a WhiteIsZero image.
+
+// grayLevel maps the sample v to a shade of gray, as described above.
+func grayLevel(v, min, max float64) color.Gray16 {
+	var t float64
+	switch {
+	case max != min:
+		t = (v - min) / (max - min)
+	case v >= max:
+		t = 1
+	}
+	if !(t > 0) { // NaN is black.
+		return color.Gray16{0}
+	}
+	if t > 1 {
+		return color.Gray16{0xffff}
+	}
+	return color.Gray16{uint16(t*0xffff + 0.5)}
+}
+
+// GrayInt16 is an in-memory image whose pixels are signed 16-bit samples.
+type GrayInt16 struct {
+	// Pix holds the image's samples. The sample at (x, y) is at
+	// Pix[(y-Rect.Min.Y)*Stride + (x-Rect.Min.X)].
+	Pix []int16
+	// Stride is the Pix stride (in samples) between vertically adjacent
+	// pixels.
+	Stride int
+	// Rect is the image's bounds.
+	Rect image.Rectangle
+	// Min and Max are the samples that At maps to black and white.
+	Min, Max float64
+}
+
+func (p *GrayInt16) ColorModel() color.Model { return color.Gray16Model }
+
+func (p *GrayInt16) Bounds() image.Rectangle { return p.Rect }
+
+func (p *GrayInt16) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return color.Gray16{}
+	}
+	return grayLevel(float64(p.Pix[p.PixOffset(x, y)]), p.Min, p.Max)
+}
+
+// Int16At returns the sample at (x, y).
+func (p *GrayInt16) Int16At(x, y int) int16 {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return 0
+	}
+	return p.Pix[p.PixOffset(x, y)]
+}
+
+// SetInt16 sets the sample at (x, y).
+func (p *GrayInt16) SetInt16(x, y int, v int16) {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return
+	}
+	p.Pix[p.PixOffset(x, y)] = v
+}
+
+// PixOffset returns the index of the element of Pix that corresponds to the
+// pixel at (x, y).
+func (p *GrayInt16) PixOffset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.Stride + (x - p.Rect.Min.X)
+}
+
+// SubImage returns an image representing the portion of the image p visible
+// through r. The returned value shares pixels with the original image.
+func (p *GrayInt16) SubImage(r image.Rectangle) image.Image {
+	r = r.Intersect(p.Rect)
+	if r.Empty() {
+		return &GrayInt16{Min: p.Min, Max: p.Max}
+	}
+	return &GrayInt16{
+		Pix:    p.Pix[p.PixOffset(r.Min.X, r.Min.Y):],
+		Stride: p.Stride,
+		Rect:   r,
+		Min:    p.Min,
+		Max:    p.Max,
+	}
+}
+
+// NewGrayInt16 returns a new GrayInt16 image with the given bounds, whose At
+// method maps the full range of int16 samples to shades of gray.
+func NewGrayInt16(r image.Rectangle) *GrayInt16 {
+	return &GrayInt16{
+		Pix:    make([]int16, r.Dx()*r.Dy()),
+		Stride: r.Dx(),
+		Rect:   r,
+		Min:    math.MinInt16,
+		Max:    math.MaxInt16,
+	}
+}
+
+// GrayFloat32 is an in-memory image whose pixels are 32-bit floating-point
+// samples.
+type GrayFloat32 struct {
+	// Pix holds the image's samples. The sample at (x, y) is at
+	// Pix[(y-Rect.Min.Y)*Stride + (x-Rect.Min.X)].
+	Pix []float32
+	// Stride is the Pix stride (in samples) between vertically adjacent
+	// pixels.
+	Stride int
+	// Rect is the image's bounds.
+	Rect image.Rectangle
+	// Min and Max are the samples that At maps to black and white.
+	Min, Max float64
+}
+
+func (p *GrayFloat32) ColorModel() color.Model { return color.Gray16Model }
+
+func (p *GrayFloat32) Bounds() image.Rectangle { return p.Rect }
+
+func (p *GrayFloat32) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return color.Gray16{}
+	}
+	return grayLevel(float64(p.Pix[p.PixOffset(x, y)]), p.Min, p.Max)
+}
+
+// Float32At returns the sample at (x, y).
+func (p *GrayFloat32) Float32At(x, y int) float32 {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return 0
+	}
+	return p.Pix[p.PixOffset(x, y)]
+}
+
+// SetFloat32 sets the sample at (x, y).
+func (p *GrayFloat32) SetFloat32(x, y int, v float32) {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return
+	}
+	p.Pix[p.PixOffset(x, y)] = v
+}
+
+// PixOffset returns the index of the element of Pix that corresponds to the
+// pixel at (x, y).
+func (p *GrayFloat32) PixOffset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.Stride + (x - p.Rect.Min.X)
+}
+
+// SubImage returns an image representing the portion of the image p visible
+// through r. The returned value shares pixels with the original image.
+func (p *GrayFloat32) SubImage(r image.Rectangle) image.Image {
+	r = r.Intersect(p.Rect)
+	if r.Empty() {
+		return &GrayFloat32{Min: p.Min, Max: p.Max}
+	}
+	return &GrayFloat32{
+		Pix:    p.Pix[p.PixOffset(r.Min.X, r.Min.Y):],
+		Stride: p.Stride,
+		Rect:   r,
+		Min:    p.Min,
+		Max:    p.Max,
+	}
+}
+
+// NewGrayFloat32 returns a new GrayFloat32 image with the given bounds, whose
+// At method maps samples from 0 to 1 to shades of gray.
+func NewGrayFloat32(r image.Rectangle) *GrayFloat32 {
+	return &GrayFloat32{
+		Pix:    make([]float32, r.Dx()*r.Dy()),
+		Stride: r.Dx(),
+		Rect:   r,
+		Max:    1,
+	}
+}
+
+// GrayFloat64 is an in-memory image whose pixels are 64-bit floating-point
+// samples.
+type GrayFloat64 struct {
+	// Pix holds the image's samples. The sample at (x, y) is at
+	// Pix[(y-Rect.Min.Y)*Stride + (x-Rect.Min.X)].
+	Pix []float64
+	// Stride is the Pix stride (in samples) between vertically adjacent
+	// pixels.
+	Stride int
+	// Rect is the image's bounds.
+	Rect image.Rectangle
+	// Min and Max are the samples that At maps to black and white.
+	Min, Max float64
+}
+
+func (p *GrayFloat64) ColorModel() color.Model { return color.Gray16Model }
+
+func (p *GrayFloat64) Bounds() image.Rectangle { return p.Rect }
+
+func (p *GrayFloat64) At(x, y int) color.Color {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return color.Gray16{}
+	}
+	return grayLevel(p.Pix[p.PixOffset(x, y)], p.Min, p.Max)
+}
+
+// Float64At returns the sample at (x, y).
+func (p *GrayFloat64) Float64At(x, y int) float64 {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return 0
+	}
+	return p.Pix[p.PixOffset(x, y)]
+}
+
+// SetFloat64 sets the sample at (x, y).
+func (p *GrayFloat64) SetFloat64(x, y int, v float64) {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return
+	}
+	p.Pix[p.PixOffset(x, y)] = v
+}
+
+// PixOffset returns the index of the element of Pix that corresponds to the
+// pixel at (x, y).
+func (p *GrayFloat64) PixOffset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.Stride + (x - p.Rect.Min.X)
+}
+
+// SubImage returns an image representing the portion of the image p visible
+// through r. The returned value shares pixels with the original image.
+func (p *GrayFloat64) SubImage(r image.Rectangle) image.Image {
+	r = r.Intersect(p.Rect)
+	if r.Empty() {
+		return &GrayFloat64{Min: p.Min, Max: p.Max}
+	}
+	return &GrayFloat64{
+		Pix:    p.Pix[p.PixOffset(r.Min.X, r.Min.Y):],
+		Stride: p.Stride,
+		Rect:   r,
+		Min:    p.Min,
+		Max:    p.Max,
+	}
+}
+
+// NewGrayFloat64 returns a new GrayFloat64 image with the given bounds, whose
+// At method maps samples from 0 to 1 to shades of gray.
+func NewGrayFloat64(r image.Rectangle) *GrayFloat64 {
+	return &GrayFloat64{
+		Pix:    make([]float64, r.Dx()*r.Dy()),
+		Stride: r.Dx(),
+		Rect:   r,
+		Max:    1,
+	}
+}
+
+// setSampleRange sets the Min and Max of m, an image of samples, to the
+// range of its finite samples, or to the reverse of that range if inverted
+// is true. Other images are left unchanged.
+func setSampleRange(m image.Image, inverted bool) {
+	min, max := math.Inf(1), math.Inf(-1)
+	add := func(v float64) {
+		if math.IsInf(v, 0) {
+			return
+		}
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	var pmin, pmax *float64
+	switch m := m.(type) {
+	case *GrayInt16:
+		for y := m.Rect.Min.Y; y < m.Rect.Max.Y; y++ {
+			for _, v := range m.Pix[m.PixOffset(m.Rect.Min.X, y):m.PixOffset(m.Rect.Max.X, y)] {
+				add(float64(v))
+			}
+		}
+		pmin, pmax = &m.Min, &m.Max
+	case *GrayFloat32:
+		for y := m.Rect.Min.Y; y < m.Rect.Max.Y; y++ {
+			for _, v := range m.Pix[m.PixOffset(m.Rect.Min.X, y):m.PixOffset(m.Rect.Max.X, y)] {
+				add(float64(v))
+			}
+		}
+		pmin, pmax = &m.Min, &m.Max
+	case *GrayFloat64:
+		for y := m.Rect.Min.Y; y < m.Rect.Max.Y; y++ {
+			for _, v := range m.Pix[m.PixOffset(m.Rect.Min.X, y):m.PixOffset(m.Rect.Max.X, y)] {
+				add(v)
+			}
+		}
+		pmin, pmax = &m.Min, &m.Max
+	default:
+		return
+	}
+	if min > max {
+		// There are no finite samples.
+		min, max = 0, 1
+	}
+	if inverted {
+		min, max = max, min
+	}
+	*pmin, *pmax = min, max
+}
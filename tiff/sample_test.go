@@ -0,0 +1,40 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tiff
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"testing"
+)
+
+func TestSampleAt(t *testing.T) {
+	m := NewGrayFloat32(image.Rect(0, 0, 6, 1))
+	copy(m.Pix, []float32{-1, 2, 4.5, 7, 100, float32(math.NaN())})
+	m.Min, m.Max = 2, 7
+	want := []uint16{0, 0, 0x8000, 0xffff, 0xffff, 0}
+	for x, w := range want {
+		if got := m.At(x, 0); got != (color.Gray16{w}) {
+			t.Errorf("x=%d: got %v, want %v", x, got, color.Gray16{w})
+		}
+	}
+
+	// Swapping Min and Max inverts the mapping.
+	m.Min, m.Max = m.Max, m.Min
+	if got := m.At(1, 0); got != (color.Gray16{0xffff}) {
+		t.Errorf("inverted: got %v, want white", got)
+	}
+
+	i := NewGrayInt16(image.Rect(0, 0, 2, 1))
+	i.SetInt16(0, 0, math.MinInt16)
+	i.SetInt16(1, 0, math.MaxInt16)
+	if got, want := i.At(0, 0), (color.Gray16{0}); got != want {
+		t.Errorf("int16: got %v, want %v", got, want)
+	}
+	if got, want := i.At(1, 0), (color.Gray16{0xffff}); got != want {
+		t.Errorf("int16: got %v, want %v", got, want)
+	}
+}
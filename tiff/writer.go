@@ -9,8 +9,12 @@ import (
 	"compress/zlib"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
 	"io"
+	"math"
 	"sort"
 )
 
@@ -21,33 +25,56 @@ import (
 //   2. Image data.
 //   3. Image File Directory (IFD).
 //   4. "Pointer area" for larger entries in the IFD.
+//
+// A multi-page file repeats 2-4 for each page.
 
 // We only write little-endian TIFF files.
 var enc = binary.LittleEndian
 
+var errTooLarge = errors.New("tiff: file too large for 32-bit offsets; use Options.BigTIFF")
+
+// maxClassicSize is the size, in bytes, from which a file must be written as
+// BigTIFF, as the offsets in a classic TIFF file are 32 bits.
+const maxClassicSize = 1 << 32
+
 // An ifdEntry is a single entry in an Image File Directory.
 // A value of type dtRational is composed of two 32-bit values,
 // thus data contains two uints (numerator and denominator) for a single number.
 type ifdEntry struct {
 	tag      int
 	datatype int
-	data     []uint32
+	data     []uint64
 }
 
 func (e ifdEntry) putData(p []byte) {
+	// Each value of a rational type is two 32-bit values. Otherwise, the
+	// data type's length is that of each value in data, which holds the bit
+	// patterns of signed and floating-point values.
+	n := lengths[e.datatype]
+	if e.datatype == dtRational || e.datatype == dtSRational {
+		n = 4
+	}
 	for _, d := range e.data {
-		switch e.datatype {
-		case dtByte, dtASCII:
+		switch n {
+		case 1:
 			p[0] = byte(d)
-			p = p[1:]
-		case dtShort:
+		case 2:
 			enc.PutUint16(p, uint16(d))
-			p = p[2:]
-		case dtLong, dtRational:
+		case 4:
 			enc.PutUint32(p, uint32(d))
-			p = p[4:]
+		case 8:
+			enc.PutUint64(p, d)
 		}
+		p = p[n:]
+	}
+}
+
+// count returns the number of values in e.
+func (e ifdEntry) count() int {
+	if e.datatype == dtRational || e.datatype == dtSRational {
+		return len(e.data) / 2
 	}
+	return len(e.data)
 }
 
 type byTag []ifdEntry
@@ -79,6 +106,26 @@ func encodeGray(w io.Writer, pix []uint8, dx, dy, stride int, predictor bool) er
 	return nil
 }
 
+// encodePacked writes the samples in pix, which are less than 1<<n, with n
+// bits each. n is 1, 2 or 4, and each row is padded to a whole byte.
+func encodePacked(w io.Writer, pix []uint8, dx, dy, stride, n int) error {
+	buf := make([]byte, (dx*n+7)/8)
+	mask := uint8(1<<uint(n) - 1)
+	for y := 0; y < dy; y++ {
+		for i := range buf {
+			buf[i] = 0
+		}
+		for x, v := range pix[y*stride : y*stride+dx] {
+			bit := x * n
+			buf[bit/8] |= (v & mask) << uint(8-n-bit%8)
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func encodeGray16(w io.Writer, pix []uint8, dx, dy, stride int, predictor bool) error {
 	buf := make([]byte, dx*2)
 	for y := 0; y < dy; y++ {
@@ -204,6 +251,34 @@ func encode(w io.Writer, m image.Image, predictor bool) error {
 	return nil
 }
 
+// encodeSamples writes the samples of m, a GrayInt16, GrayFloat32 or
+// GrayFloat64 image, row by row.
+func encodeSamples(w io.Writer, m image.Image) error {
+	b := m.Bounds()
+	var buf []byte
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		buf = buf[:0]
+		switch m := m.(type) {
+		case *GrayInt16:
+			for _, v := range m.Pix[m.PixOffset(b.Min.X, y):m.PixOffset(b.Max.X, y)] {
+				buf = enc.AppendUint16(buf, uint16(v))
+			}
+		case *GrayFloat32:
+			for _, v := range m.Pix[m.PixOffset(b.Min.X, y):m.PixOffset(b.Max.X, y)] {
+				buf = enc.AppendUint32(buf, math.Float32bits(v))
+			}
+		case *GrayFloat64:
+			for _, v := range m.Pix[m.PixOffset(b.Min.X, y):m.PixOffset(b.Max.X, y)] {
+				buf = enc.AppendUint64(buf, math.Float64bits(v))
+			}
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // writePix writes the internal byte array of an image to w. It is less general
 // but much faster then encode. writePix is used when pix directly
 // corresponds to one of the TIFF image types.
@@ -221,36 +296,83 @@ func writePix(w io.Writer, pix []byte, nrows, length, stride int) error {
 	return nil
 }
 
-func writeIFD(w io.Writer, ifdOffset int, d []ifdEntry) error {
-	var buf [ifdLen]byte
+// ifdSize returns the number of bytes that writeIFD writes for d. In
+// BigTIFF, the entry count, the offsets and each entry's count are 8 bytes
+// instead of 2 or 4, and values of up to 8 bytes fit in the entry.
+func ifdSize(d []ifdEntry, bigTIFF bool) int64 {
+	n, fieldLen := int64(2+ifdLen*len(d)+4), 4
+	if bigTIFF {
+		n, fieldLen = int64(8+bigIFDLen*len(d)+8), 8
+	}
+	for _, ent := range d {
+		if datalen := ent.count() * int(lengths[ent.datatype]); datalen > fieldLen {
+			n += even(int64(datalen))
+		}
+	}
+	return n
+}
+
+// even rounds n up to an even number. The TIFF spec requires IFDs and
+// the values that they point to to begin on a word boundary (pages 13 and
+// 15).
+func even(n int64) int64 {
+	return n + n&1
+}
+
+// writeIFD writes the IFD d, which is at ifdOffset in the file, followed by
+// its pointer area. next is the offset of the next IFD, or zero if d is the
+// last one.
+func writeIFD(w io.Writer, ifdOffset int64, d []ifdEntry, next int64, bigTIFF bool) error {
+	// The entries are preceded by their count and followed by the next IFD's
+	// offset, which take 6 bytes in total, or 16 for BigTIFF.
+	entryLen, fieldLen, extraLen := ifdLen, 4, 6
+	if bigTIFF {
+		entryLen, fieldLen, extraLen = bigIFDLen, 8, 16
+	}
+	var buf [bigIFDLen]byte
 	// Make space for "pointer area" containing IFD entry data
-	// longer than 4 bytes.
+	// longer than fieldLen bytes.
 	parea := make([]byte, 1024)
-	pstart := ifdOffset + ifdLen*len(d) + 6
+	pstart := ifdOffset + int64(entryLen*len(d)+extraLen)
 	var o int // Current offset in parea.
 
 	// The IFD has to be written with the tags in ascending order.
 	sort.Sort(byTag(d))
 
 	// Write the number of entries in this IFD.
-	if err := binary.Write(w, enc, uint16(len(d))); err != nil {
+	var err error
+	if bigTIFF {
+		err = binary.Write(w, enc, uint64(len(d)))
+	} else {
+		err = binary.Write(w, enc, uint16(len(d)))
+	}
+	if err != nil {
 		return err
 	}
 	for _, ent := range d {
-		enc.PutUint16(buf[0:2], uint16(ent.tag))
-		enc.PutUint16(buf[2:4], uint16(ent.datatype))
-		count := uint32(len(ent.data))
-		if ent.datatype == dtRational {
-			count /= 2
-		}
-		enc.PutUint32(buf[4:8], count)
-		datalen := int(count * lengths[ent.datatype])
-		if datalen <= 4 {
-			ent.putData(buf[8:12])
+		entry := buf[:entryLen]
+		for i := range entry {
+			entry[i] = 0
+		}
+		enc.PutUint16(entry[0:2], uint16(ent.tag))
+		enc.PutUint16(entry[2:4], uint16(ent.datatype))
+		count := ent.count()
+		field := entry[8:12]
+		if bigTIFF {
+			enc.PutUint64(entry[4:12], uint64(count))
+			field = entry[12:20]
+		} else {
+			enc.PutUint32(entry[4:8], uint32(count))
+		}
+		datalen := count * int(lengths[ent.datatype])
+		if datalen <= fieldLen {
+			ent.putData(field)
 		} else {
-			if (o + datalen) > len(parea) {
+			// Values in the pointer area begin on a word boundary.
+			n := int(even(int64(datalen)))
+			if (o + n) > len(parea) {
 				newlen := len(parea) + 1024
-				for (o + datalen) > newlen {
+				for (o + n) > newlen {
 					newlen += 1024
 				}
 				newarea := make([]byte, newlen)
@@ -258,19 +380,28 @@ func writeIFD(w io.Writer, ifdOffset int, d []ifdEntry) error {
 				parea = newarea
 			}
 			ent.putData(parea[o : o+datalen])
-			enc.PutUint32(buf[8:12], uint32(pstart+o))
-			o += datalen
+			if bigTIFF {
+				enc.PutUint64(field, uint64(pstart)+uint64(o))
+			} else {
+				enc.PutUint32(field, uint32(pstart)+uint32(o))
+			}
+			o += n
 		}
-		if _, err := w.Write(buf[:]); err != nil {
+		if _, err := w.Write(entry); err != nil {
 			return err
 		}
 	}
 	// The IFD ends with the offset of the next IFD in the file,
 	// or zero if it is the last one (page 14).
-	if err := binary.Write(w, enc, uint32(0)); err != nil {
+	if bigTIFF {
+		err = binary.Write(w, enc, uint64(next))
+	} else {
+		err = binary.Write(w, enc, uint32(next))
+	}
+	if err != nil {
 		return err
 	}
-	_, err := w.Write(parea[:o])
+	_, err = w.Write(parea[:o])
 	return err
 }
 
@@ -284,12 +415,153 @@ type Options struct {
 	// types of images and compressors. For example, it works well for
 	// photos with Deflate compression.
 	Predictor bool
+	// TileWidth and TileHeight, if non-zero, are the size of the tiles that
+	// the image is split into, which must be multiples of 16. Otherwise, the
+	// image is split into strips of RowsPerStrip rows, or into one strip if
+	// RowsPerStrip is zero. Each strip or tile is compressed on its own.
+	TileWidth    int
+	TileHeight   int
+	RowsPerStrip int
+	// Tags are additional IFD entries, such as the DateTime, Software and
+	// Artist tags or private tags. The XResolution, YResolution and
+	// ResolutionUnit tags replace those that are otherwise written, which
+	// give 72 dpi, but other tags that Encode writes cannot be replaced.
+	// Each Tag's Count is ignored, as it is given by its Value.
+	Tags []Tag
+	// BigTIFF is whether the file is written in the BigTIFF format, which
+	// has 64-bit offsets. Encode otherwise writes that format only if the
+	// image does not fit in 4 GiB. With an Encoder, only the first page's
+	// BigTIFF option is used, as described there.
+	BigTIFF bool
 }
 
 // Encode writes the image m to w. opt determines the options used for
 // encoding, such as the compression type. If opt is nil, an uncompressed
 // image is written.
+//
+// An *image.Paletted whose palette is black and white, in either order, is
+// written as a bilevel image with 1 bit per pixel, which decodes as an
+// *image.Gray. Other palettes are written with 4 bits per pixel if they have
+// at most 16 colors, and with 8 otherwise, and are padded to 16 or 256
+// colors, as the ColorMap has a color for each value of a pixel.
 func Encode(w io.Writer, m image.Image, opt *Options) error {
+	e := NewEncoder(w)
+	if err := e.Encode(m, opt); err != nil {
+		return err
+	}
+	return e.Close()
+}
+
+// An Encoder writes a multi-page TIFF file, such as a scanned document, one
+// page at a time. Each page is written as soon as it is encoded, except for
+// its IFD, which is written once the next page's size is known.
+//
+// The first page decides whether the file is a BigTIFF file: it is if that
+// page's Options.BigTIFF is set or if the page alone does not fit in 4 GiB.
+// The Encoder cannot know the size of later pages, so a file that may grow
+// past 4 GiB must set Options.BigTIFF for its first page. Otherwise, Encode
+// returns an error for the first page that does not fit, without writing it,
+// and Close still writes a valid file of the pages before it.
+type Encoder struct {
+	w io.Writer
+	// bigTIFF is whether the file is a BigTIFF file, which is decided by the
+	// first page, and maxSize is the size from which it must be one.
+	bigTIFF bool
+	maxSize int64
+	// off is the number of bytes written so far.
+	off int64
+	// ifd is the IFD of the last page, which is not yet written.
+	ifd []ifdEntry
+	err error
+}
+
+// NewEncoder returns an Encoder that writes to w. Its Close method must be
+// called after the last page is encoded.
+func NewEncoder(w io.Writer) *Encoder {
+	return newEncoder(w, maxClassicSize)
+}
+
+// newEncoder returns an Encoder that writes a BigTIFF file if it would
+// otherwise be maxSize bytes or larger.
+func newEncoder(w io.Writer, maxSize int64) *Encoder {
+	return &Encoder{w: w, maxSize: maxSize}
+}
+
+// Close writes the last page's IFD. It does not close the underlying writer.
+func (e *Encoder) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.ifd == nil {
+		e.err = errors.New("tiff: no pages")
+		return e.err
+	}
+	// The IFD's size was part of the check that the page fits, so it is
+	// always written.
+	err := writeIFD(e.w, e.off, e.ifd, 0, e.bigTIFF)
+	e.err = errors.New("tiff: Encoder is closed")
+	if err != nil {
+		e.err = err
+	}
+	return err
+}
+
+// startPage writes what precedes a page's image data, which is imageLen bytes
+// long, including any padding: the file header, for the first page, or the
+// previous page's IFD. It returns the offset of the image data. ifd is the
+// page's IFD, which follows the image data, and opt is its Options.
+func (e *Encoder) startPage(imageLen int64, ifd []ifdEntry, opt *Options) (int64, error) {
+	// The size of ifd in a classic TIFF file decides whether it fits.
+	size := imageLen + ifdSize(ifd, false)
+	if e.ifd == nil {
+		// The first IFD follows the first page's image data.
+		e.bigTIFF = (opt != nil && opt.BigTIFF) || 8+size > e.maxSize
+		var err error
+		if e.bigTIFF {
+			_, err = io.WriteString(e.w, leBigHeader+"\x08\x00\x00\x00")
+			e.off = 16
+		} else {
+			_, err = io.WriteString(e.w, leHeader)
+			e.off = 8
+		}
+		if err != nil {
+			return 0, err
+		}
+		if e.bigTIFF {
+			err = binary.Write(e.w, enc, uint64(e.off+imageLen))
+		} else {
+			err = binary.Write(e.w, enc, uint32(e.off+imageLen))
+		}
+		return e.off, err
+	}
+	n := ifdSize(e.ifd, e.bigTIFF)
+	if !e.bigTIFF && e.off+n+size > e.maxSize {
+		return 0, errTooLarge
+	}
+	if err := writeIFD(e.w, e.off, e.ifd, e.off+n+imageLen, e.bigTIFF); err != nil {
+		return 0, err
+	}
+	e.off += n
+	return e.off, nil
+}
+
+// Encode writes the image m as the next page. opt determines the options
+// used for encoding it, as for the Encode function.
+func (e *Encoder) Encode(m image.Image, opt *Options) error {
+	if e.err != nil {
+		return e.err
+	}
+	err := e.encode(m, opt)
+	if err != errTooLarge {
+		// Nothing of a page that is too large is written, so the
+		// earlier pages can still be closed.
+		e.err = err
+	}
+	return err
+}
+
+func (e *Encoder) encode(m image.Image, opt *Options) error {
+	w := e.w
 	d := m.Bounds().Size()
 
 	compression := uint32(cNone)
@@ -299,143 +571,435 @@ func Encode(w io.Writer, m image.Image, opt *Options) error {
 		// The predictor field is only used with LZW. See page 64 of the spec.
 		predictor = opt.Predictor && compression == cLZW
 	}
-
-	_, err := io.WriteString(w, leHeader)
-	if err != nil {
-		return err
-	}
-
-	// Compressed data is written into a buffer first, so that we
-	// know the compressed size.
-	var buf bytes.Buffer
-	// dst holds the destination for the pixel data of the image --
-	// either w or a writer to buf.
-	var dst io.Writer
-	// imageLen is the length of the pixel data in bytes.
-	// The offset of the IFD is imageLen + 8 header bytes.
-	var imageLen int
-
 	switch compression {
-	case cNone:
-		dst = w
-		// Write IFD offset before outputting pixel data.
-		switch m.(type) {
-		case *image.Paletted:
-			imageLen = d.X * d.Y * 1
-		case *image.Gray:
-			imageLen = d.X * d.Y * 1
-		case *image.Gray16:
-			imageLen = d.X * d.Y * 2
-		case *image.RGBA64:
-			imageLen = d.X * d.Y * 8
-		case *image.NRGBA64:
-			imageLen = d.X * d.Y * 8
-		default:
-			imageLen = d.X * d.Y * 4
-		}
-		err = binary.Write(w, enc, uint32(imageLen+8))
-		if err != nil {
-			return err
-		}
-	case cDeflate:
-		dst = zlib.NewWriter(&buf)
+	case cNone, cDeflate, cPackBits:
 	default:
 		return errors.New("tiff: unsupported compression")
 	}
 
-	pr := uint32(prNone)
-	photometricInterpretation := uint32(pRGB)
-	samplesPerPixel := uint32(4)
-	bitsPerSample := []uint32{8, 8, 8, 8}
-	extraSamples := uint32(0)
-	colorMap := []uint32{}
+	blocks, tiled, err := layout(m.Bounds(), opt)
+	if err != nil {
+		return err
+	}
+
+	pr := uint64(prNone)
+	photometricInterpretation := uint64(pRGB)
+	samplesPerPixel := uint64(4)
+	bitsPerSample := []uint64{8, 8, 8, 8}
+	extraSamples := uint64(0)
+	sampleFormat := uint64(0)
+	colorMap := []uint64{}
+	bitsPerPixel := int64(32)
 
 	if predictor {
 		pr = prHorizontal
 	}
 	switch m := m.(type) {
 	case *image.Paletted:
-		photometricInterpretation = pPaletted
+		var n int
+		n, photometricInterpretation = paletteDepth(m.Palette)
 		samplesPerPixel = 1
-		bitsPerSample = []uint32{8}
-		colorMap = make([]uint32, 256*3)
-		for i := 0; i < 256 && i < len(m.Palette); i++ {
-			r, g, b, _ := m.Palette[i].RGBA()
-			colorMap[i+0*256] = uint32(r)
-			colorMap[i+1*256] = uint32(g)
-			colorMap[i+2*256] = uint32(b)
-		}
-		err = encodeGray(dst, m.Pix, d.X, d.Y, m.Stride, predictor)
+		bitsPerSample = []uint64{uint64(n)}
+		if photometricInterpretation == pPaletted {
+			k := 1 << uint(n)
+			colorMap = make([]uint64, k*3)
+			for i := 0; i < k && i < len(m.Palette); i++ {
+				r, g, b, _ := m.Palette[i].RGBA()
+				colorMap[i+0*k] = uint64(r)
+				colorMap[i+1*k] = uint64(g)
+				colorMap[i+2*k] = uint64(b)
+			}
+		}
+		bitsPerPixel = int64(n)
 	case *image.Gray:
 		photometricInterpretation = pBlackIsZero
 		samplesPerPixel = 1
-		bitsPerSample = []uint32{8}
-		err = encodeGray(dst, m.Pix, d.X, d.Y, m.Stride, predictor)
+		bitsPerSample = []uint64{8}
+		bitsPerPixel = 8
 	case *image.Gray16:
 		photometricInterpretation = pBlackIsZero
 		samplesPerPixel = 1
-		bitsPerSample = []uint32{16}
-		err = encodeGray16(dst, m.Pix, d.X, d.Y, m.Stride, predictor)
+		bitsPerSample = []uint64{16}
+		bitsPerPixel = 16
 	case *image.NRGBA:
 		extraSamples = 2 // Unassociated alpha.
-		err = encodeRGBA(dst, m.Pix, d.X, d.Y, m.Stride, predictor)
 	case *image.NRGBA64:
 		extraSamples = 2 // Unassociated alpha.
-		bitsPerSample = []uint32{16, 16, 16, 16}
-		err = encodeRGBA64(dst, m.Pix, d.X, d.Y, m.Stride, predictor)
+		bitsPerSample = []uint64{16, 16, 16, 16}
+		bitsPerPixel = 64
 	case *image.RGBA:
 		extraSamples = 1 // Associated alpha.
-		err = encodeRGBA(dst, m.Pix, d.X, d.Y, m.Stride, predictor)
 	case *image.RGBA64:
 		extraSamples = 1 // Associated alpha.
-		bitsPerSample = []uint32{16, 16, 16, 16}
-		err = encodeRGBA64(dst, m.Pix, d.X, d.Y, m.Stride, predictor)
+		bitsPerSample = []uint64{16, 16, 16, 16}
+		bitsPerPixel = 64
+	case *image.CMYK:
+		photometricInterpretation = pCMYK
+	case *GrayInt16:
+		photometricInterpretation = pBlackIsZero
+		samplesPerPixel = 1
+		bitsPerSample = []uint64{16}
+		sampleFormat = sfInt
+		bitsPerPixel = 16
+	case *GrayFloat32:
+		photometricInterpretation = pBlackIsZero
+		samplesPerPixel = 1
+		bitsPerSample = []uint64{32}
+		sampleFormat = sfFloat
+		bitsPerPixel = 32
+	case *GrayFloat64:
+		photometricInterpretation = pBlackIsZero
+		samplesPerPixel = 1
+		bitsPerSample = []uint64{64}
+		sampleFormat = sfFloat
+		bitsPerPixel = 64
 	default:
 		extraSamples = 1 // Associated alpha.
-		err = encode(dst, m, predictor)
 	}
-	if err != nil {
-		return err
+
+	// The IFD is built before the image data is written, so that its size
+	// is known when deciding whether the file fits in a classic TIFF file.
+	// blockOffsets and blockLens are the offsets and lengths of each strip
+	// or tile, which are filled in as they are written. The image size is
+	// a Short, if it fits, and the offsets and lengths are Longs, until the
+	// file is known to be a BigTIFF file.
+	blockOffsets := make([]uint64, len(blocks))
+	blockLens := make([]uint64, len(blocks))
+	sizeType := dtShort
+	if d.X > 0xffff || d.Y > 0xffff {
+		sizeType = dtLong
+	}
+	ifd := []ifdEntry{
+		{tImageWidth, sizeType, []uint64{uint64(d.X)}},
+		{tImageLength, sizeType, []uint64{uint64(d.Y)}},
+		{tBitsPerSample, dtShort, bitsPerSample},
+		{tCompression, dtShort, []uint64{uint64(compression)}},
+		{tPhotometricInterpretation, dtShort, []uint64{photometricInterpretation}},
+		{tSamplesPerPixel, dtShort, []uint64{samplesPerPixel}},
+		// There is currently no support for storing the image
+		// resolution, so give a bogus value of 72x72 dpi.
+		{tXResolution, dtRational, []uint64{72, 1}},
+		{tYResolution, dtRational, []uint64{72, 1}},
+		{tResolutionUnit, dtShort, []uint64{resPerInch}},
+	}
+	if tiled {
+		ifd = append(ifd,
+			ifdEntry{tTileWidth, sizeType, []uint64{uint64(blocks[0].Dx())}},
+			ifdEntry{tTileLength, sizeType, []uint64{uint64(blocks[0].Dy())}},
+			ifdEntry{tTileOffsets, dtLong, blockOffsets},
+			ifdEntry{tTileByteCounts, dtLong, blockLens},
+		)
+	} else {
+		ifd = append(ifd,
+			ifdEntry{tStripOffsets, dtLong, blockOffsets},
+			ifdEntry{tRowsPerStrip, sizeType, []uint64{uint64(blocks[0].Dy())}},
+			ifdEntry{tStripByteCounts, dtLong, blockLens},
+		)
+	}
+	if pr != prNone {
+		ifd = append(ifd, ifdEntry{tPredictor, dtShort, []uint64{pr}})
+	}
+	if len(colorMap) != 0 {
+		ifd = append(ifd, ifdEntry{tColorMap, dtShort, colorMap})
+	}
+	if extraSamples > 0 {
+		ifd = append(ifd, ifdEntry{tExtraSamples, dtShort, []uint64{extraSamples}})
+	}
+	if sampleFormat != 0 {
+		ifd = append(ifd, ifdEntry{tSampleFormat, dtShort, []uint64{sampleFormat}})
+	}
+	if opt != nil {
+		if ifd, err = addTags(ifd, opt.Tags); err != nil {
+			return err
+		}
 	}
 
-	if compression != cNone {
-		if err = dst.(io.Closer).Close(); err != nil {
+	// imageLen is the length of the pixel data in bytes, and
+	// imageOffset is its offset. The IFD follows it, after a padding
+	// byte if imageLen is odd. The strips or tiles follow each other.
+	var imageLen, imageOffset int64
+
+	if compression == cNone {
+		// Uncompressed data is written straight to w, after the
+		// header or the previous page's IFD, which needs its length.
+		for i, b := range blocks {
+			blockLens[i] = uint64((bitsPerPixel*int64(b.Dx()) + 7) / 8 * int64(b.Dy()))
+			imageLen += int64(blockLens[i])
+		}
+		if imageOffset, err = e.startPage(even(imageLen), ifd, opt); err != nil {
 			return err
 		}
-		imageLen = buf.Len()
-		if err = binary.Write(w, enc, uint32(imageLen+8)); err != nil {
+		for _, b := range blocks {
+			if err := encodeBlock(w, m, b, predictor); err != nil {
+				return err
+			}
+		}
+	} else {
+		// Compressed data is written into a buffer first, so that we
+		// know the compressed size. Each block is compressed on its own.
+		var buf bytes.Buffer
+		for i, b := range blocks {
+			n := buf.Len()
+			var dst io.WriteCloser
+			if compression == cPackBits {
+				dst = newPackBitsWriter(&buf, int((bitsPerPixel*int64(b.Dx())+7)/8))
+			} else {
+				dst = zlib.NewWriter(&buf)
+			}
+			if err := encodeBlock(dst, m, b, predictor); err != nil {
+				return err
+			}
+			if err := dst.Close(); err != nil {
+				return err
+			}
+			blockLens[i] = uint64(buf.Len() - n)
+		}
+		imageLen = int64(buf.Len())
+		if imageOffset, err = e.startPage(even(imageLen), ifd, opt); err != nil {
 			return err
 		}
 		if _, err = buf.WriteTo(w); err != nil {
 			return err
 		}
 	}
+	if imageLen%2 != 0 {
+		if _, err = w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	for i, off := 0, uint64(imageOffset); i < len(blocks); i++ {
+		blockOffsets[i] = off
+		off += blockLens[i]
+	}
+	if e.bigTIFF {
+		// The offsets and lengths are Long8s in BigTIFF.
+		for i := range ifd {
+			switch ifd[i].tag {
+			case tStripOffsets, tStripByteCounts, tTileOffsets, tTileByteCounts:
+				ifd[i].datatype = dtLong8
+			}
+		}
+	}
 
-	ifd := []ifdEntry{
-		{tImageWidth, dtShort, []uint32{uint32(d.X)}},
-		{tImageLength, dtShort, []uint32{uint32(d.Y)}},
-		{tBitsPerSample, dtShort, bitsPerSample},
-		{tCompression, dtShort, []uint32{compression}},
-		{tPhotometricInterpretation, dtShort, []uint32{photometricInterpretation}},
-		{tStripOffsets, dtLong, []uint32{8}},
-		{tSamplesPerPixel, dtShort, []uint32{samplesPerPixel}},
-		{tRowsPerStrip, dtShort, []uint32{uint32(d.Y)}},
-		{tStripByteCounts, dtLong, []uint32{uint32(imageLen)}},
-		// There is currently no support for storing the image
-		// resolution, so give a bogus value of 72x72 dpi.
-		{tXResolution, dtRational, []uint32{72, 1}},
-		{tYResolution, dtRational, []uint32{72, 1}},
-		{tResolutionUnit, dtShort, []uint32{resPerInch}},
+	e.off += even(imageLen)
+	e.ifd = ifd
+	return nil
+}
+
+// layout returns the rectangles of the strips or tiles, in the order that
+// they are written, that an image with the given bounds is split into, and
+// whether they are tiles. Tiles all have the same size, and those at the
+// right and bottom edges extend past the bounds. A single strip holds an
+// empty image.
+func layout(bounds image.Rectangle, opt *Options) (blocks []image.Rectangle, tiled bool, err error) {
+	if opt != nil && (opt.TileWidth != 0 || opt.TileHeight != 0) {
+		tw, th := opt.TileWidth, opt.TileHeight
+		// Page 67 of the spec.
+		if tw <= 0 || th <= 0 || tw%16 != 0 || th%16 != 0 {
+			return nil, false, errors.New("tiff: tile size is not a positive multiple of 16")
+		}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y += th {
+			for x := bounds.Min.X; x < bounds.Max.X; x += tw {
+				blocks = append(blocks, image.Rect(x, y, x+tw, y+th))
+			}
+		}
+		if len(blocks) == 0 {
+			blocks = append(blocks, image.Rect(0, 0, tw, th))
+		}
+		return blocks, true, nil
 	}
-	if pr != prNone {
-		ifd = append(ifd, ifdEntry{tPredictor, dtShort, []uint32{pr}})
+
+	rowsPerStrip := bounds.Dy()
+	if opt != nil && opt.RowsPerStrip > 0 && opt.RowsPerStrip < rowsPerStrip {
+		rowsPerStrip = opt.RowsPerStrip
 	}
-	if len(colorMap) != 0 {
-		ifd = append(ifd, ifdEntry{tColorMap, dtShort, colorMap})
+	if rowsPerStrip == 0 {
+		return []image.Rectangle{bounds}, false, nil
 	}
-	if extraSamples > 0 {
-		ifd = append(ifd, ifdEntry{tExtraSamples, dtShort, []uint32{extraSamples}})
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += rowsPerStrip {
+		b := image.Rect(bounds.Min.X, y, bounds.Max.X, y+rowsPerStrip)
+		blocks = append(blocks, b.Intersect(bounds))
+	}
+	return blocks, false, nil
+}
+
+// encodeBlock writes the pixels of m within the strip or tile b. Pixels of
+// b that are outside of m's bounds are written as zeroes.
+func encodeBlock(w io.Writer, m image.Image, b image.Rectangle, predictor bool) error {
+	if b.Empty() {
+		return nil
+	}
+	sub, ok := m.(interface {
+		SubImage(r image.Rectangle) image.Image
+	})
+	if !b.In(m.Bounds()) || !ok {
+		m = padBlock(m, b)
+	} else if b != m.Bounds() {
+		m = sub.SubImage(b)
+	}
+
+	d := b.Size()
+	switch m := m.(type) {
+	case *image.Paletted:
+		if n, _ := paletteDepth(m.Palette); n < 8 {
+			return encodePacked(w, m.Pix, d.X, d.Y, m.Stride, n)
+		}
+		return encodeGray(w, m.Pix, d.X, d.Y, m.Stride, predictor)
+	case *image.Gray:
+		return encodeGray(w, m.Pix, d.X, d.Y, m.Stride, predictor)
+	case *image.Gray16:
+		return encodeGray16(w, m.Pix, d.X, d.Y, m.Stride, predictor)
+	case *image.NRGBA:
+		return encodeRGBA(w, m.Pix, d.X, d.Y, m.Stride, predictor)
+	case *image.NRGBA64:
+		return encodeRGBA64(w, m.Pix, d.X, d.Y, m.Stride, predictor)
+	case *image.RGBA:
+		return encodeRGBA(w, m.Pix, d.X, d.Y, m.Stride, predictor)
+	case *image.RGBA64:
+		return encodeRGBA64(w, m.Pix, d.X, d.Y, m.Stride, predictor)
+	case *image.CMYK:
+		// The four samples of CMYK pixels are written like those of RGBA
+		// pixels.
+		return encodeRGBA(w, m.Pix, d.X, d.Y, m.Stride, predictor)
+	case *GrayInt16, *GrayFloat32, *GrayFloat64:
+		// The predictor is never used with signed or floating-point
+		// samples, as it needs LZW compression.
+		return encodeSamples(w, m)
+	}
+	return encode(w, m, predictor)
+}
+
+// paletteDepth returns the number of bits per pixel and the photometric
+// interpretation that an image with the palette p is written with. A palette
+// of black and white, in either order, gives a bilevel image, whose indexes
+// are the pixels of a BlackIsZero or WhiteIsZero image. Palette images have
+// 4 or 8 bits per pixel, as Baseline TIFF readers need (section 5).
+func paletteDepth(p color.Palette) (bits int, photometric uint64) {
+	switch {
+	case len(p) == 2 && isBlackWhite(p[0], p[1]):
+		return 1, pBlackIsZero
+	case len(p) == 2 && isBlackWhite(p[1], p[0]):
+		return 1, pWhiteIsZero
+	case len(p) <= 16:
+		return 4, pPaletted
+	}
+	return 8, pPaletted
+}
+
+// isBlackWhite returns whether c0 is opaque black and c1 is opaque white.
+func isBlackWhite(c0, c1 color.Color) bool {
+	r0, g0, b0, a0 := c0.RGBA()
+	r1, g1, b1, a1 := c1.RGBA()
+	return r0|g0|b0 == 0 && a0 == 0xffff && r1&g1&b1&a1 == 0xffff
+}
+
+// padBlock returns a copy of the pixels of m within b, with those outside of
+// m's bounds set to zero. The copy has the same type as m, if it is one of
+// the types that Encode writes directly, or is an *image.RGBA otherwise.
+func padBlock(m image.Image, b image.Rectangle) image.Image {
+	// The pixels are copied, rather than drawn, so that they are not
+	// converted, such as to the first of duplicate palette colors.
+	switch m := m.(type) {
+	case *image.Paletted:
+		p := image.NewPaletted(b, m.Palette)
+		copyPix(p.Pix, p.Stride, b, m.Pix, m.Stride, m.Rect, 1)
+		return p
+	case *image.Gray:
+		p := image.NewGray(b)
+		copyPix(p.Pix, p.Stride, b, m.Pix, m.Stride, m.Rect, 1)
+		return p
+	case *image.Gray16:
+		p := image.NewGray16(b)
+		copyPix(p.Pix, p.Stride, b, m.Pix, m.Stride, m.Rect, 2)
+		return p
+	case *image.NRGBA:
+		p := image.NewNRGBA(b)
+		copyPix(p.Pix, p.Stride, b, m.Pix, m.Stride, m.Rect, 4)
+		return p
+	case *image.NRGBA64:
+		p := image.NewNRGBA64(b)
+		copyPix(p.Pix, p.Stride, b, m.Pix, m.Stride, m.Rect, 8)
+		return p
+	case *image.RGBA:
+		p := image.NewRGBA(b)
+		copyPix(p.Pix, p.Stride, b, m.Pix, m.Stride, m.Rect, 4)
+		return p
+	case *image.RGBA64:
+		p := image.NewRGBA64(b)
+		copyPix(p.Pix, p.Stride, b, m.Pix, m.Stride, m.Rect, 8)
+		return p
+	case *image.CMYK:
+		p := image.NewCMYK(b)
+		copyPix(p.Pix, p.Stride, b, m.Pix, m.Stride, m.Rect, 4)
+		return p
+	case *GrayInt16:
+		p := NewGrayInt16(b)
+		r := b.Intersect(m.Rect)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			copy(p.Pix[p.PixOffset(r.Min.X, y):], m.Pix[m.PixOffset(r.Min.X, y):m.PixOffset(r.Max.X, y)])
+		}
+		return p
+	case *GrayFloat32:
+		p := NewGrayFloat32(b)
+		r := b.Intersect(m.Rect)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			copy(p.Pix[p.PixOffset(r.Min.X, y):], m.Pix[m.PixOffset(r.Min.X, y):m.PixOffset(r.Max.X, y)])
+		}
+		return p
+	case *GrayFloat64:
+		p := NewGrayFloat64(b)
+		r := b.Intersect(m.Rect)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			copy(p.Pix[p.PixOffset(r.Min.X, y):], m.Pix[m.PixOffset(r.Min.X, y):m.PixOffset(r.Max.X, y)])
+		}
+		return p
 	}
+	dst := image.NewRGBA(b)
+	draw.Draw(dst, b, m, b.Min, draw.Src)
+	return dst
+}
 
-	return writeIFD(w, imageLen+8, ifd)
+// copyPix copies the pixels, of n bytes each, that are within both dstRect
+// and srcRect, from the pixel data src of an image with the bounds srcRect
+// to dst, that of an image with the bounds dstRect.
+func copyPix(dst []byte, dstStride int, dstRect image.Rectangle, src []byte, srcStride int, srcRect image.Rectangle, n int) {
+	r := dstRect.Intersect(srcRect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		d := (y-dstRect.Min.Y)*dstStride + (r.Min.X-dstRect.Min.X)*n
+		s := (y-srcRect.Min.Y)*srcStride + (r.Min.X-srcRect.Min.X)*n
+		copy(dst[d:d+r.Dx()*n], src[s:s+r.Dx()*n])
+	}
+}
+
+// addTags returns ifd with the entries for tags added to it, replacing the
+// resolution entries that it may hold.
+func addTags(ifd []ifdEntry, tags []Tag) ([]ifdEntry, error) {
+	for i, t := range tags {
+		data, err := tagData(t)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			return nil, fmt.Errorf("tiff: tag %d has no values", t.ID)
+		}
+		for _, u := range tags[:i] {
+			if u.ID == t.ID {
+				return nil, fmt.Errorf("tiff: duplicate tag %d", t.ID)
+			}
+		}
+		e := ifdEntry{int(t.ID), int(t.Type), data}
+		j := 0
+		for j < len(ifd) && ifd[j].tag != e.tag {
+			j++
+		}
+		switch {
+		case j == len(ifd):
+			ifd = append(ifd, e)
+		case e.tag == tXResolution || e.tag == tYResolution || e.tag == tResolutionUnit:
+			ifd[j] = e
+		default:
+			return nil, fmt.Errorf("tiff: tag %d is written by the encoder", t.ID)
+		}
+	}
+	return ifd, nil
 }
@@ -6,9 +6,14 @@ package tiff
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
 	"image"
+	"image/color"
 	"io/ioutil"
+	"math"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -25,6 +30,14 @@ var roundtripTests = []struct {
 	{"video-001.tiff", &Options{Predictor: true}},
 	{"video-001.tiff", &Options{Compression: Deflate}},
 	{"video-001.tiff", &Options{Predictor: true, Compression: Deflate}},
+	{"video-001.tiff", &Options{RowsPerStrip: 16}},
+	{"video-001-gray-16bit.tiff", &Options{RowsPerStrip: 10, Compression: Deflate}},
+	{"video-001.tiff", &Options{TileWidth: 64, TileHeight: 48}},
+	{"video-001-16bit.tiff", &Options{TileWidth: 32, TileHeight: 32, Compression: Deflate}},
+	{"video-001-paletted.tiff", &Options{TileWidth: 16, TileHeight: 64}},
+	{"video-001.tiff", &Options{Compression: PackBits}},
+	{"video-001-gray-16bit.tiff", &Options{Compression: PackBits, TileWidth: 32, TileHeight: 16}},
+	{"bw-packbits.tiff", &Options{Compression: PackBits}},
 }
 
 func openImage(filename string) (image.Image, error) {
@@ -75,6 +88,532 @@ func TestRoundtrip2(t *testing.T) {
 	compare(t, m0, m1)
 }
 
+// TestTiles tests that an image whose origin is not (0, 0) is split into
+// the expected strips or tiles.
+func TestTiles(t *testing.T) {
+	m0 := image.NewNRGBA(image.Rect(3, 4, 40, 57))
+	for i := range m0.Pix {
+		m0.Pix[i] = byte(i)
+	}
+	for _, tc := range []struct {
+		opts     Options
+		tag      int
+		want     []uint
+		nOffsets int
+	}{
+		{Options{}, tRowsPerStrip, []uint{53}, 1},
+		{Options{RowsPerStrip: 100}, tRowsPerStrip, []uint{53}, 1},
+		{Options{RowsPerStrip: 10}, tRowsPerStrip, []uint{10}, 6},
+		{Options{RowsPerStrip: 10, Compression: Deflate}, tRowsPerStrip, []uint{10}, 6},
+		{Options{TileWidth: 16, TileHeight: 32}, tTileWidth, []uint{16}, 6},
+		{Options{TileWidth: 48, TileHeight: 16, Compression: Deflate}, tTileLength, []uint{16}, 4},
+	} {
+		opts := tc.opts
+		out := new(bytes.Buffer)
+		if err := Encode(out, m0, &opts); err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		pages, err := DecodeAll(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		compare(t, m0, pages[0].Image)
+		if got := tagUints(pages[0].IFD, uint16(tc.tag)); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%+v: tag %d: got %v, want %v", opts, tc.tag, got, tc.want)
+		}
+		offsets := tStripOffsets
+		if opts.TileWidth != 0 {
+			offsets = tTileOffsets
+		}
+		if got := len(tagUints(pages[0].IFD, uint16(offsets))); got != tc.nOffsets {
+			t.Errorf("%+v: got %d offsets, want %d", opts, got, tc.nOffsets)
+		}
+	}
+
+	for _, opts := range []Options{
+		{TileWidth: 16},
+		{TileWidth: 24, TileHeight: 16},
+		{TileWidth: -16, TileHeight: 16},
+	} {
+		if err := Encode(ioutil.Discard, m0, &opts); err == nil {
+			t.Errorf("%+v: got nil error, want non-nil", opts)
+		}
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	var pages []image.Image
+	for _, name := range []string{"video-001.tiff", "video-001-gray.tiff", "video-001-paletted.tiff"} {
+		m, err := openImage(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, m)
+	}
+	// An odd-sized page, with an odd-sized tag value, is padded so that
+	// the IFDs and the values that they point to are at even offsets.
+	odd := image.NewGray(image.Rect(0, 0, 3, 3))
+	for i := range odd.Pix {
+		odd.Pix[i] = byte(i)
+	}
+	pages = append(pages, odd, pages[0])
+	oddTags := []Tag{{ID: TagSoftware, Type: TypeASCII, Value: "tiff"}}
+	opts := []*Options{nil, {Compression: Deflate}, nil, {Tags: oddTags}, {Compression: Deflate}}
+
+	out := new(bytes.Buffer)
+	e := NewEncoder(out)
+	for i, m := range pages {
+		if err := e.Encode(m, opts[i]); err != nil {
+			t.Fatalf("page %d: %v", i, err)
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	b := out.Bytes()
+	for i, off := 0, binary.LittleEndian.Uint32(b[4:]); off != 0; i++ {
+		if off%2 != 0 {
+			t.Errorf("page %d: IFD at odd offset %d", i, off)
+		}
+		n := int(binary.LittleEndian.Uint16(b[off:]))
+		for j := 0; j < n; j++ {
+			ent := b[int(off)+2+ifdLen*j:]
+			datatype := binary.LittleEndian.Uint16(ent[2:])
+			count := binary.LittleEndian.Uint32(ent[4:])
+			if count*lengths[datatype] <= 4 {
+				continue
+			}
+			if p := binary.LittleEndian.Uint32(ent[8:]); p%2 != 0 {
+				t.Errorf("page %d: tag %d: value at odd offset %d", i, binary.LittleEndian.Uint16(ent), p)
+			}
+		}
+		off = binary.LittleEndian.Uint32(b[int(off)+2+ifdLen*n:])
+	}
+
+	got, err := DecodeAll(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(pages) {
+		t.Fatalf("got %d pages, want %d", len(got), len(pages))
+	}
+	for i, p := range got {
+		compare(t, pages[i], p.Image)
+		want := uint32(cNone)
+		if opts[i] != nil {
+			want = opts[i].Compression.specValue()
+		}
+		if c := tagUints(p.IFD, tCompression); len(c) != 1 || c[0] != uint(want) {
+			t.Errorf("page %d: Compression: got %v, want %d", i, c, want)
+		}
+	}
+
+	if err := NewEncoder(new(bytes.Buffer)).Close(); err == nil {
+		t.Error("Close with no pages: got nil error")
+	}
+}
+
+func TestBigTIFF(t *testing.T) {
+	m0, err := openImage("video-001.tiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m1, err := openImage("video-001-paletted.tiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	e := NewEncoder(out)
+	if err := e.Encode(m0, &Options{BigTIFF: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Encode(m1, &Options{Compression: Deflate}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(out.Bytes()[:8]), leBigHeader+"\x08\x00\x00\x00"; got != want {
+		t.Fatalf("header: got %q, want %q", got, want)
+	}
+	pages, err := DecodeAll(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) != 2 {
+		t.Fatalf("got %d pages, want 2", len(pages))
+	}
+	compare(t, m0, pages[0].Image)
+	compare(t, m1, pages[1].Image)
+}
+
+func TestBigTIFFAutomatic(t *testing.T) {
+	const maxSize = 1500
+	small := image.NewGray(image.Rect(0, 0, 20, 20))
+	large := image.NewGray(image.Rect(0, 0, 40, 40))
+	// The pixels of small fit, but not with a large tag, such as XMP
+	// metadata, in its IFD.
+	xmp := &Options{Tags: []Tag{{ID: 700, Type: TypeByte, Value: make([]byte, 1000)}}}
+	for _, tc := range []struct {
+		m       image.Image
+		opt     *Options
+		bigTIFF bool
+	}{
+		{small, nil, false},
+		{large, nil, true},
+		{small, xmp, true},
+	} {
+		out := new(bytes.Buffer)
+		e := newEncoder(out, maxSize)
+		if err := e.Encode(tc.m, tc.opt); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got := string(out.Bytes()[:4]) == leBigHeader; got != tc.bigTIFF {
+			t.Errorf("%v, %v: BigTIFF: got %t, want %t", tc.m.Bounds(), tc.opt != nil, got, tc.bigTIFF)
+		}
+		if _, err := Decode(bytes.NewReader(out.Bytes())); err != nil {
+			t.Errorf("%v, %v: Decode: %v", tc.m.Bounds(), tc.opt != nil, err)
+		}
+	}
+
+	// A classic file that has started cannot switch to BigTIFF, but the
+	// pages before the one that does not fit are still written.
+	for _, tc := range []struct {
+		m   image.Image
+		opt *Options
+	}{
+		{large, nil},
+		{small, xmp},
+	} {
+		out := new(bytes.Buffer)
+		e := newEncoder(out, maxSize)
+		if err := e.Encode(small, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Encode(tc.m, tc.opt); err != errTooLarge {
+			t.Errorf("%v, %v: second page: got %v, want %v", tc.m.Bounds(), tc.opt != nil, err, errTooLarge)
+		}
+		if err := e.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if n := int64(out.Len()); n > maxSize {
+			t.Errorf("%v, %v: got %d bytes, want at most %d", tc.m.Bounds(), tc.opt != nil, n, maxSize)
+		}
+		pages, err := DecodeAll(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pages) != 1 {
+			t.Fatalf("got %d pages, want 1", len(pages))
+		}
+		compare(t, small, pages[0].Image)
+	}
+}
+
+func TestTags(t *testing.T) {
+	tags := []Tag{
+		{ID: TagXResolution, Type: TypeRational, Value: []Rational{{300, 1}}},
+		{ID: TagYResolution, Type: TypeRational, Value: []Rational{{600, 2}}},
+		{ID: TagSoftware, Type: TypeASCII, Value: "tiff test"},
+		{ID: TagDateTime, Type: TypeASCII, Value: "2016:01:02 03:04:05"},
+		{ID: TagArtist, Type: TypeASCII, Value: "Gopher"},
+		{ID: 65000, Type: TypeUndefined, Value: []byte{1, 2, 3, 4, 5}},
+		{ID: 65001, Type: TypeSShort, Value: []int16{-1, 2}},
+		{ID: 65002, Type: TypeSRational, Value: []SRational{{-1, 3}}},
+		{ID: 65003, Type: TypeFloat, Value: []float32{1.5}},
+		{ID: 65004, Type: TypeDouble, Value: []float64{-2.25, 1e100}},
+		{ID: 65005, Type: TypeLong8, Value: []uint64{1 << 40}},
+	}
+	for _, bigTIFF := range []bool{false, true} {
+		m := image.NewGray(image.Rect(0, 0, 4, 3))
+		out := new(bytes.Buffer)
+		if err := Encode(out, m, &Options{Tags: tags, BigTIFF: bigTIFF}); err != nil {
+			t.Fatal(err)
+		}
+		ifds, err := DecodeIFDs(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ifd := ifds[0]
+		for _, want := range tags {
+			got := ifd.Tag(want.ID)
+			if got == nil {
+				t.Errorf("BigTIFF %t: tag %d is missing", bigTIFF, want.ID)
+				continue
+			}
+			if got.Type != want.Type || !reflect.DeepEqual(got.Value, want.Value) {
+				t.Errorf("BigTIFF %t: got %+v, want %+v", bigTIFF, *got, want)
+			}
+		}
+		if got := ifd.Tag(TagArtist).Count; got != 7 {
+			t.Errorf("BigTIFF %t: Artist count: got %d, want 7", bigTIFF, got)
+		}
+		if got := ifd.Tag(tImageWidth); got == nil || !reflect.DeepEqual(got.Value, []uint16{4}) {
+			t.Errorf("BigTIFF %t: ImageWidth: got %+v", bigTIFF, got)
+		}
+		if got := ifd.Tag(tResolutionUnit); got == nil || !reflect.DeepEqual(got.Value, []uint16{resPerInch}) {
+			t.Errorf("BigTIFF %t: ResolutionUnit: got %+v", bigTIFF, got)
+		}
+		if _, err := Decode(bytes.NewReader(out.Bytes())); err != nil {
+			t.Errorf("BigTIFF %t: Decode: %v", bigTIFF, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		desc string
+		tags []Tag
+	}{
+		{"mismatched type", []Tag{{ID: 65000, Type: TypeShort, Value: []uint32{1}}}},
+		{"no values", []Tag{{ID: 65000, Type: TypeShort, Value: []uint16{}}}},
+		{"duplicate", []Tag{
+			{ID: TagArtist, Type: TypeASCII, Value: "a"},
+			{ID: TagArtist, Type: TypeASCII, Value: "b"},
+		}},
+		{"encoder's tag", []Tag{{ID: tImageWidth, Type: TypeShort, Value: []uint16{1}}}},
+	} {
+		m := image.NewGray(image.Rect(0, 0, 1, 1))
+		if err := Encode(ioutil.Discard, m, &Options{Tags: tc.tags}); err == nil {
+			t.Errorf("%s: got nil error, want non-nil", tc.desc)
+		}
+	}
+}
+
+func TestEncodeCMYK(t *testing.T) {
+	m0 := image.NewCMYK(image.Rect(0, 0, 37, 21))
+	for i := range m0.Pix {
+		m0.Pix[i] = byte(3 * i)
+	}
+	for _, opts := range []*Options{
+		nil,
+		{Compression: Deflate},
+		{TileWidth: 16, TileHeight: 16},
+	} {
+		out := new(bytes.Buffer)
+		if err := Encode(out, m0, opts); err != nil {
+			t.Fatal(err)
+		}
+		m1, err := Decode(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := m1.(*image.CMYK); !ok {
+			t.Errorf("%+v: got %T, want *image.CMYK", opts, m1)
+			continue
+		}
+		compare(t, m0, m1)
+	}
+}
+
+func TestEncodePacked(t *testing.T) {
+	gray := color.Gray{0x80}
+	var palette16, palette17 color.Palette
+	for i := 0; i < 17; i++ {
+		c := color.RGBA{uint8(15 * i), uint8(255 - 15*i), uint8(i), 0xff}
+		if i < 16 {
+			palette16 = append(palette16, c)
+		}
+		palette17 = append(palette17, c)
+	}
+	for _, tc := range []struct {
+		palette     color.Palette
+		bits        uint
+		photometric uint
+	}{
+		{color.Palette{color.Black, color.White}, 1, pBlackIsZero},
+		{color.Palette{color.White, color.Black}, 1, pWhiteIsZero},
+		{color.Palette{color.Black, gray}, 4, pPaletted},
+		{color.Palette{color.Black, gray, color.White, color.RGBA{0xff, 0, 0, 0xff}, color.Opaque}, 4, pPaletted},
+		{palette16, 4, pPaletted},
+		{palette17, 8, pPaletted},
+	} {
+		m0 := image.NewPaletted(image.Rect(0, 0, 13, 7), tc.palette)
+		for i := range m0.Pix {
+			m0.Pix[i] = uint8(i*i) % uint8(len(tc.palette))
+		}
+		for _, opts := range []*Options{
+			nil,
+			{Compression: Deflate},
+			{Compression: PackBits},
+			{TileWidth: 16, TileHeight: 16},
+		} {
+			out := new(bytes.Buffer)
+			if err := Encode(out, m0, opts); err != nil {
+				t.Fatal(err)
+			}
+			pages, err := DecodeAll(bytes.NewReader(out.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ifd := pages[0].IFD
+			if got := tagUints(ifd, tBitsPerSample); !reflect.DeepEqual(got, []uint{tc.bits}) {
+				t.Errorf("%v, %+v: BitsPerSample: got %v, want %d", tc.palette, opts, got, tc.bits)
+			}
+			if got := tagUints(ifd, tPhotometricInterpretation); !reflect.DeepEqual(got, []uint{tc.photometric}) {
+				t.Errorf("%v, %+v: PhotometricInterpretation: got %v, want %d", tc.palette, opts, got, tc.photometric)
+			}
+			if opts == nil {
+				want := uint((13*tc.bits + 7) / 8 * 7)
+				if got := tagUints(ifd, tStripByteCounts); !reflect.DeepEqual(got, []uint{want}) {
+					t.Errorf("%v: StripByteCounts: got %v, want %d", tc.palette, got, want)
+				}
+			}
+
+			if tc.photometric != pPaletted {
+				// A bilevel image decodes as a gray one.
+				compare(t, m0, pages[0].Image)
+				if _, ok := pages[0].Image.(*image.Gray); !ok {
+					t.Errorf("%v, %+v: got %T, want *image.Gray", tc.palette, opts, pages[0].Image)
+				}
+				continue
+			}
+			m1, ok := pages[0].Image.(*image.Paletted)
+			if !ok {
+				t.Errorf("%v, %+v: got %T, want *image.Paletted", tc.palette, opts, pages[0].Image)
+				continue
+			}
+			if !reflect.DeepEqual(m1.Pix, m0.Pix) {
+				t.Errorf("%v, %+v: got different pixels", tc.palette, opts)
+			}
+			// The palette is padded to 16 or 256 colors.
+			if wantLen := 1 << tc.bits; len(m1.Palette) != wantLen {
+				t.Errorf("%v, %+v: got %d colors, want %d", tc.palette, opts, len(m1.Palette), wantLen)
+			}
+			for i, c := range tc.palette {
+				r0, g0, b0, a0 := c.RGBA()
+				r1, g1, b1, a1 := m1.Palette[i].RGBA()
+				if r0 != r1 || g0 != g1 || b0 != b1 || a0 != a1 {
+					t.Errorf("%v, %+v: color %d: got %v, want %v", tc.palette, opts, i, m1.Palette[i], c)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodePackBitsBilevel(t *testing.T) {
+	// A page of a fax or a scan, with long runs of white and black.
+	const w, h = 200, 40
+	for _, tc := range []struct {
+		palette     color.Palette
+		photometric uint
+	}{
+		{color.Palette{color.Black, color.White}, pBlackIsZero},
+		{color.Palette{color.White, color.Black}, pWhiteIsZero},
+	} {
+		m0 := image.NewPaletted(image.Rect(0, 0, w, h), tc.palette)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				if (x/40+y/8)%2 == 0 && x%40 < 30 {
+					m0.SetColorIndex(x, y, 1)
+				}
+			}
+		}
+		out := new(bytes.Buffer)
+		if err := Encode(out, m0, &Options{Compression: PackBits}); err != nil {
+			t.Fatal(err)
+		}
+		pages, err := DecodeAll(bytes.NewReader(out.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m1, ok := pages[0].Image.(*image.Gray)
+		if !ok {
+			t.Fatalf("%v: got %T, want *image.Gray", tc.palette, pages[0].Image)
+		}
+		compare(t, m0, m1)
+
+		ifd := pages[0].IFD
+		for _, tag := range []struct {
+			id   uint16
+			want uint
+		}{
+			{tCompression, cPackBits},
+			{tPhotometricInterpretation, tc.photometric},
+			{tBitsPerSample, 1},
+		} {
+			if got := tagUints(ifd, tag.id); !reflect.DeepEqual(got, []uint{tag.want}) {
+				t.Errorf("%v: tag %d: got %v, want %d", tc.palette, tag.id, got, tag.want)
+			}
+		}
+		var n uint
+		for _, c := range tagUints(ifd, tStripByteCounts) {
+			n += c
+		}
+		if packed := uint((w + 7) / 8 * h); n >= packed {
+			t.Errorf("%v: got %d bytes of strips, want fewer than %d", tc.palette, n, packed)
+		}
+	}
+}
+
+func TestEncodeSamples(t *testing.T) {
+	r := image.Rect(0, 0, 21, 18)
+	i16 := NewGrayInt16(r)
+	f32 := NewGrayFloat32(r)
+	f64 := NewGrayFloat64(r)
+	for i := range i16.Pix {
+		i16.Pix[i] = int16(i*37 - 1000)
+		f32.Pix[i] = float32(i)/4 - 10
+		f64.Pix[i] = -float64(i) * 1e10
+	}
+	f32.Pix[5] = float32(math.NaN())
+	f32.Pix[6] = float32(math.Inf(1))
+	for _, tc := range []struct {
+		m        image.Image
+		min, max float64
+	}{
+		{i16, -1000, -1000 + 37*(21*18-1)},
+		{f32, -10, float64(21*18-1)/4 - 10},
+		{f64, -1e10 * (21*18 - 1), 0},
+	} {
+		for _, opts := range []*Options{
+			nil,
+			{Compression: Deflate},
+			{TileWidth: 16, TileHeight: 16},
+		} {
+			out := new(bytes.Buffer)
+			if err := Encode(out, tc.m, opts); err != nil {
+				t.Fatal(err)
+			}
+			m, err := Decode(bytes.NewReader(out.Bytes()))
+			if err != nil {
+				t.Fatalf("%T %+v: %v", tc.m, opts, err)
+			}
+			var ok bool
+			var min, max float64
+			switch m := m.(type) {
+			case *GrayInt16:
+				ok = reflect.DeepEqual(m.Pix, i16.Pix)
+				min, max = m.Min, m.Max
+			case *GrayFloat32:
+				ok = bytes.Equal(floatBytes(m.Pix), floatBytes(f32.Pix))
+				min, max = m.Min, m.Max
+			case *GrayFloat64:
+				ok = reflect.DeepEqual(m.Pix, f64.Pix)
+				min, max = m.Min, m.Max
+			}
+			if fmt.Sprintf("%T", m) != fmt.Sprintf("%T", tc.m) || !ok {
+				t.Errorf("%T %+v: got a %T with different samples", tc.m, opts, m)
+			}
+			if min != tc.min || max != tc.max {
+				t.Errorf("%T %+v: range: got %v to %v, want %v to %v", tc.m, opts, min, max, tc.min, tc.max)
+			}
+		}
+	}
+}
+
+// floatBytes returns the bit patterns of the values in p, so that NaNs can be
+// compared.
+func floatBytes(p []float32) []byte {
+	var b []byte
+	for _, v := range p {
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(v))
+	}
+	return b
+}
+
 func TestUnsupported(t *testing.T) {
 	img := image.NewGray(image.Rect(0, 0, 1, 1))
 	out := new(bytes.Buffer)
@@ -0,0 +1,95 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vp8
+
+// This file implements concealing the damage to truncated inter frames.
+//
+// A truncated frame's partitions are cut short to the data that is present.
+// A macroblock whose modes, in the first partition, or whose residuals, in
+// its token partition, could not be read in full is damaged, as are all of
+// the macroblocks that follow it in the same partition. Each damaged
+// macroblock is predicted from the last frame, using the median of the
+// motion vectors of the macroblocks to its left, above and above-right, and
+// has no residuals.
+
+import (
+	"bytes"
+	"io"
+)
+
+// SetErrorConcealment sets whether DecodeFrame conceals the damage to inter
+// frames that are truncated, instead of returning an error. The concealed
+// macroblocks are reported by FrameStats, and the reference frame buffers
+// are updated with the concealed frame, so that the frames that follow can be
+// decoded. If the frame's headers are damaged, only the last frame buffer is
+// updated. Key frames, and inter frames that do not follow a key frame, are
+// never concealed.
+func (d *Decoder) SetErrorConcealment(conceal bool) {
+	d.concealErrors = conceal
+}
+
+// prepareConcealment reads the rest of the frame, which may be truncated, so
+// that its partitions can be cut short to the data that is present.
+func (d *Decoder) prepareConcealment() error {
+	buf := &bytes.Buffer{}
+	if _, err := buf.ReadFrom(io.LimitReader(d.r.r, int64(d.r.n))); err != nil {
+		return err
+	}
+	d.frameTruncated = buf.Len() < d.r.n
+	d.r = limitReader{buf, buf.Len()}
+
+	n := d.mbw * d.mbh
+	if cap(d.mbMVs) < n {
+		d.mbMVs = make([]motionVector, n)
+	}
+	d.mbMVs = d.mbMVs[:n]
+	return nil
+}
+
+// concealMB conceals a damaged macroblock.
+func (d *Decoder) concealMB(mbx, mby int) {
+	var left, above, aboveRight motionVector
+	if mbx > 0 {
+		left = d.mbMVs[d.mbw*mby+mbx-1]
+	}
+	if mby > 0 {
+		above = d.mbMVs[d.mbw*(mby-1)+mbx]
+		if mbx+1 < d.mbw {
+			aboveRight = d.mbMVs[d.mbw*(mby-1)+mbx+1]
+		}
+	}
+	mv := d.clampMV(motionVector{
+		x: median3(left.x, above.x, aboveRight.x),
+		y: median3(left.y, above.y, aboveRight.y),
+	}, mbx, mby)
+
+	d.usePredY16 = false
+	d.isInterMB = true
+	d.refFrame = refFrameLast
+	d.mvMode = mvModeNew
+	d.mbMV = mv
+	d.performInterPrediction(mbx, mby)
+	d.copyYBR(mbx, mby)
+	d.mbMVs[d.mbw*mby+mbx] = mv
+
+	// The macroblocks that follow are parsed as if this one had no non-zero
+	// coefficients.
+	d.leftMB.nzMask, d.leftMB.nzY16 = 0, 0
+	d.upMB[mbx].nzMask, d.upMB[mbx].nzY16 = 0, 0
+}
+
+// median3 returns the median of a, b and c.
+func median3(a, b, c int16) int16 {
+	if a > b {
+		a, b = b, a
+	}
+	if b > c {
+		b = c
+	}
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,231 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vp8
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// encodeIntraInterFrame returns an inter frame, with two token partitions,
+// whose macroblocks are all intra-predicted with DC prediction and have no
+// non-zero coefficients. If skip is set, the macroblocks are marked as
+// skipped, so that the token partitions are empty. tokenProb are the
+// decoder's token probabilities.
+func encodeIntraInterFrame(mbw, mbh int, skip bool, tokenProb *[nPlane][nBand][nContext][nProb]uint8) []byte {
+	var fp partitionWriter
+	fp.init()
+	fp.writeBit(false, uniformProb) // Segmentation.
+	fp.writeBit(false, uniformProb) // Simple filter.
+	fp.writeUint(uniformProb, 0, 6) // Loop filter level.
+	fp.writeUint(uniformProb, 0, 3) // Sharpness.
+	fp.writeBit(false, uniformProb) // Loop filter deltas.
+	fp.writeUint(uniformProb, 1, 2) // Two token partitions.
+	fp.writeUint(uniformProb, 40, 7)
+	for i := 0; i < 5; i++ {
+		fp.writeOptionalInt(uniformProb, 0, 4)
+	}
+	fp.writeBit(false, uniformProb) // Refresh golden.
+	fp.writeBit(false, uniformProb) // Refresh alternate reference.
+	fp.writeUint(uniformProb, 0, 2) // Copy to golden.
+	fp.writeUint(uniformProb, 0, 2) // Copy to alternate reference.
+	fp.writeBit(false, uniformProb) // Golden sign bias.
+	fp.writeBit(false, uniformProb) // Alternate reference sign bias.
+	fp.writeBit(true, uniformProb)  // Refresh last.
+	for i := range tokenProbUpdateProb {
+		for j := range tokenProbUpdateProb[i] {
+			for k := range tokenProbUpdateProb[i][j] {
+				for l := range tokenProbUpdateProb[i][j][k] {
+					fp.writeBit(false, tokenProbUpdateProb[i][j][k][l])
+				}
+			}
+		}
+	}
+	const skipProb = 1
+	fp.writeBit(skip, uniformProb) // Skip probability.
+	if skip {
+		fp.writeUint(uniformProb, skipProb, 8)
+	}
+	const probIntra = 1
+	fp.writeUint(uniformProb, probIntra, 8)
+	fp.writeUint(uniformProb, 128, 8) // Last reference frame probability.
+	fp.writeUint(uniformProb, 128, 8) // Golden reference frame probability.
+	for i := range mvUpdateProb {
+		for j := range mvUpdateProb[i] {
+			fp.writeBit(false, mvUpdateProb[i][j])
+		}
+	}
+
+	var ops [2]partitionWriter
+	ops[0].init()
+	ops[1].init()
+	for mby := 0; mby < mbh; mby++ {
+		op := &ops[mby&1]
+		for mbx := 0; mbx < mbw; mbx++ {
+			if skip {
+				fp.writeBit(true, skipProb)
+			}
+			fp.writeBit(true, probIntra)     // Intra.
+			fp.writeBit(false, 145)          // 16x16 prediction.
+			fp.writeBit(false, yModeProb[0]) // DC prediction.
+			fp.writeBit(false, uvModeProb[0])
+			if skip {
+				continue
+			}
+
+			op.writeBit(false, tokenProb[planeY2][0][0][0])
+			for i := 0; i < 16; i++ {
+				op.writeBit(false, tokenProb[planeY1WithY2][1][0][0])
+			}
+			for i := 0; i < 8; i++ {
+				op.writeBit(false, tokenProb[planeUV][0][0][0])
+			}
+		}
+	}
+
+	fpBuf, op0, op1 := fp.finish(), ops[0].finish(), ops[1].finish()
+	n := len(fpBuf)
+	b := []byte{uint8(n<<5) | 0x11, uint8(n >> 3), uint8(n >> 11)}
+	b = append(b, fpBuf...)
+	b = append(b, uint8(len(op0)), uint8(len(op0)>>8), uint8(len(op0)>>16))
+	b = append(b, op0...)
+	return append(b, op1...)
+}
+
+func TestErrorConcealment(t *testing.T) {
+	const w, h = 160, 128
+	const mbw, mbh = w / 16, h / 16
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{uint8(3 * x), uint8(x ^ y), uint8(4 * y), 0xff})
+		}
+	}
+	keyFrame := &bytes.Buffer{}
+	if err := Encode(keyFrame, m, nil); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	decode := func(d *Decoder, b []byte) (*image.YCbCr, error) {
+		d.Init(bytes.NewReader(b), len(b))
+		if _, err := d.DecodeFrameHeader(); err != nil {
+			return nil, err
+		}
+		return d.DecodeFrame()
+	}
+	newDecoder := func(concurrent bool) (*Decoder, *image.YCbCr) {
+		d := NewDecoder()
+		d.SetConcurrent(concurrent)
+		d.SetErrorConcealment(true)
+		last, err := decode(d, keyFrame.Bytes())
+		if err != nil {
+			t.Fatalf("key frame: %v", err)
+		}
+		return d, d.copyFrame(last)
+	}
+	mbEqual := func(a, b *image.YCbCr, mbx, mby int) bool {
+		for y := 16 * mby; y < 16*mby+16; y++ {
+			i, j := a.YOffset(16*mbx, y), b.YOffset(16*mbx, y)
+			if !bytes.Equal(a.Y[i:i+16], b.Y[j:j+16]) {
+				return false
+			}
+		}
+		for y := 16 * mby; y < 16*mby+16; y += 2 {
+			i, j := a.COffset(16*mbx, y), b.COffset(16*mbx, y)
+			if !bytes.Equal(a.Cb[i:i+8], b.Cb[j:j+8]) || !bytes.Equal(a.Cr[i:i+8], b.Cr[j:j+8]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	d, _ := newDecoder(false)
+	frame := encodeIntraInterFrame(mbw, mbh, false, &d.tokenProb)
+	skipFrame := encodeIntraInterFrame(mbw, mbh, true, &d.tokenProb)
+	intact, err := decode(d, frame)
+	if err != nil {
+		t.Fatalf("intact frame: %v", err)
+	}
+	if s := d.FrameStats(); s.ConcealedMBs != 0 || s.Concealed != nil || s.IntraMBs() != mbw*mbh {
+		t.Fatalf("intact frame: got %d concealed and %d intra macroblocks", s.ConcealedMBs, s.IntraMBs())
+	}
+	intact = d.copyFrame(intact)
+
+	fpLen := func(f []byte) int {
+		return int(f[0]>>5) | int(f[1])<<3 | int(f[2])<<11
+	}
+	n := fpLen(frame)
+	op0Len := int(frame[3+n]) | int(frame[3+n+1])<<8 | int(frame[3+n+2])<<16
+	for _, tc := range []struct {
+		desc      string
+		truncated []byte
+		// headers is whether the frame's headers are damaged.
+		headers bool
+	}{
+		{"headers", frame[:3+4], true},
+		// As the token partitions follow the first partition, only skipped
+		// macroblocks are intact.
+		{"first partition", skipFrame[:3+fpLen(skipFrame)-8], false},
+		{"token partitions", frame[:3+n+3+op0Len/2], false},
+	} {
+		truncated := tc.truncated
+		if _, err := decode(NewDecoder(), truncated); err == nil {
+			t.Errorf("%s: without concealment: got nil error, want non-nil", tc.desc)
+		}
+		var serial *image.YCbCr
+		for _, concurrent := range []bool{false, true} {
+			d, last := newDecoder(concurrent)
+			got, err := decode(d, truncated)
+			if err != nil {
+				t.Errorf("%s, concurrent=%t: %v", tc.desc, concurrent, err)
+				continue
+			}
+			s := d.FrameStats()
+			if s.ConcealedMBs == 0 || len(s.Concealed) != mbw*mbh {
+				t.Errorf("%s, concurrent=%t: got %d concealed macroblocks", tc.desc, concurrent, s.ConcealedMBs)
+				continue
+			}
+			if all := s.ConcealedMBs == mbw*mbh; all != tc.headers {
+				t.Errorf("%s, concurrent=%t: got %d concealed macroblocks, want all=%t", tc.desc, concurrent, s.ConcealedMBs, tc.headers)
+			}
+			// The intact macroblocks are only checked up until the first
+			// concealed one, as those that follow may be predicted from it.
+			n, checkIntact := 0, true
+			for mby := 0; mby < mbh; mby++ {
+				for mbx := 0; mbx < mbw; mbx++ {
+					want := intact
+					if s.Concealed[mbw*mby+mbx] {
+						want, checkIntact = last, false
+						n++
+					} else if !checkIntact {
+						continue
+					}
+					if !mbEqual(got, want, mbx, mby) {
+						t.Errorf("%s, concurrent=%t: macroblock (%d, %d) differs", tc.desc, concurrent, mbx, mby)
+					}
+				}
+			}
+			if n != s.ConcealedMBs {
+				t.Errorf("%s, concurrent=%t: Concealed has %d macroblocks, ConcealedMBs is %d", tc.desc, concurrent, n, s.ConcealedMBs)
+			}
+			if !bytes.Equal(d.lastFrame.Y, got.Y) {
+				t.Errorf("%s, concurrent=%t: last frame buffer was not refreshed", tc.desc, concurrent)
+			}
+			if concurrent && !bytes.Equal(got.Y, serial.Y) {
+				t.Errorf("%s: concurrent and serial decoding differ", tc.desc)
+			}
+			serial = d.copyFrame(got)
+
+			// Decoding continues with the next frame.
+			if _, err := decode(d, frame); err != nil {
+				t.Errorf("%s, concurrent=%t: next frame: %v", tc.desc, concurrent, err)
+			} else if d.FrameStats().ConcealedMBs != 0 {
+				t.Errorf("%s, concurrent=%t: next frame was concealed", tc.desc, concurrent)
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vp8
+
+// This file implements decoding the macroblocks of a frame concurrently.
+//
+// The prediction modes of every macroblock are held by the first partition,
+// and are parsed up front. The residuals of each row of macroblocks are held
+// by one of the nOP token partitions, in turn, so each partition's rows are
+// decoded by a separate goroutine. A macroblock's intra prediction depends on
+// the reconstructed, but not yet loop filtered, pixels of the macroblocks to
+// its left, above and above-right, so each row stays at least two
+// macroblocks behind the row above it: a wavefront.
+//
+// Loop filtering a row modifies the pixels of that row and the bottom pixels
+// of the row above, so the rows are filtered in order, and each row is
+// filtered once the row below it has been reconstructed. This gives the same
+// pixels as filtering the whole frame after reconstructing it.
+
+import (
+	"sync"
+)
+
+// SetConcurrent sets whether DecodeFrame decodes concurrently, using one
+// goroutine for each of the frame's token partitions and pipelining the loop
+// filter with reconstruction. The decoded frames are the same either way.
+// Frames with a single token partition, which is the most common layout,
+// only gain from the loop filter running alongside reconstruction.
+func (d *Decoder) SetConcurrent(concurrent bool) {
+	d.concurrent = concurrent
+}
+
+// wavefront tracks the progress of reconstructing each row of macroblocks.
+type wavefront struct {
+	mu   sync.Mutex
+	cond sync.Cond
+	// done holds the number of reconstructed macroblocks of each row.
+	done []int
+}
+
+// wait waits until at least n macroblocks of the mby'th row are
+// reconstructed.
+func (w *wavefront) wait(mby, n int) {
+	w.mu.Lock()
+	for w.done[mby] < n {
+		w.cond.Wait()
+	}
+	w.mu.Unlock()
+}
+
+// advance records that one more macroblock of the mby'th row is
+// reconstructed.
+func (w *wavefront) advance(mby int) {
+	w.mu.Lock()
+	w.done[mby]++
+	w.mu.Unlock()
+	w.cond.Broadcast()
+}
+
+// decodeMBsConcurrently parses and reconstructs the macroblocks, and applies
+// the loop filter, concurrently.
+func (d *Decoder) decodeMBsConcurrently() {
+	n := d.mbw * d.mbh
+	if cap(d.modes) < n {
+		d.modes = make([]mbModes, n)
+	}
+	d.modes = d.modes[:n]
+
+	// Parse the modes. The macroblocks' upMB and leftMB pred fields are only
+	// used here, and their nzMask and nzY16 fields only by the workers below.
+	d.resetContexts()
+	for mby := 0; mby < d.mbh; mby++ {
+		d.resetLeftContexts()
+		for mbx := 0; mbx < d.mbw; mbx++ {
+			d.parseModes(mbx, mby)
+			d.damaged = d.fpTruncated && d.fp.unexpectedEOF
+			d.recordMBStats(mbx, mby)
+			d.modes[d.mbw*mby+mbx] = d.mbModes
+		}
+	}
+
+	wf := &wavefront{done: make([]int, d.mbh)}
+	wf.cond.L = &wf.mu
+
+	// Each worker is a shallow copy of d, with its own workspace and its own
+	// copy of its token partition's state. The img, upMB, perMBFilterParams
+	// and mbMVs slices are shared, and the wavefront orders their accesses.
+	nWorker := d.nOP
+	if nWorker > d.mbh {
+		nWorker = d.mbh
+	}
+	workers := make([]Decoder, nWorker)
+	var wg sync.WaitGroup
+	for i := range workers {
+		workers[i] = *d
+		workers[i].stats = FrameStats{Concealed: d.stats.Concealed}
+		wg.Add(1)
+		go func(w *Decoder, first int) {
+			defer wg.Done()
+			for mby := first; mby < w.mbh; mby += w.nOP {
+				w.leftMB = mb{}
+				for mbx := 0; mbx < w.mbw; mbx++ {
+					if mby > 0 {
+						above := mbx + 2
+						if above > w.mbw {
+							above = w.mbw
+						}
+						wf.wait(mby-1, above)
+					}
+					w.mbModes = w.modes[w.mbw*mby+mbx]
+					w.decodeMB(mbx, mby)
+					wf.advance(mby)
+				}
+			}
+		}(&workers[i], i)
+	}
+
+	// Filter each row once the row below it is reconstructed.
+	for mby := 0; mby < d.mbh; mby++ {
+		if d.filterHeader.level != 0 {
+			if mby+1 < d.mbh {
+				wf.wait(mby+1, d.mbw)
+			} else {
+				wf.wait(mby, d.mbw)
+			}
+			d.filterRow(mby)
+		} else if d.progress != nil {
+			wf.wait(mby, d.mbw)
+		}
+		d.reportProgress(mby + 1)
+	}
+	wg.Wait()
+
+	for i := range workers {
+		d.op[i] = workers[i].op[i]
+		d.stats.SkippedMBs += workers[i].stats.SkippedMBs
+		d.stats.ConcealedMBs += workers[i].stats.ConcealedMBs
+	}
+}
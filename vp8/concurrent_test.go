@@ -0,0 +1,259 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vp8
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeConcurrent(t *testing.T) {
+	serial, concurrent := NewDecoder(), NewDecoder()
+	concurrent.SetConcurrent(true)
+	decode := func(d *Decoder, b []byte) (*image.YCbCr, *FrameStats, error) {
+		d.Init(bytes.NewReader(b), len(b))
+		if _, err := d.DecodeFrameHeader(); err != nil {
+			return nil, nil, err
+		}
+		m, err := d.DecodeFrame()
+		if err != nil {
+			return nil, nil, err
+		}
+		return m, d.FrameStats(), nil
+	}
+
+	for _, tc := range []struct {
+		w, h, nOP, quality int
+		// partitions is the number of partitions that are used, which is
+		// nOP rounded up to a power of two, at most 8.
+		partitions int
+	}{
+		{16, 16, 1, 75, 1},
+		{100, 60, 1, 75, 1},
+		{100, 60, 2, 20, 2},
+		{100, 60, 3, 60, 4},
+		{100, 60, 4, 90, 4},
+		{100, 60, 8, 50, 8},
+		{37, 130, 8, 5, 8},
+		{130, 37, 8, 75, 8},
+		{130, 37, 9, 75, 8},
+	} {
+		name := fmt.Sprintf("%dx%d, %d partitions, quality %d", tc.w, tc.h, tc.nOP, tc.quality)
+		m := image.NewNRGBA(image.Rect(0, 0, tc.w, tc.h))
+		for y := 0; y < tc.h; y++ {
+			for x := 0; x < tc.w; x++ {
+				m.SetNRGBA(x, y, color.NRGBA{uint8(x*x + y), uint8(7*x ^ 3*y), uint8(x * y), 0xff})
+			}
+		}
+		// Flat regions give macroblocks without non-zero coefficients.
+		for y := tc.h / 2; y < tc.h; y++ {
+			for x := 0; x < tc.w/2; x++ {
+				m.SetNRGBA(x, y, color.NRGBA{0x40, 0x80, 0xc0, 0xff})
+			}
+		}
+		buf := &bytes.Buffer{}
+		if err := Encode(buf, m, &Options{Quality: tc.quality, minPartitions: tc.nOP}); err != nil {
+			t.Errorf("%s: Encode: %v", name, err)
+			continue
+		}
+		if got := len(partitionSizes(t, buf.Bytes())); got != tc.partitions {
+			t.Errorf("%s: got %d partitions, want %d", name, got, tc.partitions)
+			continue
+		}
+
+		want, wantStats, err := decode(serial, buf.Bytes())
+		if err != nil {
+			t.Errorf("%s: serial: %v", name, err)
+			continue
+		}
+		got, gotStats, err := decode(concurrent, buf.Bytes())
+		if err != nil {
+			t.Errorf("%s: concurrent: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got.Y, want.Y) || !bytes.Equal(got.Cb, want.Cb) || !bytes.Equal(got.Cr, want.Cr) {
+			t.Errorf("%s: pixels differ", name)
+		}
+		if !reflect.DeepEqual(gotStats, wantStats) {
+			t.Errorf("%s: stats: got %+v, want %+v", name, gotStats, wantStats)
+		}
+		if wantStats.FilterLevel[0] == 0 {
+			t.Errorf("%s: loop filter is disabled", name)
+		}
+	}
+}
+
+// partitionSizes returns the sizes of an encoded frame's token partitions.
+func partitionSizes(t *testing.T, b []byte) []int {
+	d := NewDecoder()
+	d.Init(bytes.NewReader(b), len(b))
+	if _, err := d.DecodeFrameHeader(); err != nil {
+		t.Fatalf("DecodeFrameHeader: %v", err)
+	}
+	if _, err := d.DecodeFrame(); err != nil {
+		t.Fatalf("DecodeFrame: %v", err)
+	}
+	return d.FrameStats().PartitionSizes
+}
+
+// encodeRandomInterFrame returns an inter frame with nOP token partitions,
+// whose modes and coefficients are random. After the frame header, the
+// first partition holds random bits, which a decoder reads as macroblock
+// modes, motion vectors and reference frames distributed by the header's
+// probabilities, and the token partitions hold random bytes. The header
+// refreshes the last frame, unless keepLast is set, and the golden and
+// alternate reference frames if refreshGolden and refreshAltRef are set.
+// signBias sets the golden and alternate reference frames' sign bias.
+func encodeRandomInterFrame(rnd *rand.Rand, mbw, mbh, nOP int, refreshGolden, refreshAltRef, signBias, keepLast bool) []byte {
+	var fp partitionWriter
+	fp.init()
+	fp.writeBit(false, uniformProb)  // Segmentation.
+	fp.writeBit(false, uniformProb)  // Simple filter.
+	fp.writeUint(uniformProb, 20, 6) // Loop filter level.
+	fp.writeUint(uniformProb, 0, 3)  // Sharpness.
+	fp.writeBit(false, uniformProb)  // Loop filter deltas.
+	log2NOP := uint32(0)
+	for 1<<log2NOP < nOP {
+		log2NOP++
+	}
+	fp.writeUint(uniformProb, log2NOP, 2) // Number of token partitions.
+	fp.writeUint(uniformProb, 40, 7)
+	for i := 0; i < 5; i++ {
+		fp.writeOptionalInt(uniformProb, 0, 4)
+	}
+	fp.writeBit(refreshGolden, uniformProb)
+	fp.writeBit(refreshAltRef, uniformProb)
+	if !refreshGolden {
+		fp.writeUint(uniformProb, 0, 2) // Copy to golden.
+	}
+	if !refreshAltRef {
+		fp.writeUint(uniformProb, 0, 2) // Copy to alternate reference.
+	}
+	fp.writeBit(signBias, uniformProb) // Golden sign bias.
+	fp.writeBit(signBias, uniformProb) // Alternate reference sign bias.
+	fp.writeBit(!keepLast, uniformProb)
+	for i := range tokenProbUpdateProb {
+		for j := range tokenProbUpdateProb[i] {
+			for k := range tokenProbUpdateProb[i][j] {
+				for l := range tokenProbUpdateProb[i][j][k] {
+					fp.writeBit(false, tokenProbUpdateProb[i][j][k][l])
+				}
+			}
+		}
+	}
+	fp.writeBit(true, uniformProb) // Skip probability.
+	fp.writeUint(uniformProb, 200, 8)
+	fp.writeUint(uniformProb, 220, 8) // Intra probability, giving few intra macroblocks.
+	fp.writeUint(uniformProb, 128, 8) // Last reference frame probability.
+	fp.writeUint(uniformProb, 128, 8) // Golden reference frame probability.
+	for i := range mvUpdateProb {
+		for j := range mvUpdateProb[i] {
+			fp.writeBit(false, mvUpdateProb[i][j])
+		}
+	}
+	for i := 0; i < 256*mbw*mbh; i++ {
+		fp.writeBit(rnd.Intn(2) == 0, uniformProb)
+	}
+
+	fpBuf := fp.finish()
+	n := len(fpBuf)
+	b := []byte{uint8(n<<5) | 0x11, uint8(n >> 3), uint8(n >> 11)}
+	b = append(b, fpBuf...)
+	ops := make([][]byte, nOP)
+	for i := range ops {
+		ops[i] = make([]byte, 64*mbw*mbh/nOP+1)
+		rnd.Read(ops[i])
+		if i < nOP-1 {
+			b = append(b, uint8(len(ops[i])), uint8(len(ops[i])>>8), uint8(len(ops[i])>>16))
+		}
+	}
+	for _, op := range ops {
+		b = append(b, op...)
+	}
+	return b
+}
+
+func TestDecodeConcurrentInterFrames(t *testing.T) {
+	const w, h = 120, 90
+	const mbw, mbh = (w + 15) / 16, (h + 15) / 16
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{uint8(x*x + y), uint8(7*x ^ 3*y), uint8(x * y), 0xff})
+		}
+	}
+	keyFrame := &bytes.Buffer{}
+	if err := Encode(keyFrame, m, nil); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	decode := func(d *Decoder, b []byte) (*image.YCbCr, error) {
+		d.Init(bytes.NewReader(b), len(b))
+		if _, err := d.DecodeFrameHeader(); err != nil {
+			return nil, err
+		}
+		return d.DecodeFrame()
+	}
+
+	for _, nOP := range []int{2, 4, 8} {
+		rnd := rand.New(rand.NewSource(int64(nOP)))
+		frames := [][]byte{keyFrame.Bytes()}
+		for _, f := range []struct{ golden, altRef, signBias, keepLast bool }{
+			{false, false, false, false},
+			{true, false, false, false},
+			{false, true, true, false},
+			{false, false, false, true},
+			{false, false, true, false},
+			{true, true, false, false},
+			{false, false, false, false},
+		} {
+			frames = append(frames, encodeRandomInterFrame(rnd, mbw, mbh, nOP, f.golden, f.altRef, f.signBias, f.keepLast))
+		}
+
+		serial, concurrent := NewDecoder(), NewDecoder()
+		concurrent.SetConcurrent(true)
+		var interModes [5]int
+		var refFrames [3]int
+		for i, frame := range frames {
+			want, err := decode(serial, frame)
+			if err != nil {
+				t.Fatalf("%d partitions, frame %d: serial: %v", nOP, i, err)
+			}
+			got, err := decode(concurrent, frame)
+			if err != nil {
+				t.Fatalf("%d partitions, frame %d: concurrent: %v", nOP, i, err)
+			}
+			if !bytes.Equal(got.Y, want.Y) || !bytes.Equal(got.Cb, want.Cb) || !bytes.Equal(got.Cr, want.Cr) {
+				t.Errorf("%d partitions, frame %d: pixels differ", nOP, i)
+			}
+			gotStats, wantStats := concurrent.FrameStats(), serial.FrameStats()
+			if !reflect.DeepEqual(gotStats, wantStats) {
+				t.Errorf("%d partitions, frame %d: stats: got %+v, want %+v", nOP, i, gotStats, wantStats)
+			}
+			if i > 0 && len(wantStats.PartitionSizes) != nOP {
+				t.Errorf("%d partitions, frame %d: got %d partitions", nOP, i, len(wantStats.PartitionSizes))
+			}
+			for j, n := range wantStats.InterModes {
+				interModes[j] += n
+			}
+			for j, n := range wantStats.RefFrames {
+				refFrames[j] += n
+			}
+		}
+		// The frames use new and split motion vectors, and each of the
+		// reference frames.
+		if interModes[3] == 0 || interModes[4] == 0 {
+			t.Errorf("%d partitions: got inter modes %v", nOP, interModes)
+		}
+		if refFrames[0] == 0 || refFrames[1] == 0 || refFrames[2] == 0 {
+			t.Errorf("%d partitions: got reference frames %v", nOP, refFrames)
+		}
+	}
+}
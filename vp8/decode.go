@@ -2,7 +2,8 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Package vp8 implements a decoder for the VP8 lossy image format.
+// Package vp8 implements a decoder and a key frame encoder for the VP8 lossy
+// image format.
 //
 // The VP8 specification is RFC 6386.
 package vp8 // import "golang.org/x/image/vp8"
@@ -31,6 +32,19 @@ func (r *limitReader) ReadFull(p []byte) error {
 	return err
 }
 
+// Read reads up to len(p) bytes into p.
+func (r *limitReader) Read(p []byte) (int, error) {
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	if len(p) == 0 {
+		return 0, io.EOF
+	}
+	n, err := r.r.Read(p)
+	r.n -= n
+	return n, err
+}
+
 // FrameHeader is a frame header, as specified in section 9.1.
 type FrameHeader struct {
 	KeyFrame          bool
@@ -128,21 +142,16 @@ type Decoder struct {
 	filterParams      [nSegment][2]filterParam
 	perMBFilterParams []filterParam
 
-	// The eight fields below relate to the current macroblock being decoded.
+	// The fields below relate to the current macroblock being decoded.
 	//
-	// Segment-based adjustments.
-	segment int
+	// Its segment, skip flag and prediction modes.
+	mbModes
 	// Per-macroblock state for the macroblock immediately left of and those
 	// macroblocks immediately above the current macroblock.
 	leftMB mb
 	upMB   []mb
 	// Bitmasks for which 4x4 regions of coeff contain non-zero coefficients.
 	nzDCMask, nzACMask uint32
-	// Predictor modes.
-	usePredY16 bool // The libwebp C code calls this !is_i4x4_.
-	predY16    uint8
-	predC8     uint8
-	predY4     [4][4]uint8
 
 	// The two fields below form a workspace for reconstructing a macroblock.
 	// Their specific sizes are documented in reconstruct.go.
@@ -166,13 +175,6 @@ type Decoder struct {
 	// Motion vector probability table (RFC 6386 Section 17).
 	mvProb [2][19]uint8
 
-	// Per-macroblock inter prediction state.
-	isInterMB bool          // Whether the current macroblock uses inter prediction.
-	refFrame  uint8         // Reference frame for current macroblock.
-	mvMode    uint8         // Motion vector mode for current macroblock.
-	mbMV      motionVector  // Motion vector for the current macroblock (16x16 mode).
-	subMV     [16]motionVector // Motion vectors for 4x4 sub-blocks (SPLITMV mode).
-
 	// Motion vectors from neighboring macroblocks for prediction.
 	leftMV  motionVector // MV of the macroblock to the left.
 	aboveMV motionVector // MV of the macroblock above.
@@ -182,11 +184,57 @@ type Decoder struct {
 	upRefFrame    []uint8 // Reference frames of macroblocks above.
 	upMV          []motionVector // Motion vectors of macroblocks above (reusing the name would conflict).
 
-	// Debug counters for MV modes.
-	MVModeCount [6]int
-	// Debug counters for MB types.
-	IntraMBCount int
-	InterMBCount int
+	// stats are the statistics about the frame being decoded.
+	stats FrameStats
+
+	// concurrent is whether DecodeFrame decodes concurrently, and modes holds
+	// each macroblock's modes, in raster order, when it does.
+	concurrent bool
+	modes      []mbModes
+
+	// progress, if non-nil, is called as rows of the frame are decoded, and
+	// moreBuf holds the bytes of the last partition that are read as it is
+	// decoded, when it is.
+	progress func(m *image.YCbCr, rows int)
+	moreBuf  []byte
+
+	// concealErrors is whether DecodeFrame conceals the damage to truncated
+	// inter frames, and concealing is whether it does so for the frame being
+	// decoded. frameTruncated, fpTruncated and opTruncated are whether that
+	// frame, its first partition and its other partitions are truncated.
+	concealErrors  bool
+	concealing     bool
+	frameTruncated bool
+	fpTruncated    bool
+	opTruncated    [8]bool
+	// mbMVs holds each macroblock's motion vector, in raster order, when
+	// concealing. Intra-predicted macroblocks have a zero motion vector.
+	mbMVs []motionVector
+}
+
+// mbModes holds the values of a macroblock that are parsed from the first
+// partition.
+type mbModes struct {
+	// Segment-based adjustments.
+	segment int
+	// skip is whether the macroblock has no non-zero coefficients, as
+	// signaled by the skip flag.
+	skip bool
+	// damaged is whether the macroblock's modes or residuals are lost to
+	// truncation, so that it is concealed.
+	damaged bool
+	// Predictor modes.
+	usePredY16 bool // The libwebp C code calls this !is_i4x4_.
+	predY16    uint8
+	predC8     uint8
+	predY4     [4][4]uint8
+
+	// Inter prediction state.
+	isInterMB bool             // Whether the macroblock uses inter prediction.
+	refFrame  uint8            // Reference frame for the macroblock.
+	mvMode    uint8            // Motion vector mode for the macroblock.
+	mbMV      motionVector     // Motion vector for the macroblock (16x16 mode).
+	subMV     [16]motionVector // Motion vectors for 4x4 sub-blocks (SPLITMV mode).
 }
 
 // NewDecoder returns a new Decoder.
@@ -289,6 +337,8 @@ func (d *Decoder) parseFilterHeader() {
 	d.filterHeader.simple = d.fp.readBit(uniformProb)
 	d.filterHeader.level = int8(d.fp.readUint(uniformProb, 6))
 	d.filterHeader.sharpness = uint8(d.fp.readUint(uniformProb, 3))
+	d.stats.SimpleFilter = d.filterHeader.simple
+	d.stats.FilterSharpness = int(d.filterHeader.sharpness)
 	d.filterHeader.useLFDelta = d.fp.readBit(uniformProb)
 	if d.filterHeader.useLFDelta && d.fp.readBit(uniformProb) {
 		for i := range d.filterHeader.refLFDelta {
@@ -312,6 +362,13 @@ func (d *Decoder) parseFilterHeader() {
 	} else {
 		d.filterHeader.perSegmentLevel[0] = d.filterHeader.level
 	}
+	for i := range d.stats.FilterLevel {
+		level := d.filterHeader.perSegmentLevel[0]
+		if d.segmentHeader.useSegment {
+			level = d.filterHeader.perSegmentLevel[i]
+		}
+		d.stats.FilterLevel[i] = int(clip(int32(level), 0, 63))
+	}
 	d.computeFilterParams()
 }
 
@@ -321,13 +378,26 @@ func (d *Decoder) parseOtherPartitions() error {
 	var partLens [maxNOP]int
 	d.nOP = 1 << d.fp.readUint(uniformProb, 2)
 
+	// When concealing, truncated is the index of the first partition that is
+	// truncated, or d.nOP if none are.
+	truncated := d.nOP
+	if d.fpTruncated {
+		truncated = 0
+	} else if d.frameTruncated {
+		truncated = d.nOP - 1
+	}
+
 	// The final partition length is implied by the remaining chunk data
 	// (d.r.n) and the other d.nOP-1 partition lengths. Those d.nOP-1 partition
 	// lengths are stored as 24-bit uints, i.e. up to 16 MiB per partition.
 	n := 3 * (d.nOP - 1)
 	partLens[d.nOP-1] = d.r.n - n
 	if partLens[d.nOP-1] < 0 {
-		return io.ErrUnexpectedEOF
+		if !d.concealing {
+			return io.ErrUnexpectedEOF
+		}
+		// The partition lengths are truncated, so every partition is lost.
+		n, partLens[d.nOP-1], truncated = 0, 0, 0
 	}
 	if n > 0 {
 		buf := make([]byte, n)
@@ -337,12 +407,21 @@ func (d *Decoder) parseOtherPartitions() error {
 		for i := 0; i < d.nOP-1; i++ {
 			pl := int(buf[3*i+0]) | int(buf[3*i+1])<<8 | int(buf[3*i+2])<<16
 			if pl > partLens[d.nOP-1] {
-				return io.ErrUnexpectedEOF
+				if !d.concealing {
+					return io.ErrUnexpectedEOF
+				}
+				pl = partLens[d.nOP-1]
+				if truncated > i {
+					truncated = i
+				}
 			}
 			partLens[i] = pl
 			partLens[d.nOP-1] -= pl
 		}
 	}
+	for i := truncated; i < d.nOP; i++ {
+		d.opTruncated[i] = true
+	}
 
 	// We check if the final partition length can also fit into a 24-bit uint.
 	// Strictly speaking, this isn't part of the spec, but it guards against a
@@ -353,7 +432,17 @@ func (d *Decoder) parseOtherPartitions() error {
 		return errors.New("vp8: too much data to decode")
 	}
 
-	buf := make([]byte, d.r.n)
+	// When reporting progress, the last partition, which follows the others,
+	// is read as it is decoded, so that the frame can be decoded while its
+	// data is still arriving.
+	n = d.r.n
+	if d.progress != nil {
+		n -= partLens[d.nOP-1]
+		if d.moreBuf == nil {
+			d.moreBuf = make([]byte, 4096)
+		}
+	}
+	buf := make([]byte, n)
 	if err := d.r.ReadFull(buf); err != nil {
 		return err
 	}
@@ -361,16 +450,46 @@ func (d *Decoder) parseOtherPartitions() error {
 		if i == d.nOP {
 			break
 		}
-		d.op[i].init(buf[:pl])
-		buf = buf[pl:]
+		if i == d.nOP-1 && d.progress != nil {
+			d.op[i].init(nil)
+			d.op[i].more = d.readMore
+		} else {
+			d.op[i].init(buf[:pl])
+			buf = buf[pl:]
+		}
+		d.stats.PartitionSizes = append(d.stats.PartitionSizes, pl)
 	}
 	return nil
 }
 
+// readMore returns the next bytes of the last partition, or nil at its end.
+func (d *Decoder) readMore() []byte {
+	for {
+		n, err := d.r.Read(d.moreBuf)
+		if n > 0 {
+			return d.moreBuf[:n]
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
 // parseOtherHeaders parses header information other than the frame header.
 func (d *Decoder) parseOtherHeaders() error {
+	d.concealing = d.concealErrors && !d.frameHeader.KeyFrame && d.lastFrame != nil
+	d.frameTruncated, d.fpTruncated, d.opTruncated = false, false, [8]bool{}
+	if d.concealing {
+		if err := d.prepareConcealment(); err != nil {
+			return err
+		}
+	}
 	// Initialize and parse the first partition.
-	firstPartition := make([]byte, d.frameHeader.FirstPartitionLen)
+	n := int(d.frameHeader.FirstPartitionLen)
+	if d.concealing && n > d.r.n {
+		n, d.fpTruncated = d.r.n, true
+	}
+	firstPartition := make([]byte, n)
 	if err := d.r.ReadFull(firstPartition); err != nil {
 		return err
 	}
@@ -430,6 +549,12 @@ func (d *Decoder) parseOtherHeaders() error {
 	if !d.frameHeader.KeyFrame {
 		d.parseMVProb()
 	}
+	if d.fpTruncated && d.fp.unexpectedEOF {
+		// The headers are damaged, so every macroblock is concealed, and only
+		// the last frame buffer is refreshed.
+		d.refreshGolden, d.refreshAltRef, d.refreshLast = false, false, true
+		d.copyToGolden, d.copyToAltRef = 0, 0
+	}
 	// Note: We do not check fp.unexpectedEOF here because VP8's arithmetic
 	// coder is designed to return 0 when reading beyond the buffer end.
 	// This is normal behavior for entropy-coded data where updates are
@@ -513,14 +638,9 @@ func (d *Decoder) getRefFrame(refType uint8) *image.YCbCr {
 	}
 }
 
-// DecodeFrame decodes the frame and returns it as an YCbCr image.
-// The image's contents are valid up until the next call to Decoder.Init.
-func (d *Decoder) DecodeFrame() (*image.YCbCr, error) {
-	d.ensureImg()
-	if err := d.parseOtherHeaders(); err != nil {
-		return nil, err
-	}
-	// Reconstruct the rows.
+// resetContexts resets the per-macroblock state for the macroblocks above the
+// first row.
+func (d *Decoder) resetContexts() {
 	for mbx := 0; mbx < d.mbw; mbx++ {
 		d.upMB[mbx] = mb{}
 		// Initialize inter prediction state for non-keyframes.
@@ -529,25 +649,92 @@ func (d *Decoder) DecodeFrame() (*image.YCbCr, error) {
 			d.upMV[mbx] = mvZero
 		}
 	}
+}
+
+// resetLeftContexts resets the per-macroblock state for the macroblock left
+// of a row's first macroblock.
+func (d *Decoder) resetLeftContexts() {
+	d.leftMB = mb{}
+	// Initialize left MB inter prediction state.
+	if !d.frameHeader.KeyFrame {
+		d.leftRefFrame = refFrameIntra
+		d.leftMV = mvZero
+	}
+}
+
+// decodeMBs parses and reconstructs the macroblocks, one at a time, and
+// applies the loop filter to each row once the row below it is reconstructed.
+func (d *Decoder) decodeMBs() {
+	// Even if we are using per-segment levels, section 15 says that "loop
+	// filtering must be skipped entirely if loop_filter_level at either the
+	// frame header level or macroblock override level is 0".
+	filter := d.filterHeader.level != 0
+	d.resetContexts()
 	for mby := 0; mby < d.mbh; mby++ {
-		d.leftMB = mb{}
-		// Initialize left MB inter prediction state.
-		if !d.frameHeader.KeyFrame {
-			d.leftRefFrame = refFrameIntra
-			d.leftMV = mvZero
-		}
+		d.resetLeftContexts()
 		for mbx := 0; mbx < d.mbw; mbx++ {
-			// Set above ref frame for current MB.
-			if !d.frameHeader.KeyFrame && mby > 0 {
-				d.aboveRefFrame = d.upRefFrame[mbx]
-				d.aboveMV = d.upMV[mbx]
+			d.parseModes(mbx, mby)
+			d.damaged = d.fpTruncated && d.fp.unexpectedEOF
+			d.recordMBStats(mbx, mby)
+			d.decodeMB(mbx, mby)
+		}
+		if !filter {
+			d.reportProgress(mby + 1)
+		} else if mby > 0 {
+			d.filterRow(mby - 1)
+			d.reportProgress(mby)
+		}
+	}
+	if filter {
+		d.filterRow(d.mbh - 1)
+		d.reportProgress(d.mbh)
+	}
+}
+
+// decodeMB reconstructs, or conceals, the macroblock whose modes are
+// d.mbModes, and computes its loop filter parameters.
+func (d *Decoder) decodeMB(mbx, mby int) {
+	skip := false
+	if !d.damaged {
+		skip = d.reconstruct(mbx, mby)
+		p := mby & (d.nOP - 1)
+		d.damaged = !d.skip && d.opTruncated[p] && d.op[p].unexpectedEOF
+	}
+	if d.damaged {
+		d.concealMB(mbx, mby)
+		skip = true
+		d.stats.Concealed[d.mbw*mby+mbx] = true
+		d.stats.ConcealedMBs++
+	} else {
+		if skip {
+			d.stats.SkippedMBs++
+		}
+		if d.concealing {
+			mv := mvZero
+			if d.isInterMB {
+				mv = d.mbMV
 			}
-			skip := d.reconstruct(mbx, mby)
-			fs := d.filterParams[d.segment][btou(!d.usePredY16)]
-			fs.inner = fs.inner || !skip
-			d.perMBFilterParams[d.mbw*mby+mbx] = fs
+			d.mbMVs[d.mbw*mby+mbx] = mv
 		}
 	}
+	fs := d.filterParams[d.segment][btou(!d.usePredY16)]
+	fs.inner = fs.inner || !skip
+	d.perMBFilterParams[d.mbw*mby+mbx] = fs
+}
+
+// DecodeFrame decodes the frame and returns it as an YCbCr image.
+// The image's contents are valid up until the next call to Decoder.Init.
+func (d *Decoder) DecodeFrame() (*image.YCbCr, error) {
+	d.ensureImg()
+	d.resetStats()
+	if err := d.parseOtherHeaders(); err != nil {
+		return nil, err
+	}
+	if d.concurrent {
+		d.decodeMBsConcurrently()
+	} else {
+		d.decodeMBs()
+	}
 	// Note: VP8's arithmetic coder is designed to return 0 when reading
 	// beyond the buffer end. This is normal behavior and not necessarily
 	// an error. We only check for unexpected EOF if we haven't successfully
@@ -564,19 +751,35 @@ func (d *Decoder) DecodeFrame() (*image.YCbCr, error) {
 			}
 		}
 	}
-	// Apply the loop filter.
-	//
-	// Even if we are using per-segment levels, section 15 says that "loop
-	// filtering must be skipped entirely if loop_filter_level at either the
-	// frame header level or macroblock override level is 0".
-	if d.filterHeader.level != 0 {
-		if d.filterHeader.simple {
-			d.simpleFilter()
-		} else {
-			d.normalFilter()
-		}
-	}
 	// Update reference frame buffers.
 	d.updateFrameBuffers()
 	return d.img, nil
 }
+
+// SetProgress sets a function that DecodeFrame calls as rows of the frame are
+// decoded, with the image that it returns and the number of rows at the top
+// of that image that hold their final values. The function is called from
+// the goroutine that calls DecodeFrame. While it is set, DecodeFrame reads
+// the frame's last token partition as it decodes it, instead of up front, so
+// that a frame can be decoded from a reader whose data is still arriving.
+func (d *Decoder) SetProgress(progress func(m *image.YCbCr, rows int)) {
+	d.progress = progress
+}
+
+// reportProgress calls d.progress, if set, once the first n rows of
+// macroblocks are reconstructed and loop filtered.
+func (d *Decoder) reportProgress(n int) {
+	if d.progress == nil {
+		return
+	}
+	rows := 16 * n
+	if n < d.mbh && d.filterHeader.level != 0 {
+		// Filtering the next row modifies the bottom 3 rows of chroma above
+		// it, which cover 6 rows of luma.
+		rows -= 6
+	}
+	if h := d.img.Rect.Dy(); rows > h {
+		rows = h
+	}
+	d.progress(d.img, rows)
+}
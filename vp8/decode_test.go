@@ -370,9 +370,10 @@ func TestDecodeCompareWithFFmpeg(t *testing.T) {
 			f.Close()
 			t.Logf("Saved frame %d (keyframe=%v) to %s", i, fh.KeyFrame, outPath)
 			if !fh.KeyFrame {
+				s := d.FrameStats()
 				t.Logf("Frame %d MV modes: NEAREST=%d, NEAR=%d, ZERO=%d, NEW=%d, SPLIT=%d | Intra=%d, Inter=%d",
-					i, d.MVModeCount[0], d.MVModeCount[1], d.MVModeCount[2], d.MVModeCount[3], d.MVModeCount[4],
-					d.IntraMBCount, d.InterMBCount)
+					i, s.InterModes[0], s.InterModes[1], s.InterModes[2], s.InterModes[3], s.InterModes[4],
+					s.IntraMBs(), s.InterMBs())
 			}
 		}
 	}
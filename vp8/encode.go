@@ -0,0 +1,479 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vp8
+
+// This file implements the top-level key frame encoding algorithm.
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// DefaultQuality is the default quality encoding parameter.
+const DefaultQuality = 75
+
+// Options are the encoding parameters.
+// Quality ranges from 0 to 100 inclusive, higher is better. Values outside of
+// that range are clamped to it, and 0 gives the same result as 1, the lowest
+// quality.
+type Options struct {
+	Quality int
+
+	// minPartitions is the smallest number of token partitions that the
+	// encoder uses, if non-zero. Tests set it to exercise decoding multiple
+	// partitions. It is rounded up to 1, 2, 4 or 8, the numbers of
+	// partitions that a frame can have.
+	minPartitions int
+}
+
+// maxDimension is the largest width or height of a VP8 frame.
+const maxDimension = 1<<14 - 1
+
+// encoder holds the state for encoding one key frame.
+type encoder struct {
+	// d holds the decoder state that the encoder mirrors. Its img field is
+	// the reconstructed frame, before loop filtering.
+	d Decoder
+	// src is the source image, padded to a whole number of macroblocks.
+	src *image.YCbCr
+	// srcYBR holds the source pixels of the current macroblock, laid out as
+	// for the d.ybr workspace.
+	srcYBR [1 + 16 + 1 + 8][32]uint8
+	// qi is the quantizer index and quant the quantization factors.
+	qi    int
+	quant quant
+	// lambda is the rate-distortion trade-off, in squared error per bit.
+	lambda int64
+	// mbs are the encoded macroblocks, in raster order.
+	mbs []mbInfo
+	// minNOP is the smallest number of token partitions to use, which is
+	// 1, 2, 4 or 8.
+	minNOP int
+}
+
+// qualityToQI maps a quality in the range [1, 100] to a quantizer index in
+// the range [0, 127], following libwebp's quality curve.
+func qualityToQI(quality int) int {
+	c := float64(quality) / 100
+	linear := 2*c - 1
+	if c < 0.75 {
+		linear = c * 2 / 3
+	}
+	qi := int(math.Round(127 * (1 - math.Cbrt(linear))))
+	if qi < 0 {
+		return 0
+	}
+	if qi > 127 {
+		return 127
+	}
+	return qi
+}
+
+// Encode writes the Image m to w as a VP8 key frame. Options may be nil, in
+// which case the default parameters are used.
+//
+// The output is the payload of a WEBP file's "VP8 " chunk, which can be
+// decoded by Decoder.DecodeFrame. Any alpha channel is discarded.
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	b := m.Bounds()
+	if b.Dx() <= 0 || b.Dy() <= 0 {
+		return errors.New("vp8: invalid image size")
+	}
+	if b.Dx() > maxDimension || b.Dy() > maxDimension {
+		return errors.New("vp8: image is too large to encode")
+	}
+	quality, minNOP := DefaultQuality, 1
+	if o != nil {
+		quality = o.Quality
+		for minNOP < o.minPartitions && minNOP < 8 {
+			minNOP *= 2
+		}
+	}
+	if quality < 1 {
+		quality = 1
+	} else if quality > 100 {
+		quality = 100
+	}
+
+	e := &encoder{minNOP: minNOP}
+	e.init(m, qualityToQI(quality))
+	for mby := 0; mby < e.d.mbh; mby++ {
+		e.d.leftMB = mb{}
+		for mbx := 0; mbx < e.d.mbw; mbx++ {
+			e.encodeMacroblock(mbx, mby, &e.mbs[e.d.mbw*mby+mbx])
+		}
+	}
+	e.pickFilterLevel()
+	buf, err := e.frame()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// init initializes the encoder to encode m with the quantizer index qi.
+func (e *encoder) init(m image.Image, qi int) {
+	d := &e.d
+	b := m.Bounds()
+	d.frameHeader = FrameHeader{
+		KeyFrame:  true,
+		ShowFrame: true,
+		Width:     b.Dx(),
+		Height:    b.Dy(),
+	}
+	d.mbw = (b.Dx() + 0x0f) >> 4
+	d.mbh = (b.Dy() + 0x0f) >> 4
+	d.tokenProb = defaultTokenProb
+	d.img = image.NewYCbCr(image.Rect(0, 0, 16*d.mbw, 16*d.mbh), image.YCbCrSubsampleRatio420)
+	d.perMBFilterParams = make([]filterParam, d.mbw*d.mbh)
+	d.upMB = make([]mb, d.mbw)
+
+	e.src = toYCbCr(m, 16*d.mbw, 16*d.mbh)
+	e.qi = qi
+	e.quant = makeQuant(int32(qi), 0, 0, 0, 0, 0)
+	d.quant[0] = e.quant
+	q := int64(e.quant.y1[1])
+	e.lambda = q*q/4 + 1
+	e.mbs = make([]mbInfo, d.mbw*d.mbh)
+}
+
+// toYCbCr converts m to a 4:2:0 YCbCr image of the given size, replicating
+// m's right and bottom edges to fill any extra width or height. The width and
+// height must be even. Other than
+// for *image.YCbCr images, the conversion from RGB follows libwebp's, which
+// uses the ITU-R BT.601 limited range.
+func toYCbCr(m image.Image, w, h int) *image.YCbCr {
+	dst := image.NewYCbCr(image.Rect(0, 0, w, h), image.YCbCrSubsampleRatio420)
+	b := m.Bounds()
+	clampX := func(x int) int {
+		if x >= b.Dx() {
+			return b.Max.X - 1
+		}
+		return b.Min.X + x
+	}
+	clampY := func(y int) int {
+		if y >= b.Dy() {
+			return b.Max.Y - 1
+		}
+		return b.Min.Y + y
+	}
+
+	if src, ok := m.(*image.YCbCr); ok {
+		for y := 0; y < h; y++ {
+			sy := clampY(y)
+			for x := 0; x < w; x++ {
+				dst.Y[y*dst.YStride+x] = src.Y[src.YOffset(clampX(x), sy)]
+			}
+		}
+		for y := 0; y < h/2; y++ {
+			for x := 0; x < w/2; x++ {
+				cb, cr := 0, 0
+				for j := 0; j < 2; j++ {
+					for i := 0; i < 2; i++ {
+						k := src.COffset(clampX(2*x+i), clampY(2*y+j))
+						cb += int(src.Cb[k])
+						cr += int(src.Cr[k])
+					}
+				}
+				dst.Cb[y*dst.CStride+x] = uint8((cb + 2) / 4)
+				dst.Cr[y*dst.CStride+x] = uint8((cr + 2) / 4)
+			}
+		}
+		return dst
+	}
+
+	// rgb holds the 8-bit RGB values of two rows.
+	rgb := make([]int32, 3*2*w)
+	for y := 0; y < h; y += 2 {
+		for j := 0; j < 2; j++ {
+			sy := clampY(y + j)
+			for x := 0; x < w; x++ {
+				var c color.NRGBA
+				if src, ok := m.(*image.NRGBA); ok {
+					i := src.PixOffset(clampX(x), sy)
+					c = color.NRGBA{src.Pix[i+0], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3]}
+				} else {
+					c = color.NRGBAModel.Convert(m.At(clampX(x), sy)).(color.NRGBA)
+				}
+				r, g, b := int32(c.R), int32(c.G), int32(c.B)
+				rgb[3*(j*w+x)+0] = r
+				rgb[3*(j*w+x)+1] = g
+				rgb[3*(j*w+x)+2] = b
+				dst.Y[(y+j)*dst.YStride+x] = uint8((16839*r + 33059*g + 6420*b + 1<<15 + 16<<16) >> 16)
+			}
+		}
+		for x := 0; x < w; x += 2 {
+			var r, g, b int32
+			for _, k := range [4]int{x, x + 1, w + x, w + x + 1} {
+				r += rgb[3*k+0]
+				g += rgb[3*k+1]
+				b += rgb[3*k+2]
+			}
+			u := (-9719*r - 19081*g + 28800*b + 1<<17 + 128<<18) >> 18
+			v := (28800*r - 24116*g - 4684*b + 1<<17 + 128<<18) >> 18
+			dst.Cb[y/2*dst.CStride+x/2] = uint8(clip(u, 0, 255))
+			dst.Cr[y/2*dst.CStride+x/2] = uint8(clip(v, 0, 255))
+		}
+	}
+	return dst
+}
+
+// pickFilterLevel chooses the loop filter level that minimizes the sum of
+// squared errors between the filtered reconstruction and the source image.
+func (e *encoder) pickFilterLevel() {
+	d := &e.d
+	recon := d.img
+	filtered := image.NewYCbCr(recon.Rect, recon.SubsampleRatio)
+	d.img = filtered
+	defer func() {
+		d.img = recon
+	}()
+
+	cache := map[int]int64{}
+	eval := func(level int) int64 {
+		if s, ok := cache[level]; ok {
+			return s
+		}
+		copy(filtered.Y, recon.Y)
+		copy(filtered.Cb, recon.Cb)
+		copy(filtered.Cr, recon.Cr)
+		e.setFilterLevel(level)
+		if level != 0 {
+			for mby := 0; mby < d.mbh; mby++ {
+				d.normalFilter(mby)
+			}
+		}
+		s := e.frameSSE(filtered)
+		cache[level] = s
+		return s
+	}
+
+	best := 0
+	for level := 8; level < 64; level += 8 {
+		if eval(level) < eval(best) {
+			best = level
+		}
+	}
+	for step := 4; step > 0; step /= 2 {
+		lo, hi := best-step, best+step
+		if lo >= 0 && eval(lo) < eval(best) {
+			best = lo
+		}
+		if hi < 64 && eval(hi) < eval(best) {
+			best = hi
+		}
+	}
+	e.setFilterLevel(best)
+}
+
+// setFilterLevel sets the normal loop filter's level and the per-macroblock
+// filter parameters, as Decoder.DecodeFrame would.
+func (e *encoder) setFilterLevel(level int) {
+	d := &e.d
+	d.filterHeader = filterHeader{level: int8(level)}
+	d.filterHeader.perSegmentLevel[0] = int8(level)
+	d.computeFilterParams()
+	for i := range e.mbs {
+		m := &e.mbs[i]
+		fs := d.filterParams[0][btou(!m.usePredY16)]
+		fs.inner = fs.inner || !m.skip
+		d.perMBFilterParams[i] = fs
+	}
+}
+
+// frameSSE returns the sum of squared errors between the visible part of
+// m and the source image.
+func (e *encoder) frameSSE(m *image.YCbCr) int64 {
+	w, h := e.d.frameHeader.Width, e.d.frameHeader.Height
+	s := int64(0)
+	plane := func(a, b []uint8, stride, w, h int) {
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				d := int64(a[y*stride+x]) - int64(b[y*stride+x])
+				s += d * d
+			}
+		}
+	}
+	plane(m.Y, e.src.Y, m.YStride, w, h)
+	plane(m.Cb, e.src.Cb, m.CStride, (w+1)/2, (h+1)/2)
+	plane(m.Cr, e.src.Cr, m.CStride, (w+1)/2, (h+1)/2)
+	return s
+}
+
+// optimizeTokenProb chooses the token probabilities that minimize the cost
+// of coding the recorded token bits, including the cost of updating them.
+func optimizeTokenProb(stats *tokenStats) (prob [nPlane][nBand][nContext][nProb]uint8) {
+	prob = defaultTokenProb
+	for i := range prob {
+		for j := range prob[i] {
+			for k := range prob[i][j] {
+				for l := range prob[i][j][k] {
+					n0, n1 := stats[i][j][k][l][0], stats[i][j][k][l][1]
+					if n0+n1 == 0 {
+						continue
+					}
+					p := (256*n0 + (n0+n1)/2) / (n0 + n1)
+					if p < 1 {
+						p = 1
+					} else if p > 255 {
+						p = 255
+					}
+					cost := func(p uint8) uint32 {
+						return n0*bitCosts[p] + n1*bitCosts[256-int(p)]
+					}
+					old, new := prob[i][j][k][l], uint8(p)
+					update := tokenProbUpdateProb[i][j][k][l]
+					oldCost := cost(old) + bitCost(false, update)
+					newCost := cost(new) + bitCost(true, update) + 8*256
+					if newCost < oldCost {
+						prob[i][j][k][l] = new
+					}
+				}
+			}
+		}
+	}
+	return prob
+}
+
+// frame returns the encoded frame: the frame header, the first partition
+// and the DCT/WHT coefficient partitions.
+func (e *encoder) frame() ([]byte, error) {
+	d := &e.d
+
+	// Decide whether to skip macroblocks without coefficients, and gather
+	// the token statistics.
+	nSkip := 0
+	for i := range e.mbs {
+		if !e.mbs[i].hasLevels() {
+			nSkip++
+		}
+	}
+	useSkipProb := nSkip > 0
+	skipProb := uint8(clip(int32(255*(len(e.mbs)-nSkip)/len(e.mbs)), 1, 254))
+	stats := &tokenStats{}
+	e.putAllResiduals(func(int) *coder {
+		return &coder{prob: &d.tokenProb, stats: stats}
+	}, useSkipProb)
+	prob := optimizeTokenProb(stats)
+
+	// Choose the number of partitions so that each fits in 24 bits.
+	var ops []partitionWriter
+	for nOP := e.minNOP; ; nOP *= 2 {
+		ops = make([]partitionWriter, nOP)
+		coders := make([]coder, nOP)
+		for i := range ops {
+			ops[i].init()
+			coders[i] = coder{pw: &ops[i], prob: &prob}
+		}
+		e.putAllResiduals(func(mby int) *coder {
+			return &coders[mby&(nOP-1)]
+		}, useSkipProb)
+		fits := true
+		for i := range ops {
+			if len(ops[i].finish()) >= 1<<24 {
+				fits = false
+			}
+		}
+		if fits || nOP == 8 {
+			break
+		}
+	}
+
+	// Write the first partition.
+	var fp partitionWriter
+	fp.init()
+	fp.writeBit(false, uniformProb) // Color space.
+	fp.writeBit(false, uniformProb) // Pixel clamping.
+	fp.writeBit(false, uniformProb) // Segmentation.
+	fp.writeBit(false, uniformProb) // Simple filter.
+	fp.writeUint(uniformProb, uint32(d.filterHeader.level), 6)
+	fp.writeUint(uniformProb, 0, 3) // Sharpness.
+	fp.writeBit(false, uniformProb) // Loop filter deltas.
+	log2NOP := uint32(0)
+	for 1<<log2NOP < len(ops) {
+		log2NOP++
+	}
+	fp.writeUint(uniformProb, log2NOP, 2)
+	fp.writeUint(uniformProb, uint32(e.qi), 7)
+	for i := 0; i < 5; i++ {
+		fp.writeOptionalInt(uniformProb, 0, 4)
+	}
+	fp.writeBit(false, uniformProb) // Refresh entropy probabilities.
+	for i := range prob {
+		for j := range prob[i] {
+			for k := range prob[i][j] {
+				for l := range prob[i][j][k] {
+					update := prob[i][j][k][l] != defaultTokenProb[i][j][k][l]
+					fp.writeBit(update, tokenProbUpdateProb[i][j][k][l])
+					if update {
+						fp.writeUint(uniformProb, uint32(prob[i][j][k][l]), 8)
+					}
+				}
+			}
+		}
+	}
+	fp.writeBit(useSkipProb, uniformProb)
+	if useSkipProb {
+		fp.writeUint(uniformProb, uint32(skipProb), 8)
+	}
+	c := &coder{pw: &fp}
+	for i := range d.upMB {
+		d.upMB[i] = mb{}
+	}
+	for mby := 0; mby < d.mbh; mby++ {
+		d.leftMB = mb{}
+		for mbx := 0; mbx < d.mbw; mbx++ {
+			m := &e.mbs[d.mbw*mby+mbx]
+			if useSkipProb {
+				c.putBit(!m.hasLevels(), skipProb)
+			}
+			e.putPredModes(c, mbx, m)
+		}
+	}
+	first := fp.finish()
+	if len(first) >= 1<<19 {
+		return nil, errors.New("vp8: first partition is too large to encode")
+	}
+
+	// Assemble the frame.
+	w, h := d.frameHeader.Width, d.frameHeader.Height
+	n := len(first)
+	buf := make([]byte, 0, 10+n+3*len(ops))
+	buf = append(buf,
+		uint8(n<<5|1<<4), uint8(n>>3), uint8(n>>11),
+		0x9d, 0x01, 0x2a,
+		uint8(w), uint8(w>>8), uint8(h), uint8(h>>8),
+	)
+	buf = append(buf, first...)
+	for _, op := range ops[:len(ops)-1] {
+		n := len(op.buf)
+		buf = append(buf, uint8(n), uint8(n>>8), uint8(n>>16))
+	}
+	for _, op := range ops {
+		buf = append(buf, op.buf...)
+	}
+	return buf, nil
+}
+
+// putAllResiduals codes every macroblock's residuals, in raster order, with
+// the coder returned by coderFor for that macroblock's row.
+func (e *encoder) putAllResiduals(coderFor func(mby int) *coder, useSkipProb bool) {
+	d := &e.d
+	for i := range d.upMB {
+		d.upMB[i] = mb{}
+	}
+	for mby := 0; mby < d.mbh; mby++ {
+		d.leftMB = mb{}
+		c := coderFor(mby)
+		for mbx := 0; mbx < d.mbw; mbx++ {
+			m := &e.mbs[d.mbw*mby+mbx]
+			e.putResiduals(c, mbx, m, useSkipProb && !m.hasLevels())
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vp8
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"testing"
+)
+
+// psnr returns the peak signal-to-noise ratio, in decibels, between the Y,
+// Cb and Cr planes of two 4:2:0 images, over the bounds of m1.
+func psnr(m0, m1 *image.YCbCr) float64 {
+	b := m1.Bounds()
+	sse, n := 0.0, 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			d := float64(m0.Y[m0.YOffset(x, y)]) - float64(m1.Y[m1.YOffset(x, y)])
+			sse += d * d
+			n++
+			if x%2 == 0 && y%2 == 0 {
+				i0, i1 := m0.COffset(x, y), m1.COffset(x, y)
+				d0 := float64(m0.Cb[i0]) - float64(m1.Cb[i1])
+				d1 := float64(m0.Cr[i0]) - float64(m1.Cr[i1])
+				sse += d0*d0 + d1*d1
+				n += 2
+			}
+		}
+	}
+	if sse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255*float64(n)/sse)
+}
+
+func encodeDecode(m image.Image, o *Options) (*image.YCbCr, int, error) {
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, m, o); err != nil {
+		return nil, 0, err
+	}
+	n := buf.Len()
+	d := NewDecoder()
+	d.Init(buf, n)
+	if _, err := d.DecodeFrameHeader(); err != nil {
+		return nil, 0, err
+	}
+	m1, err := d.DecodeFrame()
+	return m1, n, err
+}
+
+func TestEncode(t *testing.T) {
+	f, err := os.Open("../testdata/video-001.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	video, err := png.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// gradient has a size that is not a multiple of 16 and a non-zero origin.
+	gradient := image.NewYCbCr(image.Rect(5, 3, 70, 44), image.YCbCrSubsampleRatio444)
+	for y := gradient.Rect.Min.Y; y < gradient.Rect.Max.Y; y++ {
+		for x := gradient.Rect.Min.X; x < gradient.Rect.Max.X; x++ {
+			gradient.Y[gradient.YOffset(x, y)] = uint8(3*x + 2*y)
+			gradient.Cb[gradient.COffset(x, y)] = uint8(x * y)
+			gradient.Cr[gradient.COffset(x, y)] = uint8(255 - 4*y)
+		}
+	}
+
+	testCases := []struct {
+		name    string
+		m       image.Image
+		quality int
+		minPSNR float64
+	}{
+		{"video-001", video, 10, 29},
+		{"video-001", video, 50, 34},
+		{"video-001", video, 75, 36},
+		{"video-001", video, 100, 48},
+		{"gradient", gradient, 75, 33},
+		{"1x1", image.NewGray(image.Rect(0, 0, 1, 1)), 75, 40},
+	}
+	for _, tc := range testCases {
+		m1, _, err := encodeDecode(tc.m, &Options{Quality: tc.quality})
+		if err != nil {
+			t.Errorf("%s, quality %d: %v", tc.name, tc.quality, err)
+			continue
+		}
+		b := tc.m.Bounds()
+		if got, want := m1.Bounds().Size(), b.Size(); got != want {
+			t.Errorf("%s, quality %d: size: got %v, want %v", tc.name, tc.quality, got, want)
+			continue
+		}
+		m0 := toYCbCr(tc.m, (b.Dx()+1)&^1, (b.Dy()+1)&^1)
+		if got := psnr(m0, m1); got < tc.minPSNR {
+			t.Errorf("%s, quality %d: PSNR: got %.2f dB, want >= %.2f dB", tc.name, tc.quality, got, tc.minPSNR)
+		}
+	}
+}
+
+func TestEncodeQuality(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 48, 40))
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 48; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{uint8(x * y), uint8(5 * x), uint8(200 - 4*y), 0xff})
+		}
+	}
+	prevSize := 0
+	for _, quality := range []int{100, 60, 20} {
+		_, size, err := encodeDecode(m, &Options{Quality: quality})
+		if err != nil {
+			t.Fatalf("quality %d: %v", quality, err)
+		}
+		if prevSize != 0 && size >= prevSize {
+			t.Errorf("quality %d: size %d is not smaller than %d", quality, size, prevSize)
+		}
+		prevSize = size
+	}
+}
+
+func TestEncodeInvalidSize(t *testing.T) {
+	for _, r := range []image.Rectangle{
+		image.Rect(0, 0, 0, 10),
+		image.Rect(0, 0, maxDimension+1, 1),
+	} {
+		if err := Encode(&bytes.Buffer{}, image.NewGray(r), nil); err == nil {
+			t.Errorf("%v: got nil error, want non-nil", r)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vp8
+
+// This file implements choosing each macroblock's predictor modes and
+// quantized residual coefficients, and reconstructing the macroblock exactly
+// as a decoder would.
+//
+// The encoder re-uses a Decoder's ybr and coeff workspaces, prediction
+// functions and inverse transforms. The source pixels of the current
+// macroblock are held in a second workspace, srcYBR, with the same layout as
+// ybr, so that a predicted or reconstructed value ybr[y][x] is compared to the
+// source value srcYBR[y][x].
+//
+// Each mode is chosen to minimize a rate-distortion score: 256 times the sum
+// of squared errors plus lambda times the cost in 1/256ths of a bit.
+
+const (
+	// maxLevel is the largest magnitude of a quantized coefficient.
+	maxLevel = 2047
+	// whtLevels is the index in mbInfo.levels of the Y2 region.
+	whtLevels = 24
+)
+
+// mbInfo is the encoded form of a macroblock.
+type mbInfo struct {
+	// Predictor modes.
+	usePredY16 bool
+	predY16    uint8
+	predC8     uint8
+	predY4     [4][4]uint8
+	// levels are the quantized coefficients, in zigzag order, of the 16 luma
+	// regions, the 4 + 4 chroma regions and the Y2 region.
+	levels [25][16]int16
+	// skip is whether inner loop filtering should be skipped for this
+	// macroblock, as returned by Decoder.reconstruct.
+	skip bool
+}
+
+// hasLevels returns whether m has any non-zero quantized coefficients.
+func (m *mbInfo) hasLevels() bool {
+	for i := range m.levels {
+		if !m.usePredY16 && i == whtLevels {
+			break
+		}
+		for _, l := range m.levels[i] {
+			if l != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Quantization biases, out of 256, for the DC and AC coefficients. They are
+// the same as libwebp's.
+var (
+	biasY1 = [2]uint32{96, 110}
+	biasY2 = [2]uint32{96, 108}
+	biasUV = [2]uint32{110, 115}
+)
+
+// quantize4 quantizes the raster-ordered coefficients in, from the first'th
+// coefficient in zigzag order onwards, into levels. It returns a 0/1 value
+// indicating whether there was at least one non-zero level.
+func quantize4(in *[16]int32, levels *[16]int16, q [2]uint16, bias [2]uint32, first int) (nz uint8) {
+	for n := first; n < 16; n++ {
+		i := btou(n > 0)
+		c := in[zigzag[n]]
+		neg := c < 0
+		if neg {
+			c = -c
+		}
+		l := (uint32(c) + uint32(q[i])*bias[i]>>8) / uint32(q[i])
+		if l > maxLevel {
+			l = maxLevel
+		}
+		levels[n] = int16(l)
+		if neg {
+			levels[n] = -levels[n]
+		}
+		nz |= btou(l != 0)
+	}
+	return nz
+}
+
+// dequantize4 writes the dequantized levels, from the first'th onwards, to
+// e.d.coeff, in the same manner as Decoder.parseResiduals4.
+func (e *encoder) dequantize4(levels *[16]int16, q [2]uint16, first, coeffBase int) {
+	for n := first; n < 16; n++ {
+		e.d.coeff[coeffBase+int(zigzag[n])] = int16(int32(levels[n]) * int32(q[btou(n > 0)]))
+	}
+}
+
+// residual4 computes the forward DCT of the difference between the source and
+// the prediction of the 4x4 region at (y, x) in the ybr workspace.
+func (e *encoder) residual4(y, x int, out *[16]int32) {
+	var r [16]int32
+	for j := 0; j < 4; j++ {
+		for i := 0; i < 4; i++ {
+			r[4*j+i] = int32(e.srcYBR[y+j][x+i]) - int32(e.d.ybr[y+j][x+i])
+		}
+	}
+	forwardDCT4(&r, out)
+}
+
+// sse returns the sum of squared errors of the w×h region at (y, x) in the
+// ybr workspace.
+func (e *encoder) sse(y, x, w, h int) int64 {
+	s := int64(0)
+	for j := y; j < y+h; j++ {
+		for i := x; i < x+w; i++ {
+			d := int64(e.srcYBR[j][i]) - int64(e.d.ybr[j][i])
+			s += d * d
+		}
+	}
+	return s
+}
+
+// score returns the rate-distortion score of a sum of squared errors and a
+// cost in 1/256ths of a bit.
+func (e *encoder) score(sse int64, cost uint32) int64 {
+	return 256*sse + e.lambda*int64(cost)
+}
+
+// pickY16 chooses the best 16x16 luma predictor mode, setting m's predY16
+// and luma levels, and returns the rate-distortion score.
+func (e *encoder) pickY16(mbx, mby int, m *mbInfo) int64 {
+	d := &e.d
+	best := int64(-1)
+	var (
+		levels  [17][16]int16
+		coeffs  [16][16]int32
+		dc, wht [16]int32
+	)
+	for _, mode := range [...]uint8{predDC, predTM, predVE, predHE} {
+		predFunc16[checkTopLeftPred(mbx, mby, mode)](d, ybrYY, ybrYX)
+		for n := 0; n < 16; n++ {
+			e.residual4(ybrYY+4*(n/4), ybrYX+4*(n%4), &coeffs[n])
+			dc[n] = coeffs[n][0]
+		}
+		forwardWHT16(&dc, &wht)
+		quantize4(&wht, &levels[16], e.quant.y2, biasY2, 0)
+
+		c := coder{prob: &d.tokenProb}
+		c.putBit(true, 145)
+		c.putPredModeY16(mode)
+		c.putResiduals4(planeY2, d.leftMB.nzY16+d.upMB[mbx].nzY16, &levels[16], false)
+		lnz := unpack[d.leftMB.nzMask&0x0f]
+		unz := unpack[d.upMB[mbx].nzMask&0x0f]
+		for n := 0; n < 16; n++ {
+			quantize4(&coeffs[n], &levels[n], e.quant.y1, biasY1, 1)
+			x, y := n%4, n/4
+			nz := c.putResiduals4(planeY1WithY2, lnz[y]+unz[x], &levels[n], true)
+			lnz[y], unz[x] = nz, nz
+		}
+
+		e.dequantize4(&levels[16], e.quant.y2, 0, whtCoeffBase)
+		d.inverseWHT16()
+		for n := 0; n < 16; n++ {
+			e.dequantize4(&levels[n], e.quant.y1, 1, 16*n)
+			d.inverseDCT4(ybrYY+4*(n/4), ybrYX+4*(n%4), 16*n)
+		}
+		if s := e.score(e.sse(ybrYY, ybrYX, 16, 16), c.cost); best < 0 || s < best {
+			best = s
+			m.predY16 = mode
+			copy(m.levels[:16], levels[:16])
+			m.levels[whtLevels] = levels[16]
+		}
+	}
+	return best
+}
+
+// pickY4 chooses the best 4x4 luma predictor modes, setting m's predY4 and
+// luma levels, and returns the rate-distortion score. It gives up early,
+// returning -1, if the score would exceed limit.
+func (e *encoder) pickY4(mbx int, m *mbInfo, limit int64) int64 {
+	d := &e.d
+	c := coder{prob: &d.tokenProb}
+	c.putBit(false, 145)
+	total := e.score(0, c.cost)
+	above, left := d.upMB[mbx].pred, d.leftMB.pred
+	lnz := unpack[d.leftMB.nzMask&0x0f]
+	unz := unpack[d.upMB[mbx].nzMask&0x0f]
+	var (
+		coeffs    [16]int32
+		levels    [16]int16
+		bestPix   [4][4]uint8
+		bestLevel [16]int16
+		bestNZ    uint8
+	)
+	for n := 0; n < 16; n++ {
+		i, j := n%4, n/4
+		y, x := ybrYY+4*j, ybrYX+4*i
+		best := int64(-1)
+		for mode := uint8(0); mode < nPred; mode++ {
+			predFunc4[mode](d, y, x)
+			e.residual4(y, x, &coeffs)
+			quantize4(&coeffs, &levels, e.quant.y1, biasY1, 0)
+			c := coder{prob: &d.tokenProb}
+			c.putPredModeY4(above[i], left[j], mode)
+			nz := c.putResiduals4(planeY1SansY2, lnz[j]+unz[i], &levels, false)
+			e.dequantize4(&levels, e.quant.y1, 0, 16*n)
+			d.inverseDCT4(y, x, 16*n)
+			if s := e.score(e.sse(y, x, 4, 4), c.cost); best < 0 || s < best {
+				best = s
+				m.predY4[j][i] = mode
+				bestLevel, bestNZ = levels, nz
+				for k := range bestPix {
+					copy(bestPix[k][:], d.ybr[y+k][x:x+4])
+				}
+			}
+		}
+		for k := range bestPix {
+			copy(d.ybr[y+k][x:x+4], bestPix[k][:])
+		}
+		m.levels[n] = bestLevel
+		above[i], left[j] = m.predY4[j][i], m.predY4[j][i]
+		lnz[j], unz[i] = bestNZ, bestNZ
+		total += best
+		if limit >= 0 && total > limit {
+			return -1
+		}
+	}
+	return total
+}
+
+// pickC8 chooses the best chroma predictor mode, setting m's predC8 and
+// chroma levels.
+func (e *encoder) pickC8(mbx, mby int, m *mbInfo) {
+	d := &e.d
+	best := int64(-1)
+	var (
+		coeffs [16]int32
+		levels [8][16]int16
+	)
+	for _, mode := range [...]uint8{predDC, predTM, predVE, predHE} {
+		p := checkTopLeftPred(mbx, mby, mode)
+		predFunc8[p](d, ybrBY, ybrBX)
+		predFunc8[p](d, ybrRY, ybrRX)
+		c := coder{prob: &d.tokenProb}
+		c.putPredModeC8(mode)
+		lnz := unpack[d.leftMB.nzMask>>4]
+		unz := unpack[d.upMB[mbx].nzMask>>4]
+		for k := 0; k < 8; k++ {
+			ch, y, x := k/4*2, k/2%2, k%2
+			yy, xx := ybrBY+4*y, ybrBX+4*x
+			if ch != 0 {
+				yy, xx = ybrRY+4*y, ybrRX+4*x
+			}
+			e.residual4(yy, xx, &coeffs)
+			quantize4(&coeffs, &levels[k], e.quant.uv, biasUV, 0)
+			nz := c.putResiduals4(planeUV, lnz[y+ch]+unz[x+ch], &levels[k], false)
+			lnz[y+ch], unz[x+ch] = nz, nz
+			e.dequantize4(&levels[k], e.quant.uv, 0, bCoeffBase+16*k)
+			d.inverseDCT4(yy, xx, bCoeffBase+16*k)
+		}
+		sse := e.sse(ybrBY, ybrBX, 8, 8) + e.sse(ybrRY, ybrRX, 8, 8)
+		if s := e.score(sse, c.cost); best < 0 || s < best {
+			best = s
+			m.predC8 = mode
+			copy(m.levels[16:24], levels[:])
+		}
+	}
+}
+
+// encodeMacroblock chooses the predictor modes and quantized coefficients of
+// a macroblock, reconstructs it into e.d.img and updates the decoder state as
+// Decoder.reconstruct would.
+func (e *encoder) encodeMacroblock(mbx, mby int, m *mbInfo) {
+	d := &e.d
+	*m = mbInfo{}
+	d.prepareYBR(mbx, mby)
+	base := d.ybr
+	for y := 0; y < 16; y++ {
+		copy(e.srcYBR[ybrYY+y][ybrYX:ybrYX+16], e.src.Y[(16*mby+y)*e.src.YStride+16*mbx:])
+	}
+	for y := 0; y < 8; y++ {
+		copy(e.srcYBR[ybrBY+y][ybrBX:ybrBX+8], e.src.Cb[(8*mby+y)*e.src.CStride+8*mbx:])
+		copy(e.srcYBR[ybrRY+y][ybrRX:ybrRX+8], e.src.Cr[(8*mby+y)*e.src.CStride+8*mbx:])
+	}
+
+	var m4 mbInfo
+	s16 := e.pickY16(mbx, mby, m)
+	if s4 := e.pickY4(mbx, &m4, s16); s4 >= 0 && s4 < s16 {
+		m.predY4 = m4.predY4
+		copy(m.levels[:16], m4.levels[:16])
+	} else {
+		m.usePredY16 = true
+	}
+	e.pickC8(mbx, mby, m)
+
+	// Reconstruct the macroblock from scratch, exactly as a decoder would.
+	d.ybr = base
+	for i := range d.coeff {
+		d.coeff[i] = 0
+	}
+	d.usePredY16 = m.usePredY16
+	d.predY16 = m.predY16
+	d.predY4 = m.predY4
+	d.predC8 = m.predC8
+	first := 0
+	if m.usePredY16 {
+		e.dequantize4(&m.levels[whtLevels], e.quant.y2, 0, whtCoeffBase)
+		d.inverseWHT16()
+		first = 1
+	}
+	d.nzDCMask, d.nzACMask = 0, 0
+	for n := 0; n < 24; n++ {
+		q := e.quant.y1
+		if n >= 16 {
+			q = e.quant.uv
+			first = 0
+		}
+		e.dequantize4(&m.levels[n], q, first, 16*n)
+		for k := first; k < 16; k++ {
+			if m.levels[n][k] != 0 {
+				d.nzACMask |= 1 << uint(n)
+				break
+			}
+		}
+		if d.coeff[16*n] != 0 {
+			d.nzDCMask |= 1 << uint(n)
+		}
+	}
+	m.skip = d.nzDCMask == 0 && d.nzACMask == 0
+	d.reconstructMacroblock(mbx, mby)
+	for i, y := (mby*d.img.YStride+mbx)*16, 0; y < 16; i, y = i+d.img.YStride, y+1 {
+		copy(d.img.Y[i:i+16], d.ybr[ybrYY+y][ybrYX:ybrYX+16])
+	}
+	for i, y := (mby*d.img.CStride+mbx)*8, 0; y < 8; i, y = i+d.img.CStride, y+1 {
+		copy(d.img.Cb[i:i+8], d.ybr[ybrBY+y][ybrBX:ybrBX+8])
+		copy(d.img.Cr[i:i+8], d.ybr[ybrRY+y][ybrRX:ybrRX+8])
+	}
+
+	// Update the per-macroblock state for the next macroblocks' contexts.
+	e.putPredModes(&coder{prob: &d.tokenProb}, mbx, m)
+	e.putResiduals(&coder{prob: &d.tokenProb}, mbx, m, false)
+}
+
+// putPredModes codes m's predictor modes, the inverse of the mode parsing in
+// Decoder.reconstruct, and updates e.d's above and left predictor modes.
+func (e *encoder) putPredModes(c *coder, mbx int, m *mbInfo) {
+	d := &e.d
+	c.putBit(m.usePredY16, 145)
+	if m.usePredY16 {
+		c.putPredModeY16(m.predY16)
+		for i := 0; i < 4; i++ {
+			d.upMB[mbx].pred[i] = m.predY16
+			d.leftMB.pred[i] = m.predY16
+		}
+	} else {
+		for j := 0; j < 4; j++ {
+			p := d.leftMB.pred[j]
+			for i := 0; i < 4; i++ {
+				c.putPredModeY4(d.upMB[mbx].pred[i], p, m.predY4[j][i])
+				p = m.predY4[j][i]
+				d.upMB[mbx].pred[i] = p
+			}
+			d.leftMB.pred[j] = p
+		}
+	}
+	c.putPredModeC8(m.predC8)
+}
+
+// putResiduals codes m's quantized coefficients, the inverse of
+// Decoder.parseResiduals, and updates e.d's above and left non-zero masks.
+// If skip is true, nothing is coded and the masks are cleared, as for a
+// skipped macroblock.
+func (e *encoder) putResiduals(c *coder, mbx int, m *mbInfo, skip bool) {
+	d := &e.d
+	if skip {
+		if m.usePredY16 {
+			d.leftMB.nzY16 = 0
+			d.upMB[mbx].nzY16 = 0
+		}
+		d.leftMB.nzMask = 0
+		d.upMB[mbx].nzMask = 0
+		return
+	}
+	plane := planeY1SansY2
+	if m.usePredY16 {
+		nz := c.putResiduals4(planeY2, d.leftMB.nzY16+d.upMB[mbx].nzY16, &m.levels[whtLevels], false)
+		d.leftMB.nzY16 = nz
+		d.upMB[mbx].nzY16 = nz
+		plane = planeY1WithY2
+	}
+
+	lnz := unpack[d.leftMB.nzMask&0x0f]
+	unz := unpack[d.upMB[mbx].nzMask&0x0f]
+	for y := 0; y < 4; y++ {
+		nz := lnz[y]
+		for x := 0; x < 4; x++ {
+			nz = c.putResiduals4(plane, nz+unz[x], &m.levels[4*y+x], m.usePredY16)
+			unz[x] = nz
+		}
+		lnz[y] = nz
+	}
+	lnzMask := pack(lnz, 0)
+	unzMask := pack(unz, 0)
+
+	lnz = unpack[d.leftMB.nzMask>>4]
+	unz = unpack[d.upMB[mbx].nzMask>>4]
+	n := 16
+	for ch := 0; ch < 4; ch += 2 {
+		for y := 0; y < 2; y++ {
+			nz := lnz[y+ch]
+			for x := 0; x < 2; x++ {
+				nz = c.putResiduals4(planeUV, nz+unz[x+ch], &m.levels[n], false)
+				unz[x+ch] = nz
+				n++
+			}
+			lnz[y+ch] = nz
+		}
+	}
+	lnzMask |= pack(lnz, 4)
+	unzMask |= pack(unz, 4)
+
+	d.leftMB.nzMask = uint8(lnzMask)
+	d.upMB[mbx].nzMask = uint8(unzMask)
+}
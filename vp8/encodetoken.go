@@ -0,0 +1,322 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vp8
+
+// This file implements encoding a partition's bitstream, the inverse of
+// partition.go, and encoding the predictor modes and DCT/WHT residual
+// coefficients, the inverse of pred.go and reconstruct.go. The boolean
+// encoder follows libvpx's vp8_encode_bool.
+
+import (
+	"math"
+	"math/bits"
+)
+
+// partitionWriter holds arithmetic-coded bits.
+type partitionWriter struct {
+	// buf is the output bytes.
+	buf []byte
+	// rng is the range, in the arithmetic coding sense.
+	rng uint32
+	// low holds the bits not yet shifted out to buf.
+	low uint32
+	// count is the number of bits in low, minus 24.
+	count int
+}
+
+// init initializes the partitionWriter.
+func (p *partitionWriter) init() {
+	p.buf = p.buf[:0]
+	p.rng = 255
+	p.low = 0
+	p.count = -24
+}
+
+// writeBit writes the bit b, whose probability of being 0 is prob/256.
+func (p *partitionWriter) writeBit(b bool, prob uint8) {
+	split := 1 + (p.rng-1)*uint32(prob)>>8
+	if b {
+		p.low += split
+		p.rng -= split
+	} else {
+		p.rng = split
+	}
+	shift := bits.LeadingZeros8(uint8(p.rng))
+	p.rng <<= uint(shift)
+	p.count += shift
+	if p.count >= 0 {
+		offset := shift - p.count
+		if (p.low<<uint(offset-1))&0x80000000 != 0 {
+			// Propagate the carry.
+			x := len(p.buf) - 1
+			for x >= 0 && p.buf[x] == 0xff {
+				p.buf[x] = 0
+				x--
+			}
+			p.buf[x]++
+		}
+		p.buf = append(p.buf, uint8(p.low>>uint(24-offset)))
+		p.low <<= uint(offset)
+		shift = p.count
+		p.low &= 0xffffff
+		p.count -= 8
+	}
+	p.low <<= uint(shift)
+}
+
+// writeUint writes the n-bit unsigned integer u.
+func (p *partitionWriter) writeUint(prob uint8, u uint32, n uint8) {
+	for n > 0 {
+		n--
+		p.writeBit(u&(1<<n) != 0, prob)
+	}
+}
+
+// writeOptionalInt writes the n-bit signed integer i in an encoding where
+// the likely value is zero.
+func (p *partitionWriter) writeOptionalInt(prob uint8, i int32, n uint8) {
+	if i == 0 {
+		p.writeBit(false, prob)
+		return
+	}
+	p.writeBit(true, prob)
+	if i < 0 {
+		p.writeUint(prob, uint32(-i), n)
+		p.writeBit(true, prob)
+	} else {
+		p.writeUint(prob, uint32(i), n)
+		p.writeBit(false, prob)
+	}
+}
+
+// finish flushes the pending bits and returns the encoded bytes. It pads the
+// output so that a decoder never reads past its end.
+func (p *partitionWriter) finish() []byte {
+	for i := 0; i < 32; i++ {
+		p.writeBit(false, uniformProb)
+	}
+	return p.buf
+}
+
+// bitCosts[prob] is the cost, in 1/256ths of a bit, of coding a bit whose
+// probability is prob/256.
+var bitCosts = func() (c [257]uint32) {
+	for i := 1; i < len(c); i++ {
+		c[i] = uint32(math.Round(-256 * math.Log2(float64(i)/256)))
+	}
+	c[0] = c[1]
+	return c
+}()
+
+// bitCost returns the cost, in 1/256ths of a bit, of coding the bit b whose
+// probability of being 0 is prob/256.
+func bitCost(b bool, prob uint8) uint32 {
+	if b {
+		return bitCosts[256-int(prob)]
+	}
+	return bitCosts[prob]
+}
+
+// tokenStats counts the 0 and 1 bits coded with each token probability.
+type tokenStats [nPlane][nBand][nContext][nProb][2]uint32
+
+// coder codes bits either to a partitionWriter or, if pw is nil, nowhere.
+// Either way, it accumulates the bits' cost.
+type coder struct {
+	pw *partitionWriter
+	// prob are the DCT/WHT coefficient coding probabilities.
+	prob *[nPlane][nBand][nContext][nProb]uint8
+	// stats, if non-nil, records the token bits coded.
+	stats *tokenStats
+	// cost is the accumulated cost, in 1/256ths of a bit.
+	cost uint32
+}
+
+// putBit codes the bit b.
+func (c *coder) putBit(b bool, prob uint8) {
+	if c.pw != nil {
+		c.pw.writeBit(b, prob)
+	}
+	c.cost += bitCost(b, prob)
+}
+
+// putUint codes the n-bit unsigned integer u.
+func (c *coder) putUint(prob uint8, u uint32, n uint8) {
+	for n > 0 {
+		n--
+		c.putBit(u&(1<<n) != 0, prob)
+	}
+}
+
+// putTokenBit codes the bit b with the i'th token probability of the given
+// plane, band and context.
+func (c *coder) putTokenBit(b bool, plane int, band, context uint8, i int) {
+	if c.stats != nil {
+		c.stats[plane][band][context][i][btou(b)]++
+	}
+	c.putBit(b, c.prob[plane][band][context][i])
+}
+
+// putPredModeY16 codes a 16x16 luma predictor mode, the inverse of
+// parsePredModeY16. It does not code the preceding Y16-or-Y4 bit.
+func (c *coder) putPredModeY16(p uint8) {
+	switch p {
+	case predDC:
+		c.putBit(false, 156)
+		c.putBit(false, 163)
+	case predVE:
+		c.putBit(false, 156)
+		c.putBit(true, 163)
+	case predHE:
+		c.putBit(true, 156)
+		c.putBit(false, 128)
+	case predTM:
+		c.putBit(true, 156)
+		c.putBit(true, 128)
+	}
+}
+
+// putPredModeY4 codes a 4x4 luma predictor mode p given the modes of the
+// regions above and left of it, the inverse of parsePredModeY4.
+func (c *coder) putPredModeY4(above, left, p uint8) {
+	prob := &predProb[above][left]
+	c.putBit(p != predDC, prob[0])
+	if p == predDC {
+		return
+	}
+	c.putBit(p != predTM, prob[1])
+	if p == predTM {
+		return
+	}
+	c.putBit(p != predVE, prob[2])
+	if p == predVE {
+		return
+	}
+	switch p {
+	case predHE, predRD, predVR:
+		c.putBit(false, prob[3])
+		c.putBit(p != predHE, prob[4])
+		if p != predHE {
+			c.putBit(p == predVR, prob[5])
+		}
+	default:
+		c.putBit(true, prob[3])
+		c.putBit(p != predLD, prob[6])
+		if p == predLD {
+			return
+		}
+		c.putBit(p != predVL, prob[7])
+		if p == predVL {
+			return
+		}
+		c.putBit(p == predHU, prob[8])
+	}
+}
+
+// putPredModeC8 codes a chroma predictor mode, the inverse of
+// parsePredModeC8.
+func (c *coder) putPredModeC8(p uint8) {
+	c.putBit(p != predDC, 142)
+	if p == predDC {
+		return
+	}
+	c.putBit(p != predVE, 114)
+	if p == predVE {
+		return
+	}
+	c.putBit(p != predHE, 183)
+}
+
+// putResiduals4 codes a 4x4 region of quantized coefficients, the inverse of
+// parseResiduals4, and returns a 0/1 value indicating whether there was at
+// least one non-zero coefficient. levels are in zigzag order.
+func (c *coder) putResiduals4(plane int, context uint8, levels *[16]int16, skipFirstCoeff bool) uint8 {
+	n := 0
+	if skipFirstCoeff {
+		n = 1
+	}
+	last := -1
+	for i := n; i < 16; i++ {
+		if levels[i] != 0 {
+			last = i
+		}
+	}
+	band, ctx := bands[n], context
+	c.putTokenBit(last >= 0, plane, band, ctx, 0)
+	if last < 0 {
+		return 0
+	}
+	for n != 16 {
+		v := int(levels[n])
+		neg := v < 0
+		if neg {
+			v = -v
+		}
+		n++
+		if v == 0 {
+			c.putTokenBit(false, plane, band, ctx, 1)
+			band, ctx = bands[n], 0
+			continue
+		}
+		c.putTokenBit(true, plane, band, ctx, 1)
+		if v == 1 {
+			c.putTokenBit(false, plane, band, ctx, 2)
+			band, ctx = bands[n], 1
+		} else {
+			c.putTokenBit(true, plane, band, ctx, 2)
+			switch {
+			case v <= 4:
+				c.putTokenBit(false, plane, band, ctx, 3)
+				c.putTokenBit(v != 2, plane, band, ctx, 4)
+				if v != 2 {
+					c.putTokenBit(v == 4, plane, band, ctx, 5)
+				}
+			case v <= 10:
+				c.putTokenBit(true, plane, band, ctx, 3)
+				c.putTokenBit(false, plane, band, ctx, 6)
+				if v <= 6 {
+					// Category 1.
+					c.putTokenBit(false, plane, band, ctx, 7)
+					c.putBit(v == 6, 159)
+				} else {
+					// Category 2.
+					c.putTokenBit(true, plane, band, ctx, 7)
+					c.putBit(v >= 9, 165)
+					c.putBit((v-7)&1 != 0, 145)
+				}
+			default:
+				// Categories 3, 4, 5 or 6.
+				c.putTokenBit(true, plane, band, ctx, 3)
+				c.putTokenBit(true, plane, band, ctx, 6)
+				cat := 3
+				for v < 3+(8<<uint(cat)) {
+					cat--
+				}
+				b1 := cat >> 1
+				c.putTokenBit(b1 != 0, plane, band, ctx, 8)
+				c.putTokenBit(cat&1 != 0, plane, band, ctx, 9+b1)
+				tab := &cat3456[cat]
+				nBits := 0
+				for tab[nBits] != 0 {
+					nBits++
+				}
+				extra := v - 3 - (8 << uint(cat))
+				for i := 0; i < nBits; i++ {
+					c.putBit(extra&(1<<uint(nBits-1-i)) != 0, tab[i])
+				}
+			}
+			band, ctx = bands[n], 2
+		}
+		c.putBit(neg, uniformProb)
+		if n == 16 {
+			return 1
+		}
+		c.putTokenBit(n <= last, plane, band, ctx, 0)
+		if n > last {
+			return 1
+		}
+	}
+	return 1
+}
@@ -0,0 +1,62 @@
+// Copyright 2011 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vp8
+
+// This file implements the forward Discrete Cosine Transform and the forward
+// Walsh Hadamard Transform (WHT), the inverses of those in idct.go. They follow
+// the libvpx reference encoder.
+
+// forwardDCT4 transforms a 4x4 block of residuals, in raster order, into DCT
+// coefficients, also in raster order.
+func forwardDCT4(in *[16]int32, out *[16]int32) {
+	var m [16]int32
+	for i := 0; i < 4; i++ {
+		a := (in[4*i+0] + in[4*i+3]) * 8
+		b := (in[4*i+1] + in[4*i+2]) * 8
+		c := (in[4*i+1] - in[4*i+2]) * 8
+		d := (in[4*i+0] - in[4*i+3]) * 8
+		m[4*i+0] = a + b
+		m[4*i+2] = a - b
+		m[4*i+1] = (c*2217 + d*5352 + 14500) >> 12
+		m[4*i+3] = (d*2217 - c*5352 + 7500) >> 12
+	}
+	for i := 0; i < 4; i++ {
+		a := m[0+i] + m[12+i]
+		b := m[4+i] + m[8+i]
+		c := m[4+i] - m[8+i]
+		d := m[0+i] - m[12+i]
+		out[0+i] = (a + b + 7) >> 4
+		out[8+i] = (a - b + 7) >> 4
+		out[4+i] = (c*2217+d*5352+12000)>>16 + int32(btou(d != 0))
+		out[12+i] = (d*2217 - c*5352 + 51000) >> 16
+	}
+}
+
+// forwardWHT16 transforms the 16 DC coefficients of a macroblock's luma
+// blocks, in raster order, into WHT coefficients, also in raster order.
+func forwardWHT16(in *[16]int32, out *[16]int32) {
+	var m [16]int32
+	for i := 0; i < 4; i++ {
+		a := (in[4*i+0] + in[4*i+2]) * 4
+		d := (in[4*i+1] + in[4*i+3]) * 4
+		c := (in[4*i+1] - in[4*i+3]) * 4
+		b := (in[4*i+0] - in[4*i+2]) * 4
+		m[4*i+0] = a + d + int32(btou(a != 0))
+		m[4*i+1] = b + c
+		m[4*i+2] = b - c
+		m[4*i+3] = a - d
+	}
+	for i := 0; i < 4; i++ {
+		a := m[0+i] + m[8+i]
+		d := m[4+i] + m[12+i]
+		c := m[4+i] - m[12+i]
+		b := m[0+i] - m[8+i]
+		a2, b2, c2, d2 := a+d, b+c, b-c, a-d
+		out[0+i] = (a2 + int32(btou(a2 < 0)) + 3) >> 3
+		out[4+i] = (b2 + int32(btou(b2 < 0)) + 3) >> 3
+		out[8+i] = (c2 + int32(btou(c2 < 0)) + 3) >> 3
+		out[12+i] = (d2 + int32(btou(d2 < 0)) + 3) >> 3
+	}
+}
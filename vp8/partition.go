@@ -55,6 +55,9 @@ type partition struct {
 	nBits uint8
 	// unexpectedEOF tells whether we tried to read past buf.
 	unexpectedEOF bool
+	// more, if non-nil, returns the partition's next bytes once buf is
+	// consumed, or nil at the end of the partition.
+	more func() []byte
 }
 
 // init initializes the partition.
@@ -65,12 +68,27 @@ func (p *partition) init(buf []byte) {
 	p.bits = 0
 	p.nBits = 0
 	p.unexpectedEOF = false
+	p.more = nil
+}
+
+// refill replaces the consumed buf with the partition's next bytes, if any,
+// and reports whether there were any.
+func (p *partition) refill() bool {
+	if p.more == nil {
+		return false
+	}
+	p.buf, p.r = p.more(), 0
+	if len(p.buf) == 0 {
+		p.more = nil
+		return false
+	}
+	return true
 }
 
 // readBit returns the next bit.
 func (p *partition) readBit(prob uint8) bool {
 	if p.nBits < 8 {
-		if p.r >= len(p.buf) {
+		if p.r >= len(p.buf) && !p.refill() {
 			p.unexpectedEOF = true
 			return false
 		}
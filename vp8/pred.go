@@ -128,13 +128,11 @@ func (d *Decoder) parseMBModeInter(mbx, mby int) bool {
 		// Bit is 1: Intra macroblock.
 		d.isInterMB = false
 		d.refFrame = refFrameIntra
-		d.IntraMBCount++
 		return false
 	}
 
 	// Bit is 0: Inter macroblock - determine the reference frame.
 	d.isInterMB = true
-	d.InterMBCount++
 	d.refFrame = d.parseRefFrame()
 
 	// Parse the motion vector mode.
@@ -204,28 +202,23 @@ func (d *Decoder) parseMVMode(mbx, mby int) {
 		// ZEROMV
 		d.mvMode = mvModeZero
 		d.mbMV = mvZero
-		d.MVModeCount[mvModeZero]++
 	} else if !d.fp.readBit(prob[1]) {
 		// NEARESTMV
 		d.mvMode = mvModeNearest
 		d.mbMV = d.clampMV(nearest, mbx, mby)
-		d.MVModeCount[mvModeNearest]++
 	} else if !d.fp.readBit(prob[2]) {
 		// NEARMV
 		d.mvMode = mvModeNear
 		d.mbMV = d.clampMV(near, mbx, mby)
-		d.MVModeCount[mvModeNear]++
 	} else if !d.fp.readBit(prob[3]) {
 		// NEWMV
 		d.mvMode = mvModeNew
 		// Read the new MV and add to the nearest MV.
 		deltaMV := d.readMV()
 		d.mbMV = d.clampMV(addMV(nearest, deltaMV), mbx, mby)
-		d.MVModeCount[mvModeNew]++
 	} else {
 		// SPLITMV - each sub-block has its own MV.
 		d.mvMode = mvModeSplit
-		d.MVModeCount[mvModeSplit]++
 		d.parseSplitMV(mbx, mby, nearest)
 	}
 }
@@ -28,7 +28,6 @@ func clip(x, min, max int32) int32 {
 func (d *Decoder) parseQuant() {
 	baseQ0 := d.fp.readUint(uniformProb, 7)
 	dqy1DC := d.fp.readOptionalInt(uniformProb, 4)
-	const dqy1AC = 0
 	dqy2DC := d.fp.readOptionalInt(uniformProb, 4)
 	dqy2AC := d.fp.readOptionalInt(uniformProb, 4)
 	dquvDC := d.fp.readOptionalInt(uniformProb, 4)
@@ -42,19 +41,28 @@ func (d *Decoder) parseQuant() {
 				q = int32(d.segmentHeader.quantizer[i])
 			}
 		}
-		d.quant[i].y1[0] = dequantTableDC[clip(q+dqy1DC, 0, 127)]
-		d.quant[i].y1[1] = dequantTableAC[clip(q+dqy1AC, 0, 127)]
-		d.quant[i].y2[0] = dequantTableDC[clip(q+dqy2DC, 0, 127)] * 2
-		d.quant[i].y2[1] = dequantTableAC[clip(q+dqy2AC, 0, 127)] * 155 / 100
-		if d.quant[i].y2[1] < 8 {
-			d.quant[i].y2[1] = 8
-		}
-		// The 117 is not a typo. The dequant_init function in the spec's Reference
-		// Decoder Source Code (http://tools.ietf.org/html/rfc6386#section-9.6 Page 145)
-		// says to clamp the LHS value at 132, which is equal to dequantTableDC[117].
-		d.quant[i].uv[0] = dequantTableDC[clip(q+dquvDC, 0, 117)]
-		d.quant[i].uv[1] = dequantTableAC[clip(q+dquvAC, 0, 127)]
+		d.quant[i] = makeQuant(q, dqy1DC, dqy2DC, dqy2AC, dquvDC, dquvAC)
+		d.stats.Quantizer[i] = int(clip(q, 0, 127))
+	}
+}
+
+// makeQuant returns the quantization factors for the quantizer index q and the
+// per-component deltas, as specified in section 9.6.
+func makeQuant(q, dqy1DC, dqy2DC, dqy2AC, dquvDC, dquvAC int32) (r quant) {
+	const dqy1AC = 0
+	r.y1[0] = dequantTableDC[clip(q+dqy1DC, 0, 127)]
+	r.y1[1] = dequantTableAC[clip(q+dqy1AC, 0, 127)]
+	r.y2[0] = dequantTableDC[clip(q+dqy2DC, 0, 127)] * 2
+	r.y2[1] = dequantTableAC[clip(q+dqy2AC, 0, 127)] * 155 / 100
+	if r.y2[1] < 8 {
+		r.y2[1] = 8
 	}
+	// The 117 is not a typo. The dequant_init function in the spec's Reference
+	// Decoder Source Code (http://tools.ietf.org/html/rfc6386#section-9.6 Page 145)
+	// says to clamp the LHS value at 132, which is equal to dequantTableDC[117].
+	r.uv[0] = dequantTableDC[clip(q+dquvDC, 0, 117)]
+	r.uv[1] = dequantTableAC[clip(q+dquvAC, 0, 127)]
+	return r
 }
 
 // The dequantization tables are specified in section 14.1.
@@ -424,9 +424,10 @@ func (d *Decoder) reconstructInterMacroblock(mbx, mby int) {
 	}
 }
 
-// reconstruct reconstructs one macroblock and returns whether inner loop
-// filtering should be skipped for it.
-func (d *Decoder) reconstruct(mbx, mby int) (skip bool) {
+// parseModes parses the segment, skip flag and prediction modes of one
+// macroblock from the first partition into d.mbModes. It also updates the
+// motion vector prediction state of the macroblocks to the left and above.
+func (d *Decoder) parseModes(mbx, mby int) {
 	if d.segmentHeader.updateMap {
 		if !d.fp.readBit(d.segmentHeader.prob[0]) {
 			d.segment = int(d.fp.readUint(d.segmentHeader.prob[1], 1))
@@ -434,14 +435,10 @@ func (d *Decoder) reconstruct(mbx, mby int) (skip bool) {
 			d.segment = int(d.fp.readUint(d.segmentHeader.prob[2], 1)) + 2
 		}
 	}
+	d.skip = false
 	if d.useSkipProb {
-		skip = d.fp.readBit(d.skipProb)
-	}
-	// Prepare the workspace.
-	for i := range d.coeff {
-		d.coeff[i] = 0
+		d.skip = d.fp.readBit(d.skipProb)
 	}
-	d.prepareYBR(mbx, mby)
 
 	// Determine if this is a keyframe or inter frame.
 	if d.frameHeader.KeyFrame {
@@ -453,89 +450,87 @@ func (d *Decoder) reconstruct(mbx, mby int) (skip bool) {
 			d.parsePredModeY4(mbx)
 		}
 		d.parsePredModeC8()
-		// Parse the residuals.
-		if !skip {
-			skip = d.parseResiduals(mbx, mby)
-		} else {
-			if d.usePredY16 {
-				d.leftMB.nzY16 = 0
-				d.upMB[mbx].nzY16 = 0
-			}
-			d.leftMB.nzMask = 0
-			d.upMB[mbx].nzMask = 0
-			d.nzDCMask = 0
-			d.nzACMask = 0
-		}
-		// Reconstruct the YCbCr data and copy it to the image.
-		d.reconstructMacroblock(mbx, mby)
-	} else {
-		// Inter frame: may use intra or inter prediction.
-		isInter := d.parseMBModeInter(mbx, mby)
-
-		if isInter {
-			// Inter prediction.
-			// RFC 6386: Inter-predicted macroblocks do NOT use Y2 (WHT).
-			// They use 16 individual 4x4 DCT blocks directly.
-			d.usePredY16 = false
-
-			// Parse residuals.
-			if !skip {
-				skip = d.parseResiduals(mbx, mby)
-			} else {
-				d.leftMB.nzY16 = 0
-				d.upMB[mbx].nzY16 = 0
-				d.leftMB.nzMask = 0
-				d.upMB[mbx].nzMask = 0
-				d.nzDCMask = 0
-				d.nzACMask = 0
-			}
+		return
+	}
 
-			// Reconstruct using inter prediction.
-			d.reconstructInterMacroblock(mbx, mby)
+	// Set above ref frame for current MB.
+	if mby > 0 {
+		d.aboveRefFrame = d.upRefFrame[mbx]
+		d.aboveMV = d.upMV[mbx]
+	}
+	// Inter frame: may use intra or inter prediction.
+	if d.parseMBModeInter(mbx, mby) {
+		// Inter prediction.
+		// RFC 6386: Inter-predicted macroblocks do NOT use Y2 (WHT).
+		// They use 16 individual 4x4 DCT blocks directly.
+		d.usePredY16 = false
 
-			// Update neighbor info for MV prediction.
-			d.leftMV = d.mbMV
-			d.leftRefFrame = d.refFrame
-			d.upMV[mbx] = d.mbMV
-			d.upRefFrame[mbx] = d.refFrame
+		// Update neighbor info for MV prediction.
+		d.leftMV = d.mbMV
+		d.leftRefFrame = d.refFrame
+		d.upMV[mbx] = d.mbMV
+		d.upRefFrame[mbx] = d.refFrame
+	} else {
+		// Intra prediction within inter frame.
+		// RFC 6386 Section 16.1: read is_i4x4 with probability 145.
+		// bit 0 means Y16 mode, bit 1 means Y4 mode.
+		d.usePredY16 = !d.fp.readBit(145)
+		if d.usePredY16 {
+			d.parsePredModeY16Intra(mbx)
 		} else {
-			// Intra prediction within inter frame.
-			// RFC 6386 Section 16.1: read is_i4x4 with probability 145.
-			// bit 0 means Y16 mode, bit 1 means Y4 mode.
-			d.usePredY16 = !d.fp.readBit(145)
-			if d.usePredY16 {
-				d.parsePredModeY16Intra(mbx)
-			} else {
-				d.parsePredModeY4(mbx)
-			}
-			d.parsePredModeC8Intra()
+			d.parsePredModeY4(mbx)
+		}
+		d.parsePredModeC8Intra()
 
-			// Parse residuals.
-			if !skip {
-				skip = d.parseResiduals(mbx, mby)
-			} else {
-				if d.usePredY16 {
-					d.leftMB.nzY16 = 0
-					d.upMB[mbx].nzY16 = 0
-				}
-				d.leftMB.nzMask = 0
-				d.upMB[mbx].nzMask = 0
-				d.nzDCMask = 0
-				d.nzACMask = 0
-			}
+		// Update neighbor info (intra has zero MV).
+		d.leftMV = mvZero
+		d.leftRefFrame = refFrameIntra
+		d.upMV[mbx] = mvZero
+		d.upRefFrame[mbx] = refFrameIntra
+	}
+}
 
-			// Reconstruct using intra prediction.
-			d.reconstructMacroblock(mbx, mby)
+// reconstruct parses the residuals of one macroblock, whose modes are
+// d.mbModes, reconstructs it and returns whether inner loop filtering should
+// be skipped for it.
+func (d *Decoder) reconstruct(mbx, mby int) (skip bool) {
+	inter := !d.frameHeader.KeyFrame && d.isInterMB
 
-			// Update neighbor info (intra has zero MV).
-			d.leftMV = mvZero
-			d.leftRefFrame = refFrameIntra
-			d.upMV[mbx] = mvZero
-			d.upRefFrame[mbx] = refFrameIntra
+	// Prepare the workspace.
+	for i := range d.coeff {
+		d.coeff[i] = 0
+	}
+	d.prepareYBR(mbx, mby)
+
+	// Parse the residuals.
+	skip = d.skip
+	if !skip {
+		skip = d.parseResiduals(mbx, mby)
+	} else {
+		if d.usePredY16 || inter {
+			d.leftMB.nzY16 = 0
+			d.upMB[mbx].nzY16 = 0
 		}
+		d.leftMB.nzMask = 0
+		d.upMB[mbx].nzMask = 0
+		d.nzDCMask = 0
+		d.nzACMask = 0
+	}
+
+	// Reconstruct the YCbCr data, using inter or intra prediction.
+	if inter {
+		d.reconstructInterMacroblock(mbx, mby)
+	} else {
+		d.reconstructMacroblock(mbx, mby)
 	}
 
-	// Copy reconstructed data to the image.
+	d.copyYBR(mbx, mby)
+	return skip
+}
+
+// copyYBR copies the reconstructed macroblock from the ybr workspace to the
+// image.
+func (d *Decoder) copyYBR(mbx, mby int) {
 	for i, y := (mby*d.img.YStride+mbx)*16, 0; y < 16; i, y = i+d.img.YStride, y+1 {
 		copy(d.img.Y[i:i+16], d.ybr[ybrYY+y][ybrYX:ybrYX+16])
 	}
@@ -543,5 +538,4 @@ func (d *Decoder) reconstruct(mbx, mby int) (skip bool) {
 		copy(d.img.Cb[i:i+8], d.ybr[ybrBY+y][ybrBX:ybrBX+8])
 		copy(d.img.Cr[i:i+8], d.ybr[ybrRY+y][ybrRX:ybrRX+8])
 	}
-	return skip
 }
@@ -0,0 +1,121 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vp8
+
+// This file implements the statistics gathered while decoding a frame.
+
+// FrameStats holds statistics about a decoded frame, for analyzing a VP8
+// stream.
+type FrameStats struct {
+	// MBWidth and MBHeight are the frame's size in 16x16 macroblocks.
+	MBWidth, MBHeight int
+	// IntraModes counts the intra-predicted macroblocks by luma prediction
+	// mode: DC, TrueMotion, vertical and horizontal 16x16 prediction, and
+	// 4x4 prediction.
+	IntraModes [5]int
+	// InterModes counts the inter-predicted macroblocks by motion vector
+	// mode: nearest, near, zero, new and split.
+	InterModes [5]int
+	// RefFrames counts the inter-predicted macroblocks by reference frame:
+	// the last, golden and alternate reference frames.
+	RefFrames [3]int
+	// SkippedMBs is the number of macroblocks without non-zero coefficients.
+	SkippedMBs int
+	// SegmentMap holds each macroblock's segment, in the range [0, 3], in
+	// raster order.
+	SegmentMap []uint8
+	// Quantizer holds each segment's quantizer index, in the range [0, 127].
+	Quantizer [nSegment]int
+	// FilterLevel holds each segment's loop filter level, in the range
+	// [0, 63], before any reference frame and mode deltas. The loop filter
+	// is disabled if the frame's level, FilterLevel[0] without segments, is
+	// zero.
+	FilterLevel [nSegment]int
+	// SimpleFilter is whether the simple loop filter is used instead of the
+	// normal one, and FilterSharpness is its sharpness, in the range [0, 7].
+	SimpleFilter    bool
+	FilterSharpness int
+	// ConcealedMBs is the number of macroblocks that were concealed, as they
+	// were lost to truncation, and Concealed holds whether each macroblock was
+	// concealed, in raster order. Concealed is nil if no macroblocks were
+	// concealed. See Decoder.SetErrorConcealment.
+	ConcealedMBs int
+	Concealed    []bool
+	// FirstPartitionSize is the size, in bytes, of the first partition, which
+	// holds the prediction modes. PartitionSizes holds the sizes of the
+	// partitions of DCT coefficients.
+	FirstPartitionSize int
+	PartitionSizes     []int
+}
+
+// IntraMBs returns the number of intra-predicted macroblocks.
+func (s *FrameStats) IntraMBs() (n int) {
+	for _, c := range s.IntraModes {
+		n += c
+	}
+	return n
+}
+
+// InterMBs returns the number of inter-predicted macroblocks.
+func (s *FrameStats) InterMBs() (n int) {
+	for _, c := range s.InterModes {
+		n += c
+	}
+	return n
+}
+
+// FrameStats returns statistics about the frame most recently decoded by
+// DecodeFrame. The returned value is not modified by later calls.
+func (d *Decoder) FrameStats() *FrameStats {
+	s := d.stats
+	s.SegmentMap = append([]uint8(nil), s.SegmentMap...)
+	if s.ConcealedMBs == 0 {
+		s.Concealed = nil
+	} else {
+		s.Concealed = append([]bool(nil), s.Concealed...)
+	}
+	s.PartitionSizes = append([]int(nil), s.PartitionSizes...)
+	return &s
+}
+
+// resetStats prepares d.stats for decoding a frame.
+func (d *Decoder) resetStats() {
+	n := d.mbw * d.mbh
+	segmentMap, concealed := d.stats.SegmentMap, d.stats.Concealed
+	if cap(segmentMap) < n {
+		segmentMap = make([]uint8, n)
+		concealed = make([]bool, n)
+	}
+	concealed = concealed[:n]
+	for i := range concealed {
+		concealed[i] = false
+	}
+	d.stats = FrameStats{
+		MBWidth:            d.mbw,
+		MBHeight:           d.mbh,
+		SegmentMap:         segmentMap[:n],
+		Concealed:          concealed,
+		FirstPartitionSize: int(d.frameHeader.FirstPartitionLen),
+		PartitionSizes:     d.stats.PartitionSizes[:0],
+	}
+}
+
+// recordMBStats records the statistics of the macroblock whose modes were
+// just parsed. Skipped macroblocks are counted as they are reconstructed.
+func (d *Decoder) recordMBStats(mbx, mby int) {
+	s := &d.stats
+	s.SegmentMap[d.mbw*mby+mbx] = uint8(d.segment)
+	if d.damaged {
+		return
+	}
+	if !d.frameHeader.KeyFrame && d.isInterMB {
+		s.InterModes[d.mvMode]++
+		s.RefFrames[d.refFrame-refFrameLast]++
+	} else if d.usePredY16 {
+		s.IntraModes[d.predY16]++
+	} else {
+		s.IntraModes[4]++
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vp8
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestFrameStats(t *testing.T) {
+	const w, h = 72, 40
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{uint8(x * y), uint8(3 * x), uint8(5 * y), 0xff})
+		}
+	}
+	// The right half is flat, so that some macroblocks have no non-zero
+	// coefficients.
+	for y := 0; y < h; y++ {
+		for x := 40; x < w; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{0x80, 0x80, 0x80, 0xff})
+		}
+	}
+	const quality = 60
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, m, &Options{Quality: quality}); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	n := buf.Len()
+	d := NewDecoder()
+	d.Init(buf, n)
+	fh, err := d.DecodeFrameHeader()
+	if err != nil {
+		t.Fatalf("DecodeFrameHeader: %v", err)
+	}
+	if _, err := d.DecodeFrame(); err != nil {
+		t.Fatalf("DecodeFrame: %v", err)
+	}
+	s := d.FrameStats()
+
+	const mbw, mbh = (w + 15) / 16, (h + 15) / 16
+	if s.MBWidth != mbw || s.MBHeight != mbh {
+		t.Errorf("size: got %dx%d macroblocks, want %dx%d", s.MBWidth, s.MBHeight, mbw, mbh)
+	}
+	if got := s.IntraMBs(); got != mbw*mbh || s.InterMBs() != 0 || s.RefFrames != [3]int{} {
+		t.Errorf("IntraMBs, InterMBs, RefFrames: got %d, %d, %v, want %d, 0, zero", got, s.InterMBs(), s.RefFrames, mbw*mbh)
+	}
+	if s.SkippedMBs == 0 || s.SkippedMBs == mbw*mbh {
+		t.Errorf("SkippedMBs: got %d, want some but not all", s.SkippedMBs)
+	}
+	if len(s.SegmentMap) != mbw*mbh {
+		t.Errorf("SegmentMap: got length %d, want %d", len(s.SegmentMap), mbw*mbh)
+	}
+	for i, seg := range s.SegmentMap {
+		if seg != 0 {
+			t.Errorf("SegmentMap[%d]: got %d, want 0", i, seg)
+		}
+	}
+	qi := qualityToQI(quality)
+	if want := [4]int{qi, qi, qi, qi}; s.Quantizer != want {
+		t.Errorf("Quantizer: got %v, want %v", s.Quantizer, want)
+	}
+	if l := s.FilterLevel[0]; l < 0 || l > 63 || s.FilterLevel != [4]int{l, l, l, l} {
+		t.Errorf("FilterLevel: got %v", s.FilterLevel)
+	}
+	if s.SimpleFilter || s.FilterSharpness != 0 {
+		t.Errorf("SimpleFilter, FilterSharpness: got %t, %d, want false, 0", s.SimpleFilter, s.FilterSharpness)
+	}
+	if s.FirstPartitionSize != int(fh.FirstPartitionLen) {
+		t.Errorf("FirstPartitionSize: got %d, want %d", s.FirstPartitionSize, fh.FirstPartitionLen)
+	}
+	// A key frame's header is 10 bytes long, and all but the last partition's
+	// size are stored in 3 bytes each.
+	total := 10 + s.FirstPartitionSize + 3*(len(s.PartitionSizes)-1)
+	for _, p := range s.PartitionSizes {
+		total += p
+	}
+	if total != n {
+		t.Errorf("total size: got %d, want %d", total, n)
+	}
+
+	// The returned stats do not share memory with the Decoder.
+	s.SegmentMap[0] = 3
+	if d.FrameStats().SegmentMap[0] != 0 {
+		t.Errorf("FrameStats: SegmentMap is shared")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vp8
+
+import (
+	"errors"
+	"image"
+	"io"
+	"math"
+	"time"
+
+	"golang.org/x/image/ivf"
+)
+
+// Frame is a decoded frame of a video.
+type Frame struct {
+	// Image is the frame's image. Its contents are valid up until the next
+	// call to VideoReader.Next.
+	Image *image.YCbCr
+	// Header is the frame's header. An inter frame's header holds the
+	// dimensions of the most recent key frame.
+	Header FrameHeader
+	// Timestamp is the frame's presentation time, in units of the IVF time
+	// base, and Time is the same presentation time as a time.Duration.
+	Timestamp uint64
+	Time      time.Duration
+	// Stats are the statistics gathered while decoding the frame.
+	Stats *FrameStats
+}
+
+// VideoReader decodes the frames of a VP8 video held in an IVF container.
+type VideoReader struct {
+	z *ivf.Reader
+	d *Decoder
+	// keyFrame is whether a key frame has been decoded.
+	keyFrame bool
+}
+
+// NewVideoReader returns a VideoReader that reads an IVF stream from r.
+func NewVideoReader(r io.Reader) (*VideoReader, error) {
+	z, err := ivf.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	if h := z.Header(); string(h.FourCC[:]) != "VP80" {
+		return nil, errors.New("vp8: unsupported IVF codec " + string(h.FourCC[:]))
+	}
+	return &VideoReader{z: z, d: NewDecoder()}, nil
+}
+
+// Header returns the IVF file header.
+func (v *VideoReader) Header() ivf.FileHeader {
+	return v.z.Header()
+}
+
+// SetConcurrent sets whether frames are decoded concurrently, as for
+// Decoder.SetConcurrent.
+func (v *VideoReader) SetConcurrent(concurrent bool) {
+	v.d.SetConcurrent(concurrent)
+}
+
+// SetErrorConcealment sets whether the damage to truncated frames is
+// concealed, as for Decoder.SetErrorConcealment.
+func (v *VideoReader) SetErrorConcealment(conceal bool) {
+	v.d.SetErrorConcealment(conceal)
+}
+
+// Next decodes and returns the next shown frame. Frames that are not shown,
+// such as alternate reference frames, are decoded but not returned. Empty
+// frames, which denote dropped frames, are skipped. Next returns io.EOF if
+// there are no more frames.
+func (v *VideoReader) Next() (Frame, error) {
+	for {
+		ivfh, data, err := v.z.Next()
+		if err != nil {
+			return Frame{}, err
+		}
+		if ivfh.Size == 0 {
+			continue
+		}
+		if ivfh.Size > math.MaxInt32 {
+			return Frame{}, errors.New("vp8: frame is too large")
+		}
+
+		v.d.Init(data, int(ivfh.Size))
+		fh, err := v.d.DecodeFrameHeader()
+		if err != nil {
+			return Frame{}, err
+		}
+		if !fh.KeyFrame && !v.keyFrame {
+			return Frame{}, errors.New("vp8: video does not start with a key frame")
+		}
+		m, err := v.d.DecodeFrame()
+		if err != nil {
+			return Frame{}, err
+		}
+		v.keyFrame = true
+		if !fh.ShowFrame {
+			continue
+		}
+		return Frame{
+			Image:     m,
+			Header:    fh,
+			Timestamp: ivfh.Timestamp,
+			Time:      v.z.Header().Duration(ivfh.Timestamp),
+			Stats:     v.d.FrameStats(),
+		}, nil
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vp8
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"testing"
+	"time"
+)
+
+// ivfFrame is a frame of an IVF stream.
+type ivfFrame struct {
+	data      []byte
+	timestamp uint64
+}
+
+// encodeIVF returns a VP8 IVF stream with a time base of 1/1000 seconds.
+func encodeIVF(w, h int, frames []ivfFrame) []byte {
+	b := []byte("DKIF\x00\x00\x20\x00VP80")
+	b = append(b, uint8(w), uint8(w>>8), uint8(h), uint8(h>>8))
+	b = append(b, 1, 0, 0, 0, 0xe8, 0x03, 0, 0)
+	b = append(b, uint8(len(frames)), 0, 0, 0, 0, 0, 0, 0)
+	for _, f := range frames {
+		n, ts := len(f.data), f.timestamp
+		b = append(b, uint8(n), uint8(n>>8), uint8(n>>16), uint8(n>>24))
+		b = append(b, uint8(ts), uint8(ts>>8), uint8(ts>>16), uint8(ts>>24), 0, 0, 0, 0)
+		b = append(b, f.data...)
+	}
+	return b
+}
+
+func TestVideoReader(t *testing.T) {
+	const w, h = 48, 32
+	var (
+		frames []ivfFrame
+		want   []*image.YCbCr
+	)
+	for i := 0; i < 3; i++ {
+		m := image.NewNRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				m.SetNRGBA(x, y, color.NRGBA{uint8(x * 5 * i), uint8(y * 7), uint8(80 * i), 0xff})
+			}
+		}
+		buf := &bytes.Buffer{}
+		if err := Encode(buf, m, nil); err != nil {
+			t.Fatalf("frame %d: Encode: %v", i, err)
+		}
+		frames = append(frames, ivfFrame{buf.Bytes(), uint64(40 * i)})
+		want = append(want, toYCbCr(m, w, h))
+	}
+	// Hide the second frame, and add an empty frame.
+	hidden := append([]byte(nil), frames[1].data...)
+	hidden[0] &^= 0x10
+	frames = []ivfFrame{frames[0], {hidden, 40}, {nil, 60}, frames[2]}
+	want = []*image.YCbCr{want[0], want[2]}
+
+	v, err := NewVideoReader(bytes.NewReader(encodeIVF(w, h, frames)))
+	if err != nil {
+		t.Fatalf("NewVideoReader: %v", err)
+	}
+	if got := v.Header(); got.Width != w || got.Height != h {
+		t.Errorf("Header: got %dx%d, want %dx%d", got.Width, got.Height, w, h)
+	}
+	wantTimes := []uint64{0, 80}
+	for i := range want {
+		f, err := v.Next()
+		if err != nil {
+			t.Fatalf("frame %d: Next: %v", i, err)
+		}
+		if f.Timestamp != wantTimes[i] || f.Time != time.Duration(wantTimes[i])*time.Millisecond {
+			t.Errorf("frame %d: got timestamp %d, time %v, want %d", i, f.Timestamp, f.Time, wantTimes[i])
+		}
+		if !f.Header.KeyFrame || !f.Header.ShowFrame || f.Header.Width != w || f.Header.Height != h {
+			t.Errorf("frame %d: got header %+v", i, f.Header)
+		}
+		if got := psnr(want[i], f.Image); got < 30 {
+			t.Errorf("frame %d: PSNR: got %.2f dB, want >= 30 dB", i, got)
+		}
+	}
+	if _, err := v.Next(); err != io.EOF {
+		t.Errorf("Next: got %v, want io.EOF", err)
+	}
+}
+
+func TestVideoReaderInvalid(t *testing.T) {
+	b := encodeIVF(16, 16, nil)
+	copy(b[8:12], "VP90")
+	if _, err := NewVideoReader(bytes.NewReader(b)); err == nil {
+		t.Errorf("VP9: got nil error, want non-nil")
+	}
+
+	// An inter frame header is 3 bytes long, with the low bit set.
+	b = encodeIVF(16, 16, []ivfFrame{{[]byte{0x11, 0x00, 0x00}, 0}})
+	v, err := NewVideoReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("NewVideoReader: %v", err)
+	}
+	if _, err := v.Next(); err == nil {
+		t.Errorf("inter frame first: got nil error, want non-nil")
+	}
+}
@@ -2,7 +2,8 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-// Package vp8l implements a decoder for the VP8L lossless image format.
+// Package vp8l implements a decoder and encoder for the VP8L lossless image
+// format.
 //
 // The VP8L specification is at:
 // https://developers.google.com/speed/webp/docs/riff_container
@@ -11,6 +12,7 @@ package vp8l // import "golang.org/x/image/vp8l"
 import (
 	"bufio"
 	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"io"
@@ -61,6 +63,23 @@ type decoder struct {
 	r     io.ByteReader
 	bits  uint32
 	nBits uint32
+	// rowsDecoded, if non-nil, is called with the top-level pixels whenever
+	// more of their rows are decoded.
+	rowsDecoded func(pix []byte, rows int32)
+	// maxBytes, if positive, limits the number of bytes allocated for pixels,
+	// and allocated is the number of bytes allocated so far.
+	maxBytes  int64
+	allocated int64
+}
+
+// alloc records that n more bytes of pixels are to be allocated, returning a
+// *LimitError if that would exceed d.maxBytes.
+func (d *decoder) alloc(n int64) error {
+	d.allocated += n
+	if d.maxBytes > 0 && d.allocated > d.maxBytes {
+		return &LimitError{"MaxBytes", d.allocated, d.maxBytes}
+	}
+	return nil
 }
 
 // read reads the next n bits from the decoder's bit-stream.
@@ -382,10 +401,14 @@ func (d *decoder) decodePix(w int32, h int32, minCap int32, topLevel bool) ([]by
 	if minCap < 4*w*h {
 		minCap = 4 * w * h
 	}
+	if err := d.alloc(int64(minCap)); err != nil {
+		return nil, err
+	}
 	pix := make([]byte, 4*w*h, minCap)
 	p, cachedP := 0, 0
 	x, y := int32(0), int32(0)
 	hg, lookupHG := &hGroups[0], hMask != 0
+	report, reported := topLevel && d.rowsDecoded != nil, int32(0)
 	for p < len(pix) {
 		if lookupHG {
 			i := 4 * (tilesPerRow*(y>>hBits) + (x >> hBits))
@@ -482,6 +505,11 @@ func (d *decoder) decodePix(w int32, h int32, minCap int32, topLevel bool) ([]by
 			}
 			lookupHG = hMask != 0 && x&hMask == 0
 		}
+
+		if report && y > reported {
+			d.rowsDecoded(pix, y)
+			reported = y
+		}
 	}
 	return pix, nil
 }
@@ -552,12 +580,87 @@ func DecodeConfig(r io.Reader) (image.Config, error) {
 	}, nil
 }
 
+// DecodeOptions bound the memory that DecodeWithOptions uses for a VP8L
+// bitstream. A zero limit means no limit.
+type DecodeOptions struct {
+	// MaxWidth and MaxHeight limit the 14-bit width and height in the
+	// bitstream's header.
+	MaxWidth  int
+	MaxHeight int
+	// MaxPixels limits the width times the height.
+	MaxPixels int64
+	// MaxBytes limits the total size of the decoded image and of the
+	// entropy, color and predictor images that its transforms and Huffman
+	// codes are stored as.
+	MaxBytes int64
+}
+
+// A LimitError is returned by DecodeWithOptions when the header, or one of the
+// sub-images that precede the pixels, needs more than DecodeOptions allow.
+// The allocation that would break the limit is not made.
+type LimitError struct {
+	// Limit is "MaxWidth", "MaxHeight", "MaxPixels" or "MaxBytes".
+	Limit string
+	// Value is the amount needed, which for MaxBytes counts everything
+	// allocated so far, and Max is the limit.
+	Value int64
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("vp8l: image exceeds %s: %d > %d", e.Limit, e.Value, e.Max)
+}
+
+// checkSize returns a *LimitError if a w by h image exceeds o's limits. o may
+// be nil.
+func (o *DecodeOptions) checkSize(w, h int32) error {
+	if o == nil {
+		return nil
+	}
+	w64, h64 := int64(w), int64(h)
+	switch {
+	case o.MaxWidth > 0 && w64 > int64(o.MaxWidth):
+		return &LimitError{"MaxWidth", w64, int64(o.MaxWidth)}
+	case o.MaxHeight > 0 && h64 > int64(o.MaxHeight):
+		return &LimitError{"MaxHeight", h64, int64(o.MaxHeight)}
+	case o.MaxPixels > 0 && w64*h64 > o.MaxPixels:
+		return &LimitError{"MaxPixels", w64 * h64, o.MaxPixels}
+	}
+	return nil
+}
+
 // Decode decodes a VP8L image from r.
 func Decode(r io.Reader) (image.Image, error) {
+	return decode(r, nil, nil)
+}
+
+// DecodeWithOptions is like Decode, but returns a *LimitError for images that
+// exceed the limits given by o. o may be nil, in which case there are no
+// limits.
+func DecodeWithOptions(r io.Reader, o *DecodeOptions) (image.Image, error) {
+	return decode(r, o, nil)
+}
+
+// DecodeWithProgress is like Decode, but also calls progress whenever more
+// rows of the image are decoded, with the *image.NRGBA that it returns and
+// the number of rows at the top of that image that hold their final values.
+// progress is called from the calling goroutine, and its last call, if
+// decoding succeeds, is with all of the image's rows.
+func DecodeWithProgress(r io.Reader, progress func(m *image.NRGBA, rows int)) (image.Image, error) {
+	return decode(r, nil, progress)
+}
+
+func decode(r io.Reader, o *DecodeOptions, progress func(m *image.NRGBA, rows int)) (image.Image, error) {
 	d, w, h, err := decodeHeader(r)
 	if err != nil {
 		return nil, err
 	}
+	if err := o.checkSize(w, h); err != nil {
+		return nil, err
+	}
+	if o != nil {
+		d.maxBytes = o.MaxBytes
+	}
 	// Decode the transforms.
 	var (
 		nTransforms    int
@@ -585,19 +688,48 @@ func Decode(r io.Reader) (image.Image, error) {
 		transforms[nTransforms] = t
 		nTransforms++
 	}
+	m := &image.NRGBA{
+		Stride: 4 * int(originalW),
+		Rect:   image.Rect(0, 0, int(originalW), int(h)),
+	}
+	ts := transforms[:nTransforms]
+	// The inverse color-indexing transform needs a separate image when it
+	// widens the decoded pixels.
+	if w != originalW {
+		if err := d.alloc(4 * int64(originalW) * int64(h)); err != nil {
+			return nil, err
+		}
+	}
+	if progress != nil {
+		// The inverse transformations are applied to a copy of the rows
+		// decoded so far, as the pixels still to be decoded can refer back to
+		// their transformed values.
+		if err := d.alloc(4 * int64(w) * int64(h)); err != nil {
+			return nil, err
+		}
+		var buf []byte
+		done := int32(0)
+		d.rowsDecoded = func(pix []byte, rows int32) {
+			if buf == nil {
+				buf = make([]byte, len(pix))
+			}
+			copy(buf[4*w*done:], pix[4*w*done:4*w*rows])
+			out := inverseTransform(ts, buf, h, done, rows)
+			if m.Pix == nil {
+				m.Pix = out
+			}
+			done = rows
+			progress(m, int(rows))
+		}
+	}
 	// Decode the transformed pixels.
 	pix, err := d.decodePix(w, h, 0, true)
 	if err != nil {
 		return nil, err
 	}
 	// Apply the inverse transformations.
-	for i := nTransforms - 1; i >= 0; i-- {
-		t := &transforms[i]
-		pix = inverseTransforms[t.transformType](t, pix, h)
+	if progress == nil {
+		m.Pix = inverseTransform(ts, pix, h, 0, h)
 	}
-	return &image.NRGBA{
-		Pix:    pix,
-		Stride: 4 * int(originalW),
-		Rect:   image.Rect(0, 0, int(originalW), int(h)),
-	}, nil
+	return m, nil
 }
@@ -0,0 +1,538 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package vp8l
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"math/bits"
+)
+
+// DefaultEffort is the default encoding effort.
+const DefaultEffort = 75
+
+// Options are the encoding parameters.
+type Options struct {
+	// Effort trades encoding speed for compressed size, in the range
+	// [0, 100] inclusive. Higher is slower but smaller.
+	Effort int
+}
+
+// maxDimension is the maximum width or height of a VP8L image.
+const maxDimension = 1 << 14
+
+// maxLZ77Length and maxLZ77Distance are the largest backwards reference
+// length and distance that the prefix coding in section 4.2.2 can represent.
+const (
+	maxLZ77Length   = 4096
+	maxLZ77Distance = 1<<20 - len(distanceMapTable)
+)
+
+// bitWriter accumulates a bit-stream, least significant bit first.
+type bitWriter struct {
+	buf   []byte
+	bits  uint64
+	nBits uint32
+}
+
+// write writes the low n bits of u, for n <= 32.
+func (b *bitWriter) write(u uint32, n uint32) {
+	b.bits |= uint64(u&(1<<n-1)) << b.nBits
+	b.nBits += n
+	for b.nBits >= 8 {
+		b.buf = append(b.buf, uint8(b.bits))
+		b.bits >>= 8
+		b.nBits -= 8
+	}
+}
+
+// writeSymbol writes symbol s with the Huffman code h.
+func (b *bitWriter) writeSymbol(h *hCode, s uint32) {
+	b.write(h.codes[s], h.lengths[s])
+}
+
+// flush pads the bit-stream to a whole number of bytes and returns it.
+func (b *bitWriter) flush() []byte {
+	if b.nBits > 0 {
+		b.write(0, 8-b.nBits)
+	}
+	return b.buf
+}
+
+// lz77Prefix returns the prefix code symbol and the extra bits for an LZ77
+// length or distance, the inverse of decoder.lz77Param.
+func lz77Prefix(value uint32) (symbol, extraBits, extra uint32) {
+	v := value - 1
+	if v < 4 {
+		return v, 0, 0
+	}
+	hb := uint32(bits.Len32(v)) - 1
+	extraBits = hb - 1
+	return 2*hb + (v>>extraBits)&1, extraBits, v & (1<<extraBits - 1)
+}
+
+const (
+	tokenLiteral = iota
+	tokenCache
+	tokenCopy
+)
+
+// token is an element of the encoded pixel stream: a literal ARGB pixel, a
+// color cache index or a LZ77 backwards reference.
+type token struct {
+	kind uint8
+	// value is the ARGB pixel, the color cache index or the copy length.
+	value uint32
+	// distCode is the distance code of a backwards reference, as per
+	// distanceMap.
+	distCode uint32
+}
+
+// distanceCodes returns the inverse of distanceMap for an image of width w:
+// the shortest code for each distance that has one of the 120 short codes.
+func distanceCodes(w int32) map[int32]uint32 {
+	m := make(map[int32]uint32, len(distanceMapTable))
+	for code := uint32(1); code <= uint32(len(distanceMapTable)); code++ {
+		if d := distanceMap(w, code); int(d) <= maxLZ77Distance {
+			if _, ok := m[d]; !ok {
+				m[d] = code
+			}
+		}
+	}
+	return m
+}
+
+const hashBits = 16
+
+// hashPair hashes two consecutive pixels, for finding LZ77 matches.
+func hashPair(a, b uint32) uint32 {
+	return (a*colorCacheMultiplier ^ b*0x9e3779b1) >> (32 - hashBits)
+}
+
+// tokenize converts the pixels of an image of width w into tokens, using a
+// color cache of 1<<ccBits entries (or none, if ccBits is zero) and following
+// up to chainLen hash chain links when searching for LZ77 matches.
+func tokenize(argb []uint32, w int32, ccBits uint32, chainLen int) []token {
+	var cache []uint32
+	ccShift := 32 - ccBits
+	if ccBits > 0 {
+		cache = make([]uint32, 1<<ccBits)
+	}
+	distCodes := distanceCodes(w)
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, len(argb))
+	insert := func(i int) {
+		if i+1 < len(argb) {
+			h := hashPair(argb[i], argb[i+1])
+			prev[i], head[h] = head[h], int32(i)
+		}
+	}
+	matchLen := func(i, d int) int {
+		n := len(argb) - i
+		if n > maxLZ77Length {
+			n = maxLZ77Length
+		}
+		k := 0
+		for k < n && argb[i+k] == argb[i+k-d] {
+			k++
+		}
+		return k
+	}
+
+	tokens := make([]token, 0, len(argb)/2)
+	for i := 0; i < len(argb); {
+		// Look for the longest match, trying the pixels to the left and
+		// above first, as they are the most likely to match.
+		bestLen, bestDist := 0, 0
+		for _, d := range [2]int{1, int(w)} {
+			if d <= i {
+				if n := matchLen(i, d); n > bestLen {
+					bestLen, bestDist = n, d
+				}
+			}
+		}
+		if i+1 < len(argb) {
+			j := head[hashPair(argb[i], argb[i+1])]
+			for c := 0; c < chainLen && j >= 0 && bestLen < maxLZ77Length; c++ {
+				d := i - int(j)
+				if d > maxLZ77Distance {
+					break
+				}
+				if n := matchLen(i, d); n > bestLen {
+					bestLen, bestDist = n, d
+				}
+				j = prev[j]
+			}
+		}
+
+		if bestLen >= 3 {
+			distCode, ok := distCodes[int32(bestDist)]
+			if !ok {
+				distCode = uint32(bestDist + len(distanceMapTable))
+			}
+			tokens = append(tokens, token{kind: tokenCopy, value: uint32(bestLen), distCode: distCode})
+			for end := i + bestLen; i < end; i++ {
+				if cache != nil {
+					cache[(argb[i]*colorCacheMultiplier)>>ccShift] = argb[i]
+				}
+				insert(i)
+			}
+			continue
+		}
+
+		c := argb[i]
+		if cache != nil {
+			k := (c * colorCacheMultiplier) >> ccShift
+			if cache[k] == c {
+				tokens = append(tokens, token{kind: tokenCache, value: k})
+			} else {
+				tokens = append(tokens, token{kind: tokenLiteral, value: c})
+				cache[k] = c
+			}
+		} else {
+			tokens = append(tokens, token{kind: tokenLiteral, value: c})
+		}
+		insert(i)
+		i++
+	}
+	return tokens
+}
+
+// writeCodeLengths writes a Huffman code's code lengths, themselves Huffman
+// encoded, as per section 5.2.2.
+func (b *bitWriter) writeCodeLengths(lengths []uint32) {
+	// Run-length encode the code lengths with the repeat codes 16, 17 and
+	// 18. Each element of rle is a code length code and its extra bits.
+	type rleCode struct{ code, extra uint32 }
+	var rle []rleCode
+	prev := uint32(8)
+	for i := 0; i < len(lengths); {
+		v, run := lengths[i], 1
+		for i+run < len(lengths) && lengths[i+run] == v {
+			run++
+		}
+		i += run
+		if v == 0 {
+			for run >= 3 {
+				if run >= 11 {
+					k := run
+					if k > 138 {
+						k = 138
+					}
+					rle = append(rle, rleCode{18, uint32(k - 11)})
+					run -= k
+				} else {
+					k := run
+					if k > 10 {
+						k = 10
+					}
+					rle = append(rle, rleCode{17, uint32(k - 3)})
+					run -= k
+				}
+			}
+		} else {
+			if v != prev {
+				rle = append(rle, rleCode{v, 0})
+				prev = v
+				run--
+			}
+			for run >= 3 {
+				k := run
+				if k > 6 {
+					k = 6
+				}
+				rle = append(rle, rleCode{16, uint32(k - 3)})
+				run -= k
+			}
+		}
+		for ; run > 0; run-- {
+			rle = append(rle, rleCode{v, 0})
+		}
+	}
+
+	var histogram [len(codeLengthCodeOrder)]uint32
+	for _, r := range rle {
+		histogram[r.code]++
+	}
+	clLengths := buildCodeLengths(histogram[:], maxEncodeCodeLengthCodeLength)
+	nCodes := 4
+	for i, c := range codeLengthCodeOrder {
+		if clLengths[c] != 0 && nCodes < i+1 {
+			nCodes = i + 1
+		}
+	}
+	b.write(uint32(nCodes-4), 4)
+	for _, c := range codeLengthCodeOrder[:nCodes] {
+		b.write(clLengths[c], 3)
+	}
+	// Set useLength to zero: all of the code lengths are written.
+	b.write(0, 1)
+	clCode := newHCode(clLengths)
+	for _, r := range rle {
+		b.writeSymbol(&clCode, r.code)
+		if r.code >= repeatsCodeLength {
+			b.write(r.extra, uint32(repeatBits[r.code-repeatsCodeLength]))
+		}
+	}
+}
+
+// writeHuffmanCode writes a Huffman code for the given symbol histogram, and
+// returns that code.
+func (b *bitWriter) writeHuffmanCode(histogram []uint32) hCode {
+	var symbols []uint32
+	for s, c := range histogram {
+		if c != 0 {
+			symbols = append(symbols, uint32(s))
+			if len(symbols) > 2 {
+				break
+			}
+		}
+	}
+
+	switch {
+	case len(symbols) == 0:
+		// No symbol is ever used. Write a simple code with the single
+		// symbol 0.
+		b.write(1, 1)
+		b.write(0, 1)
+		b.write(0, 1)
+		b.write(0, 1)
+		return newHCode(make([]uint32, len(histogram)))
+
+	case len(symbols) <= 2 && symbols[len(symbols)-1] < 256:
+		// Write a simple code. With two symbols, the first symbol's code
+		// is 0 and the second symbol's code is 1.
+		b.write(1, 1)
+		b.write(uint32(len(symbols)-1), 1)
+		if symbols[0] < 2 {
+			b.write(0, 1)
+			b.write(symbols[0], 1)
+		} else {
+			b.write(1, 1)
+			b.write(symbols[0], 8)
+		}
+		h := newHCode(make([]uint32, len(histogram)))
+		if len(symbols) == 2 {
+			b.write(symbols[1], 8)
+			h.codes[symbols[1]] = 1
+			h.lengths[symbols[0]] = 1
+			h.lengths[symbols[1]] = 1
+		}
+		return h
+	}
+
+	lengths := buildCodeLengths(histogram, maxEncodeCodeLength)
+	b.write(0, 1)
+	b.writeCodeLengths(lengths)
+	return newHCode(lengths)
+}
+
+// writePix writes pixel data, as per section 5.2.2. Only the top-level image
+// has a meta prefix code bit, which the encoder always sets to zero: the one
+// Huffman group applies to the whole image.
+func (b *bitWriter) writePix(argb []uint32, w int32, ccBits uint32, topLevel bool, chainLen int) {
+	if ccBits > 0 {
+		b.write(1, 1)
+		b.write(ccBits, 4)
+	} else {
+		b.write(0, 1)
+	}
+	if topLevel {
+		b.write(0, 1)
+	}
+
+	tokens := tokenize(argb, w, ccBits, chainLen)
+	var histograms [nHuff][]uint32
+	for i, n := range alphabetSizes {
+		if i == huffGreen && ccBits > 0 {
+			n += 1 << ccBits
+		}
+		histograms[i] = make([]uint32, n)
+	}
+	for _, t := range tokens {
+		switch t.kind {
+		case tokenLiteral:
+			histograms[huffGreen][(t.value>>8)&0xff]++
+			histograms[huffRed][(t.value>>16)&0xff]++
+			histograms[huffBlue][t.value&0xff]++
+			histograms[huffAlpha][t.value>>24]++
+		case tokenCache:
+			histograms[huffGreen][nLiteralCodes+nLengthCodes+t.value]++
+		case tokenCopy:
+			s, _, _ := lz77Prefix(t.value)
+			histograms[huffGreen][nLiteralCodes+s]++
+			s, _, _ = lz77Prefix(t.distCode)
+			histograms[huffDistance][s]++
+		}
+	}
+	var codes [nHuff]hCode
+	for i := range codes {
+		codes[i] = b.writeHuffmanCode(histograms[i])
+	}
+
+	for _, t := range tokens {
+		switch t.kind {
+		case tokenLiteral:
+			b.writeSymbol(&codes[huffGreen], (t.value>>8)&0xff)
+			b.writeSymbol(&codes[huffRed], (t.value>>16)&0xff)
+			b.writeSymbol(&codes[huffBlue], t.value&0xff)
+			b.writeSymbol(&codes[huffAlpha], t.value>>24)
+		case tokenCache:
+			b.writeSymbol(&codes[huffGreen], nLiteralCodes+nLengthCodes+t.value)
+		case tokenCopy:
+			s, n, extra := lz77Prefix(t.value)
+			b.writeSymbol(&codes[huffGreen], nLiteralCodes+s)
+			b.write(extra, n)
+			s, n, extra = lz77Prefix(t.distCode)
+			b.writeSymbol(&codes[huffDistance], s)
+			b.write(extra, n)
+		}
+	}
+}
+
+// encodeConfig is one way of encoding an image. The encoder tries several
+// and keeps the smallest result.
+type encodeConfig struct {
+	// usePalette is whether to use the color-indexing transform. Otherwise,
+	// the subtract-green, predictor and cross-color transforms are used.
+	usePalette bool
+	// tileBits is the log-2 tile size of the predictor and cross-color
+	// transforms.
+	tileBits uint32
+	// ccBits is the log-2 color cache size, or zero for no color cache.
+	ccBits uint32
+	// chainLen is the maximum number of LZ77 candidates to consider.
+	chainLen int
+}
+
+// encode encodes the ARGB pixels of a w by h image.
+func encode(argb []uint32, w, h int32, hasAlpha bool, pal []uint32, cfg encodeConfig) []byte {
+	b := &bitWriter{}
+	b.write(0x2f, 8)
+	b.write(uint32(w-1), 14)
+	b.write(uint32(h-1), 14)
+	if hasAlpha {
+		b.write(1, 1)
+	} else {
+		b.write(0, 1)
+	}
+	b.write(0, 3)
+
+	pix := append([]uint32(nil), argb...)
+	if cfg.usePalette {
+		packed, packedW, palImage := forwardColorIndexing(pix, w, h, pal)
+		b.write(1, 1)
+		b.write(transformTypeColorIndexing, 2)
+		b.write(uint32(len(pal)-1), 8)
+		b.writePix(palImage, int32(len(palImage)), 0, false, cfg.chainLen)
+		pix, w = packed, packedW
+	} else {
+		b.write(1, 1)
+		b.write(transformTypeSubtractGreen, 2)
+		forwardSubtractGreen(pix)
+
+		modes := forwardPredictor(pix, w, h, cfg.tileBits)
+		b.write(1, 1)
+		b.write(transformTypePredictor, 2)
+		b.write(cfg.tileBits-2, 3)
+		b.writePix(modes, nTiles(w, cfg.tileBits), 0, false, cfg.chainLen)
+
+		elements := forwardCrossColor(pix, w, h, cfg.tileBits)
+		b.write(1, 1)
+		b.write(transformTypeCrossColor, 2)
+		b.write(cfg.tileBits-2, 3)
+		b.writePix(elements, nTiles(w, cfg.tileBits), 0, false, cfg.chainLen)
+	}
+	b.write(0, 1)
+
+	b.writePix(pix, w, cfg.ccBits, true, cfg.chainLen)
+	return b.flush()
+}
+
+// toARGB returns the pixels of m as ARGB values, and whether any of them are
+// not fully opaque.
+func toARGB(m image.Image) (argb []uint32, hasAlpha bool) {
+	b := m.Bounds()
+	argb = make([]uint32, 0, b.Dx()*b.Dy())
+	if n, ok := m.(*image.NRGBA); ok {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			pix := n.Pix[n.PixOffset(b.Min.X, y):n.PixOffset(b.Max.X, y)]
+			for i := 0; i < len(pix); i += 4 {
+				argb = append(argb, uint32(pix[i+3])<<24|uint32(pix[i+0])<<16|uint32(pix[i+1])<<8|uint32(pix[i+2]))
+			}
+		}
+	} else {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+				argb = append(argb, uint32(c.A)<<24|uint32(c.R)<<16|uint32(c.G)<<8|uint32(c.B))
+			}
+		}
+	}
+	for _, c := range argb {
+		if c>>24 != 0xff {
+			return argb, true
+		}
+	}
+	return argb, false
+}
+
+// Encode writes the Image m to w in VP8L format. Options may be nil, in which
+// case the default parameters are used.
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	effort := DefaultEffort
+	if o != nil {
+		effort = o.Effort
+		if effort < 0 {
+			effort = 0
+		} else if effort > 100 {
+			effort = 100
+		}
+	}
+
+	b := m.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width <= 0 || height <= 0 || width > maxDimension || height > maxDimension {
+		return errors.New("vp8l: invalid image size " + b.String())
+	}
+	argb, hasAlpha := toARGB(m)
+
+	// Choose the configurations to try, according to the effort.
+	chainLen := 1 + effort
+	ccBitsChoices := []uint32{0}
+	switch {
+	case effort >= 70:
+		ccBitsChoices = []uint32{0, 6, 10}
+	case effort >= 30:
+		ccBitsChoices = []uint32{0, 10}
+	}
+	pal := palette(argb)
+	var configs []encodeConfig
+	for _, ccBits := range ccBitsChoices {
+		if pal != nil {
+			configs = append(configs, encodeConfig{usePalette: true, ccBits: ccBits, chainLen: chainLen})
+			if effort < 70 {
+				// A palette almost always wins, so only try the other
+				// transforms when asked for a high effort.
+				continue
+			}
+		}
+		configs = append(configs, encodeConfig{tileBits: 4, ccBits: ccBits, chainLen: chainLen})
+	}
+
+	var best []byte
+	for _, cfg := range configs {
+		if enc := encode(argb, int32(width), int32(height), hasAlpha, pal, cfg); best == nil || len(enc) < len(best) {
+			best = enc
+		}
+	}
+	_, err := w.Write(best)
+	return err
+}
@@ -6,6 +6,7 @@ package vp8l
 
 import (
 	"io"
+	"sort"
 )
 
 // reverseBits reverses the bits in a byte.
@@ -243,3 +244,144 @@ slowPath:
 	}
 	return h.nodes[n].symbol, nil
 }
+
+// maxEncodeCodeLength is the maximum code length that the encoder produces
+// for the pixel alphabets. The code length alphabet is limited to 7 bits, as
+// those code lengths are themselves encoded in 3 bits.
+const (
+	maxEncodeCodeLength           = 15
+	maxEncodeCodeLengthCodeLength = 7
+)
+
+// hNodeBuild is a node in a Huffman tree under construction.
+type hNodeBuild struct {
+	count  uint64
+	parent int32
+}
+
+// buildCodeLengths returns the lengths of a Huffman code for the given symbol
+// histogram, such that no code is longer than maxLength bits. Symbols that
+// never occur have a zero code length. If exactly one symbol occurs, its code
+// length is 1, which is how the decoder expects a single-symbol code to be
+// described.
+func buildCodeLengths(histogram []uint32, maxLength uint32) []uint32 {
+	lengths := make([]uint32, len(histogram))
+	var symbols []int
+	for s, c := range histogram {
+		if c != 0 {
+			symbols = append(symbols, s)
+		}
+	}
+	switch len(symbols) {
+	case 0:
+		return lengths
+	case 1:
+		lengths[symbols[0]] = 1
+		return lengths
+	}
+
+	// If the unconstrained Huffman code is too deep, flatten the histogram by
+	// raising every count to at least minCount, doubling minCount each time.
+	for minCount := uint64(1); ; minCount *= 2 {
+		nodes := make([]hNodeBuild, len(symbols), 2*len(symbols)-1)
+		for i, s := range symbols {
+			c := uint64(histogram[s])
+			if c < minCount {
+				c = minCount
+			}
+			nodes[i] = hNodeBuild{count: c, parent: -1}
+		}
+		// Sort the leaves by count, breaking ties by symbol order, so that
+		// the output is deterministic.
+		leaves := make([]int32, len(symbols))
+		for i := range leaves {
+			leaves[i] = int32(i)
+		}
+		sort.SliceStable(leaves, func(i, j int) bool {
+			return nodes[leaves[i]].count < nodes[leaves[j]].count
+		})
+
+		// Merge the two lowest weight nodes, drawing from two queues: the
+		// sorted leaves and the (implicitly sorted) internal nodes.
+		var internal []int32
+		pop := func() int32 {
+			if len(internal) == 0 || (len(leaves) != 0 && nodes[leaves[0]].count <= nodes[internal[0]].count) {
+				n := leaves[0]
+				leaves = leaves[1:]
+				return n
+			}
+			n := internal[0]
+			internal = internal[1:]
+			return n
+		}
+		for len(leaves)+len(internal) > 1 {
+			a, b := pop(), pop()
+			n := int32(len(nodes))
+			nodes = append(nodes, hNodeBuild{count: nodes[a].count + nodes[b].count, parent: -1})
+			nodes[a].parent = n
+			nodes[b].parent = n
+			internal = append(internal, n)
+		}
+
+		ok := true
+		for i, s := range symbols {
+			depth := uint32(0)
+			for n := int32(i); nodes[n].parent >= 0; n = nodes[n].parent {
+				depth++
+			}
+			if depth > maxLength {
+				ok = false
+				break
+			}
+			lengths[s] = depth
+		}
+		if ok {
+			return lengths
+		}
+	}
+}
+
+// hCode is a Huffman code for encoding symbols.
+type hCode struct {
+	// codes are the symbols' codes, with their bits reversed so that they
+	// can be written least significant bit first.
+	codes []uint32
+	// lengths are the number of bits written per symbol. A code with a
+	// single symbol has a zero length, as the decoder reads no bits for it.
+	lengths []uint32
+}
+
+// newHCode returns the canonical Huffman code for the given code lengths.
+func newHCode(codeLengths []uint32) hCode {
+	h := hCode{
+		codes:   make([]uint32, len(codeLengths)),
+		lengths: make([]uint32, len(codeLengths)),
+	}
+	nSymbols := 0
+	for _, cl := range codeLengths {
+		if cl != 0 {
+			nSymbols++
+		}
+	}
+	if nSymbols <= 1 {
+		return h
+	}
+	codes, err := codeLengthsToCodes(codeLengths)
+	if err != nil {
+		// The encoder only builds code lengths of at most 15 bits.
+		panic("vp8l: invalid code lengths")
+	}
+	for symbol, cl := range codeLengths {
+		if cl == 0 {
+			continue
+		}
+		code := codes[symbol]
+		rev := uint32(0)
+		for i := uint32(0); i < cl; i++ {
+			rev = rev<<1 | (code>>i)&1
+		}
+		h.codes[symbol] = rev
+		h.lengths[symbol] = cl
+	}
+	return h
+}
@@ -4,6 +4,10 @@
 
 package vp8l
 
+import (
+	"sort"
+)
+
 // This file deals with image transforms, specified in section 3.
 
 // nTiles returns the number of tiles needed to cover size pixels, where each
@@ -37,160 +41,201 @@ type transform struct {
 	// pix is the tile values, for the predictor and cross-color
 	// transforms, and the color palette, for the color-index transform.
 	pix []byte
+	// top holds a copy of the last row output by the inverse predictor
+	// transform, followed by room for the next row, when the image is
+	// inverse transformed a few rows at a time.
+	top []byte
+	// dst is the output of the inverse color-index transform, when it
+	// reduces the width.
+	dst []byte
 }
 
-var inverseTransforms = [nTransformTypes]func(*transform, []byte, int32) []byte{
+// The inverse transforms each invert rows [y0, y1) of an image that is h
+// pixels high, and return the pixels holding the result. The rows are
+// inverted in order, and may be inverted a few rows at a time.
+var inverseTransforms = [nTransformTypes]func(t *transform, pix []byte, h, y0, y1 int32) []byte{
 	transformTypePredictor:     inversePredictor,
 	transformTypeCrossColor:    inverseCrossColor,
 	transformTypeSubtractGreen: inverseSubtractGreen,
 	transformTypeColorIndexing: inverseColorIndexing,
 }
 
-func inversePredictor(t *transform, pix []byte, h int32) []byte {
-	if t.oldWidth == 0 || h == 0 {
+// inverseTransform applies the inverse of ts, in reverse order, to rows
+// [y0, y1) of pix.
+func inverseTransform(ts []transform, pix []byte, h, y0, y1 int32) []byte {
+	for i := len(ts) - 1; i >= 0; i-- {
+		t := &ts[i]
+		pix = inverseTransforms[t.transformType](t, pix, h, y0, y1)
+	}
+	return pix
+}
+
+func inversePredictor(t *transform, pix []byte, h, y0, y1 int32) []byte {
+	if t.oldWidth == 0 || y0 == y1 {
 		return pix
 	}
-	// The first pixel's predictor is mode 0 (opaque black).
-	pix[3] += 0xff
-	p, mask := int32(4), int32(1)<<t.bits-1
-	for x := int32(1); x < t.oldWidth; x++ {
-		// The rest of the first row's predictor is mode 1 (L).
-		pix[p+0] += pix[p-4]
-		pix[p+1] += pix[p-3]
-		pix[p+2] += pix[p-2]
-		pix[p+3] += pix[p-1]
-		p += 4
-	}
-	top, tilesPerRow := 0, nTiles(t.oldWidth, t.bits)
-	for y := int32(1); y < h; y++ {
-		// The first column's predictor is mode 2 (T).
-		pix[p+0] += pix[top+0]
-		pix[p+1] += pix[top+1]
-		pix[p+2] += pix[top+2]
-		pix[p+3] += pix[top+3]
-		p, top = p+4, top+4
+	w4, y := 4*t.oldWidth, y0
+	if y == 0 {
+		// The first pixel's predictor is mode 0 (opaque black).
+		pix[3] += 0xff
+		for p := int32(4); p < w4; p += 4 {
+			// The rest of the first row's predictor is mode 1 (L).
+			pix[p+0] += pix[p-4]
+			pix[p+1] += pix[p-3]
+			pix[p+2] += pix[p-2]
+			pix[p+3] += pix[p-1]
+		}
+		y++
+	} else {
+		// The row above has been through the transforms that follow this
+		// one, so the first row is predicted next to the copy in t.top.
+		copy(t.top[w4:], pix[w4*y:w4*y+w4])
+		t.predictRow(t.top, w4, y)
+		copy(pix[w4*y:], t.top[w4:])
+		y++
+	}
+	for ; y < y1; y++ {
+		t.predictRow(pix, w4*y, y)
+	}
+	if y1 < h {
+		if t.top == nil {
+			t.top = make([]byte, 2*w4)
+		}
+		copy(t.top, pix[w4*(y1-1):w4*y1])
+	}
+	return pix
+}
 
-		q := 4 * (y >> t.bits) * tilesPerRow
-		predictorMode := t.pix[q+1] & 0x0f
-		q += 4
-		for x := int32(1); x < t.oldWidth; x++ {
-			if x&mask == 0 {
-				predictorMode = t.pix[q+1] & 0x0f
-				q += 4
+// predictRow inverts the predictor transform for the y'th row, which starts
+// at pix[p:] and immediately follows the row above. y must be positive.
+func (t *transform) predictRow(pix []byte, p, y int32) {
+	top, mask := p-4*t.oldWidth, int32(1)<<t.bits-1
+	// The first column's predictor is mode 2 (T).
+	pix[p+0] += pix[top+0]
+	pix[p+1] += pix[top+1]
+	pix[p+2] += pix[top+2]
+	pix[p+3] += pix[top+3]
+	p, top = p+4, top+4
+
+	q := 4 * (y >> t.bits) * nTiles(t.oldWidth, t.bits)
+	predictorMode := t.pix[q+1] & 0x0f
+	q += 4
+	for x := int32(1); x < t.oldWidth; x++ {
+		if x&mask == 0 {
+			predictorMode = t.pix[q+1] & 0x0f
+			q += 4
+		}
+		switch predictorMode {
+		case 0: // Opaque black.
+			pix[p+3] += 0xff
+
+		case 1: // L.
+			pix[p+0] += pix[p-4]
+			pix[p+1] += pix[p-3]
+			pix[p+2] += pix[p-2]
+			pix[p+3] += pix[p-1]
+
+		case 2: // T.
+			pix[p+0] += pix[top+0]
+			pix[p+1] += pix[top+1]
+			pix[p+2] += pix[top+2]
+			pix[p+3] += pix[top+3]
+
+		case 3: // TR.
+			pix[p+0] += pix[top+4]
+			pix[p+1] += pix[top+5]
+			pix[p+2] += pix[top+6]
+			pix[p+3] += pix[top+7]
+
+		case 4: // TL.
+			pix[p+0] += pix[top-4]
+			pix[p+1] += pix[top-3]
+			pix[p+2] += pix[top-2]
+			pix[p+3] += pix[top-1]
+
+		case 5: // Average2(Average2(L, TR), T).
+			pix[p+0] += avg2(avg2(pix[p-4], pix[top+4]), pix[top+0])
+			pix[p+1] += avg2(avg2(pix[p-3], pix[top+5]), pix[top+1])
+			pix[p+2] += avg2(avg2(pix[p-2], pix[top+6]), pix[top+2])
+			pix[p+3] += avg2(avg2(pix[p-1], pix[top+7]), pix[top+3])
+
+		case 6: // Average2(L, TL).
+			pix[p+0] += avg2(pix[p-4], pix[top-4])
+			pix[p+1] += avg2(pix[p-3], pix[top-3])
+			pix[p+2] += avg2(pix[p-2], pix[top-2])
+			pix[p+3] += avg2(pix[p-1], pix[top-1])
+
+		case 7: // Average2(L, T).
+			pix[p+0] += avg2(pix[p-4], pix[top+0])
+			pix[p+1] += avg2(pix[p-3], pix[top+1])
+			pix[p+2] += avg2(pix[p-2], pix[top+2])
+			pix[p+3] += avg2(pix[p-1], pix[top+3])
+
+		case 8: // Average2(TL, T).
+			pix[p+0] += avg2(pix[top-4], pix[top+0])
+			pix[p+1] += avg2(pix[top-3], pix[top+1])
+			pix[p+2] += avg2(pix[top-2], pix[top+2])
+			pix[p+3] += avg2(pix[top-1], pix[top+3])
+
+		case 9: // Average2(T, TR).
+			pix[p+0] += avg2(pix[top+0], pix[top+4])
+			pix[p+1] += avg2(pix[top+1], pix[top+5])
+			pix[p+2] += avg2(pix[top+2], pix[top+6])
+			pix[p+3] += avg2(pix[top+3], pix[top+7])
+
+		case 10: // Average2(Average2(L, TL), Average2(T, TR)).
+			pix[p+0] += avg2(avg2(pix[p-4], pix[top-4]), avg2(pix[top+0], pix[top+4]))
+			pix[p+1] += avg2(avg2(pix[p-3], pix[top-3]), avg2(pix[top+1], pix[top+5]))
+			pix[p+2] += avg2(avg2(pix[p-2], pix[top-2]), avg2(pix[top+2], pix[top+6]))
+			pix[p+3] += avg2(avg2(pix[p-1], pix[top-1]), avg2(pix[top+3], pix[top+7]))
+
+		case 11: // Select(L, T, TL).
+			l0 := int32(pix[p-4])
+			l1 := int32(pix[p-3])
+			l2 := int32(pix[p-2])
+			l3 := int32(pix[p-1])
+			c0 := int32(pix[top-4])
+			c1 := int32(pix[top-3])
+			c2 := int32(pix[top-2])
+			c3 := int32(pix[top-1])
+			t0 := int32(pix[top+0])
+			t1 := int32(pix[top+1])
+			t2 := int32(pix[top+2])
+			t3 := int32(pix[top+3])
+			l := abs(c0-t0) + abs(c1-t1) + abs(c2-t2) + abs(c3-t3)
+			t := abs(c0-l0) + abs(c1-l1) + abs(c2-l2) + abs(c3-l3)
+			if l < t {
+				pix[p+0] += uint8(l0)
+				pix[p+1] += uint8(l1)
+				pix[p+2] += uint8(l2)
+				pix[p+3] += uint8(l3)
+			} else {
+				pix[p+0] += uint8(t0)
+				pix[p+1] += uint8(t1)
+				pix[p+2] += uint8(t2)
+				pix[p+3] += uint8(t3)
 			}
-			switch predictorMode {
-			case 0: // Opaque black.
-				pix[p+3] += 0xff
-
-			case 1: // L.
-				pix[p+0] += pix[p-4]
-				pix[p+1] += pix[p-3]
-				pix[p+2] += pix[p-2]
-				pix[p+3] += pix[p-1]
-
-			case 2: // T.
-				pix[p+0] += pix[top+0]
-				pix[p+1] += pix[top+1]
-				pix[p+2] += pix[top+2]
-				pix[p+3] += pix[top+3]
-
-			case 3: // TR.
-				pix[p+0] += pix[top+4]
-				pix[p+1] += pix[top+5]
-				pix[p+2] += pix[top+6]
-				pix[p+3] += pix[top+7]
-
-			case 4: // TL.
-				pix[p+0] += pix[top-4]
-				pix[p+1] += pix[top-3]
-				pix[p+2] += pix[top-2]
-				pix[p+3] += pix[top-1]
-
-			case 5: // Average2(Average2(L, TR), T).
-				pix[p+0] += avg2(avg2(pix[p-4], pix[top+4]), pix[top+0])
-				pix[p+1] += avg2(avg2(pix[p-3], pix[top+5]), pix[top+1])
-				pix[p+2] += avg2(avg2(pix[p-2], pix[top+6]), pix[top+2])
-				pix[p+3] += avg2(avg2(pix[p-1], pix[top+7]), pix[top+3])
-
-			case 6: // Average2(L, TL).
-				pix[p+0] += avg2(pix[p-4], pix[top-4])
-				pix[p+1] += avg2(pix[p-3], pix[top-3])
-				pix[p+2] += avg2(pix[p-2], pix[top-2])
-				pix[p+3] += avg2(pix[p-1], pix[top-1])
-
-			case 7: // Average2(L, T).
-				pix[p+0] += avg2(pix[p-4], pix[top+0])
-				pix[p+1] += avg2(pix[p-3], pix[top+1])
-				pix[p+2] += avg2(pix[p-2], pix[top+2])
-				pix[p+3] += avg2(pix[p-1], pix[top+3])
-
-			case 8: // Average2(TL, T).
-				pix[p+0] += avg2(pix[top-4], pix[top+0])
-				pix[p+1] += avg2(pix[top-3], pix[top+1])
-				pix[p+2] += avg2(pix[top-2], pix[top+2])
-				pix[p+3] += avg2(pix[top-1], pix[top+3])
-
-			case 9: // Average2(T, TR).
-				pix[p+0] += avg2(pix[top+0], pix[top+4])
-				pix[p+1] += avg2(pix[top+1], pix[top+5])
-				pix[p+2] += avg2(pix[top+2], pix[top+6])
-				pix[p+3] += avg2(pix[top+3], pix[top+7])
-
-			case 10: // Average2(Average2(L, TL), Average2(T, TR)).
-				pix[p+0] += avg2(avg2(pix[p-4], pix[top-4]), avg2(pix[top+0], pix[top+4]))
-				pix[p+1] += avg2(avg2(pix[p-3], pix[top-3]), avg2(pix[top+1], pix[top+5]))
-				pix[p+2] += avg2(avg2(pix[p-2], pix[top-2]), avg2(pix[top+2], pix[top+6]))
-				pix[p+3] += avg2(avg2(pix[p-1], pix[top-1]), avg2(pix[top+3], pix[top+7]))
-
-			case 11: // Select(L, T, TL).
-				l0 := int32(pix[p-4])
-				l1 := int32(pix[p-3])
-				l2 := int32(pix[p-2])
-				l3 := int32(pix[p-1])
-				c0 := int32(pix[top-4])
-				c1 := int32(pix[top-3])
-				c2 := int32(pix[top-2])
-				c3 := int32(pix[top-1])
-				t0 := int32(pix[top+0])
-				t1 := int32(pix[top+1])
-				t2 := int32(pix[top+2])
-				t3 := int32(pix[top+3])
-				l := abs(c0-t0) + abs(c1-t1) + abs(c2-t2) + abs(c3-t3)
-				t := abs(c0-l0) + abs(c1-l1) + abs(c2-l2) + abs(c3-l3)
-				if l < t {
-					pix[p+0] += uint8(l0)
-					pix[p+1] += uint8(l1)
-					pix[p+2] += uint8(l2)
-					pix[p+3] += uint8(l3)
-				} else {
-					pix[p+0] += uint8(t0)
-					pix[p+1] += uint8(t1)
-					pix[p+2] += uint8(t2)
-					pix[p+3] += uint8(t3)
-				}
 
-			case 12: // ClampAddSubtractFull(L, T, TL).
-				pix[p+0] += clampAddSubtractFull(pix[p-4], pix[top+0], pix[top-4])
-				pix[p+1] += clampAddSubtractFull(pix[p-3], pix[top+1], pix[top-3])
-				pix[p+2] += clampAddSubtractFull(pix[p-2], pix[top+2], pix[top-2])
-				pix[p+3] += clampAddSubtractFull(pix[p-1], pix[top+3], pix[top-1])
-
-			case 13: // ClampAddSubtractHalf(Average2(L, T), TL).
-				pix[p+0] += clampAddSubtractHalf(avg2(pix[p-4], pix[top+0]), pix[top-4])
-				pix[p+1] += clampAddSubtractHalf(avg2(pix[p-3], pix[top+1]), pix[top-3])
-				pix[p+2] += clampAddSubtractHalf(avg2(pix[p-2], pix[top+2]), pix[top-2])
-				pix[p+3] += clampAddSubtractHalf(avg2(pix[p-1], pix[top+3]), pix[top-1])
-			}
-			p, top = p+4, top+4
+		case 12: // ClampAddSubtractFull(L, T, TL).
+			pix[p+0] += clampAddSubtractFull(pix[p-4], pix[top+0], pix[top-4])
+			pix[p+1] += clampAddSubtractFull(pix[p-3], pix[top+1], pix[top-3])
+			pix[p+2] += clampAddSubtractFull(pix[p-2], pix[top+2], pix[top-2])
+			pix[p+3] += clampAddSubtractFull(pix[p-1], pix[top+3], pix[top-1])
+
+		case 13: // ClampAddSubtractHalf(Average2(L, T), TL).
+			pix[p+0] += clampAddSubtractHalf(avg2(pix[p-4], pix[top+0]), pix[top-4])
+			pix[p+1] += clampAddSubtractHalf(avg2(pix[p-3], pix[top+1]), pix[top-3])
+			pix[p+2] += clampAddSubtractHalf(avg2(pix[p-2], pix[top+2]), pix[top-2])
+			pix[p+3] += clampAddSubtractHalf(avg2(pix[p-1], pix[top+3]), pix[top-1])
 		}
+		p, top = p+4, top+4
 	}
-	return pix
 }
 
-func inverseCrossColor(t *transform, pix []byte, h int32) []byte {
+func inverseCrossColor(t *transform, pix []byte, h, y0, y1 int32) []byte {
 	var greenToRed, greenToBlue, redToBlue int32
-	p, mask, tilesPerRow := int32(0), int32(1)<<t.bits-1, nTiles(t.oldWidth, t.bits)
-	for y := int32(0); y < h; y++ {
+	p, mask, tilesPerRow := 4*t.oldWidth*y0, int32(1)<<t.bits-1, nTiles(t.oldWidth, t.bits)
+	for y := y0; y < y1; y++ {
 		q := 4 * (y >> t.bits) * tilesPerRow
 		for x := int32(0); x < t.oldWidth; x++ {
 			if x&mask == 0 {
@@ -213,8 +258,8 @@ func inverseCrossColor(t *transform, pix []byte, h int32) []byte {
 	return pix
 }
 
-func inverseSubtractGreen(t *transform, pix []byte, h int32) []byte {
-	for p := 0; p < len(pix); p += 4 {
+func inverseSubtractGreen(t *transform, pix []byte, h, y0, y1 int32) []byte {
+	for p := 4 * t.oldWidth * y0; p < 4*t.oldWidth*y1; p += 4 {
 		green := pix[p+1]
 		pix[p+0] += green
 		pix[p+2] += green
@@ -222,9 +267,9 @@ func inverseSubtractGreen(t *transform, pix []byte, h int32) []byte {
 	return pix
 }
 
-func inverseColorIndexing(t *transform, pix []byte, h int32) []byte {
+func inverseColorIndexing(t *transform, pix []byte, h, y0, y1 int32) []byte {
 	if t.bits == 0 {
-		for p := 0; p < len(pix); p += 4 {
+		for p := 4 * t.oldWidth * y0; p < 4*t.oldWidth*y1; p += 4 {
 			i := 4 * uint32(pix[p+1])
 			pix[p+0] = t.pix[i+0]
 			pix[p+1] = t.pix[i+1]
@@ -244,8 +289,11 @@ func inverseColorIndexing(t *transform, pix []byte, h int32) []byte {
 		vMask, xMask = 0x01, 0x07
 	}
 
-	d, p, v, dst := 0, 0, uint32(0), make([]byte, 4*t.oldWidth*h)
-	for y := int32(0); y < h; y++ {
+	if t.dst == nil {
+		t.dst = make([]byte, 4*t.oldWidth*h)
+	}
+	d, p, v, dst := 4*t.oldWidth*y0, 4*nTiles(t.oldWidth, t.bits)*y0, uint32(0), t.dst
+	for y := y0; y < y1; y++ {
 		for x := int32(0); x < t.oldWidth; x++ {
 			if x&xMask == 0 {
 				v = uint32(pix[p+1])
@@ -297,3 +345,354 @@ func clampAddSubtractHalf(a, b uint8) uint8 {
 	}
 	return uint8(x)
 }
+
+// The functions below implement the forward transforms, used by the encoder.
+// Pixels are held as ARGB uint32 values, in row-major order, and each forward
+// transform is the exact inverse of the corresponding inverse transform above.
+
+// argbAdd and argbSub add or subtract two ARGB values channel-wise, modulo 256.
+func argbAdd(a, b uint32) uint32 {
+	ag := (a & 0xff00ff00) + (b & 0xff00ff00)
+	rb := (a & 0x00ff00ff) + (b & 0x00ff00ff)
+	return ag&0xff00ff00 | rb&0x00ff00ff
+}
+
+func argbSub(a, b uint32) uint32 {
+	ag := 0x00ff00ff + (a & 0xff00ff00) - (b & 0xff00ff00)
+	rb := 0xff00ff00 + (a & 0x00ff00ff) - (b & 0x00ff00ff)
+	return ag&0xff00ff00 | rb&0x00ff00ff
+}
+
+// argbAvg2 returns the channel-wise Average2 of two ARGB values.
+func argbAvg2(a, b uint32) uint32 {
+	return (((a ^ b) & 0xfefefefe) >> 1) + (a & b)
+}
+
+// argbChannels splits an ARGB value into its alpha, red, green and blue
+// channels.
+func argbChannels(c uint32) [4]int32 {
+	return [4]int32{int32(c >> 24), int32(c>>16) & 0xff, int32(c>>8) & 0xff, int32(c) & 0xff}
+}
+
+func argbFromChannels(c [4]int32) uint32 {
+	return uint32(c[0])<<24 | uint32(c[1])<<16 | uint32(c[2])<<8 | uint32(c[3])
+}
+
+// predict returns the predicted value for the given predictor mode and the
+// left, top, top-right and top-left neighbors.
+func predict(mode uint32, l, t, tr, tl uint32) uint32 {
+	switch mode {
+	case 0: // Opaque black.
+		return 0xff000000
+	case 1: // L.
+		return l
+	case 2: // T.
+		return t
+	case 3: // TR.
+		return tr
+	case 4: // TL.
+		return tl
+	case 5: // Average2(Average2(L, TR), T).
+		return argbAvg2(argbAvg2(l, tr), t)
+	case 6: // Average2(L, TL).
+		return argbAvg2(l, tl)
+	case 7: // Average2(L, T).
+		return argbAvg2(l, t)
+	case 8: // Average2(TL, T).
+		return argbAvg2(tl, t)
+	case 9: // Average2(T, TR).
+		return argbAvg2(t, tr)
+	case 10: // Average2(Average2(L, TL), Average2(T, TR)).
+		return argbAvg2(argbAvg2(l, tl), argbAvg2(t, tr))
+	case 11: // Select(L, T, TL).
+		lc, tc, tlc := argbChannels(l), argbChannels(t), argbChannels(tl)
+		pl, pt := int32(0), int32(0)
+		for i := range tlc {
+			pl += abs(tlc[i] - tc[i])
+			pt += abs(tlc[i] - lc[i])
+		}
+		if pl < pt {
+			return l
+		}
+		return t
+	case 12: // ClampAddSubtractFull(L, T, TL).
+		lc, tc, tlc := argbChannels(l), argbChannels(t), argbChannels(tl)
+		var c [4]int32
+		for i := range c {
+			c[i] = int32(clampAddSubtractFull(uint8(lc[i]), uint8(tc[i]), uint8(tlc[i])))
+		}
+		return argbFromChannels(c)
+	case 13: // ClampAddSubtractHalf(Average2(L, T), TL).
+		a, tlc := argbChannels(argbAvg2(l, t)), argbChannels(tl)
+		var c [4]int32
+		for i := range c {
+			c[i] = int32(clampAddSubtractHalf(uint8(a[i]), uint8(tlc[i])))
+		}
+		return argbFromChannels(c)
+	}
+	return 0
+}
+
+const nPredictorModes = 14
+
+// residualCost estimates the cost of encoding a residual. Small residuals,
+// positive or negative, are cheaper.
+func residualCost(r uint32) int32 {
+	return abs(int32(int8(r>>24))) + abs(int32(int8(r>>16))) +
+		abs(int32(int8(r>>8))) + abs(int32(int8(r)))
+}
+
+// forwardPredictor replaces the pixels by their prediction residuals,
+// choosing the best predictor mode for each tile. It returns the sub-image
+// that holds the per-tile modes in its green channel.
+func forwardPredictor(argb []uint32, w, h int32, bits uint32) []uint32 {
+	tilesPerRow, tilesPerColumn := nTiles(w, bits), nTiles(h, bits)
+	modes := make([]uint32, tilesPerRow*tilesPerColumn)
+	orig := append([]uint32(nil), argb...)
+
+	// residual returns the residual at (x, y) under the given mode, applying
+	// the special cases for the first row and column.
+	residual := func(x, y int32, mode uint32) uint32 {
+		p := y*w + x
+		switch {
+		case y == 0 && x == 0:
+			mode = 0
+		case y == 0:
+			mode = 1
+		case x == 0:
+			mode = 2
+		}
+		var l, t, tr, tl uint32
+		if x > 0 {
+			l = orig[p-1]
+		}
+		if y > 0 {
+			t = orig[p-w]
+			// For the rightmost column, the top-right pixel is the leftmost
+			// pixel of the current row, which is also at orig[p-w+1].
+			tr = orig[p-w+1]
+			if x > 0 {
+				tl = orig[p-w-1]
+			}
+		}
+		return argbSub(orig[p], predict(mode, l, t, tr, tl))
+	}
+
+	for ty := int32(0); ty < tilesPerColumn; ty++ {
+		y0, y1 := ty<<bits, (ty+1)<<bits
+		if y1 > h {
+			y1 = h
+		}
+		for tx := int32(0); tx < tilesPerRow; tx++ {
+			x0, x1 := tx<<bits, (tx+1)<<bits
+			if x1 > w {
+				x1 = w
+			}
+			bestMode, bestCost := uint32(0), int32(-1)
+			for mode := uint32(0); mode < nPredictorModes; mode++ {
+				cost := int32(0)
+				for y := y0; y < y1; y++ {
+					for x := x0; x < x1; x++ {
+						cost += residualCost(residual(x, y, mode))
+					}
+				}
+				if bestCost < 0 || cost < bestCost {
+					bestMode, bestCost = mode, cost
+				}
+			}
+			modes[ty*tilesPerRow+tx] = 0xff000000 | bestMode<<8
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					argb[y*w+x] = residual(x, y, bestMode)
+				}
+			}
+		}
+	}
+	return modes
+}
+
+// colorTransformDelta is the ColorTransformDelta function from section 4.2.
+func colorTransformDelta(t, c int8) uint32 {
+	return uint32(int32(t)*int32(c)) >> 5
+}
+
+// crossColorCost estimates the cost of the red or blue residuals of a tile
+// under the given cross-color multipliers.
+func crossColorCost(argb []uint32, w, x0, y0, x1, y1 int32, blue bool, m0, m1 int8) int32 {
+	cost := int32(0)
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			c := argb[y*w+x]
+			red, green := int8(c>>16), int8(c>>8)
+			if blue {
+				b := uint32(c) - colorTransformDelta(m0, green) - colorTransformDelta(m1, red)
+				cost += abs(int32(int8(b)))
+			} else {
+				r := uint32(c>>16) - colorTransformDelta(m0, green)
+				cost += abs(int32(int8(r)))
+			}
+		}
+	}
+	return cost
+}
+
+// clampInt8 clamps x to the range of an int8.
+func clampInt8(x int32) int8 {
+	if x < -128 {
+		return -128
+	}
+	if x > 127 {
+		return 127
+	}
+	return int8(x)
+}
+
+// forwardCrossColor decorrelates the red and blue channels from the green
+// channel (and the blue channel from the red channel), choosing multipliers
+// for each tile. It returns the sub-image that holds the per-tile
+// multipliers.
+func forwardCrossColor(argb []uint32, w, h int32, bits uint32) []uint32 {
+	tilesPerRow, tilesPerColumn := nTiles(w, bits), nTiles(h, bits)
+	elements := make([]uint32, tilesPerRow*tilesPerColumn)
+	for ty := int32(0); ty < tilesPerColumn; ty++ {
+		y0, y1 := ty<<bits, (ty+1)<<bits
+		if y1 > h {
+			y1 = h
+		}
+		for tx := int32(0); tx < tilesPerRow; tx++ {
+			x0, x1 := tx<<bits, (tx+1)<<bits
+			if x1 > w {
+				x1 = w
+			}
+
+			// Start with a least squares estimate of the multipliers, and then
+			// refine it by searching its neighborhood.
+			var sgg, sgr, sgb, srr, srb int64
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					c := argb[y*w+x]
+					r, g, b := int64(int8(c>>16)), int64(int8(c>>8)), int64(int8(c))
+					sgg += g * g
+					sgr += g * r
+					sgb += g * b
+					srr += r * r
+					srb += r * b
+				}
+			}
+			var estGR, estGB, estRB int32
+			if sgg != 0 {
+				estGR = int32(32 * sgr / sgg)
+			}
+			if det := sgg*srr - sgr*sgr; det != 0 {
+				estGB = int32(32 * (sgb*srr - srb*sgr) / det)
+				estRB = int32(32 * (srb*sgg - sgb*sgr) / det)
+			}
+
+			greenToRed, best := int8(0), crossColorCost(argb, w, x0, y0, x1, y1, false, 0, 0)
+			for d := int32(-4); d <= 4; d++ {
+				m := clampInt8(estGR + d)
+				if c := crossColorCost(argb, w, x0, y0, x1, y1, false, m, 0); c < best {
+					greenToRed, best = m, c
+				}
+			}
+			greenToBlue, redToBlue := int8(0), int8(0)
+			best = crossColorCost(argb, w, x0, y0, x1, y1, true, 0, 0)
+			for d0 := int32(-2); d0 <= 2; d0++ {
+				for d1 := int32(-2); d1 <= 2; d1++ {
+					m0, m1 := clampInt8(estGB+d0), clampInt8(estRB+d1)
+					if c := crossColorCost(argb, w, x0, y0, x1, y1, true, m0, m1); c < best {
+						greenToBlue, redToBlue, best = m0, m1, c
+					}
+				}
+			}
+
+			elements[ty*tilesPerRow+tx] = 0xff000000 |
+				uint32(uint8(redToBlue))<<16 | uint32(uint8(greenToBlue))<<8 | uint32(uint8(greenToRed))
+			for y := y0; y < y1; y++ {
+				for x := x0; x < x1; x++ {
+					p := y*w + x
+					c := argb[p]
+					red, green := int8(c>>16), int8(c>>8)
+					r := uint32(c>>16) - colorTransformDelta(greenToRed, green)
+					b := uint32(c) - colorTransformDelta(greenToBlue, green) - colorTransformDelta(redToBlue, red)
+					argb[p] = c&0xff00ff00 | (r&0xff)<<16 | b&0xff
+				}
+			}
+		}
+	}
+	return elements
+}
+
+// forwardSubtractGreen subtracts the green value from the red and blue values.
+func forwardSubtractGreen(argb []uint32) {
+	for i, c := range argb {
+		g := (c >> 8) & 0xff
+		rb := 0xff00ff00 + (c & 0x00ff00ff) - (g<<16 | g)
+		argb[i] = c&0xff00ff00 | rb&0x00ff00ff
+	}
+}
+
+// palette returns the distinct colors of argb, sorted, or nil if there are
+// more than 256 of them.
+func palette(argb []uint32) []uint32 {
+	seen := make(map[uint32]struct{})
+	for _, c := range argb {
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		if len(seen) == 256 {
+			return nil
+		}
+		seen[c] = struct{}{}
+	}
+	pal := make([]uint32, 0, len(seen))
+	for c := range seen {
+		pal = append(pal, c)
+	}
+	sort.Slice(pal, func(i, j int) bool { return pal[i] < pal[j] })
+	return pal
+}
+
+// colorIndexingBits returns the log-2 number of pixels packed per byte for a
+// palette of n colors, as per section 4.4.
+func colorIndexingBits(n int) uint32 {
+	switch {
+	case n <= 2:
+		return 3
+	case n <= 4:
+		return 2
+	case n <= 16:
+		return 1
+	}
+	return 0
+}
+
+// forwardColorIndexing replaces the pixels by their palette indices, packing
+// several indices into one pixel for small palettes. It returns the packed
+// pixels, their width, and the delta-coded palette sub-image.
+func forwardColorIndexing(argb []uint32, w, h int32, pal []uint32) (packed []uint32, packedW int32, palImage []uint32) {
+	index := make(map[uint32]uint32, len(pal))
+	for i, c := range pal {
+		index[c] = uint32(i)
+	}
+	bits := colorIndexingBits(len(pal))
+	bitsPerPixel := uint32(8 >> bits)
+	packedW = nTiles(w, bits)
+	packed = make([]uint32, packedW*h)
+	for y := int32(0); y < h; y++ {
+		for x := int32(0); x < w; x++ {
+			i := index[argb[y*w+x]]
+			packed[y*packedW+x>>bits] |= i << (bitsPerPixel * uint32(x&(1<<bits-1)))
+		}
+	}
+	for i, v := range packed {
+		packed[i] = 0xff000000 | (v&0xff)<<8
+	}
+
+	palImage = make([]uint32, len(pal))
+	palImage[0] = pal[0]
+	for i := 1; i < len(pal); i++ {
+		palImage[i] = argbSub(pal[i], pal[i-1])
+	}
+	return packed, packedW, palImage
+}
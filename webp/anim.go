@@ -0,0 +1,147 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import (
+	"image"
+	"image/color"
+)
+
+// Disposal methods, as specified in the ANMF chunk.
+const (
+	// DisposalNone leaves the canvas as is.
+	DisposalNone = 0x00
+	// DisposalBackground fills the frame's rectangle of the canvas with the
+	// background color before rendering the next frame.
+	DisposalBackground = 0x01
+)
+
+// Blending methods, as specified in the ANMF chunk.
+const (
+	// BlendAlpha alpha-blends the frame onto the canvas.
+	BlendAlpha = 0x00
+	// BlendNone overwrites the frame's rectangle of the canvas.
+	BlendNone = 0x01
+)
+
+// WEBP represents the possibly multiple images stored in a WEBP file.
+type WEBP struct {
+	// Image are the successive frames. Each frame's bounds give its position
+	// on the canvas.
+	Image []image.Image
+	// Duration are the successive display times, in milliseconds, one per
+	// frame.
+	Duration []int
+	// Disposal are the successive disposal methods, one per frame.
+	Disposal []byte
+	// Blend are the successive blending methods, one per frame.
+	Blend []byte
+	// LoopCount is the number of times the animation is shown. Zero means to
+	// loop forever.
+	LoopCount int
+	// BackgroundColor is the suggested color of the canvas. Viewers may
+	// ignore it, as the Compositor does by default.
+	BackgroundColor color.NRGBA
+	// Config is the global color model and canvas size.
+	Config image.Config
+}
+
+// Compositor renders the frames of a WEBP onto a canvas.
+type Compositor struct {
+	// UseBackgroundColor is whether the canvas is initialized and disposed to
+	// the WEBP's BackgroundColor. Otherwise, it is transparent black, as for
+	// libwebp's animation decoder. It should be set before the first call to
+	// Next.
+	UseBackgroundColor bool
+
+	w      *WEBP
+	canvas *image.NRGBA
+	i      int
+}
+
+// NewCompositor returns a Compositor for the frames of w.
+func NewCompositor(w *WEBP) *Compositor {
+	return &Compositor{w: w}
+}
+
+// Next renders the next frame and returns the fully rendered canvas. The
+// returned image is not modified by later calls. It returns nil if there are
+// no more frames.
+func (c *Compositor) Next() *image.NRGBA {
+	w := c.w
+	if c.i >= len(w.Image) {
+		return nil
+	}
+	bg := color.NRGBA{}
+	if c.UseBackgroundColor {
+		bg = w.BackgroundColor
+	}
+	if c.canvas == nil {
+		c.canvas = image.NewNRGBA(image.Rect(0, 0, w.Config.Width, w.Config.Height))
+		fillNRGBA(c.canvas, c.canvas.Rect, bg)
+	} else if byteAt(w.Disposal, c.i-1) == DisposalBackground {
+		fillNRGBA(c.canvas, w.Image[c.i-1].Bounds(), bg)
+	}
+
+	m := w.Image[c.i]
+	blend := byteAt(w.Blend, c.i) == BlendAlpha
+	r := m.Bounds().Intersect(c.canvas.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			src := color.NRGBAModel.Convert(m.At(x, y)).(color.NRGBA)
+			if blend {
+				src = blendNRGBA(src, c.canvas.NRGBAAt(x, y))
+			}
+			c.canvas.SetNRGBA(x, y, src)
+		}
+	}
+	c.i++
+
+	canvas := image.NewNRGBA(c.canvas.Rect)
+	copy(canvas.Pix, c.canvas.Pix)
+	return canvas
+}
+
+// byteAt returns b[i], or zero if i is out of range.
+func byteAt(b []byte, i int) byte {
+	if i < 0 || i >= len(b) {
+		return 0
+	}
+	return b[i]
+}
+
+// fillNRGBA fills the part of m within r with the color c.
+func fillNRGBA(m *image.NRGBA, r image.Rectangle, c color.NRGBA) {
+	r = r.Intersect(m.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			m.SetNRGBA(x, y, c)
+		}
+	}
+}
+
+// blendNRGBA returns src alpha-blended onto dst, as specified for the ANMF
+// chunk. The integer arithmetic follows libwebp's BlendPixelNonPremult.
+func blendNRGBA(src, dst color.NRGBA) color.NRGBA {
+	if src.A == 0xff {
+		return src
+	}
+	if src.A == 0 {
+		return dst
+	}
+	srcA := uint32(src.A)
+	dstFactorA := uint32(dst.A) * (256 - srcA) >> 8
+	blendA := srcA + dstFactorA
+	scale := (1 << 24) / blendA
+	channel := func(s, d uint8) uint8 {
+		return uint8((uint32(s)*srcA + uint32(d)*dstFactorA) * scale >> 24)
+	}
+	return color.NRGBA{
+		R: channel(src.R, dst.R),
+		G: channel(src.G, dst.G),
+		B: channel(src.B, dst.B),
+		A: uint8(blendA),
+	}
+}
@@ -0,0 +1,351 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/image/riff"
+)
+
+// writeChunk writes a RIFF chunk, padded to an even length.
+func writeChunk(w io.Writer, id riff.FourCC, data []byte) {
+	n := uint32(len(data))
+	w.Write(append(id[:], uint8(n), uint8(n>>8), uint8(n>>16), uint8(n>>24)))
+	w.Write(data)
+	if n&1 != 0 {
+		w.Write([]byte{0})
+	}
+}
+
+// frameChunks returns the ALPH, VP8 and VP8L chunks, but not the VP8X chunk,
+// of m encoded as a still WEBP image.
+func frameChunks(t *testing.T, m image.Image, o *Options) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, m, o); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	_, r, err := riff.NewReader(buf)
+	if err != nil {
+		t.Fatalf("riff.NewReader: %v", err)
+	}
+	chunks := &bytes.Buffer{}
+	for {
+		id, _, data, err := r.Next()
+		if err != nil {
+			break
+		}
+		b, err := ioutil.ReadAll(data)
+		if err != nil {
+			t.Fatalf("ReadAll: %v", err)
+		}
+		if id != fccVP8X {
+			writeChunk(chunks, id, b)
+		}
+	}
+	return chunks.Bytes()
+}
+
+type testFrame struct {
+	m                  image.Image
+	o                  *Options
+	duration           int
+	disposal, blending byte
+}
+
+// makeAnimation returns an animated WEBP image with the given canvas size,
+// background color, loop count and frames.
+func makeAnimation(t *testing.T, w, h int, bg color.NRGBA, loopCount int, frames []testFrame) []byte {
+	t.Helper()
+	chunks := &bytes.Buffer{}
+	chunks.Write(fccWEBP[:])
+	writeChunk(chunks, fccVP8X, []byte{
+		0x12, 0, 0, 0,
+		uint8(w - 1), uint8((w - 1) >> 8), 0,
+		uint8(h - 1), uint8((h - 1) >> 8), 0,
+	})
+	writeChunk(chunks, fccANIM, []byte{bg.B, bg.G, bg.R, bg.A, uint8(loopCount), uint8(loopCount >> 8)})
+	for _, f := range frames {
+		b := f.m.Bounds()
+		data := []byte{
+			uint8(b.Min.X / 2), 0, 0,
+			uint8(b.Min.Y / 2), 0, 0,
+			uint8(b.Dx() - 1), 0, 0,
+			uint8(b.Dy() - 1), 0, 0,
+			uint8(f.duration), uint8(f.duration >> 8), 0,
+			f.blending<<1 | f.disposal,
+		}
+		data = append(data, frameChunks(t, f.m, f.o)...)
+		writeChunk(chunks, fccANMF, data)
+	}
+	buf := &bytes.Buffer{}
+	writeChunk(buf, riff.FourCC{'R', 'I', 'F', 'F'}, chunks.Bytes())
+	return buf.Bytes()
+}
+
+func uniformNRGBA(r image.Rectangle, c color.NRGBA) *image.NRGBA {
+	m := image.NewNRGBA(r)
+	fillNRGBA(m, r, c)
+	return m
+}
+
+func TestDecodeAnimation(t *testing.T) {
+	var (
+		red   = color.NRGBA{0xff, 0x00, 0x00, 0xff}
+		blue  = color.NRGBA{0x00, 0x00, 0xff, 0x80}
+		green = color.NRGBA{0x00, 0xff, 0x00, 0xff}
+		bg    = color.NRGBA{0x10, 0x20, 0x30, 0x40}
+		// purple is blue alpha-blended onto red.
+		purple = color.NRGBA{0x7e, 0x00, 0x7f, 0xff}
+	)
+	// lossy is a lossy frame with an ALPH chunk.
+	lossy := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	for i := range lossy.Pix {
+		lossy.Pix[i] = uint8(16 * i)
+	}
+	frames := []testFrame{
+		{uniformNRGBA(image.Rect(0, 0, 8, 6), red), nil, 100, DisposalNone, BlendNone},
+		{uniformNRGBA(image.Rect(2, 2, 6, 4), blue), nil, 200, DisposalBackground, BlendAlpha},
+		{uniformNRGBA(image.Rect(4, 0, 6, 2), green), nil, 300, DisposalNone, BlendAlpha},
+		{lossy, &Options{Lossy: true}, 400, DisposalNone, BlendNone},
+	}
+	data := makeAnimation(t, 8, 6, bg, 3, frames)
+
+	w, err := DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("DecodeAll: %v", err)
+	}
+	if w.Config.Width != 8 || w.Config.Height != 6 || w.Config.ColorModel != color.NRGBAModel {
+		t.Errorf("Config: got %v %dx%d, want NRGBA 8x6", w.Config.ColorModel, w.Config.Width, w.Config.Height)
+	}
+	if w.LoopCount != 3 || w.BackgroundColor != bg {
+		t.Errorf("LoopCount, BackgroundColor: got %d, %v, want 3, %v", w.LoopCount, w.BackgroundColor, bg)
+	}
+	if len(w.Image) != len(frames) {
+		t.Fatalf("number of frames: got %d, want %d", len(w.Image), len(frames))
+	}
+	for i, f := range frames {
+		if got, want := w.Image[i].Bounds(), f.m.Bounds(); got != want {
+			t.Errorf("frame %d: bounds: got %v, want %v", i, got, want)
+		}
+		if w.Duration[i] != f.duration || w.Disposal[i] != f.disposal || w.Blend[i] != f.blending {
+			t.Errorf("frame %d: got duration %d, disposal %d, blend %d, want %d, %d, %d",
+				i, w.Duration[i], w.Disposal[i], w.Blend[i], f.duration, f.disposal, f.blending)
+		}
+	}
+	a, ok := w.Image[3].(*image.NYCbCrA)
+	if !ok {
+		t.Fatalf("frame 3: got %T, want *image.NYCbCrA", w.Image[3])
+	}
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 4; x++ {
+			if got, want := a.NYCbCrAAt(x, y).A, lossy.NRGBAAt(x, y).A; got != want {
+				t.Errorf("frame 3: alpha at (%d, %d): got %d, want %d", x, y, got, want)
+			}
+		}
+	}
+
+	// want holds the expected canvases, as rows of "r" for red, "p" for
+	// purple, "g" for green and "." for transparent black.
+	want := [][]string{
+		{"rrrrrrrr", "rrrrrrrr", "rrrrrrrr", "rrrrrrrr", "rrrrrrrr", "rrrrrrrr"},
+		{"rrrrrrrr", "rrrrrrrr", "rrpppprr", "rrpppprr", "rrrrrrrr", "rrrrrrrr"},
+		{"rrrrggrr", "rrrrggrr", "rr....rr", "rr....rr", "rrrrrrrr", "rrrrrrrr"},
+	}
+	colors := map[byte]color.NRGBA{'r': red, 'p': purple, 'g': green, '.': {}}
+	c := NewCompositor(w)
+	for i := 0; ; i++ {
+		canvas := c.Next()
+		if canvas == nil {
+			if i != len(frames) {
+				t.Errorf("got %d canvases, want %d", i, len(frames))
+			}
+			break
+		}
+		if i >= len(want) {
+			// The lossy frame's colors are not exact. Check its alpha and
+			// that it did not affect the rest of the canvas.
+			if got, want := canvas.NRGBAAt(1, 1).A, lossy.NRGBAAt(1, 1).A; got != want {
+				t.Errorf("canvas %d: alpha at (1, 1): got %d, want %d", i, got, want)
+			}
+			if got := canvas.NRGBAAt(4, 0); got != green {
+				t.Errorf("canvas %d: at (4, 0): got %v, want %v", i, got, green)
+			}
+			continue
+		}
+		for y, row := range want[i] {
+			for x := range row {
+				if got, want := canvas.NRGBAAt(x, y), colors[row[x]]; got != want {
+					t.Errorf("canvas %d: at (%d, %d): got %v, want %v", i, x, y, got, want)
+				}
+			}
+		}
+	}
+
+	// Decode returns the first canvas.
+	m, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if got, ok := m.(*image.NRGBA); !ok || got.Bounds() != image.Rect(0, 0, 8, 6) || got.NRGBAAt(3, 3) != red {
+		t.Errorf("Decode: got %T with bounds %v, want the first canvas", m, m.Bounds())
+	}
+	cfg, err := DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("DecodeConfig: %v", err)
+	}
+	if cfg != w.Config {
+		t.Errorf("DecodeConfig: got %v, want %v", cfg, w.Config)
+	}
+}
+
+func TestCompositorBackgroundColor(t *testing.T) {
+	bg := color.NRGBA{0x10, 0x20, 0x30, 0xff}
+	w := &WEBP{
+		Image: []image.Image{
+			uniformNRGBA(image.Rect(0, 0, 2, 2), color.NRGBA{}),
+			uniformNRGBA(image.Rect(2, 0, 4, 2), color.NRGBA{0xff, 0xff, 0xff, 0xff}),
+		},
+		Disposal:        []byte{DisposalNone, DisposalBackground},
+		Blend:           []byte{BlendAlpha, BlendAlpha},
+		BackgroundColor: bg,
+		Config:          image.Config{ColorModel: color.NRGBAModel, Width: 4, Height: 2},
+	}
+	c := NewCompositor(w)
+	c.UseBackgroundColor = true
+	if got := c.Next().NRGBAAt(0, 0); got != bg {
+		t.Errorf("at (0, 0): got %v, want %v", got, bg)
+	}
+}
+
+func TestDecodeAllStill(t *testing.T) {
+	f, err := ioutil.ReadFile("../testdata/yellow_rose.lossy-with-alpha.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := DecodeAll(bytes.NewReader(f))
+	if err != nil {
+		t.Fatalf("DecodeAll: %v", err)
+	}
+	if len(w.Image) != 1 {
+		t.Fatalf("number of frames: got %d, want 1", len(w.Image))
+	}
+	if _, ok := w.Image[0].(*image.NYCbCrA); !ok || w.Config.ColorModel != color.NYCbCrAModel {
+		t.Errorf("got %T and %v, want *image.NYCbCrA", w.Image[0], w.Config.ColorModel)
+	}
+}
+
+func TestEncodeAll(t *testing.T) {
+	var (
+		red   = color.NRGBA{0xff, 0x00, 0x00, 0xff}
+		blue  = color.NRGBA{0x00, 0x00, 0xff, 0xff}
+		green = color.NRGBA{0x00, 0xff, 0x00, 0x80}
+	)
+	// The frames are full canvases, as when converting from a GIF.
+	const w, h = 64, 48
+	frame0 := uniformNRGBA(image.Rect(0, 0, w, h), red)
+	frame1 := uniformNRGBA(image.Rect(0, 0, w, h), red)
+	fillNRGBA(frame1, image.Rect(13, 7, 20, 30), blue)
+	frame2 := uniformNRGBA(image.Rect(0, 0, w, h), red)
+	fillNRGBA(frame2, image.Rect(40, 20, 50, 25), green)
+	frame3 := image.NewNRGBA(image.Rect(0, 0, w, h))
+	fillNRGBA(frame3, image.Rect(1, 1, 3, 3), blue)
+	in := &WEBP{
+		Image:           []image.Image{frame0, frame1, frame2, frame2, frame3},
+		Duration:        []int{10, 20, 30, 40, 50},
+		Blend:           []byte{BlendNone, BlendNone, BlendNone, BlendNone, BlendNone},
+		LoopCount:       7,
+		BackgroundColor: color.NRGBA{0x01, 0x02, 0x03, 0x04},
+		Config:          image.Config{ColorModel: color.NRGBAModel, Width: w, Height: h},
+	}
+	buf := &bytes.Buffer{}
+	if err := EncodeAll(buf, in, nil); err != nil {
+		t.Fatalf("EncodeAll: %v", err)
+	}
+	out, err := DecodeAll(buf)
+	if err != nil {
+		t.Fatalf("DecodeAll: %v", err)
+	}
+	if out.Config.Width != w || out.Config.Height != h {
+		t.Errorf("canvas size: got %dx%d, want %dx%d", out.Config.Width, out.Config.Height, w, h)
+	}
+	if out.LoopCount != in.LoopCount || out.BackgroundColor != in.BackgroundColor {
+		t.Errorf("LoopCount, BackgroundColor: got %d, %v, want %d, %v",
+			out.LoopCount, out.BackgroundColor, in.LoopCount, in.BackgroundColor)
+	}
+	if len(out.Image) != len(in.Image) {
+		t.Fatalf("number of frames: got %d, want %d", len(out.Image), len(in.Image))
+	}
+	for i := range in.Image {
+		if out.Duration[i] != in.Duration[i] {
+			t.Errorf("frame %d: duration: got %d, want %d", i, out.Duration[i], in.Duration[i])
+		}
+	}
+	// Only the changed rectangles, rounded to even offsets, are written.
+	wantBounds := []image.Rectangle{
+		image.Rect(0, 0, w, h),
+		image.Rect(12, 6, 20, 30),
+		image.Rect(12, 6, 50, 30),
+		image.Rect(0, 0, 1, 1),
+	}
+	for i, want := range wantBounds {
+		if got := out.Image[i].Bounds(); got != want {
+			t.Errorf("frame %d: bounds: got %v, want %v", i, got, want)
+		}
+	}
+
+	cin, cout := NewCompositor(in), NewCompositor(out)
+	for i := range in.Image {
+		want, got := cin.Next(), cout.Next()
+		if !bytes.Equal(got.Pix, want.Pix) {
+			t.Errorf("canvas %d: pixels differ", i)
+		}
+	}
+}
+
+func TestEncodeAllLossy(t *testing.T) {
+	m0 := uniformNRGBA(image.Rect(0, 0, 32, 32), color.NRGBA{0x80, 0x40, 0x20, 0xff})
+	m1 := uniformNRGBA(image.Rect(8, 8, 16, 16), color.NRGBA{0x20, 0x40, 0x80, 0xff})
+	in := &WEBP{
+		Image:    []image.Image{m0, m1},
+		Duration: []int{100, 100},
+	}
+	buf := &bytes.Buffer{}
+	if err := EncodeAll(buf, in, &Options{Lossy: true}); err != nil {
+		t.Fatalf("EncodeAll: %v", err)
+	}
+	out, err := DecodeAll(buf)
+	if err != nil {
+		t.Fatalf("DecodeAll: %v", err)
+	}
+	if len(out.Image) != 2 {
+		t.Fatalf("number of frames: got %d, want 2", len(out.Image))
+	}
+	if out.Config.Width != 32 || out.Config.Height != 32 {
+		t.Errorf("canvas size: got %dx%d, want 32x32", out.Config.Width, out.Config.Height)
+	}
+	if got, want := out.Image[1].Bounds(), m1.Bounds(); got != want {
+		t.Errorf("frame 1: bounds: got %v, want %v", got, want)
+	}
+}
+
+func TestEncodeAllInvalid(t *testing.T) {
+	m := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	for _, a := range []*WEBP{
+		{},
+		{Image: []image.Image{m}},
+		{Image: []image.Image{m}, Duration: []int{0}, LoopCount: 1 << 16},
+	} {
+		if err := EncodeAll(&bytes.Buffer{}, a, nil); err == nil {
+			t.Errorf("%+v: got nil error, want non-nil", a)
+		}
+	}
+}
@@ -7,6 +7,7 @@ package webp
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"io"
@@ -16,145 +17,386 @@ import (
 	"golang.org/x/image/vp8l"
 )
 
-var errInvalidFormat = errors.New("webp: invalid format")
+var (
+	errInvalidFormat        = errors.New("webp: invalid format")
+	errIncrementalAnimation = errors.New("webp: incremental decoding of animated images is not supported")
+)
 
 var (
 	fccALPH = riff.FourCC{'A', 'L', 'P', 'H'}
+	fccANIM = riff.FourCC{'A', 'N', 'I', 'M'}
+	fccANMF = riff.FourCC{'A', 'N', 'M', 'F'}
 	fccVP8  = riff.FourCC{'V', 'P', '8', ' '}
 	fccVP8L = riff.FourCC{'V', 'P', '8', 'L'}
 	fccVP8X = riff.FourCC{'V', 'P', '8', 'X'}
 	fccWEBP = riff.FourCC{'W', 'E', 'B', 'P'}
 )
 
-func decode(r io.Reader, configOnly bool) (image.Image, image.Config, error) {
+// VP8X chunk flags.
+const (
+	animationBit    = 1 << 1
+	xmpMetadataBit  = 1 << 2
+	exifMetadataBit = 1 << 3
+	alphaBit        = 1 << 4
+	iccProfileBit   = 1 << 5
+)
+
+// decode decodes a WEBP image, and returns whether it is animated. If
+// configOnly is true, only the returned WEBP's Config is set. If allFrames is
+// false, only the first frame of an animated image is decoded. o may be nil,
+// in which case the default options are used. If progress is non-nil, it is
+// called as rows of a still image are decoded, and animated images are
+// rejected.
+func decode(r io.Reader, configOnly, allFrames bool, o *DecodeOptions, progress func(m image.Image, rows int)) (w *WEBP, animated bool, err error) {
+	if o == nil {
+		o = &DecodeOptions{}
+	}
 	formType, riffReader, err := riff.NewReader(r)
 	if err != nil {
-		return nil, image.Config{}, err
+		return nil, false, err
 	}
 	if formType != fccWEBP {
-		return nil, image.Config{}, errInvalidFormat
+		return nil, false, errInvalidFormat
 	}
 
+	w = &WEBP{}
+	l := &limits{o: o}
 	var (
-		alpha          []byte
-		alphaStride    int
-		wantAlpha      bool
-		seenVP8X       bool
-		widthMinusOne  uint32
-		heightMinusOne uint32
-		buf            [10]byte
+		f        = frameDecoder{rgb: o.RGB, limits: l, progress: progress}
+		seenVP8X bool
+		seenANIM bool
+		buf      [frameHeaderLen]byte
 	)
 	for {
 		chunkID, chunkLen, chunkData, err := riffReader.Next()
 		if err == io.EOF {
 			err = errInvalidFormat
+			if len(w.Image) > 0 {
+				return w, animated, nil
+			}
 		}
 		if err != nil {
-			return nil, image.Config{}, err
+			return nil, false, err
 		}
 
 		switch chunkID {
-		case fccALPH:
-			if !wantAlpha {
-				return nil, image.Config{}, errInvalidFormat
-			}
-			wantAlpha = false
-			// Read the Pre-processing | Filter | Compression byte.
-			if _, err := io.ReadFull(chunkData, buf[:1]); err != nil {
-				if err == io.EOF {
-					err = errInvalidFormat
-				}
-				return nil, image.Config{}, err
+		case fccALPH, fccVP8, fccVP8L:
+			if animated {
+				return nil, false, errInvalidFormat
 			}
-			alpha, alphaStride, err = readAlpha(chunkData, widthMinusOne, heightMinusOne, buf[0]&0x03)
+			m, c, err := f.next(chunkID, chunkLen, chunkData, configOnly)
 			if err != nil {
-				return nil, image.Config{}, err
+				return nil, false, err
+			}
+			if c.ColorModel != nil {
+				w.Config = c
+				return w, animated, nil
+			}
+			if m != nil {
+				b := m.Bounds()
+				w.Image = []image.Image{m}
+				w.Duration = []int{0}
+				w.Disposal = []byte{DisposalNone}
+				w.Blend = []byte{BlendAlpha}
+				w.Config = image.Config{
+					ColorModel: m.ColorModel(),
+					Width:      b.Dx(),
+					Height:     b.Dy(),
+				}
+				return w, animated, nil
 			}
-			unfilterAlpha(alpha, alphaStride, (buf[0]>>2)&0x03)
 
-		case fccVP8:
-			if wantAlpha || int32(chunkLen) < 0 {
-				return nil, image.Config{}, errInvalidFormat
+		case fccANIM:
+			if !animated || seenANIM || chunkLen != 6 {
+				return nil, false, errInvalidFormat
 			}
-			d := vp8.NewDecoder()
-			d.Init(chunkData, int(chunkLen))
-			fh, err := d.DecodeFrameHeader()
-			if err != nil {
-				return nil, image.Config{}, err
+			seenANIM = true
+			if _, err := io.ReadFull(chunkData, buf[:6]); err != nil {
+				return nil, false, err
 			}
-			if configOnly {
-				return nil, image.Config{
-					ColorModel: color.YCbCrModel,
-					Width:      fh.Width,
-					Height:     fh.Height,
-				}, nil
+			w.BackgroundColor = color.NRGBA{buf[2], buf[1], buf[0], buf[3]}
+			w.LoopCount = int(buf[4]) | int(buf[5])<<8
+
+		case fccANMF:
+			if !seenANIM || chunkLen < frameHeaderLen {
+				return nil, false, errInvalidFormat
 			}
-			m, err := d.DecodeFrame()
-			if err != nil {
-				return nil, image.Config{}, err
+			if _, err := io.ReadFull(chunkData, buf[:frameHeaderLen]); err != nil {
+				return nil, false, err
 			}
-			if alpha != nil {
-				return &image.NYCbCrA{
-					YCbCr:   *m,
-					A:       alpha,
-					AStride: alphaStride,
-				}, image.Config{}, nil
+			if o.MaxFrames > 0 && len(w.Image) >= o.MaxFrames {
+				return nil, false, &LimitError{"MaxFrames", int64(len(w.Image) + 1), int64(o.MaxFrames)}
 			}
-			return m, image.Config{}, nil
-
-		case fccVP8L:
-			if wantAlpha || alpha != nil {
-				return nil, image.Config{}, errInvalidFormat
+			m, err := decodeFrame(buf[:frameHeaderLen], chunkData, w.Config, o.RGB, l)
+			if err != nil {
+				return nil, false, err
 			}
-			if configOnly {
-				c, err := vp8l.DecodeConfig(chunkData)
-				return nil, c, err
+			w.Image = append(w.Image, m)
+			w.Duration = append(w.Duration, int(u24(buf[12:])))
+			w.Disposal = append(w.Disposal, buf[15]&0x01)
+			w.Blend = append(w.Blend, (buf[15]>>1)&0x01)
+			if !allFrames {
+				return w, animated, nil
 			}
-			m, err := vp8l.Decode(chunkData)
-			return m, image.Config{}, err
 
 		case fccVP8X:
 			if seenVP8X {
-				return nil, image.Config{}, errInvalidFormat
+				return nil, false, errInvalidFormat
 			}
 			seenVP8X = true
 			if chunkLen != 10 {
-				return nil, image.Config{}, errInvalidFormat
+				return nil, false, errInvalidFormat
 			}
 			if _, err := io.ReadFull(chunkData, buf[:10]); err != nil {
-				return nil, image.Config{}, err
+				return nil, false, err
+			}
+			animated = (buf[0] & animationBit) != 0
+			if animated && progress != nil {
+				return nil, false, errIncrementalAnimation
+			}
+			f.wantAlpha = (buf[0]&alphaBit) != 0 && !animated
+			f.widthMinusOne = u24(buf[4:])
+			f.heightMinusOne = u24(buf[7:])
+			w.Config = image.Config{
+				ColorModel: color.YCbCrModel,
+				Width:      int(f.widthMinusOne) + 1,
+				Height:     int(f.heightMinusOne) + 1,
+			}
+			if animated {
+				w.Config.ColorModel = color.NRGBAModel
+			} else if f.wantAlpha {
+				w.Config.ColorModel = color.NYCbCrAModel
 			}
-			const (
-				animationBit    = 1 << 1
-				xmpMetadataBit  = 1 << 2
-				exifMetadataBit = 1 << 3
-				alphaBit        = 1 << 4
-				iccProfileBit   = 1 << 5
-			)
-			wantAlpha = (buf[0] & alphaBit) != 0
-			widthMinusOne = uint32(buf[4]) | uint32(buf[5])<<8 | uint32(buf[6])<<16
-			heightMinusOne = uint32(buf[7]) | uint32(buf[8])<<8 | uint32(buf[9])<<16
 			if configOnly {
-				if wantAlpha {
-					return nil, image.Config{
-						ColorModel: color.NYCbCrAModel,
-						Width:      int(widthMinusOne) + 1,
-						Height:     int(heightMinusOne) + 1,
-					}, nil
+				return w, animated, nil
+			}
+			if err := l.checkSize(w.Config.Width, w.Config.Height); err != nil {
+				return nil, false, err
+			}
+			if animated && !allFrames {
+				// The first frame is composited onto a canvas, which is then
+				// copied.
+				if err := l.alloc(8 * int64(w.Config.Width) * int64(w.Config.Height)); err != nil {
+					return nil, false, err
 				}
-				return nil, image.Config{
-					ColorModel: color.YCbCrModel,
-					Width:      int(widthMinusOne) + 1,
-					Height:     int(heightMinusOne) + 1,
-				}, nil
 			}
 		}
 	}
 }
 
-func readAlpha(chunkData io.Reader, widthMinusOne, heightMinusOne uint32, compression byte) (
+// frameHeaderLen is the length of the ANMF chunk's header, before the frame
+// data.
+const frameHeaderLen = 16
+
+// u24 decodes the first three bytes of b as a little-endian integer.
+func u24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+// decodeFrame decodes an ANMF chunk's frame data, given its header hdr and
+// the canvas configuration c. The returned image's bounds give the frame's
+// position on the canvas. rgb and l are as for frameDecoder.
+func decodeFrame(hdr []byte, chunkData io.Reader, c image.Config, rgb bool, l *limits) (image.Image, error) {
+	x, y := 2*int(u24(hdr[0:])), 2*int(u24(hdr[3:]))
+	f := frameDecoder{
+		rgb:            rgb,
+		limits:         l,
+		optionalAlpha:  true,
+		widthMinusOne:  u24(hdr[6:]),
+		heightMinusOne: u24(hdr[9:]),
+	}
+	r := image.Rect(x, y, x+int(f.widthMinusOne)+1, y+int(f.heightMinusOne)+1)
+	if !r.In(image.Rect(0, 0, c.Width, c.Height)) {
+		return nil, errInvalidFormat
+	}
+
+	// The frame data is a sequence of chunks, but not a RIFF list.
+	data, err := io.ReadAll(chunkData)
+	if err != nil {
+		return nil, err
+	}
+	for len(data) >= 8 {
+		id := riff.FourCC{data[0], data[1], data[2], data[3]}
+		n := uint32(data[4]) | uint32(data[5])<<8 | uint32(data[6])<<16 | uint32(data[7])<<24
+		data = data[8:]
+		if uint64(n) > uint64(len(data)) {
+			return nil, errInvalidFormat
+		}
+		m, _, err := f.next(id, n, bytes.NewReader(data[:n]), false)
+		if err != nil {
+			return nil, err
+		}
+		if m != nil {
+			if m.Bounds().Size() != r.Size() {
+				return nil, errInvalidFormat
+			}
+			return translate(m, r.Min), nil
+		}
+		data = data[n:]
+		if n&1 != 0 && len(data) > 0 {
+			data = data[1:]
+		}
+	}
+	return nil, errInvalidFormat
+}
+
+// translate returns m, as decoded by a frameDecoder, with its bounds moved
+// so that its top-left corner is p. p's coordinates must be even.
+func translate(m image.Image, p image.Point) image.Image {
+	switch m := m.(type) {
+	case *image.NRGBA:
+		m.Rect = m.Rect.Sub(m.Rect.Min).Add(p)
+	case *image.RGBA:
+		m.Rect = m.Rect.Sub(m.Rect.Min).Add(p)
+	case *image.YCbCr:
+		m.Rect = m.Rect.Sub(m.Rect.Min).Add(p)
+	case *image.NYCbCrA:
+		m.Rect = m.Rect.Sub(m.Rect.Min).Add(p)
+	}
+	return m
+}
+
+// frameDecoder decodes the ALPH, VP8 and VP8L chunks of a still image or of
+// an animation frame.
+type frameDecoder struct {
+	alpha       []byte
+	alphaStride int
+	// wantAlpha is whether an ALPH chunk must precede the VP8 chunk.
+	wantAlpha bool
+	// optionalAlpha is whether an ALPH chunk may precede the VP8 chunk.
+	optionalAlpha  bool
+	widthMinusOne  uint32
+	heightMinusOne uint32
+	buf            [1]byte
+	// rgb is whether VP8 images are converted to RGB.
+	rgb bool
+	// limits are the limits on the memory that is allocated.
+	limits *limits
+	// progress, if non-nil, is called as rows of the image are decoded.
+	progress func(m image.Image, rows int)
+}
+
+// next decodes the next chunk. It returns the decoded image, or the config
+// if configOnly is true, once the chunk holding the image data is decoded.
+// Chunks of other types are ignored.
+func (f *frameDecoder) next(chunkID riff.FourCC, chunkLen uint32, chunkData io.Reader, configOnly bool) (image.Image, image.Config, error) {
+	switch chunkID {
+	case fccALPH:
+		if !f.wantAlpha && !f.optionalAlpha {
+			return nil, image.Config{}, errInvalidFormat
+		}
+		f.wantAlpha = false
+		f.optionalAlpha = false
+		// Read the Pre-processing | Filter | Compression byte.
+		if _, err := io.ReadFull(chunkData, f.buf[:1]); err != nil {
+			if err == io.EOF {
+				err = errInvalidFormat
+			}
+			return nil, image.Config{}, err
+		}
+		var err error
+		f.alpha, f.alphaStride, err = readAlpha(chunkData, f.widthMinusOne, f.heightMinusOne, f.buf[0]&0x03, f.limits)
+		if err != nil {
+			return nil, image.Config{}, err
+		}
+		unfilterAlpha(f.alpha, f.alphaStride, (f.buf[0]>>2)&0x03)
+
+	case fccVP8:
+		if f.wantAlpha || int32(chunkLen) < 0 {
+			return nil, image.Config{}, errInvalidFormat
+		}
+		d := vp8.NewDecoder()
+		d.Init(chunkData, int(chunkLen))
+		fh, err := d.DecodeFrameHeader()
+		if err != nil {
+			return nil, image.Config{}, err
+		}
+		if configOnly {
+			return nil, image.Config{
+				ColorModel: color.YCbCrModel,
+				Width:      fh.Width,
+				Height:     fh.Height,
+			}, nil
+		}
+		if f.alpha != nil && len(f.alpha) != fh.Width*fh.Height {
+			return nil, image.Config{}, errInvalidFormat
+		}
+		if err := f.limits.checkSize(fh.Width, fh.Height); err != nil {
+			return nil, image.Config{}, err
+		}
+		// The decoded frame is whole macroblocks: 16x16 luma samples and two
+		// 8x8 chroma samples each.
+		mbw, mbh := int64(fh.Width+15)/16, int64(fh.Height+15)/16
+		n := 384 * mbw * mbh
+		if f.rgb {
+			n += 4 * int64(fh.Width) * int64(fh.Height)
+		}
+		if err := f.limits.alloc(n); err != nil {
+			return nil, image.Config{}, err
+		}
+		withAlpha := func(m *image.YCbCr) image.Image {
+			if f.alpha == nil {
+				return m
+			}
+			return &image.NYCbCrA{
+				YCbCr:   *m,
+				A:       f.alpha,
+				AStride: f.alphaStride,
+			}
+		}
+		var p image.Image
+		if f.progress != nil {
+			d.SetProgress(func(m *image.YCbCr, rows int) {
+				if p == nil {
+					p = withAlpha(m)
+				}
+				f.progress(p, rows)
+			})
+		}
+		m, err := d.DecodeFrame()
+		if err != nil {
+			return nil, image.Config{}, err
+		}
+		if f.rgb {
+			return toRGB(m, f.alpha, f.alphaStride), image.Config{}, nil
+		}
+		if p != nil {
+			return p, image.Config{}, nil
+		}
+		return withAlpha(m), image.Config{}, nil
+
+	case fccVP8L:
+		// The VP8X alpha flag may be set for a VP8L image, which holds its
+		// own alpha values, but an ALPH chunk may not precede it.
+		if f.alpha != nil {
+			return nil, image.Config{}, errInvalidFormat
+		}
+		if configOnly {
+			c, err := vp8l.DecodeConfig(chunkData)
+			return nil, c, err
+		}
+		if f.progress != nil {
+			m, err := vp8l.DecodeWithProgress(chunkData, func(m *image.NRGBA, rows int) {
+				f.progress(m, rows)
+			})
+			return m, image.Config{}, err
+		}
+		m, err := f.limits.decodeVP8L(chunkData)
+		if err != nil {
+			return nil, image.Config{}, err
+		}
+		f.limits.bytes += int64(len(m.Pix))
+		return m, image.Config{}, nil
+	}
+	return nil, image.Config{}, nil
+}
+
+func readAlpha(chunkData io.Reader, widthMinusOne, heightMinusOne uint32, compression byte, l *limits) (
 	alpha []byte, alphaStride int, err error) {
 
+	if err := l.alloc((int64(widthMinusOne) + 1) * (int64(heightMinusOne) + 1)); err != nil {
+		return nil, 0, err
+	}
 	switch compression {
 	case 0:
 		w := int(widthMinusOne) + 1
@@ -175,7 +417,7 @@ func readAlpha(chunkData io.Reader, widthMinusOne, heightMinusOne uint32, compre
 		if widthMinusOne > 0x3fff || heightMinusOne > 0x3fff {
 			return nil, 0, errors.New("webp: invalid format")
 		}
-		alphaImage, err := vp8l.Decode(io.MultiReader(
+		alphaImage, err := l.decodeVP8L(io.MultiReader(
 			bytes.NewReader([]byte{
 				0x2f, // VP8L magic number.
 				uint8(widthMinusOne),
@@ -190,7 +432,7 @@ func readAlpha(chunkData io.Reader, widthMinusOne, heightMinusOne uint32, compre
 		}
 		// The green values of the inner NRGBA image are the alpha values of the
 		// outer NYCbCrA image.
-		pix := alphaImage.(*image.NRGBA).Pix
+		pix := alphaImage.Pix
 		alpha = make([]byte, len(pix)/4)
 		for i := range alpha {
 			alpha[i] = pix[4*i+1]
@@ -255,20 +497,155 @@ func unfilterAlpha(alpha []byte, alphaStride int, filter byte) {
 	}
 }
 
-// Decode reads a WEBP image from r and returns it as an image.Image.
+// DecodeOptions are the decoding parameters.
+type DecodeOptions struct {
+	// RGB is whether lossy images are converted to an *image.RGBA, or to an
+	// *image.NRGBA if they have alpha, instead of being returned as an
+	// *image.YCbCr or *image.NYCbCrA. The conversion matches libwebp's,
+	// including its bilinear "fancy upsampling" of the chroma samples, which
+	// gives smoother edges than the image/color package's conversion of each
+	// pixel's nearest chroma sample.
+	RGB bool
+
+	// The remaining fields limit the images that are decoded. Exceeding a
+	// limit is a *LimitError. A zero limit means no limit.
+	//
+	// MaxWidth and MaxHeight are the maximum width and height, in pixels, of
+	// the image or animation canvas and of each frame.
+	MaxWidth  int
+	MaxHeight int
+	// MaxPixels is the maximum number of pixels, the width times the height,
+	// of the image or canvas and of each frame.
+	MaxPixels int64
+	// MaxBytes is the maximum number of bytes allocated for the decoded
+	// frames, in total, and for the intermediate images that they are
+	// decoded from.
+	MaxBytes int64
+	// MaxFrames is the maximum number of frames of an animated image.
+	MaxFrames int
+}
+
+// A LimitError means that a WebP file's canvas, one of its frames, or the
+// number of frames is beyond a DecodeOptions limit. Frames decoded before
+// the limit was reached are discarded.
+type LimitError struct {
+	// Limit is "MaxWidth", "MaxHeight", "MaxPixels", "MaxBytes" or
+	// "MaxFrames".
+	Limit string
+	// Value is the size of the canvas or frame, the bytes needed by all of
+	// the frames so far, or the frame count, and Max is the limit.
+	Value int64
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("webp: image exceeds %s: %d > %d", e.Limit, e.Value, e.Max)
+}
+
+// limits tracks an image's use of the limits given by DecodeOptions.
+type limits struct {
+	o *DecodeOptions
+	// bytes is the number of bytes allocated so far.
+	bytes int64
+}
+
+// checkSize returns a *LimitError if a w by h image or frame exceeds l's
+// limits.
+func (l *limits) checkSize(w, h int) error {
+	o := l.o
+	switch {
+	case o.MaxWidth > 0 && w > o.MaxWidth:
+		return &LimitError{"MaxWidth", int64(w), int64(o.MaxWidth)}
+	case o.MaxHeight > 0 && h > o.MaxHeight:
+		return &LimitError{"MaxHeight", int64(h), int64(o.MaxHeight)}
+	case o.MaxPixels > 0 && int64(w)*int64(h) > o.MaxPixels:
+		return &LimitError{"MaxPixels", int64(w) * int64(h), o.MaxPixels}
+	}
+	return nil
+}
+
+// alloc records that n more bytes are to be allocated, returning a
+// *LimitError if that would exceed l's MaxBytes.
+func (l *limits) alloc(n int64) error {
+	l.bytes += n
+	if l.o.MaxBytes > 0 && l.bytes > l.o.MaxBytes {
+		return &LimitError{"MaxBytes", l.bytes, l.o.MaxBytes}
+	}
+	return nil
+}
+
+// decodeVP8L decodes a VP8L image, or VP8L-compressed alpha values, within
+// the bytes that remain of l's MaxBytes. The bytes that the vp8l package
+// allocates are not added to l.bytes, as its intermediate images are freed
+// once it returns.
+func (l *limits) decodeVP8L(r io.Reader) (*image.NRGBA, error) {
+	o := &vp8l.DecodeOptions{
+		MaxWidth:  l.o.MaxWidth,
+		MaxHeight: l.o.MaxHeight,
+		MaxPixels: l.o.MaxPixels,
+	}
+	if l.o.MaxBytes > 0 {
+		// A zero limit would mean no limit, but no VP8L image fits in one
+		// byte either.
+		o.MaxBytes = l.o.MaxBytes - l.bytes
+		if o.MaxBytes < 1 {
+			o.MaxBytes = 1
+		}
+	}
+	m, err := vp8l.DecodeWithOptions(r, o)
+	if e, ok := err.(*vp8l.LimitError); ok {
+		if e.Limit == "MaxBytes" {
+			return nil, &LimitError{e.Limit, l.bytes + e.Value, l.o.MaxBytes}
+		}
+		return nil, &LimitError{e.Limit, e.Value, e.Max}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m.(*image.NRGBA), nil
+}
+
+// Decode reads a WEBP image from r and returns it as an image.Image. For an
+// animated image, it returns the first frame rendered onto the canvas.
 func Decode(r io.Reader) (image.Image, error) {
-	m, _, err := decode(r, false)
+	return DecodeWithOptions(r, nil)
+}
+
+// DecodeWithOptions is like Decode, but with the given options. o may be nil,
+// in which case the default options are used.
+func DecodeWithOptions(r io.Reader, o *DecodeOptions) (image.Image, error) {
+	w, animated, err := decode(r, false, false, o, nil)
 	if err != nil {
 		return nil, err
 	}
-	return m, nil
+	if animated {
+		return NewCompositor(w).Next(), nil
+	}
+	return w.Image[0], nil
 }
 
 // DecodeConfig returns the color model and dimensions of a WEBP image without
-// decoding the entire image.
+// decoding the entire image. For an animated image, they are those of the
+// canvas.
 func DecodeConfig(r io.Reader) (image.Config, error) {
-	_, c, err := decode(r, true)
-	return c, err
+	w, _, err := decode(r, true, false, nil, nil)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return w.Config, nil
+}
+
+// DecodeAll reads a WEBP image from r and returns the sequential frames and
+// timing information. A still image is returned as a single frame.
+func DecodeAll(r io.Reader) (*WEBP, error) {
+	return DecodeAllWithOptions(r, nil)
+}
+
+// DecodeAllWithOptions is like DecodeAll, but with the given options. o may
+// be nil, in which case the default options are used.
+func DecodeAllWithOptions(r io.Reader, o *DecodeOptions) (*WEBP, error) {
+	w, _, err := decode(r, false, true, o, nil)
+	return w, err
 }
 
 func init() {
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"fmt"
 	"image"
+	"image/color"
 	"image/png"
 	"io/ioutil"
 	"os"
@@ -279,6 +280,70 @@ func TestDuplicateVP8X(t *testing.T) {
 	}
 }
 
+func TestDecodeLimits(t *testing.T) {
+	const w, h = 30, 20
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{uint8(x * y), uint8(8 * x), uint8(8 * y), uint8(0x80 + x)})
+		}
+	}
+	encode := func(o *Options) []byte {
+		buf := &bytes.Buffer{}
+		if err := Encode(buf, m, o); err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		return buf.Bytes()
+	}
+	lossless, lossy := encode(nil), encode(&Options{Lossy: true})
+	anim := &bytes.Buffer{}
+	if err := EncodeAll(anim, &WEBP{
+		Image:    []image.Image{m, m, m},
+		Duration: []int{10, 10, 10},
+		Config:   image.Config{ColorModel: color.NRGBAModel, Width: w, Height: h},
+	}, nil); err != nil {
+		t.Fatalf("EncodeAll: %v", err)
+	}
+	// huge is the lossless image with its VP8L header patched to declare
+	// 16384x16384 pixels.
+	huge := append([]byte(nil), lossless...)
+	copy(huge[21:25], []byte{0xff, 0xff, 0xff, 0x0f})
+
+	for _, tc := range []struct {
+		desc  string
+		src   []byte
+		o     DecodeOptions
+		limit string
+	}{
+		{"lossless", lossless, DecodeOptions{MaxWidth: w, MaxHeight: h, MaxPixels: w * h, MaxBytes: 1 << 20}, ""},
+		{"lossless", lossless, DecodeOptions{MaxWidth: w - 1}, "MaxWidth"},
+		{"lossless", lossless, DecodeOptions{MaxHeight: h - 1}, "MaxHeight"},
+		{"lossless", lossless, DecodeOptions{MaxPixels: w*h - 1}, "MaxPixels"},
+		{"lossless", lossless, DecodeOptions{MaxBytes: 1000}, "MaxBytes"},
+		{"lossless huge", huge, DecodeOptions{MaxPixels: 1 << 20}, "MaxPixels"},
+		{"lossy", lossy, DecodeOptions{MaxWidth: w, MaxHeight: h, MaxPixels: w * h, MaxBytes: 1 << 20}, ""},
+		{"lossy", lossy, DecodeOptions{MaxWidth: w - 1}, "MaxWidth"},
+		{"lossy", lossy, DecodeOptions{MaxPixels: w*h - 1}, "MaxPixels"},
+		{"lossy", lossy, DecodeOptions{MaxBytes: 1000}, "MaxBytes"},
+		{"lossy", lossy, DecodeOptions{MaxBytes: 4500}, ""},
+		{"lossy", lossy, DecodeOptions{RGB: true, MaxBytes: 4500}, "MaxBytes"},
+		{"animated", anim.Bytes(), DecodeOptions{MaxFrames: 3}, ""},
+		{"animated", anim.Bytes(), DecodeOptions{MaxFrames: 2}, "MaxFrames"},
+		{"animated", anim.Bytes(), DecodeOptions{MaxWidth: w - 1}, "MaxWidth"},
+	} {
+		_, err := DecodeAllWithOptions(bytes.NewReader(tc.src), &tc.o)
+		if tc.limit == "" {
+			if err != nil {
+				t.Errorf("%s, %+v: got %v, want nil", tc.desc, tc.o, err)
+			}
+			continue
+		}
+		if e, ok := err.(*LimitError); !ok || e.Limit != tc.limit {
+			t.Errorf("%s, %+v: got %v, want a %s LimitError", tc.desc, tc.o, err, tc.limit)
+		}
+	}
+}
+
 func benchmarkDecode(b *testing.B, filename string) {
 	data, err := ioutil.ReadFile("../testdata/blue-purple-pink-large." + filename + ".webp")
 	if err != nil {
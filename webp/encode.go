@@ -0,0 +1,390 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+
+	"golang.org/x/image/riff"
+	"golang.org/x/image/vp8"
+	"golang.org/x/image/vp8l"
+)
+
+// DefaultQuality is the default quality encoding parameter.
+const DefaultQuality = 75
+
+// Options are the encoding parameters.
+type Options struct {
+	// Lossy is whether to use the lossy VP8 format instead of the lossless
+	// VP8L format.
+	Lossy bool
+	// Quality is in the range [0, 100] inclusive, and values outside of it
+	// are clamped to it. For lossy encoding, it trades compressed size for
+	// fidelity: higher is larger but closer to the original, and 0 gives
+	// the same result as 1, as for vp8.Options. For lossless encoding, it
+	// trades encoding speed for compressed size: higher is slower but
+	// smaller.
+	Quality int
+	// Metadata, if non-nil, holds the ICC profile, Exif and XMP metadata to
+	// write alongside the image data.
+	Metadata *Metadata
+}
+
+// Encode writes the Image m to w in WEBP format. Options may be nil, in which
+// case the default parameters are used.
+func Encode(w io.Writer, m image.Image, o *Options) error {
+	d, err := encodeImage(m, o)
+	if err != nil {
+		return err
+	}
+	var md *Metadata
+	if o != nil {
+		md = o.Metadata
+	}
+	var flags byte
+	if d.hasAlpha {
+		flags |= alphaBit
+	}
+	// The ALPH chunk requires a VP8X chunk.
+	extended := d.alph != nil
+	b := m.Bounds()
+	return writeWEBP(w, extended, flags, b.Dx(), b.Dy(), md, d.size(), d.write)
+}
+
+// writeWEBP writes a WEBP file whose image data, of dataLen bytes, is written
+// by writeData. If extended is true or md is not empty, the file is in the
+// extended format: a VP8X chunk, with the given flags and canvas size,
+// precedes md's ICCP chunk and the image data, and md's EXIF and "XMP "
+// chunks follow.
+func writeWEBP(w io.Writer, extended bool, flags byte, width, height int, md *Metadata,
+	dataLen int64, writeData func(z *riff.Writer) error) error {
+
+	type chunk struct {
+		id   riff.FourCC
+		data []byte
+	}
+	var pre, post []chunk
+	if extended || !md.empty() {
+		pre = append(pre, chunk{fccVP8X, vp8xData(flags|md.flags(), width, height)})
+		if md != nil {
+			if md.ICCProfile != nil {
+				pre = append(pre, chunk{fccICCP, md.ICCProfile})
+			}
+			if md.EXIF != nil {
+				post = append(post, chunk{fccEXIF, md.EXIF})
+			}
+			if md.XMP != nil {
+				post = append(post, chunk{fccXMP, md.XMP})
+			}
+		}
+	}
+
+	riffLen := 4 + dataLen
+	for _, c := range append(pre, post...) {
+		riffLen += riff.ChunkSize(uint32(len(c.data)))
+	}
+	z, err := riff.NewWriter(w, fccWEBP, riffLen)
+	if err != nil {
+		return err
+	}
+	for _, c := range pre {
+		if err := z.WriteChunk(c.id, c.data); err != nil {
+			return err
+		}
+	}
+	if err := writeData(z); err != nil {
+		return err
+	}
+	for _, c := range post {
+		if err := z.WriteChunk(c.id, c.data); err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+// vp8xData returns the payload of a VP8X chunk.
+func vp8xData(flags byte, width, height int) []byte {
+	wm1, hm1 := uint32(width-1), uint32(height-1)
+	return []byte{
+		flags, 0, 0, 0,
+		uint8(wm1), uint8(wm1 >> 8), uint8(wm1 >> 16),
+		uint8(hm1), uint8(hm1 >> 8), uint8(hm1 >> 16),
+	}
+}
+
+// imageData is the encoded image data of a still image or of an animation
+// frame.
+type imageData struct {
+	// alph is the ALPH chunk's data, or nil.
+	alph []byte
+	// id and data are the VP8 or VP8L chunk's ID and data.
+	id   riff.FourCC
+	data []byte
+	// hasAlpha is whether the image is not opaque.
+	hasAlpha bool
+}
+
+// size returns the number of bytes taken by d's chunks.
+func (d *imageData) size() int64 {
+	n := riff.ChunkSize(uint32(len(d.data)))
+	if d.alph != nil {
+		n += riff.ChunkSize(uint32(len(d.alph)))
+	}
+	return n
+}
+
+// write writes d's chunks.
+func (d *imageData) write(z *riff.Writer) error {
+	if d.alph != nil {
+		if err := z.WriteChunk(fccALPH, d.alph); err != nil {
+			return err
+		}
+	}
+	return z.WriteChunk(d.id, d.data)
+}
+
+// encodeImage encodes m as either a VP8L chunk or, for lossy encoding, a VP8
+// chunk preceded by an ALPH chunk if m is not opaque.
+func encodeImage(m image.Image, o *Options) (*imageData, error) {
+	quality, lossy := DefaultQuality, false
+	if o != nil {
+		quality, lossy = o.Quality, o.Lossy
+	}
+	alpha := alphaImage(m)
+
+	data := &bytes.Buffer{}
+	if !lossy {
+		if err := vp8l.Encode(data, m, &vp8l.Options{Effort: quality}); err != nil {
+			return nil, err
+		}
+		return &imageData{id: fccVP8L, data: data.Bytes(), hasAlpha: alpha != nil}, nil
+	}
+
+	if err := vp8.Encode(data, m, &vp8.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	d := &imageData{id: fccVP8, data: data.Bytes(), hasAlpha: alpha != nil}
+	if alpha != nil {
+		a := &bytes.Buffer{}
+		if err := vp8l.Encode(a, alpha, nil); err != nil {
+			return nil, err
+		}
+		// The ALPH chunk holds a header byte for no pre-processing, no
+		// filtering and lossless compression, then the VP8L image data
+		// without its 5-byte header.
+		d.alph = append([]byte{0x01}, a.Bytes()[5:]...)
+	}
+	return d, nil
+}
+
+// alphaImage returns an image whose green values are m's alpha values, or nil
+// if m is opaque.
+func alphaImage(m image.Image) *image.NRGBA {
+	if o, ok := m.(interface{ Opaque() bool }); ok && o.Opaque() {
+		return nil
+	}
+	b := m.Bounds()
+	a := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	opaque := true
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			_, _, _, alpha := m.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			i := a.PixOffset(x, y)
+			a.Pix[i+1] = uint8(alpha >> 8)
+			a.Pix[i+3] = 0xff
+			opaque = opaque && alpha == 0xffff
+		}
+	}
+	if opaque {
+		return nil
+	}
+	return a
+}
+
+// EncodeAll writes the frames of a to w as an animated WEBP image. Options
+// may be nil, in which case the default parameters are used.
+//
+// The frames are rendered as by a Compositor, so that a may be as returned
+// by DecodeAll. A nil Disposal or Blend slice means DisposalNone or
+// BlendAlpha for every frame. If a.Config's Width or Height is zero, the
+// canvas is the smallest that holds every frame. The encoder chooses each
+// written frame's rectangle, and its disposal and blending methods, to
+// minimize the output size.
+func EncodeAll(w io.Writer, a *WEBP, o *Options) error {
+	if len(a.Image) == 0 {
+		return errors.New("webp: no frames to encode")
+	}
+	if len(a.Duration) != len(a.Image) {
+		return errors.New("webp: mismatched image and duration lengths")
+	}
+	if a.LoopCount < 0 || a.LoopCount > 0xffff {
+		return errors.New("webp: invalid loop count")
+	}
+	c := a.Config
+	if c.Width == 0 || c.Height == 0 {
+		for _, m := range a.Image {
+			b := m.Bounds()
+			if b.Max.X > c.Width {
+				c.Width = b.Max.X
+			}
+			if b.Max.Y > c.Height {
+				c.Height = b.Max.Y
+			}
+		}
+	}
+	if c.Width <= 0 || c.Height <= 0 || c.Width > 1<<24 || c.Height > 1<<24 {
+		return errors.New("webp: invalid canvas size")
+	}
+	rendered := *a
+	rendered.Config = c
+	comp := NewCompositor(&rendered)
+
+	var (
+		frames   []*imageData
+		hdrs     [][frameHeaderLen]byte
+		hasAlpha bool
+		// prev is the canvas after the previous frame, before its disposal.
+		prev = image.NewNRGBA(image.Rect(0, 0, c.Width, c.Height))
+		// prevRect is the previous frame's rectangle.
+		prevRect image.Rectangle
+	)
+	for i := range a.Image {
+		cur := comp.Next()
+
+		// Try both disposal methods for the previous frame, and keep the
+		// smaller encoding.
+		var (
+			best        *imageData
+			bestHdr     [frameHeaderLen]byte
+			bestRect    image.Rectangle
+			bestDispose byte
+		)
+		for _, dispose := range []byte{DisposalNone, DisposalBackground} {
+			if dispose == DisposalBackground && i == 0 {
+				break
+			}
+			base := prev
+			if dispose == DisposalBackground {
+				base = image.NewNRGBA(prev.Rect)
+				copy(base.Pix, prev.Pix)
+				fillNRGBA(base, prevRect, color.NRGBA{})
+			}
+			m, blend := frameDiff(base, cur)
+			d, err := encodeImage(m, o)
+			if err != nil {
+				return err
+			}
+			if best == nil || d.size() < best.size() {
+				best, bestRect, bestDispose = d, m.Bounds(), dispose
+				bestHdr = anmfHeader(bestRect, a.Duration[i], blend)
+			}
+		}
+		if i > 0 {
+			hdrs[i-1][15] |= bestDispose
+		}
+		frames = append(frames, best)
+		hdrs = append(hdrs, bestHdr)
+		hasAlpha = hasAlpha || best.hasAlpha
+		prev, prevRect = cur, bestRect
+	}
+
+	flags := byte(animationBit)
+	if hasAlpha {
+		flags |= alphaBit
+	}
+	var md *Metadata
+	if o != nil {
+		md = o.Metadata
+	}
+	dataLen := riff.ChunkSize(6)
+	for _, f := range frames {
+		dataLen += riff.ChunkSize(uint32(frameHeaderLen + f.size()))
+	}
+	return writeWEBP(w, true, flags, c.Width, c.Height, md, dataLen, func(z *riff.Writer) error {
+		bg := a.BackgroundColor
+		anim := []byte{bg.B, bg.G, bg.R, bg.A, uint8(a.LoopCount), uint8(a.LoopCount >> 8)}
+		if err := z.WriteChunk(fccANIM, anim); err != nil {
+			return err
+		}
+		for i, f := range frames {
+			if err := z.BeginChunk(fccANMF, frameHeaderLen+f.size()); err != nil {
+				return err
+			}
+			if _, err := z.Write(hdrs[i][:]); err != nil {
+				return err
+			}
+			if err := f.write(z); err != nil {
+				return err
+			}
+			if err := z.End(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// anmfHeader returns the header of an ANMF chunk for a frame with bounds r.
+// Its disposal method is DisposalNone.
+func anmfHeader(r image.Rectangle, duration int, blend byte) (h [frameHeaderLen]byte) {
+	if duration < 0 {
+		duration = 0
+	} else if duration > 1<<24-1 {
+		duration = 1<<24 - 1
+	}
+	for i, v := range [...]int{r.Min.X / 2, r.Min.Y / 2, r.Dx() - 1, r.Dy() - 1, duration} {
+		h[3*i+0] = uint8(v)
+		h[3*i+1] = uint8(v >> 8)
+		h[3*i+2] = uint8(v >> 16)
+	}
+	h[15] = blend << 1
+	return h
+}
+
+// frameDiff returns the frame that turns the canvas base into cur, and that
+// frame's blending method. The frame covers the smallest rectangle, with an
+// even top-left corner, that holds every changed pixel. If every changed pixel
+// is opaque, the frame is alpha-blended and its unchanged pixels are
+// transparent, which compresses better.
+func frameDiff(base, cur *image.NRGBA) (*image.NRGBA, byte) {
+	r, opaque := image.Rectangle{}, true
+	b := cur.Rect
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := cur.NRGBAAt(x, y)
+			if c == base.NRGBAAt(x, y) {
+				continue
+			}
+			r = r.Union(image.Rect(x, y, x+1, y+1))
+			opaque = opaque && c.A == 0xff
+		}
+	}
+	if r.Empty() {
+		// Nothing changed. Write a single transparent pixel.
+		return image.NewNRGBA(image.Rect(0, 0, 1, 1)), BlendAlpha
+	}
+	r.Min.X &^= 1
+	r.Min.Y &^= 1
+
+	m := image.NewNRGBA(r)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			c := cur.NRGBAAt(x, y)
+			if opaque && c == base.NRGBAAt(x, y) {
+				c = color.NRGBA{}
+			}
+			m.SetNRGBA(x, y, c)
+		}
+	}
+	if opaque {
+		return m, BlendAlpha
+	}
+	return m, BlendNone
+}
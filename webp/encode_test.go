@@ -0,0 +1,246 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"testing"
+)
+
+func decodePNG(filename string) (image.Image, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return png.Decode(f)
+}
+
+// compareNRGBA checks that m1, a decoded lossless WEBP image, holds exactly
+// the same non-premultiplied colors as m0.
+func compareNRGBA(t *testing.T, tc string, m0, m1 image.Image) {
+	t.Helper()
+	n1, ok := m1.(*image.NRGBA)
+	if !ok {
+		t.Errorf("%s: decoded image is %T, want *image.NRGBA", tc, m1)
+		return
+	}
+	b0, b1 := m0.Bounds(), n1.Bounds()
+	if b0.Size() != b1.Size() {
+		t.Errorf("%s: size: got %v, want %v", tc, b1.Size(), b0.Size())
+		return
+	}
+	for y := 0; y < b0.Dy(); y++ {
+		for x := 0; x < b0.Dx(); x++ {
+			want := color.NRGBAModel.Convert(m0.At(b0.Min.X+x, b0.Min.Y+y))
+			if got := n1.NRGBAAt(x, y); got != want {
+				t.Errorf("%s: at (%d, %d): got %v, want %v", tc, x, y, got, want)
+				return
+			}
+		}
+	}
+}
+
+func TestEncodeLossless(t *testing.T) {
+	testCases := []string{
+		"blue-purple-pink",
+		"gopher-doc.1bpp",
+		"gopher-doc.2bpp",
+		"gopher-doc.4bpp",
+		"gopher-doc.8bpp",
+		"tux",
+		"video-001",
+		"yellow_rose-small",
+	}
+
+	for _, tc := range testCases {
+		m0, err := decodePNG("../testdata/" + tc + ".png")
+		if err != nil {
+			t.Errorf("%s: Decode PNG: %v", tc, err)
+			continue
+		}
+		for _, quality := range []int{0, 50, 100} {
+			buf := &bytes.Buffer{}
+			if err := Encode(buf, m0, &Options{Quality: quality}); err != nil {
+				t.Errorf("%s: Encode: %v", tc, err)
+				continue
+			}
+			m1, err := Decode(buf)
+			if err != nil {
+				t.Errorf("%s: Decode WEBP: %v", tc, err)
+				continue
+			}
+			compareNRGBA(t, tc, m0, m1)
+		}
+	}
+}
+
+func TestEncodeLosslessSynthetic(t *testing.T) {
+	// gradient has translucent pixels, too many colors for a palette, and
+	// a width that is not a multiple of the transform tile size.
+	gradient := image.NewNRGBA(image.Rect(3, 5, 70, 44))
+	for y := gradient.Rect.Min.Y; y < gradient.Rect.Max.Y; y++ {
+		for x := gradient.Rect.Min.X; x < gradient.Rect.Max.X; x++ {
+			gradient.SetNRGBA(x, y, color.NRGBA{uint8(4 * x), uint8(x * y), uint8(7 * y), uint8(x + y)})
+		}
+	}
+	// solid has a single color.
+	solid := image.NewNRGBA(image.Rect(0, 0, 17, 1))
+	for i := range solid.Pix {
+		solid.Pix[i] = 0x80
+	}
+	// noise is incompressible.
+	noise := image.NewNRGBA(image.Rect(0, 0, 31, 9))
+	for i, v := 0, uint32(1); i < len(noise.Pix); i++ {
+		v = v*1103515245 + 12345
+		noise.Pix[i] = uint8(v >> 16)
+	}
+	// gray has a non-NRGBA type.
+	gray := image.NewGray(image.Rect(0, 0, 20, 20))
+	for i := range gray.Pix {
+		gray.Pix[i] = uint8(i / 3)
+	}
+
+	testCases := []struct {
+		name string
+		m    image.Image
+	}{
+		{"gradient", gradient},
+		{"solid", solid},
+		{"noise", noise},
+		{"gray", gray},
+		{"1x1", image.NewNRGBA(image.Rect(0, 0, 1, 1))},
+	}
+	for _, tc := range testCases {
+		buf := &bytes.Buffer{}
+		if err := Encode(buf, tc.m, nil); err != nil {
+			t.Errorf("%s: Encode: %v", tc.name, err)
+			continue
+		}
+		m1, err := Decode(buf)
+		if err != nil {
+			t.Errorf("%s: Decode WEBP: %v", tc.name, err)
+			continue
+		}
+		compareNRGBA(t, tc.name, tc.m, m1)
+	}
+}
+
+func TestEncodeInvalidSize(t *testing.T) {
+	if err := Encode(&bytes.Buffer{}, image.NewNRGBA(image.Rect(0, 0, 0, 10)), nil); err == nil {
+		t.Error("empty image: got nil error, want non-nil")
+	}
+}
+
+// ycbcrPSNR returns the peak signal-to-noise ratio, in decibels, between the
+// Y, Cb and Cr planes of two 4:2:0 images of the same size.
+func ycbcrPSNR(m0, m1 *image.YCbCr) float64 {
+	sse, n := 0.0, 0
+	plane := func(p0, p1 []uint8, stride0, stride1, w, h int) {
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				d := float64(p0[y*stride0+x]) - float64(p1[y*stride1+x])
+				sse += d * d
+				n++
+			}
+		}
+	}
+	w, h := m0.Rect.Dx(), m0.Rect.Dy()
+	plane(m0.Y, m1.Y, m0.YStride, m1.YStride, w, h)
+	plane(m0.Cb, m1.Cb, m0.CStride, m1.CStride, (w+1)/2, (h+1)/2)
+	plane(m0.Cr, m1.Cr, m0.CStride, m1.CStride, (w+1)/2, (h+1)/2)
+	if sse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255*float64(n)/sse)
+}
+
+func TestEncodeLossy(t *testing.T) {
+	f, err := os.Open("../testdata/blue-purple-pink.lossy.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m0, err := Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	y0, ok := m0.(*image.YCbCr)
+	if !ok {
+		t.Fatalf("decoded image is %T, want *image.YCbCr", m0)
+	}
+
+	for _, tc := range []struct {
+		quality int
+		minPSNR float64
+	}{
+		{25, 33},
+		{75, 40},
+		{100, 50},
+	} {
+		buf := &bytes.Buffer{}
+		if err := Encode(buf, m0, &Options{Lossy: true, Quality: tc.quality}); err != nil {
+			t.Errorf("quality %d: Encode: %v", tc.quality, err)
+			continue
+		}
+		m1, err := Decode(buf)
+		if err != nil {
+			t.Errorf("quality %d: Decode WEBP: %v", tc.quality, err)
+			continue
+		}
+		y1, ok := m1.(*image.YCbCr)
+		if !ok {
+			t.Errorf("quality %d: decoded image is %T, want *image.YCbCr", tc.quality, m1)
+			continue
+		}
+		if got, want := y1.Rect, y0.Rect; got != want {
+			t.Errorf("quality %d: bounds: got %v, want %v", tc.quality, got, want)
+			continue
+		}
+		if got := ycbcrPSNR(y0, y1); got < tc.minPSNR {
+			t.Errorf("quality %d: PSNR: got %.2f dB, want >= %.2f dB", tc.quality, got, tc.minPSNR)
+		}
+	}
+}
+
+func TestEncodeLossyAlpha(t *testing.T) {
+	m0 := image.NewNRGBA(image.Rect(0, 0, 37, 21))
+	for y := 0; y < 21; y++ {
+		for x := 0; x < 37; x++ {
+			m0.SetNRGBA(x, y, color.NRGBA{uint8(7 * x), uint8(9 * y), 0x80, uint8(x * y)})
+		}
+	}
+	buf := &bytes.Buffer{}
+	if err := Encode(buf, m0, &Options{Lossy: true}); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	c, err := DecodeConfig(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("DecodeConfig: %v", err)
+	}
+	if c.ColorModel != color.NYCbCrAModel || c.Width != 37 || c.Height != 21 {
+		t.Fatalf("DecodeConfig: got %v %dx%d, want NYCbCrA 37x21", c.ColorModel, c.Width, c.Height)
+	}
+	m1, err := Decode(buf)
+	if err != nil {
+		t.Fatalf("Decode WEBP: %v", err)
+	}
+	n1, ok := m1.(*image.NYCbCrA)
+	if !ok {
+		t.Fatalf("decoded image is %T, want *image.NYCbCrA", m1)
+	}
+	for y := 0; y < 21; y++ {
+		for x := 0; x < 37; x++ {
+			if got, want := n1.A[n1.AOffset(x, y)], m0.NRGBAAt(x, y).A; got != want {
+				t.Fatalf("alpha at (%d, %d): got %d, want %d", x, y, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import (
+	"image"
+	"io"
+	"sync"
+)
+
+// IncrementalDecoder decodes a still WEBP image from data that arrives a
+// piece at a time, such as over a slow network connection, so that the top
+// of the image can be shown before the rest of the data is available.
+//
+// The data is given to Write, and the image decoded so far is returned by
+// Image. Decoding runs in a goroutine that the first Write starts. It stops
+// when a Write returns an error, or otherwise when Close is called, which
+// must be done once all of the data has been written. Animated images are
+// not supported.
+type IncrementalDecoder struct {
+	mu   sync.Mutex
+	cond sync.Cond
+	// buf holds the written bytes that are not yet read by the decoding
+	// goroutine.
+	buf []byte
+	// started is whether the decoding goroutine has been started, closed
+	// is whether Close has been called, waiting is whether the decoding
+	// goroutine is waiting for more bytes, and done is whether it has
+	// finished, with the error err.
+	started bool
+	closed  bool
+	waiting bool
+	done    bool
+	err     error
+	// m is the image being decoded, and rows is the number of rows at its
+	// top that hold their final values.
+	m    image.Image
+	rows int
+}
+
+// NewIncrementalDecoder returns a new IncrementalDecoder.
+func NewIncrementalDecoder() *IncrementalDecoder {
+	d := &IncrementalDecoder{}
+	d.cond.L = &d.mu
+	return d
+}
+
+// start starts the decoding goroutine, if it has not been started yet. d.mu
+// must be held.
+func (d *IncrementalDecoder) start() {
+	if !d.started {
+		d.started = true
+		go d.decode()
+	}
+}
+
+// decode decodes the image from the written bytes.
+func (d *IncrementalDecoder) decode() {
+	w, _, err := decode(incrementalReader{d}, false, false, nil, d.progress)
+
+	d.mu.Lock()
+	if err == nil {
+		d.m, d.rows = w.Image[0], w.Config.Height
+	}
+	d.done, d.err, d.buf = true, err, nil
+	d.mu.Unlock()
+	d.cond.Broadcast()
+}
+
+// progress records the rows decoded so far.
+func (d *IncrementalDecoder) progress(m image.Image, rows int) {
+	d.mu.Lock()
+	d.m, d.rows = m, rows
+	d.mu.Unlock()
+}
+
+// Write writes the next bytes of the WEBP data. It returns once they have
+// been decoded as far as possible, with the error, if any, that decoding
+// failed with. Once Write has returned an error, decoding has stopped, and
+// later calls to Write and Close return the same error. Bytes that follow
+// the image data, such as metadata chunks, are ignored.
+func (d *IncrementalDecoder) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.done {
+		d.start()
+		d.buf = append(d.buf, p...)
+		d.cond.Broadcast()
+		for !d.done && !(d.waiting && len(d.buf) == 0) {
+			d.cond.Wait()
+		}
+	}
+	return len(p), d.err
+}
+
+// Close signals that all of the WEBP data has been written, and waits for
+// decoding to finish. It returns a nil error if the image was decoded in
+// full, and io.ErrUnexpectedEOF or another error otherwise.
+func (d *IncrementalDecoder) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.closed = true
+	// With no data, the decoding goroutine fails straight away.
+	d.start()
+	d.cond.Broadcast()
+	for !d.done {
+		d.cond.Wait()
+	}
+	return d.err
+}
+
+// Image returns the image being decoded, and the number of rows at the top
+// of its bounds that hold their final values. The image is nil until enough
+// of the data has been written to start decoding the pixels. It is an
+// *image.YCbCr or *image.NYCbCrA for a lossy image and an *image.NRGBA for a
+// lossless one, and once decoding has finished, it is the image that Decode
+// would return.
+//
+// The decoder keeps writing to the rest of the image's rows, so they must
+// not be read until they are reported as final.
+func (d *IncrementalDecoder) Image() (m image.Image, rows int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.m, d.rows
+}
+
+// incrementalReader is the io.Reader that an IncrementalDecoder's decoding
+// goroutine reads the written bytes from, waiting for them as needed.
+type incrementalReader struct {
+	d *IncrementalDecoder
+}
+
+func (r incrementalReader) Read(p []byte) (int, error) {
+	d := r.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for len(d.buf) == 0 && !d.closed {
+		d.waiting = true
+		d.cond.Broadcast()
+		d.cond.Wait()
+	}
+	d.waiting = false
+	if len(d.buf) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
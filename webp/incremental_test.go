@@ -0,0 +1,149 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestIncrementalDecoder(t *testing.T) {
+	const w, h = 150, 100
+	m := image.NewNRGBA(image.Rect(0, 0, w, h))
+	paletted := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			m.SetNRGBA(x, y, color.NRGBA{uint8(x*x + y), uint8(3*x ^ y), uint8(x * y), uint8(255 - x - y)})
+			i := uint8((x*x + 3*y) % 13)
+			paletted.SetNRGBA(x, y, color.NRGBA{20 * i, 0x40, 255 - 20*i, 0xff})
+		}
+	}
+	opaque := image.NewNRGBA(m.Rect)
+	for i := range opaque.Pix {
+		opaque.Pix[i] = m.Pix[i] | uint8(0xff*btou(i%4 == 3))
+	}
+
+	// row returns the colors of the y'th row of m.
+	row := func(m image.Image, y int) []color.RGBA64 {
+		b := m.Bounds()
+		c := make([]color.RGBA64, 0, b.Dx())
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, b, a := m.At(x, y).RGBA()
+			c = append(c, color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)})
+		}
+		return c
+	}
+
+	for _, tc := range []struct {
+		desc string
+		m    image.Image
+		o    *Options
+	}{
+		{"lossy", opaque, &Options{Lossy: true}},
+		{"lossy with alpha", m, &Options{Lossy: true}},
+		{"lossless", m, nil},
+		{"lossless paletted", paletted, nil},
+	} {
+		buf := &bytes.Buffer{}
+		if err := Encode(buf, tc.m, tc.o); err != nil {
+			t.Errorf("%s: Encode: %v", tc.desc, err)
+			continue
+		}
+		want, err := Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Errorf("%s: Decode: %v", tc.desc, err)
+			continue
+		}
+
+		d := NewIncrementalDecoder()
+		data, partial := buf.Bytes(), false
+		// rows holds each row as it was when first reported as final.
+		var rows [][]color.RGBA64
+		for len(data) > 0 {
+			n := 16
+			if n > len(data) {
+				n = len(data)
+			}
+			if _, err := d.Write(data[:n]); err != nil {
+				t.Errorf("%s: Write: %v", tc.desc, err)
+				break
+			}
+			data = data[n:]
+			got, n := d.Image()
+			if n < len(rows) || n > h {
+				t.Errorf("%s: got %d rows after %d", tc.desc, n, len(rows))
+				break
+			}
+			partial = partial || (0 < n && n < h)
+			for y := len(rows); y < n; y++ {
+				rows = append(rows, row(got, y))
+			}
+		}
+		if err := d.Close(); err != nil {
+			t.Errorf("%s: Close: %v", tc.desc, err)
+			continue
+		}
+		if !partial {
+			t.Errorf("%s: no partial image was decoded", tc.desc)
+		}
+		got, n := d.Image()
+		if n != h || reflect.TypeOf(got) != reflect.TypeOf(want) {
+			t.Errorf("%s: got %T with %d rows, want %T with %d", tc.desc, got, n, want, h)
+			continue
+		}
+		for y := 0; y < h; y++ {
+			if y < len(rows) && !reflect.DeepEqual(rows[y], row(want, y)) {
+				t.Errorf("%s: row %d changed after it was reported final", tc.desc, y)
+				break
+			}
+			if !reflect.DeepEqual(row(got, y), row(want, y)) {
+				t.Errorf("%s: row %d differs from Decode", tc.desc, y)
+				break
+			}
+		}
+
+		d = NewIncrementalDecoder()
+		d.Write(buf.Bytes()[:buf.Len()/2])
+		if err := d.Close(); err == nil {
+			t.Errorf("%s: truncated: got nil error", tc.desc)
+		}
+	}
+}
+
+func TestIncrementalDecoderStop(t *testing.T) {
+	// No goroutine is started until the first Write.
+	n := runtime.NumGoroutine()
+	d := NewIncrementalDecoder()
+	if got := runtime.NumGoroutine(); got != n {
+		t.Errorf("NewIncrementalDecoder: got %d goroutines, want %d", got, n)
+	}
+	if err := d.Close(); err == nil {
+		t.Error("Close with no data: got nil error")
+	}
+
+	// A failed Write stops decoding, without Close being called.
+	d = NewIncrementalDecoder()
+	_, err := d.Write([]byte("RIFF\x04\x00\x00\x00JUNK"))
+	if err == nil {
+		t.Fatal("Write: got nil error")
+	}
+	if _, err1 := d.Write([]byte{0}); err1 != err {
+		t.Errorf("second Write: got %v, want %v", err1, err)
+	}
+	if err1 := d.Close(); err1 != err {
+		t.Errorf("Close: got %v, want %v", err1, err)
+	}
+}
+
+func btou(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
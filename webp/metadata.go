@@ -0,0 +1,96 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import (
+	"io"
+
+	"golang.org/x/image/riff"
+)
+
+var (
+	fccEXIF = riff.FourCC{'E', 'X', 'I', 'F'}
+	fccICCP = riff.FourCC{'I', 'C', 'C', 'P'}
+	fccXMP  = riff.FourCC{'X', 'M', 'P', ' '}
+)
+
+// Metadata holds the raw metadata of a WEBP image. A nil slice means that
+// the corresponding chunk is absent.
+type Metadata struct {
+	// ICCProfile is the ICC color profile, from the ICCP chunk.
+	ICCProfile []byte
+	// EXIF is the Exif metadata, from the EXIF chunk.
+	EXIF []byte
+	// XMP is the XMP packet, from the "XMP " chunk.
+	XMP []byte
+}
+
+func (md *Metadata) empty() bool {
+	return md == nil || (md.ICCProfile == nil && md.EXIF == nil && md.XMP == nil)
+}
+
+// flags returns the VP8X chunk flags for md's chunks.
+func (md *Metadata) flags() (flags byte) {
+	if md == nil {
+		return 0
+	}
+	if md.ICCProfile != nil {
+		flags |= iccProfileBit
+	}
+	if md.EXIF != nil {
+		flags |= exifMetadataBit
+	}
+	if md.XMP != nil {
+		flags |= xmpMetadataBit
+	}
+	return flags
+}
+
+// DecodeMetadata reads the ICCP, EXIF and "XMP " chunks of a WEBP image from
+// r, without decoding the image data. Only images in the extended format,
+// which starts with a VP8X chunk, can hold metadata. If a chunk occurs more
+// than once, the first is returned.
+func DecodeMetadata(r io.Reader) (*Metadata, error) {
+	formType, riffReader, err := riff.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	if formType != fccWEBP {
+		return nil, errInvalidFormat
+	}
+	md := &Metadata{}
+	for first := true; ; first = false {
+		chunkID, _, chunkData, err := riffReader.Next()
+		if err == io.EOF {
+			if first {
+				return nil, errInvalidFormat
+			}
+			return md, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var dst *[]byte
+		switch chunkID {
+		case fccICCP:
+			dst = &md.ICCProfile
+		case fccEXIF:
+			dst = &md.EXIF
+		case fccXMP:
+			dst = &md.XMP
+		case fccVP8, fccVP8L:
+			if first {
+				// A simple format image has no metadata.
+				return md, nil
+			}
+		}
+		if dst == nil || *dst != nil {
+			continue
+		}
+		if *dst, err = io.ReadAll(chunkData); err != nil {
+			return nil, err
+		}
+	}
+}
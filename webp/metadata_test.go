@@ -0,0 +1,129 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"golang.org/x/image/riff"
+)
+
+func TestMetadata(t *testing.T) {
+	md := &Metadata{
+		ICCProfile: []byte("icc profile"),
+		EXIF:       []byte("Exif\x00\x00MM"),
+		XMP:        []byte("<x:xmpmeta/>"),
+	}
+	opaque := uniformNRGBA(image.Rect(0, 0, 6, 4), color.NRGBA{0x40, 0x80, 0xc0, 0xff})
+	translucent := uniformNRGBA(image.Rect(0, 0, 6, 4), color.NRGBA{0x40, 0x80, 0xc0, 0x80})
+	testCases := []struct {
+		name string
+		md   *Metadata
+		m    image.Image
+		o    Options
+	}{
+		{"lossless", md, opaque, Options{}},
+		{"lossless alpha", md, translucent, Options{}},
+		{"lossy", md, opaque, Options{Lossy: true}},
+		{"lossy alpha", md, translucent, Options{Lossy: true}},
+		{"ICC only", &Metadata{ICCProfile: md.ICCProfile}, opaque, Options{}},
+		{"empty XMP", &Metadata{XMP: []byte{}}, opaque, Options{}},
+		{"none", &Metadata{}, opaque, Options{}},
+	}
+	for _, tc := range testCases {
+		tc.o.Metadata = tc.md
+		buf := &bytes.Buffer{}
+		if err := Encode(buf, tc.m, &tc.o); err != nil {
+			t.Errorf("%s: Encode: %v", tc.name, err)
+			continue
+		}
+		data := buf.Bytes()
+		got, err := DecodeMetadata(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: DecodeMetadata: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.md) {
+			t.Errorf("%s: got %q, want %q", tc.name, *got, *tc.md)
+		}
+		m, err := Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: Decode: %v", tc.name, err)
+			continue
+		}
+		if m.Bounds() != tc.m.Bounds() {
+			t.Errorf("%s: bounds: got %v, want %v", tc.name, m.Bounds(), tc.m.Bounds())
+		}
+	}
+}
+
+func TestMetadataChunkOrder(t *testing.T) {
+	md := &Metadata{
+		ICCProfile: []byte("icc"),
+		EXIF:       []byte("exif"),
+		XMP:        []byte("xmp"),
+	}
+	m := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	a := &WEBP{
+		Image:    []image.Image{m, m},
+		Duration: []int{1, 1},
+	}
+	buf := &bytes.Buffer{}
+	if err := EncodeAll(buf, a, &Options{Metadata: md}); err != nil {
+		t.Fatalf("EncodeAll: %v", err)
+	}
+	data := buf.Bytes()
+
+	_, r, err := riff.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("riff.NewReader: %v", err)
+	}
+	var ids []riff.FourCC
+	for {
+		id, _, chunkData, err := r.Next()
+		if err != nil {
+			break
+		}
+		ids = append(ids, id)
+		if id == fccVP8X {
+			b, _ := ioutil.ReadAll(chunkData)
+			const want = animationBit | alphaBit | iccProfileBit | exifMetadataBit | xmpMetadataBit
+			if b[0] != want {
+				t.Errorf("VP8X flags: got %#02x, want %#02x", b[0], want)
+			}
+		}
+	}
+	want := []riff.FourCC{fccVP8X, fccICCP, fccANIM, fccANMF, fccANMF, fccEXIF, fccXMP}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("chunks: got %q, want %q", ids, want)
+	}
+
+	got, err := DecodeMetadata(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("DecodeMetadata: %v", err)
+	}
+	if !reflect.DeepEqual(got, md) {
+		t.Errorf("got %q, want %q", *got, *md)
+	}
+}
+
+func TestDecodeMetadataSimpleFormat(t *testing.T) {
+	f, err := ioutil.ReadFile("../testdata/blue-purple-pink.lossless.webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := DecodeMetadata(bytes.NewReader(f))
+	if err != nil {
+		t.Fatalf("DecodeMetadata: %v", err)
+	}
+	if !md.empty() {
+		t.Errorf("got %q, want no metadata", *md)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+// This file implements converting lossy images to RGB the way that libwebp
+// does by default. Each chroma sample covers 2x2 pixels, and each pixel's
+// chroma is interpolated from the 2x2 samples nearest to it, weighted 9:3:3:1,
+// which libwebp calls "fancy upsampling". The samples are mirrored at the
+// image's edges.
+
+import (
+	"image"
+)
+
+// toRGB converts m, a decoded VP8 frame, to an *image.RGBA, or to an
+// *image.NRGBA if alpha is non-nil.
+func toRGB(m *image.YCbCr, alpha []byte, alphaStride int) image.Image {
+	b := m.Rect
+	w, h := b.Dx(), b.Dy()
+	pix, stride := make([]byte, 4*w*h), 4*w
+	lastC := (h+1)/2 - 1
+	for y := 0; y < h; y++ {
+		// The near chroma row covers this row. The far one is above it, for
+		// even rows, and below it, for odd rows.
+		near, far := y/2, y/2-1
+		if y&1 != 0 {
+			far = near + 1
+		}
+		if far < 0 {
+			far = 0
+		} else if far > lastC {
+			far = lastC
+		}
+		yi := m.YOffset(b.Min.X, b.Min.Y+y)
+		ni := m.COffset(b.Min.X, b.Min.Y+2*near)
+		fi := m.COffset(b.Min.X, b.Min.Y+2*far)
+		upsampleRow(pix[stride*y:stride*y+stride], m.Y[yi:yi+w],
+			m.Cb[ni:], m.Cr[ni:], m.Cb[fi:], m.Cr[fi:])
+	}
+
+	r := image.Rect(0, 0, w, h).Add(b.Min)
+	if alpha == nil {
+		return &image.RGBA{Pix: pix, Stride: stride, Rect: r}
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			pix[stride*y+4*x+3] = alpha[alphaStride*y+x]
+		}
+	}
+	return &image.NRGBA{Pix: pix, Stride: stride, Rect: r}
+}
+
+// upsampleRow converts a row of luma samples, given the chroma rows nearest to
+// and second nearest to it, to opaque RGBA pixels in dst.
+func upsampleRow(dst, yRow, nearCb, nearCr, farCb, farCr []byte) {
+	w := len(yRow)
+	set := func(x, u, v int) {
+		d := dst[4*x : 4*x+4]
+		d[0], d[1], d[2] = yuvToRGB(int(yRow[x]), u, v)
+		d[3] = 0xff
+	}
+	// edge interpolates the chroma at the left or right edge, which only has
+	// one pair of samples.
+	edge := func(near, far []byte, i int) int {
+		return (3*int(near[i]) + int(far[i]) + 2) >> 2
+	}
+
+	set(0, edge(nearCb, farCb, 0), edge(nearCr, farCr, 0))
+	last := (w - 1) >> 1
+	for i := 1; i <= last; i++ {
+		// Pixels 2i-1 and 2i lie between the samples i-1 and i of each row.
+		u0, u1 := interpolate(nearCb[i-1], nearCb[i], farCb[i-1], farCb[i])
+		v0, v1 := interpolate(nearCr[i-1], nearCr[i], farCr[i-1], farCr[i])
+		set(2*i-1, u0, v0)
+		set(2*i, u1, v1)
+	}
+	if w&1 == 0 {
+		set(w-1, edge(nearCb, farCb, last), edge(nearCr, farCr, last))
+	}
+}
+
+// interpolate returns the chroma of the two pixels between the near samples a
+// and b and the far samples c and d, with a and c to their left.
+func interpolate(a, b, c, d uint8) (left, right int) {
+	avg := int(a) + int(b) + int(c) + int(d) + 8
+	diag12 := (avg + 2*(int(b)+int(c))) >> 3
+	diag03 := (avg + 2*(int(a)+int(d))) >> 3
+	return (diag12 + int(a)) >> 1, (diag03 + int(b)) >> 1
+}
+
+// yuvToRGB converts a Y'CbCr triple to RGB with libwebp's fixed-point
+// arithmetic, which uses the ITU-R BT.601 studio-swing range.
+func yuvToRGB(y, u, v int) (r, g, b uint8) {
+	multHi := func(v, coeff int) int {
+		return (v * coeff) >> 8
+	}
+	y = multHi(y, 19077)
+	return clip8(y + multHi(v, 26149) - 14234),
+		clip8(y - multHi(u, 6419) - multHi(v, 13320) + 8708),
+		clip8(y + multHi(u, 33050) - 17685)
+}
+
+// clip8 clamps v, which has 6 fractional bits, to a uint8.
+func clip8(v int) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v >= 256<<6 {
+		return 0xff
+	}
+	return uint8(v >> 6)
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package webp
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestYUVToRGB(t *testing.T) {
+	for _, tc := range []struct {
+		y, u, v int
+		want    [3]uint8
+	}{
+		{16, 128, 128, [3]uint8{0x00, 0x00, 0x00}},
+		{235, 128, 128, [3]uint8{0xff, 0xff, 0xff}},
+		{126, 128, 128, [3]uint8{0x80, 0x80, 0x80}},
+		{82, 90, 240, [3]uint8{0xff, 0x01, 0x00}},
+		{0, 0, 0, [3]uint8{0x00, 0x88, 0x00}},
+		{255, 255, 255, [3]uint8{0xff, 0x7d, 0xff}},
+	} {
+		r, g, b := yuvToRGB(tc.y, tc.u, tc.v)
+		if got := [3]uint8{r, g, b}; got != tc.want {
+			t.Errorf("yuvToRGB(%d, %d, %d): got %v, want %v", tc.y, tc.u, tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestUpsampleRow(t *testing.T) {
+	gray := []byte{128, 128}
+	for _, tc := range []struct {
+		desc      string
+		near, far []byte
+		w         int
+		wantCb    []int
+	}{
+		{"horizontal", []byte{0, 200}, []byte{0, 200}, 4, []int{0, 50, 150, 200}},
+		{"horizontal, odd width", []byte{0, 200}, []byte{0, 200}, 3, []int{0, 50, 150}},
+		{"vertical", []byte{0, 0}, []byte{160, 160}, 4, []int{40, 40, 40, 40}},
+		{"diagonal", []byte{0, 0}, []byte{0, 160}, 4, []int{0, 10, 30, 40}},
+	} {
+		yRow := bytes.Repeat([]byte{128}, tc.w)
+		dst := make([]byte, 4*tc.w)
+		upsampleRow(dst, yRow, tc.near, gray, tc.far, gray)
+		for x, u := range tc.wantCb {
+			r, g, b := yuvToRGB(128, u, 128)
+			want := []byte{r, g, b, 0xff}
+			if got := dst[4*x : 4*x+4]; !bytes.Equal(got, want) {
+				t.Errorf("%s: pixel %d: got %v, want %v (Cb %d)", tc.desc, x, got, want, u)
+			}
+		}
+	}
+}
+
+func TestDecodeRGB(t *testing.T) {
+	const w, h = 37, 21
+	want := color.NRGBA{0x40, 0x80, 0xc0, 0xff}
+	for _, alpha := range []uint8{0xff, 0x80} {
+		m := image.NewNRGBA(image.Rect(0, 0, w, h))
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				m.SetNRGBA(x, y, color.NRGBA{want.R, want.G, want.B, alpha})
+			}
+		}
+		buf := &bytes.Buffer{}
+		if err := Encode(buf, m, &Options{Lossy: true, Quality: 100}); err != nil {
+			t.Fatalf("alpha %#02x: Encode: %v", alpha, err)
+		}
+		got, err := DecodeWithOptions(bytes.NewReader(buf.Bytes()), &DecodeOptions{RGB: true})
+		if err != nil {
+			t.Fatalf("alpha %#02x: DecodeWithOptions: %v", alpha, err)
+		}
+		if got.Bounds() != m.Bounds() {
+			t.Errorf("alpha %#02x: bounds: got %v, want %v", alpha, got.Bounds(), m.Bounds())
+			continue
+		}
+		var pix []byte
+		switch got := got.(type) {
+		case *image.RGBA:
+			if alpha != 0xff {
+				t.Errorf("alpha %#02x: got %T, want *image.NRGBA", alpha, got)
+			}
+			pix = got.Pix
+		case *image.NRGBA:
+			if alpha == 0xff {
+				t.Errorf("alpha %#02x: got %T, want *image.RGBA", alpha, got)
+			}
+			pix = got.Pix
+		default:
+			t.Errorf("alpha %#02x: got %T", alpha, got)
+			continue
+		}
+		for i := 0; i < len(pix); i += 4 {
+			if d := absDiff(pix[i+0], want.R) + absDiff(pix[i+1], want.G) + absDiff(pix[i+2], want.B); d > 6 || pix[i+3] != alpha {
+				t.Errorf("alpha %#02x: pixel %d: got %v, want %v", alpha, i/4, pix[i:i+4], want)
+				break
+			}
+		}
+	}
+}
+
+func absDiff(a, b uint8) int {
+	if a < b {
+		return int(b - a)
+	}
+	return int(a - b)
+}